@@ -0,0 +1,210 @@
+package anonymize
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"path"
+	"strings"
+
+	"acbr/backup"
+	"acbr/config"
+	"acbr/report"
+	"acbr/storage"
+
+	awssdk "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider/types"
+)
+
+// nameAttributes are the standard attributes holding personal names
+var nameAttributes = map[string]bool{
+	"name":               true,
+	"given_name":         true,
+	"family_name":        true,
+	"middle_name":        true,
+	"nickname":           true,
+	"preferred_username": true,
+}
+
+// Anonymizer deterministically pseudonymizes the personal data of a backup.
+// The same key always maps the same input to the same pseudonym, so usernames
+// stay consistent between users and group memberships.
+type Anonymizer struct {
+	key        []byte
+	attributes map[string]bool
+}
+
+// New creates an Anonymizer. attributes lists additional attributes, such as
+// custom ones, to pseudonymize.
+func New(key []byte, attributes []string) *Anonymizer {
+	a := &Anonymizer{
+		key:        key,
+		attributes: make(map[string]bool, len(attributes)),
+	}
+	for _, attr := range attributes {
+		a.attributes[attr] = true
+	}
+	return a
+}
+
+// Execute reads the backup at cfg.BackupPath and writes an anonymized copy to
+// cfg.OutputPath, or next to the original. It returns the new backup's path.
+func Execute(ctx context.Context, cfg *config.Config) (string, error) {
+	if cfg.AnonymizeKey == "" {
+		return "", fmt.Errorf("anonymize-key is required")
+	}
+
+	original, err := backup.Load(ctx, cfg.BackupPath)
+	if err != nil {
+		return "", err
+	}
+
+	anonymized := New([]byte(cfg.AnonymizeKey), cfg.AnonymizeAttributes).Backup(original)
+
+	dir := cfg.OutputPath
+	if dir == "" {
+		dir = storage.Dir(cfg.BackupPath)
+	}
+	filename := strings.TrimSuffix(path.Base(cfg.BackupPath), ".json") + "-anonymized.json"
+	if anonymized.Manifest != nil {
+		manifest := *anonymized.Manifest
+		manifest.ID = filename
+		anonymized.Manifest = &manifest
+	}
+
+	out, err := backup.Save(ctx, dir, filename, anonymized)
+	if err != nil {
+		return "", err
+	}
+	slog.Info("anonymized backup", "users", len(anonymized.Users), "path", out)
+	return out, nil
+}
+
+// Backup returns an anonymized copy of the backup. Pool configuration, groups,
+// clients, resource servers and identity providers are kept as they are.
+func (a *Anonymizer) Backup(b *backup.CognitoBackup) *backup.CognitoBackup {
+	out := *b
+
+	out.Users = make([]types.UserType, len(b.Users))
+	for i, user := range b.Users {
+		out.Users[i] = a.User(user)
+	}
+
+	if b.UserIndex != nil {
+		out.UserIndex = make([]backup.UserIndexEntry, len(b.UserIndex))
+		for i, entry := range b.UserIndex {
+			entry.Username = a.Username(entry.Username)
+			entry.Sub = a.Attribute("sub", entry.Sub)
+			out.UserIndex[i] = entry
+		}
+	}
+	if b.DeletedUsers != nil {
+		out.DeletedUsers = make([]string, len(b.DeletedUsers))
+		for i, username := range b.DeletedUsers {
+			out.DeletedUsers[i] = a.Username(username)
+		}
+	}
+
+	if b.GroupMemberships != nil {
+		out.GroupMemberships = make(map[string][]string, len(b.GroupMemberships))
+		for group, usernames := range b.GroupMemberships {
+			for _, username := range usernames {
+				out.GroupMemberships[group] = append(out.GroupMemberships[group], a.Username(username))
+			}
+		}
+	}
+
+	if b.Failures != nil {
+		out.Failures = make([]report.Failure, len(b.Failures))
+		for i, failure := range b.Failures {
+			out.Failures[i] = a.failure(failure)
+		}
+	}
+
+	return &out
+}
+
+// failure pseudonymizes the user named by a failure of a failed-items file and
+// drops its message, which may quote user data. The error code is kept.
+func (a *Anonymizer) failure(f report.Failure) report.Failure {
+	switch f.Kind {
+	case "user":
+		f.Name = a.Username(f.Name)
+	case "membership":
+		if group, username, ok := strings.Cut(f.Name, "/"); ok {
+			f.Name = group + "/" + a.Username(username)
+		}
+	}
+	f.Message = ""
+	return f
+}
+
+// User returns a pseudonymized copy of the user. Linked identities are dropped
+// as they carry the external provider's user IDs; such users restore as native users.
+func (a *Anonymizer) User(user types.UserType) types.UserType {
+	out := user
+	out.Username = awssdk.String(a.Username(awssdk.ToString(user.Username)))
+
+	out.Attributes = nil
+	for _, attr := range user.Attributes {
+		name := awssdk.ToString(attr.Name)
+		if name == "identities" {
+			continue
+		}
+		value := a.Attribute(name, awssdk.ToString(attr.Value))
+		out.Attributes = append(out.Attributes, types.AttributeType{
+			Name:  awssdk.String(name),
+			Value: awssdk.String(value),
+		})
+	}
+
+	return out
+}
+
+// Username pseudonymizes a username
+func (a *Anonymizer) Username(username string) string {
+	return "user-" + a.digest("username", username)[:16]
+}
+
+// Attribute pseudonymizes an attribute value, keeping the format Cognito
+// validates for emails, phone numbers and subs
+func (a *Anonymizer) Attribute(name, value string) string {
+	switch {
+	case name == "email":
+		return "user-" + a.digest(name, strings.ToLower(value))[:16] + "@example.com"
+	case name == "phone_number":
+		// The full 15 E.164 digits, so that distinct numbers practically never
+		// share a pseudonym
+		return "+1" + digits(a.digest(name, value), 14)
+	case name == "sub":
+		d := a.digest(name, value)
+		return fmt.Sprintf("%s-%s-%s-%s-%s", d[:8], d[8:12], d[12:16], d[16:20], d[20:32])
+	case nameAttributes[name]:
+		return "Name-" + a.digest(name, value)[:12]
+	case a.attributes[name]:
+		return a.digest(name, value)[:16]
+	default:
+		return value
+	}
+}
+
+// digest is the hex HMAC-SHA256 of value, namespaced by kind
+func (a *Anonymizer) digest(kind, value string) string {
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(kind))
+	mac.Write([]byte{0})
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// digits maps the hex digest onto n decimal digits. The digest is reduced as
+// one number, so each digit is uniformly distributed.
+func digits(hexDigest string, n int) string {
+	v, _ := new(big.Int).SetString(hexDigest, 16)
+	mod := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+	return fmt.Sprintf("%0*d", n, v.Mod(v, mod))
+}
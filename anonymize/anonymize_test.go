@@ -0,0 +1,156 @@
+package anonymize
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"acbr/backup"
+	"acbr/config"
+	"acbr/report"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider/types"
+)
+
+func TestAnonymizerBackup(t *testing.T) {
+	original := &backup.CognitoBackup{
+		Users: []types.UserType{
+			{
+				Username: aws.String("alice"),
+				Enabled:  true,
+				Attributes: []types.AttributeType{
+					{Name: aws.String("sub"), Value: aws.String("0f1e2d3c-aaaa-bbbb-cccc-123456789abc")},
+					{Name: aws.String("email"), Value: aws.String("Alice@Corp.com")},
+					{Name: aws.String("phone_number"), Value: aws.String("+442071234567")},
+					{Name: aws.String("given_name"), Value: aws.String("Alice")},
+					{Name: aws.String("custom:ssn"), Value: aws.String("123-45-6789")},
+					{Name: aws.String("locale"), Value: aws.String("en-GB")},
+					{Name: aws.String("identities"), Value: aws.String(`[{"userId":"1"}]`)},
+				},
+			},
+		},
+		Groups:           []types.GroupType{{GroupName: aws.String("admins")}},
+		GroupMemberships: map[string][]string{"admins": {"alice"}},
+	}
+
+	a := New([]byte("secret"), []string{"custom:ssn"})
+	got := a.Backup(original)
+
+	user := got.Users[0]
+	if *user.Username == "alice" || !strings.HasPrefix(*user.Username, "user-") {
+		t.Errorf("Backup() username = %s, want a pseudonym", *user.Username)
+	}
+	if members := got.GroupMemberships["admins"]; len(members) != 1 || members[0] != *user.Username {
+		t.Errorf("Backup() memberships = %v, want [%s]", members, *user.Username)
+	}
+	if *got.Groups[0].GroupName != "admins" {
+		t.Errorf("Backup() changed group name to %s", *got.Groups[0].GroupName)
+	}
+	if *original.Users[0].Username != "alice" {
+		t.Error("Backup() modified the original backup")
+	}
+
+	attrs := make(map[string]string)
+	for _, attr := range user.Attributes {
+		attrs[*attr.Name] = *attr.Value
+	}
+	checks := map[string]*regexp.Regexp{
+		"sub":          regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`),
+		"email":        regexp.MustCompile(`^user-[0-9a-f]{16}@example\.com$`),
+		"phone_number": regexp.MustCompile(`^\+1[0-9]{14}$`),
+		"given_name":   regexp.MustCompile(`^Name-[0-9a-f]{12}$`),
+		"custom:ssn":   regexp.MustCompile(`^[0-9a-f]{16}$`),
+		"locale":       regexp.MustCompile(`^en-GB$`),
+	}
+	for name, re := range checks {
+		if !re.MatchString(attrs[name]) {
+			t.Errorf("Backup() %s = %q, want match for %s", name, attrs[name], re)
+		}
+	}
+	if _, ok := attrs["identities"]; ok {
+		t.Error("Backup() kept identities")
+	}
+
+	// Deterministic for the same key, different for another
+	if again := New([]byte("secret"), nil).Username("alice"); again != *user.Username {
+		t.Errorf("Username() = %s, want %s for the same key", again, *user.Username)
+	}
+	if other := New([]byte("other"), nil).Username("alice"); other == *user.Username {
+		t.Error("Username() is the same for different keys")
+	}
+}
+
+func TestAnonymizerBackupFailures(t *testing.T) {
+	original := &backup.CognitoBackup{
+		Users: []types.UserType{{Username: aws.String("alice")}},
+		Failures: []report.Failure{
+			{Kind: "group", Name: "admins", Message: "group admins failed"},
+			{Kind: "membership", Name: "admins/alice", Message: "user alice not found"},
+			{Kind: "user", Name: "alice", Code: "InvalidParameterException", Message: "Invalid email address format: alice@corp.com"},
+		},
+	}
+
+	a := New([]byte("secret"), nil)
+	got := a.Backup(original)
+
+	pseudonym := a.Username("alice")
+	want := []report.Failure{
+		{Kind: "group", Name: "admins"},
+		{Kind: "membership", Name: "admins/" + pseudonym},
+		{Kind: "user", Name: pseudonym, Code: "InvalidParameterException"},
+	}
+	if !reflect.DeepEqual(got.Failures, want) {
+		t.Errorf("Backup() failures = %+v, want %+v", got.Failures, want)
+	}
+	if original.Failures[2].Name != "alice" {
+		t.Error("Backup() modified the original failures")
+	}
+}
+
+func TestPhoneNumberPseudonymsAreDistinct(t *testing.T) {
+	a := New([]byte("secret"), nil)
+	seen := make(map[string]string)
+	for i := 0; i < 20000; i++ {
+		phone := fmt.Sprintf("+4420%08d", i)
+		got := a.Attribute("phone_number", phone)
+		if other, ok := seen[got]; ok {
+			t.Fatalf("Attribute() gave %s and %s the same pseudonym %s", other, phone, got)
+		}
+		seen[got] = phone
+	}
+}
+
+func TestExecute(t *testing.T) {
+	dir := t.TempDir()
+	in, err := backup.Save(context.Background(), dir, "cognito-backup-pool.json", &backup.CognitoBackup{
+		Users: []types.UserType{{Username: aws.String("alice")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Execute(context.Background(), &config.Config{BackupPath: in}); err == nil {
+		t.Error("Execute() without key error = nil, want error")
+	}
+
+	out, err := Execute(context.Background(), &config.Config{BackupPath: in, AnonymizeKey: "secret"})
+	if err != nil {
+		t.Fatalf("Execute() error = %v", err)
+	}
+	if want := filepath.Join(dir, "cognito-backup-pool-anonymized.json"); out != want {
+		t.Errorf("Execute() path = %s, want %s", out, want)
+	}
+
+	got, err := backup.Load(context.Background(), out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Users) != 1 || *got.Users[0].Username == "alice" {
+		t.Errorf("Execute() wrote users %v", got.Users)
+	}
+}
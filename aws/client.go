@@ -3,17 +3,69 @@ package aws
 import (
 	"context"
 
+	appconfig "acbr/config"
+
+	awssdk "github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go-v2/service/cognitoidentity"
 	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
 )
 
-func NewCognitoClient(region string) (*cognitoidentityprovider.Client, error) {
+// defaultSessionName names assumed role sessions unless configured
+const defaultSessionName = "acbr"
+
+// LoadConfig loads the default AWS configuration. With a role ARN, the default
+// credentials are used to assume that role through STS.
+func LoadConfig(region string, role appconfig.AssumeRole) (awssdk.Config, error) {
 	cfg, err := config.LoadDefaultConfig(context.TODO(),
 		config.WithRegion(region),
 	)
+	if err != nil || role.RoleArn == "" {
+		return cfg, err
+	}
+
+	provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), role.RoleArn, func(o *stscreds.AssumeRoleOptions) {
+		o.RoleSessionName = defaultSessionName
+		if role.SessionName != "" {
+			o.RoleSessionName = role.SessionName
+		}
+		if role.ExternalID != "" {
+			o.ExternalID = awssdk.String(role.ExternalID)
+		}
+	})
+	cfg.Credentials = awssdk.NewCredentialsCache(provider)
+	return cfg, nil
+}
+
+func NewCognitoClient(region string, role appconfig.AssumeRole) (*cognitoidentityprovider.Client, error) {
+	cfg, err := LoadConfig(region, role)
+	if err != nil {
+		return nil, err
+	}
+
+	// LimitedClient retries with backoff, so the SDK makes a single attempt
+	return cognitoidentityprovider.NewFromConfig(cfg, func(o *cognitoidentityprovider.Options) {
+		o.RetryMaxAttempts = 1
+	}), nil
+}
+
+func NewLogsClient(region string, role appconfig.AssumeRole) (*cloudwatchlogs.Client, error) {
+	cfg, err := LoadConfig(region, role)
+	if err != nil {
+		return nil, err
+	}
+
+	return cloudwatchlogs.NewFromConfig(cfg), nil
+}
+
+func NewIdentityClient(region string, role appconfig.AssumeRole) (*cognitoidentity.Client, error) {
+	cfg, err := LoadConfig(region, role)
 	if err != nil {
 		return nil, err
 	}
 
-	return cognitoidentityprovider.NewFromConfig(cfg), nil
+	return cognitoidentity.NewFromConfig(cfg), nil
 }
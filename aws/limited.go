@@ -0,0 +1,383 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sort"
+	"sync"
+	"time"
+
+	"acbr/tracing"
+
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// RetryOptions configure how LimitedClient retries throttled and transient failures
+type RetryOptions struct {
+	// MaxAttempts is the most calls made for one request, including the first
+	MaxAttempts int
+	// BaseDelay is doubled on every retry up to MaxDelay; the actual delay is
+	// a random duration up to that value
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+// DefaultRetryOptions are used for options left unset
+var DefaultRetryOptions = RetryOptions{
+	MaxAttempts: 8,
+	BaseDelay:   200 * time.Millisecond,
+	MaxDelay:    20 * time.Second,
+}
+
+// minRateFraction is how far throttling may lower a category's rate
+const minRateFraction = 0.05
+
+// LimitedClient is a CognitoClient that keeps within the account's quotas. It
+// shares a token bucket per quota category between all callers, and retries
+// throttled and transient failures with exponential backoff and jitter.
+// Throttling halves the category's rate, which recovers gradually on success.
+type LimitedClient struct {
+	client  CognitoClient
+	retry   RetryOptions
+	rates   map[Category]float64
+	buckets map[Category]*TokenBucket
+
+	mu      sync.Mutex
+	retries map[string]int
+	// observe is told about every call made, for metrics
+	observe func(op string, throttled bool)
+}
+
+// NewLimitedClient wraps client with the given rates in requests per second.
+// Categories without a rate use DefaultRates.
+func NewLimitedClient(client CognitoClient, rates map[Category]float64, options RetryOptions) *LimitedClient {
+	if options.MaxAttempts < 1 {
+		options.MaxAttempts = DefaultRetryOptions.MaxAttempts
+	}
+	if options.BaseDelay <= 0 {
+		options.BaseDelay = DefaultRetryOptions.BaseDelay
+	}
+	if options.MaxDelay <= 0 {
+		options.MaxDelay = DefaultRetryOptions.MaxDelay
+	}
+
+	c := &LimitedClient{
+		client:  client,
+		retry:   options,
+		rates:   make(map[Category]float64, len(DefaultRates)),
+		buckets: make(map[Category]*TokenBucket, len(DefaultRates)),
+		retries: make(map[string]int),
+	}
+	for category, rate := range DefaultRates {
+		if custom, ok := rates[category]; ok && custom > 0 {
+			rate = custom
+		}
+		c.rates[category] = rate
+		c.buckets[category] = NewTokenBucket(rate)
+	}
+	return c
+}
+
+// OnCall makes the client call fn after every Cognito call it makes, including
+// retries, with whether the call was throttled. It must be set before use.
+func (c *LimitedClient) OnCall(fn func(op string, throttled bool)) {
+	c.observe = fn
+}
+
+// Retries returns the number of retries made per operation
+func (c *LimitedClient) Retries() map[string]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	retries := make(map[string]int, len(c.retries))
+	for op, count := range c.retries {
+		retries[op] = count
+	}
+	return retries
+}
+
+// RetrySummary lists the operations that were retried, as op=count
+func (c *LimitedClient) RetrySummary() []string {
+	var summary []string
+	for op, count := range c.Retries() {
+		summary = append(summary, fmt.Sprintf("%s=%d", op, count))
+	}
+	sort.Strings(summary)
+	return summary
+}
+
+var (
+	isThrottle  = retry.IsErrorThrottles(retry.DefaultThrottles)
+	isRetryable = retry.IsErrorRetryables(retry.DefaultRetryables)
+)
+
+// invoke calls fn within the category's rate limit, retrying throttled and
+// transient failures. The call and its retries share one span.
+func invoke[T any](ctx context.Context, c *LimitedClient, op string, category Category, fn func(context.Context) (T, error)) (output T, err error) {
+	ctx, span := tracing.Start(ctx, "Cognito."+op,
+		attribute.String("rpc.system", "aws-api"),
+		attribute.String("rpc.service", "CognitoIdentityProvider"),
+		attribute.String("rpc.method", op))
+	attempts, throttles := 0, 0
+	defer func() {
+		span.SetAttributes(attribute.Int("acbr.attempts", attempts), attribute.Int("acbr.throttles", throttles))
+		tracing.End(span, err)
+	}()
+
+	bucket := c.buckets[category]
+	for attempt := 1; ; attempt++ {
+		if err := bucket.Wait(ctx); err != nil {
+			var zero T
+			return zero, err
+		}
+
+		attempts++
+		output, err := fn(ctx)
+		throttled := err != nil && isThrottle.IsErrorThrottle(err).Bool()
+		if c.observe != nil {
+			c.observe(op, throttled)
+		}
+		if throttled {
+			throttles++
+			bucket.SetRate(max(bucket.Rate()/2, c.rates[category]*minRateFraction))
+		} else if rate := bucket.Rate(); rate < c.rates[category] {
+			bucket.SetRate(min(rate+c.rates[category]*minRateFraction, c.rates[category]))
+		}
+
+		if err == nil || attempt >= c.retry.MaxAttempts || errors.Is(err, context.Canceled) ||
+			(!throttled && !isRetryable.IsErrorRetryable(err).Bool()) {
+			return output, err
+		}
+
+		c.mu.Lock()
+		c.retries[op]++
+		c.mu.Unlock()
+
+		if err := sleep(ctx, c.backoff(attempt)); err != nil {
+			var zero T
+			return zero, err
+		}
+	}
+}
+
+// backoff returns a random delay up to BaseDelay * 2^(attempt-1), capped at MaxDelay
+func (c *LimitedClient) backoff(attempt int) time.Duration {
+	ceiling := c.retry.MaxDelay
+	if shift := attempt - 1; shift < 30 {
+		ceiling = min(c.retry.BaseDelay<<shift, c.retry.MaxDelay)
+	}
+	return time.Duration(rand.Int64N(int64(ceiling) + 1))
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (c *LimitedClient) DescribeUserPool(ctx context.Context, params *cognitoidentityprovider.DescribeUserPoolInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.DescribeUserPoolOutput, error) {
+	return invoke(ctx, c, "DescribeUserPool", UserPoolRead, func(ctx context.Context) (*cognitoidentityprovider.DescribeUserPoolOutput, error) {
+		return c.client.DescribeUserPool(ctx, params, optFns...)
+	})
+}
+
+func (c *LimitedClient) ListUserPools(ctx context.Context, params *cognitoidentityprovider.ListUserPoolsInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.ListUserPoolsOutput, error) {
+	return invoke(ctx, c, "ListUserPools", UserPoolRead, func(ctx context.Context) (*cognitoidentityprovider.ListUserPoolsOutput, error) {
+		return c.client.ListUserPools(ctx, params, optFns...)
+	})
+}
+
+func (c *LimitedClient) ListUsers(ctx context.Context, params *cognitoidentityprovider.ListUsersInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.ListUsersOutput, error) {
+	return invoke(ctx, c, "ListUsers", UserList, func(ctx context.Context) (*cognitoidentityprovider.ListUsersOutput, error) {
+		return c.client.ListUsers(ctx, params, optFns...)
+	})
+}
+
+func (c *LimitedClient) ListGroups(ctx context.Context, params *cognitoidentityprovider.ListGroupsInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.ListGroupsOutput, error) {
+	return invoke(ctx, c, "ListGroups", UserPoolResourceRead, func(ctx context.Context) (*cognitoidentityprovider.ListGroupsOutput, error) {
+		return c.client.ListGroups(ctx, params, optFns...)
+	})
+}
+
+func (c *LimitedClient) ListResourceServers(ctx context.Context, params *cognitoidentityprovider.ListResourceServersInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.ListResourceServersOutput, error) {
+	return invoke(ctx, c, "ListResourceServers", UserPoolResourceRead, func(ctx context.Context) (*cognitoidentityprovider.ListResourceServersOutput, error) {
+		return c.client.ListResourceServers(ctx, params, optFns...)
+	})
+}
+
+func (c *LimitedClient) ListUserPoolClients(ctx context.Context, params *cognitoidentityprovider.ListUserPoolClientsInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.ListUserPoolClientsOutput, error) {
+	return invoke(ctx, c, "ListUserPoolClients", UserPoolClientRead, func(ctx context.Context) (*cognitoidentityprovider.ListUserPoolClientsOutput, error) {
+		return c.client.ListUserPoolClients(ctx, params, optFns...)
+	})
+}
+
+func (c *LimitedClient) ListIdentityProviders(ctx context.Context, params *cognitoidentityprovider.ListIdentityProvidersInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.ListIdentityProvidersOutput, error) {
+	return invoke(ctx, c, "ListIdentityProviders", UserPoolResourceRead, func(ctx context.Context) (*cognitoidentityprovider.ListIdentityProvidersOutput, error) {
+		return c.client.ListIdentityProviders(ctx, params, optFns...)
+	})
+}
+
+func (c *LimitedClient) CreateUserPool(ctx context.Context, params *cognitoidentityprovider.CreateUserPoolInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.CreateUserPoolOutput, error) {
+	return invoke(ctx, c, "CreateUserPool", UserPoolUpdate, func(ctx context.Context) (*cognitoidentityprovider.CreateUserPoolOutput, error) {
+		return c.client.CreateUserPool(ctx, params, optFns...)
+	})
+}
+
+func (c *LimitedClient) UpdateUserPool(ctx context.Context, params *cognitoidentityprovider.UpdateUserPoolInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.UpdateUserPoolOutput, error) {
+	return invoke(ctx, c, "UpdateUserPool", UserPoolUpdate, func(ctx context.Context) (*cognitoidentityprovider.UpdateUserPoolOutput, error) {
+		return c.client.UpdateUserPool(ctx, params, optFns...)
+	})
+}
+
+func (c *LimitedClient) CreateGroup(ctx context.Context, params *cognitoidentityprovider.CreateGroupInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.CreateGroupOutput, error) {
+	return invoke(ctx, c, "CreateGroup", UserPoolResourceUpdate, func(ctx context.Context) (*cognitoidentityprovider.CreateGroupOutput, error) {
+		return c.client.CreateGroup(ctx, params, optFns...)
+	})
+}
+
+func (c *LimitedClient) AdminCreateUser(ctx context.Context, params *cognitoidentityprovider.AdminCreateUserInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.AdminCreateUserOutput, error) {
+	return invoke(ctx, c, "AdminCreateUser", UserCreation, func(ctx context.Context) (*cognitoidentityprovider.AdminCreateUserOutput, error) {
+		return c.client.AdminCreateUser(ctx, params, optFns...)
+	})
+}
+
+func (c *LimitedClient) CreateResourceServer(ctx context.Context, params *cognitoidentityprovider.CreateResourceServerInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.CreateResourceServerOutput, error) {
+	return invoke(ctx, c, "CreateResourceServer", UserPoolResourceUpdate, func(ctx context.Context) (*cognitoidentityprovider.CreateResourceServerOutput, error) {
+		return c.client.CreateResourceServer(ctx, params, optFns...)
+	})
+}
+
+func (c *LimitedClient) CreateUserPoolClient(ctx context.Context, params *cognitoidentityprovider.CreateUserPoolClientInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.CreateUserPoolClientOutput, error) {
+	return invoke(ctx, c, "CreateUserPoolClient", UserPoolClientUpdate, func(ctx context.Context) (*cognitoidentityprovider.CreateUserPoolClientOutput, error) {
+		return c.client.CreateUserPoolClient(ctx, params, optFns...)
+	})
+}
+
+func (c *LimitedClient) CreateIdentityProvider(ctx context.Context, params *cognitoidentityprovider.CreateIdentityProviderInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.CreateIdentityProviderOutput, error) {
+	return invoke(ctx, c, "CreateIdentityProvider", UserPoolResourceUpdate, func(ctx context.Context) (*cognitoidentityprovider.CreateIdentityProviderOutput, error) {
+		return c.client.CreateIdentityProvider(ctx, params, optFns...)
+	})
+}
+
+func (c *LimitedClient) GetCSVHeader(ctx context.Context, params *cognitoidentityprovider.GetCSVHeaderInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.GetCSVHeaderOutput, error) {
+	return invoke(ctx, c, "GetCSVHeader", UserPoolResourceRead, func(ctx context.Context) (*cognitoidentityprovider.GetCSVHeaderOutput, error) {
+		return c.client.GetCSVHeader(ctx, params, optFns...)
+	})
+}
+
+func (c *LimitedClient) CreateUserImportJob(ctx context.Context, params *cognitoidentityprovider.CreateUserImportJobInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.CreateUserImportJobOutput, error) {
+	return invoke(ctx, c, "CreateUserImportJob", UserPoolResourceUpdate, func(ctx context.Context) (*cognitoidentityprovider.CreateUserImportJobOutput, error) {
+		return c.client.CreateUserImportJob(ctx, params, optFns...)
+	})
+}
+
+func (c *LimitedClient) StartUserImportJob(ctx context.Context, params *cognitoidentityprovider.StartUserImportJobInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.StartUserImportJobOutput, error) {
+	return invoke(ctx, c, "StartUserImportJob", UserPoolResourceUpdate, func(ctx context.Context) (*cognitoidentityprovider.StartUserImportJobOutput, error) {
+		return c.client.StartUserImportJob(ctx, params, optFns...)
+	})
+}
+
+func (c *LimitedClient) DescribeUserImportJob(ctx context.Context, params *cognitoidentityprovider.DescribeUserImportJobInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.DescribeUserImportJobOutput, error) {
+	return invoke(ctx, c, "DescribeUserImportJob", UserPoolResourceRead, func(ctx context.Context) (*cognitoidentityprovider.DescribeUserImportJobOutput, error) {
+		return c.client.DescribeUserImportJob(ctx, params, optFns...)
+	})
+}
+
+func (c *LimitedClient) ListUsersInGroup(ctx context.Context, params *cognitoidentityprovider.ListUsersInGroupInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.ListUsersInGroupOutput, error) {
+	return invoke(ctx, c, "ListUsersInGroup", UserList, func(ctx context.Context) (*cognitoidentityprovider.ListUsersInGroupOutput, error) {
+		return c.client.ListUsersInGroup(ctx, params, optFns...)
+	})
+}
+
+func (c *LimitedClient) AdminAddUserToGroup(ctx context.Context, params *cognitoidentityprovider.AdminAddUserToGroupInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.AdminAddUserToGroupOutput, error) {
+	return invoke(ctx, c, "AdminAddUserToGroup", UserUpdate, func(ctx context.Context) (*cognitoidentityprovider.AdminAddUserToGroupOutput, error) {
+		return c.client.AdminAddUserToGroup(ctx, params, optFns...)
+	})
+}
+
+func (c *LimitedClient) CreateUserPoolDomain(ctx context.Context, params *cognitoidentityprovider.CreateUserPoolDomainInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.CreateUserPoolDomainOutput, error) {
+	return invoke(ctx, c, "CreateUserPoolDomain", UserPoolUpdate, func(ctx context.Context) (*cognitoidentityprovider.CreateUserPoolDomainOutput, error) {
+		return c.client.CreateUserPoolDomain(ctx, params, optFns...)
+	})
+}
+
+func (c *LimitedClient) AdminDisableUser(ctx context.Context, params *cognitoidentityprovider.AdminDisableUserInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.AdminDisableUserOutput, error) {
+	return invoke(ctx, c, "AdminDisableUser", UserUpdate, func(ctx context.Context) (*cognitoidentityprovider.AdminDisableUserOutput, error) {
+		return c.client.AdminDisableUser(ctx, params, optFns...)
+	})
+}
+
+func (c *LimitedClient) AdminGetUser(ctx context.Context, params *cognitoidentityprovider.AdminGetUserInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.AdminGetUserOutput, error) {
+	return invoke(ctx, c, "AdminGetUser", UserRead, func(ctx context.Context) (*cognitoidentityprovider.AdminGetUserOutput, error) {
+		return c.client.AdminGetUser(ctx, params, optFns...)
+	})
+}
+
+func (c *LimitedClient) UpdateGroup(ctx context.Context, params *cognitoidentityprovider.UpdateGroupInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.UpdateGroupOutput, error) {
+	return invoke(ctx, c, "UpdateGroup", UserPoolResourceUpdate, func(ctx context.Context) (*cognitoidentityprovider.UpdateGroupOutput, error) {
+		return c.client.UpdateGroup(ctx, params, optFns...)
+	})
+}
+
+func (c *LimitedClient) DeleteGroup(ctx context.Context, params *cognitoidentityprovider.DeleteGroupInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.DeleteGroupOutput, error) {
+	return invoke(ctx, c, "DeleteGroup", UserPoolResourceUpdate, func(ctx context.Context) (*cognitoidentityprovider.DeleteGroupOutput, error) {
+		return c.client.DeleteGroup(ctx, params, optFns...)
+	})
+}
+
+func (c *LimitedClient) UpdateResourceServer(ctx context.Context, params *cognitoidentityprovider.UpdateResourceServerInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.UpdateResourceServerOutput, error) {
+	return invoke(ctx, c, "UpdateResourceServer", UserPoolResourceUpdate, func(ctx context.Context) (*cognitoidentityprovider.UpdateResourceServerOutput, error) {
+		return c.client.UpdateResourceServer(ctx, params, optFns...)
+	})
+}
+
+func (c *LimitedClient) AdminUpdateUserAttributes(ctx context.Context, params *cognitoidentityprovider.AdminUpdateUserAttributesInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.AdminUpdateUserAttributesOutput, error) {
+	return invoke(ctx, c, "AdminUpdateUserAttributes", UserUpdate, func(ctx context.Context) (*cognitoidentityprovider.AdminUpdateUserAttributesOutput, error) {
+		return c.client.AdminUpdateUserAttributes(ctx, params, optFns...)
+	})
+}
+
+func (c *LimitedClient) AdminDeleteUserAttributes(ctx context.Context, params *cognitoidentityprovider.AdminDeleteUserAttributesInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.AdminDeleteUserAttributesOutput, error) {
+	return invoke(ctx, c, "AdminDeleteUserAttributes", UserUpdate, func(ctx context.Context) (*cognitoidentityprovider.AdminDeleteUserAttributesOutput, error) {
+		return c.client.AdminDeleteUserAttributes(ctx, params, optFns...)
+	})
+}
+
+func (c *LimitedClient) AdminEnableUser(ctx context.Context, params *cognitoidentityprovider.AdminEnableUserInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.AdminEnableUserOutput, error) {
+	return invoke(ctx, c, "AdminEnableUser", UserUpdate, func(ctx context.Context) (*cognitoidentityprovider.AdminEnableUserOutput, error) {
+		return c.client.AdminEnableUser(ctx, params, optFns...)
+	})
+}
+
+func (c *LimitedClient) AdminDeleteUser(ctx context.Context, params *cognitoidentityprovider.AdminDeleteUserInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.AdminDeleteUserOutput, error) {
+	return invoke(ctx, c, "AdminDeleteUser", UserUpdate, func(ctx context.Context) (*cognitoidentityprovider.AdminDeleteUserOutput, error) {
+		return c.client.AdminDeleteUser(ctx, params, optFns...)
+	})
+}
+
+func (c *LimitedClient) AdminRemoveUserFromGroup(ctx context.Context, params *cognitoidentityprovider.AdminRemoveUserFromGroupInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.AdminRemoveUserFromGroupOutput, error) {
+	return invoke(ctx, c, "AdminRemoveUserFromGroup", UserUpdate, func(ctx context.Context) (*cognitoidentityprovider.AdminRemoveUserFromGroupOutput, error) {
+		return c.client.AdminRemoveUserFromGroup(ctx, params, optFns...)
+	})
+}
+
+func (c *LimitedClient) DescribeUserPoolClient(ctx context.Context, params *cognitoidentityprovider.DescribeUserPoolClientInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.DescribeUserPoolClientOutput, error) {
+	return invoke(ctx, c, "DescribeUserPoolClient", UserPoolClientRead, func(ctx context.Context) (*cognitoidentityprovider.DescribeUserPoolClientOutput, error) {
+		return c.client.DescribeUserPoolClient(ctx, params, optFns...)
+	})
+}
+
+func (c *LimitedClient) DescribeIdentityProvider(ctx context.Context, params *cognitoidentityprovider.DescribeIdentityProviderInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.DescribeIdentityProviderOutput, error) {
+	return invoke(ctx, c, "DescribeIdentityProvider", UserPoolResourceRead, func(ctx context.Context) (*cognitoidentityprovider.DescribeIdentityProviderOutput, error) {
+		return c.client.DescribeIdentityProvider(ctx, params, optFns...)
+	})
+}
@@ -0,0 +1,244 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider"
+	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider/types"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// mockCognitoClient fails AdminCreateUser with errs, one per call, then succeeds
+type mockCognitoClient struct {
+	errs  []error
+	calls int
+}
+
+func (m *mockCognitoClient) AdminCreateUser(ctx context.Context, params *cognitoidentityprovider.AdminCreateUserInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.AdminCreateUserOutput, error) {
+	m.calls++
+	if len(m.errs) > 0 {
+		err := m.errs[0]
+		m.errs = m.errs[1:]
+		return nil, err
+	}
+	return &cognitoidentityprovider.AdminCreateUserOutput{}, nil
+}
+
+func (m *mockCognitoClient) DescribeUserPool(ctx context.Context, params *cognitoidentityprovider.DescribeUserPoolInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.DescribeUserPoolOutput, error) {
+	return &cognitoidentityprovider.DescribeUserPoolOutput{}, nil
+}
+
+func (m *mockCognitoClient) ListUserPools(ctx context.Context, params *cognitoidentityprovider.ListUserPoolsInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.ListUserPoolsOutput, error) {
+	return &cognitoidentityprovider.ListUserPoolsOutput{}, nil
+}
+
+func (m *mockCognitoClient) ListUsers(ctx context.Context, params *cognitoidentityprovider.ListUsersInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.ListUsersOutput, error) {
+	return &cognitoidentityprovider.ListUsersOutput{}, nil
+}
+
+func (m *mockCognitoClient) ListGroups(ctx context.Context, params *cognitoidentityprovider.ListGroupsInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.ListGroupsOutput, error) {
+	return &cognitoidentityprovider.ListGroupsOutput{}, nil
+}
+
+func (m *mockCognitoClient) ListResourceServers(ctx context.Context, params *cognitoidentityprovider.ListResourceServersInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.ListResourceServersOutput, error) {
+	return &cognitoidentityprovider.ListResourceServersOutput{}, nil
+}
+
+func (m *mockCognitoClient) ListUserPoolClients(ctx context.Context, params *cognitoidentityprovider.ListUserPoolClientsInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.ListUserPoolClientsOutput, error) {
+	return &cognitoidentityprovider.ListUserPoolClientsOutput{}, nil
+}
+
+func (m *mockCognitoClient) ListIdentityProviders(ctx context.Context, params *cognitoidentityprovider.ListIdentityProvidersInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.ListIdentityProvidersOutput, error) {
+	return &cognitoidentityprovider.ListIdentityProvidersOutput{}, nil
+}
+
+func (m *mockCognitoClient) CreateUserPool(ctx context.Context, params *cognitoidentityprovider.CreateUserPoolInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.CreateUserPoolOutput, error) {
+	return &cognitoidentityprovider.CreateUserPoolOutput{}, nil
+}
+
+func (m *mockCognitoClient) UpdateUserPool(ctx context.Context, params *cognitoidentityprovider.UpdateUserPoolInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.UpdateUserPoolOutput, error) {
+	return &cognitoidentityprovider.UpdateUserPoolOutput{}, nil
+}
+
+func (m *mockCognitoClient) CreateGroup(ctx context.Context, params *cognitoidentityprovider.CreateGroupInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.CreateGroupOutput, error) {
+	return &cognitoidentityprovider.CreateGroupOutput{}, nil
+}
+
+func (m *mockCognitoClient) CreateResourceServer(ctx context.Context, params *cognitoidentityprovider.CreateResourceServerInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.CreateResourceServerOutput, error) {
+	return &cognitoidentityprovider.CreateResourceServerOutput{}, nil
+}
+
+func (m *mockCognitoClient) CreateUserPoolClient(ctx context.Context, params *cognitoidentityprovider.CreateUserPoolClientInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.CreateUserPoolClientOutput, error) {
+	return &cognitoidentityprovider.CreateUserPoolClientOutput{}, nil
+}
+
+func (m *mockCognitoClient) CreateIdentityProvider(ctx context.Context, params *cognitoidentityprovider.CreateIdentityProviderInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.CreateIdentityProviderOutput, error) {
+	return &cognitoidentityprovider.CreateIdentityProviderOutput{}, nil
+}
+
+func (m *mockCognitoClient) GetCSVHeader(ctx context.Context, params *cognitoidentityprovider.GetCSVHeaderInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.GetCSVHeaderOutput, error) {
+	return &cognitoidentityprovider.GetCSVHeaderOutput{}, nil
+}
+
+func (m *mockCognitoClient) CreateUserImportJob(ctx context.Context, params *cognitoidentityprovider.CreateUserImportJobInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.CreateUserImportJobOutput, error) {
+	return &cognitoidentityprovider.CreateUserImportJobOutput{}, nil
+}
+
+func (m *mockCognitoClient) StartUserImportJob(ctx context.Context, params *cognitoidentityprovider.StartUserImportJobInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.StartUserImportJobOutput, error) {
+	return &cognitoidentityprovider.StartUserImportJobOutput{}, nil
+}
+
+func (m *mockCognitoClient) DescribeUserImportJob(ctx context.Context, params *cognitoidentityprovider.DescribeUserImportJobInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.DescribeUserImportJobOutput, error) {
+	return &cognitoidentityprovider.DescribeUserImportJobOutput{}, nil
+}
+
+func (m *mockCognitoClient) ListUsersInGroup(ctx context.Context, params *cognitoidentityprovider.ListUsersInGroupInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.ListUsersInGroupOutput, error) {
+	return &cognitoidentityprovider.ListUsersInGroupOutput{}, nil
+}
+
+func (m *mockCognitoClient) AdminAddUserToGroup(ctx context.Context, params *cognitoidentityprovider.AdminAddUserToGroupInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.AdminAddUserToGroupOutput, error) {
+	return &cognitoidentityprovider.AdminAddUserToGroupOutput{}, nil
+}
+
+func (m *mockCognitoClient) CreateUserPoolDomain(ctx context.Context, params *cognitoidentityprovider.CreateUserPoolDomainInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.CreateUserPoolDomainOutput, error) {
+	return &cognitoidentityprovider.CreateUserPoolDomainOutput{}, nil
+}
+
+func (m *mockCognitoClient) AdminDisableUser(ctx context.Context, params *cognitoidentityprovider.AdminDisableUserInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.AdminDisableUserOutput, error) {
+	return &cognitoidentityprovider.AdminDisableUserOutput{}, nil
+}
+
+func (m *mockCognitoClient) AdminGetUser(ctx context.Context, params *cognitoidentityprovider.AdminGetUserInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.AdminGetUserOutput, error) {
+	return &cognitoidentityprovider.AdminGetUserOutput{}, nil
+}
+
+func (m *mockCognitoClient) UpdateGroup(ctx context.Context, params *cognitoidentityprovider.UpdateGroupInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.UpdateGroupOutput, error) {
+	return &cognitoidentityprovider.UpdateGroupOutput{}, nil
+}
+
+func (m *mockCognitoClient) DeleteGroup(ctx context.Context, params *cognitoidentityprovider.DeleteGroupInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.DeleteGroupOutput, error) {
+	return &cognitoidentityprovider.DeleteGroupOutput{}, nil
+}
+
+func (m *mockCognitoClient) UpdateResourceServer(ctx context.Context, params *cognitoidentityprovider.UpdateResourceServerInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.UpdateResourceServerOutput, error) {
+	return &cognitoidentityprovider.UpdateResourceServerOutput{}, nil
+}
+
+func (m *mockCognitoClient) AdminUpdateUserAttributes(ctx context.Context, params *cognitoidentityprovider.AdminUpdateUserAttributesInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.AdminUpdateUserAttributesOutput, error) {
+	return &cognitoidentityprovider.AdminUpdateUserAttributesOutput{}, nil
+}
+
+func (m *mockCognitoClient) AdminDeleteUserAttributes(ctx context.Context, params *cognitoidentityprovider.AdminDeleteUserAttributesInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.AdminDeleteUserAttributesOutput, error) {
+	return &cognitoidentityprovider.AdminDeleteUserAttributesOutput{}, nil
+}
+
+func (m *mockCognitoClient) AdminEnableUser(ctx context.Context, params *cognitoidentityprovider.AdminEnableUserInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.AdminEnableUserOutput, error) {
+	return &cognitoidentityprovider.AdminEnableUserOutput{}, nil
+}
+
+func (m *mockCognitoClient) AdminDeleteUser(ctx context.Context, params *cognitoidentityprovider.AdminDeleteUserInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.AdminDeleteUserOutput, error) {
+	return &cognitoidentityprovider.AdminDeleteUserOutput{}, nil
+}
+
+func (m *mockCognitoClient) AdminRemoveUserFromGroup(ctx context.Context, params *cognitoidentityprovider.AdminRemoveUserFromGroupInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.AdminRemoveUserFromGroupOutput, error) {
+	return &cognitoidentityprovider.AdminRemoveUserFromGroupOutput{}, nil
+}
+
+func (m *mockCognitoClient) DescribeUserPoolClient(ctx context.Context, params *cognitoidentityprovider.DescribeUserPoolClientInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.DescribeUserPoolClientOutput, error) {
+	return &cognitoidentityprovider.DescribeUserPoolClientOutput{}, nil
+}
+
+func (m *mockCognitoClient) DescribeIdentityProvider(ctx context.Context, params *cognitoidentityprovider.DescribeIdentityProviderInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.DescribeIdentityProviderOutput, error) {
+	return &cognitoidentityprovider.DescribeIdentityProviderOutput{}, nil
+}
+
+func TestLimitedClientRetries(t *testing.T) {
+	throttled := &types.TooManyRequestsException{}
+	limited := &types.LimitExceededException{}
+	exists := &types.UsernameExistsException{}
+
+	tests := []struct {
+		name        string
+		errs        []error
+		wantErr     error
+		wantCalls   int
+		wantRetries int
+		wantSlower  bool
+		// wantThrottles is the number of throttled calls observed
+		wantThrottles int
+	}{
+		{name: "success", wantCalls: 1},
+		{name: "retries throttling", errs: []error{throttled, limited}, wantCalls: 3, wantRetries: 2, wantSlower: true, wantThrottles: 2},
+		{name: "gives up after max attempts", errs: []error{throttled, throttled, throttled, throttled}, wantErr: throttled, wantCalls: 3, wantRetries: 2, wantSlower: true, wantThrottles: 3},
+		{name: "doesn't retry other errors", errs: []error{exists}, wantErr: exists, wantCalls: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := &mockCognitoClient{errs: tt.errs}
+			client := NewLimitedClient(mock, map[Category]float64{UserCreation: 1000}, RetryOptions{
+				MaxAttempts: 3,
+				BaseDelay:   time.Millisecond,
+				MaxDelay:    2 * time.Millisecond,
+			})
+			var observed, throttles int
+			client.OnCall(func(op string, throttled bool) {
+				if op != "AdminCreateUser" {
+					t.Errorf("OnCall() got operation %s", op)
+				}
+				observed++
+				if throttled {
+					throttles++
+				}
+			})
+
+			_, err := client.AdminCreateUser(context.Background(), &cognitoidentityprovider.AdminCreateUserInput{})
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("AdminCreateUser() error = %v, want %v", err, tt.wantErr)
+			}
+			if mock.calls != tt.wantCalls {
+				t.Errorf("AdminCreateUser() made %d calls, want %d", mock.calls, tt.wantCalls)
+			}
+			if observed != tt.wantCalls || throttles != tt.wantThrottles {
+				t.Errorf("OnCall() observed %d calls, %d throttled, want %d, %d", observed, throttles, tt.wantCalls, tt.wantThrottles)
+			}
+			if got := client.Retries()["AdminCreateUser"]; got != tt.wantRetries {
+				t.Errorf("Retries() = %d, want %d", got, tt.wantRetries)
+			}
+			if slower := client.buckets[UserCreation].Rate() < 1000; slower != tt.wantSlower {
+				t.Errorf("rate = %v, want slowed down %t", client.buckets[UserCreation].Rate(), tt.wantSlower)
+			}
+		})
+	}
+}
+
+func TestLimitedClientSpan(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	defer otel.SetTracerProvider(previous)
+
+	mock := &mockCognitoClient{errs: []error{&types.TooManyRequestsException{}}}
+	client := NewLimitedClient(mock, nil, RetryOptions{BaseDelay: time.Millisecond, MaxDelay: time.Millisecond})
+	if _, err := client.AdminCreateUser(context.Background(), &cognitoidentityprovider.AdminCreateUserInput{}); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 || spans[0].Name != "Cognito.AdminCreateUser" {
+		t.Fatalf("got spans %v, want one for the call and its retry", spans)
+	}
+	attrs := make(map[attribute.Key]attribute.Value)
+	for _, attr := range spans[0].Attributes {
+		attrs[attr.Key] = attr.Value
+	}
+	if attrs["rpc.method"].AsString() != "AdminCreateUser" || attrs["acbr.attempts"].AsInt64() != 2 || attrs["acbr.throttles"].AsInt64() != 1 {
+		t.Errorf("span attributes = %v", spans[0].Attributes)
+	}
+}
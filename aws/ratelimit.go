@@ -0,0 +1,105 @@
+package aws
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Category is a Cognito API request rate quota category. Operations in the
+// same category share one quota per account and region.
+type Category string
+
+const (
+	UserCreation           Category = "UserCreation"
+	UserRead               Category = "UserRead"
+	UserList               Category = "UserList"
+	UserUpdate             Category = "UserUpdate"
+	UserPoolRead           Category = "UserPoolRead"
+	UserPoolUpdate         Category = "UserPoolUpdate"
+	UserPoolClientRead     Category = "UserPoolClientRead"
+	UserPoolClientUpdate   Category = "UserPoolClientUpdate"
+	UserPoolResourceRead   Category = "UserPoolResourceRead"
+	UserPoolResourceUpdate Category = "UserPoolResourceUpdate"
+)
+
+// DefaultRates are Cognito's default quotas in requests per second
+var DefaultRates = map[Category]float64{
+	UserCreation:           50,
+	UserRead:               120,
+	UserList:               30,
+	UserUpdate:             25,
+	UserPoolRead:           15,
+	UserPoolUpdate:         15,
+	UserPoolClientRead:     15,
+	UserPoolClientUpdate:   15,
+	UserPoolResourceRead:   20,
+	UserPoolResourceUpdate: 15,
+}
+
+// TokenBucket limits requests to a rate, allowing bursts of up to one second's worth
+type TokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func NewTokenBucket(rate float64) *TokenBucket {
+	return &TokenBucket{
+		rate:   rate,
+		tokens: rate,
+		last:   time.Now(),
+	}
+}
+
+// Wait blocks until a request may be made or ctx is done
+func (b *TokenBucket) Wait(ctx context.Context) error {
+	for {
+		delay := b.reserve()
+		if delay == 0 {
+			return nil
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// reserve takes a token and returns zero, or returns how long until one is available
+func (b *TokenBucket) reserve() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	b.last = now
+	if burst := max(b.rate, 1); b.tokens > burst {
+		b.tokens = burst
+	}
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// Rate returns the current rate in requests per second
+func (b *TokenBucket) Rate() float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rate
+}
+
+// SetRate changes the rate in requests per second
+func (b *TokenBucket) SetRate(rate float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rate = rate
+}
@@ -0,0 +1,40 @@
+package aws
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	bucket := NewTokenBucket(20)
+
+	// The first second's worth of requests goes through at once
+	start := time.Now()
+	for i := 0; i < 20; i++ {
+		if err := bucket.Wait(context.Background()); err != nil {
+			t.Fatalf("Wait() error = %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 20*time.Millisecond {
+		t.Errorf("burst took %v, want no waiting", elapsed)
+	}
+
+	// Then requests are spaced at the rate
+	start = time.Now()
+	for i := 0; i < 2; i++ {
+		if err := bucket.Wait(context.Background()); err != nil {
+			t.Fatalf("Wait() error = %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 75*time.Millisecond {
+		t.Errorf("2 requests after the burst took %v, want about 100ms", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	bucket.SetRate(0.001)
+	if err := bucket.Wait(ctx); err == nil {
+		t.Error("Wait() with canceled context error = nil, want error")
+	}
+}
@@ -4,12 +4,15 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"path/filepath"
-	"strings"
+	"log/slog"
+	"sort"
+	"sync"
 	"time"
 
 	"acbr/aws"
 	"acbr/config"
+	"acbr/logging"
+	"acbr/report"
 	"acbr/storage"
 
 	awssdk "github.com/aws/aws-sdk-go-v2/aws"
@@ -18,146 +21,338 @@ import (
 )
 
 type CognitoBackup struct {
-	UserPoolConfig    *cognitoidentityprovider.DescribeUserPoolOutput
-	Users             []types.UserType
-	Groups            []types.GroupType
-	ResourceServers   []types.ResourceServerType
-	Clients           []types.UserPoolClientDescription
-	IdentityProviders []types.ProviderDescription
+	// Manifest describes the backup and its place in a backup chain
+	Manifest        *Manifest `json:",omitempty"`
+	UserPoolConfig  *cognitoidentityprovider.DescribeUserPoolOutput
+	Users           []types.UserType
+	Groups          []types.GroupType
+	ResourceServers []types.ResourceServerType
+	// Clients and IdentityProviders hold the full settings; backups from
+	// before they were described hold only names, IDs and types
+	Clients           []types.UserPoolClientType
+	IdentityProviders []types.IdentityProviderType
+	// IdentityPools are the identity pools trusting the pool, when backed up
+	IdentityPools []IdentityPool `json:",omitempty"`
+	// GroupMemberships maps each group name to the usernames of its members
+	GroupMemberships map[string][]string
+	// UserIndex lists every user of the pool, only in incremental backups
+	UserIndex []UserIndexEntry `json:",omitempty"`
+	// DeletedUsers are the usernames removed since the parent backup
+	DeletedUsers []string `json:",omitempty"`
+	// Failures are the reasons the items of a failed-items file failed
+	Failures []report.Failure `json:",omitempty"`
 }
 
 type Backup struct {
-	client aws.CognitoClient
-	config *config.Config
+	client   aws.CognitoClient
+	identity aws.IdentityClient
+	config   *config.Config
+	report   *report.Report
 }
 
 func NewBackup(client aws.CognitoClient, config *config.Config) *Backup {
 	return &Backup{
 		client: client,
 		config: config,
+		report: report.New(config),
 	}
 }
 
-func (b *Backup) Execute() error {
-	backup := &CognitoBackup{}
+// Report returns the report of what the backup read and wrote
+func (b *Backup) Report() *report.Report {
+	return b.report
+}
 
-	// Get User Pool configuration
-	userPool, err := b.getUserPool()
-	if err != nil {
-		return fmt.Errorf("failed to get user pool: %w", err)
+// log returns the logger of the run, with its run and pool IDs
+func (b *Backup) log() *slog.Logger {
+	return slog.With(logging.RunID, b.report.RunID, logging.PoolID, b.config.PoolID)
+}
+
+func (b *Backup) Execute(ctx context.Context) error {
+	// Changes are detected relative to when the scan started
+	startedAt := time.Now().UTC()
+
+	if b.config.Incremental {
+		return b.executeIncremental(ctx, startedAt)
 	}
-	backup.UserPoolConfig = userPool
 
-	// Get Users
-	users, err := b.getUsers()
+	collectCtx, collected := b.report.Phase(ctx, "collect")
+	backup, err := b.Collect(collectCtx)
+	collected()
 	if err != nil {
-		return fmt.Errorf("failed to get users: %w", err)
+		return err
+	}
+	b.recordCounts(backup)
+	backup.Manifest = &Manifest{
+		ID:            b.filename(BackupTypeFull, startedAt),
+		PoolID:        b.config.PoolID,
+		Type:          BackupTypeFull,
+		CreatedAt:     startedAt,
+		SectionHashes: sectionHashes(backup),
+		Users:         len(backup.Users),
 	}
-	backup.Users = users
 
-	// Get Groups
-	groups, err := b.getGroups()
-	if err != nil {
-		return fmt.Errorf("failed to get groups: %w", err)
+	// Save backup to file
+	return b.saveBackup(ctx, backup)
+}
+
+// Collect reads the whole pool: configuration, groups and users
+func (b *Backup) Collect(ctx context.Context) (*CognitoBackup, error) {
+	return b.collect(ctx, true)
+}
+
+// collectConfig reads everything except users
+func (b *Backup) collectConfig(ctx context.Context) (*CognitoBackup, error) {
+	return b.collect(ctx, false)
+}
+
+// collect reads the pool's sections concurrently, on up to the configured
+// number of workers. The first failure cancels the remaining calls.
+func (b *Backup) collect(ctx context.Context, withUsers bool) (*CognitoBackup, error) {
+	backup := &CognitoBackup{}
+	g := newTaskGroup(ctx, b.config.GetWorkers())
+
+	g.Go(func(ctx context.Context) error {
+		userPool, err := b.getUserPool(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get user pool: %w", err)
+		}
+		backup.UserPoolConfig = userPool
+		return nil
+	})
+
+	// Memberships are read per group once the groups are known
+	var mu sync.Mutex
+	backup.GroupMemberships = make(map[string][]string)
+	g.Go(func(ctx context.Context) error {
+		groups, err := b.getGroups(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get groups: %w", err)
+		}
+		backup.Groups = groups
+
+		for _, group := range groups {
+			g.Go(func(ctx context.Context) error {
+				members, err := b.getGroupMembers(ctx, *group.GroupName)
+				if err != nil {
+					return fmt.Errorf("failed to get group memberships: group %s: %w", *group.GroupName, err)
+				}
+				if len(members) > 0 {
+					mu.Lock()
+					backup.GroupMemberships[*group.GroupName] = members
+					mu.Unlock()
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+
+	g.Go(func(ctx context.Context) error {
+		servers, err := b.getResourceServers(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get resource servers: %w", err)
+		}
+		backup.ResourceServers = servers
+		return nil
+	})
+
+	// Client and identity provider settings are described one by one
+	g.Go(func(ctx context.Context) error {
+		clients, err := b.getClients(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get clients: %w", err)
+		}
+		backup.Clients = make([]types.UserPoolClientType, len(clients))
+		for i, client := range clients {
+			g.Go(func(ctx context.Context) error {
+				details, err := b.describeClient(ctx, client)
+				if err != nil {
+					return fmt.Errorf("failed to get clients: client %s: %w", *client.ClientName, err)
+				}
+				backup.Clients[i] = details
+				return nil
+			})
+		}
+		return nil
+	})
+
+	g.Go(func(ctx context.Context) error {
+		providers, err := b.getIdentityProviders(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get identity providers: %w", err)
+		}
+		backup.IdentityProviders = make([]types.IdentityProviderType, len(providers))
+		for i, provider := range providers {
+			g.Go(func(ctx context.Context) error {
+				details, err := b.describeIdentityProvider(ctx, provider)
+				if err != nil {
+					return fmt.Errorf("failed to get identity providers: provider %s: %w", *provider.ProviderName, err)
+				}
+				backup.IdentityProviders[i] = details
+				return nil
+			})
+		}
+		return nil
+	})
+
+	if b.identity != nil {
+		g.Go(func(ctx context.Context) error {
+			pools, err := b.getIdentityPools(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to get identity pools: %w", err)
+			}
+			backup.IdentityPools = pools
+			return nil
+		})
 	}
-	backup.Groups = groups
 
-	// Get Resource Servers
-	servers, err := b.getResourceServers()
-	if err != nil {
-		return fmt.Errorf("failed to get resource servers: %w", err)
+	if withUsers {
+		g.Go(func(ctx context.Context) error {
+			users, err := b.getUsers(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to get users: %w", err)
+			}
+			backup.Users = users
+			return nil
+		})
 	}
-	backup.ResourceServers = servers
 
-	// Get Clients
-	clients, err := b.getClients()
-	if err != nil {
-		return fmt.Errorf("failed to get clients: %w", err)
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	nameClients(backup.IdentityPools, backup.Clients, UserPoolProviderName(b.config.PoolID))
+	return backup, nil
+}
+
+// filename names a backup file after the pool, its type and creation time
+func (b *Backup) filename(backupType string, createdAt time.Time) string {
+	suffix := ""
+	if backupType == BackupTypeIncremental {
+		suffix = "-incr"
+	}
+	return fmt.Sprintf("cognito-backup-%s-%s%s.json",
+		b.config.PoolID,
+		createdAt.Format("20060102-150405"),
+		suffix)
+}
+
+// recordCounts adds what the backup holds to the report
+func (b *Backup) recordCounts(backup *CognitoBackup) {
+	memberships := 0
+	for _, usernames := range backup.GroupMemberships {
+		memberships += len(usernames)
 	}
-	backup.Clients = clients
+	b.report.BackedUp("user", len(backup.Users))
+	b.report.BackedUp("group", len(backup.Groups))
+	b.report.BackedUp("membership", memberships)
+	b.report.BackedUp("resource-server", len(backup.ResourceServers))
+	b.report.BackedUp("client", len(backup.Clients))
+	b.report.BackedUp("idp", len(backup.IdentityProviders))
+	b.report.BackedUp("identity-pool", len(backup.IdentityPools))
+}
 
-	// Get Identity Providers
-	providers, err := b.getIdentityProviders()
+func (b *Backup) saveBackup(ctx context.Context, backup *CognitoBackup) error {
+	ctx, saved := b.report.Phase(ctx, "save")
+	defer saved()
+	path, err := Save(ctx, b.config.BackupPath, backup.Manifest.ID, backup)
 	if err != nil {
-		return fmt.Errorf("failed to get identity providers: %w", err)
+		return err
 	}
-	backup.IdentityProviders = providers
+	b.report.Backup = path
+	b.log().Info("backup saved", "path", path, "type", backup.Manifest.Type, "users", len(backup.Users))
 
-	// Save backup to file
-	return b.saveBackup(backup)
+	// The manifest is also stored on its own so chains can be listed cheaply
+	return saveManifest(ctx, b.config.BackupPath, backup.Manifest)
 }
 
-func (b *Backup) saveBackup(backup *CognitoBackup) error {
+// Save writes the backup as filename inside the backupPath directory and
+// returns the path it was stored under
+func Save(ctx context.Context, backupPath, filename string, backup *CognitoBackup) (string, error) {
 	// Create storage based on backup path
-	storage, err := storage.NewStorage(b.config.BackupPath)
+	store, err := storage.NewStorage(ctx, backupPath)
 	if err != nil {
-		return fmt.Errorf("failed to create storage: %w", err)
+		return "", fmt.Errorf("failed to create storage: %w", err)
 	}
 
 	// Marshal backup data
 	data, err := json.Marshal(backup)
 	if err != nil {
-		return fmt.Errorf("failed to marshal backup: %w", err)
+		return "", fmt.Errorf("failed to marshal backup: %w", err)
 	}
 
-	// Generate backup filename
-	filename := fmt.Sprintf("cognito-backup-%s-%s.json",
-		b.config.PoolID,
-		time.Now().Format("20060102-150405"))
-
 	// For local storage, join path with filename
 	// For S3, the path handling is already correct in S3Storage
-	path := filename
-	if !strings.HasPrefix(b.config.BackupPath, "s3://") {
-		path = filepath.Join(b.config.BackupPath, filename)
-	}
+	path := storage.JoinPath(backupPath, filename)
 
 	// Save backup
-	if err := storage.Save(context.Background(), data, path); err != nil {
-		return fmt.Errorf("failed to save backup: %w", err)
+	if err := store.Save(ctx, data, path); err != nil {
+		return "", fmt.Errorf("failed to save backup: %w", err)
 	}
 
-	return nil
+	return path, nil
 }
 
-func (b *Backup) getUserPool() (*cognitoidentityprovider.DescribeUserPoolOutput, error) {
-	return b.client.DescribeUserPool(context.Background(), &cognitoidentityprovider.DescribeUserPoolInput{
+// Load reads and decodes the backup file at path
+func Load(ctx context.Context, path string) (*CognitoBackup, error) {
+	// Load backup data
+	data, err := storage.ReadFile(ctx, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load backup: %w", err)
+	}
+
+	// Unmarshal backup data
+	var backup CognitoBackup
+	if err := json.Unmarshal(data, &backup); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal backup: %w", err)
+	}
+
+	return &backup, nil
+}
+
+func (b *Backup) getUserPool(ctx context.Context) (*cognitoidentityprovider.DescribeUserPoolOutput, error) {
+	return b.client.DescribeUserPool(ctx, &cognitoidentityprovider.DescribeUserPoolInput{
 		UserPoolId: &b.config.PoolID,
 	})
 }
 
-func (b *Backup) getUsers() ([]types.UserType, error) {
-	var users []types.UserType
-	paginator := cognitoidentityprovider.NewListUsersPaginator(b.client, &cognitoidentityprovider.ListUsersInput{
+func (b *Backup) getGroups(ctx context.Context) ([]types.GroupType, error) {
+	var groups []types.GroupType
+	paginator := cognitoidentityprovider.NewListGroupsPaginator(b.client, &cognitoidentityprovider.ListGroupsInput{
 		UserPoolId: &b.config.PoolID,
 	})
 	for paginator.HasMorePages() {
-		output, err := paginator.NextPage(context.Background())
+		output, err := paginator.NextPage(ctx)
 		if err != nil {
 			return nil, err
 		}
-		users = append(users, output.Users...)
+		groups = append(groups, output.Groups...)
 	}
-	return users, nil
+	return groups, nil
 }
 
-func (b *Backup) getGroups() ([]types.GroupType, error) {
-	var groups []types.GroupType
-	paginator := cognitoidentityprovider.NewListGroupsPaginator(b.client, &cognitoidentityprovider.ListGroupsInput{
+// getGroupMembers returns the sorted usernames of the group's members
+func (b *Backup) getGroupMembers(ctx context.Context, group string) ([]string, error) {
+	var members []string
+	paginator := cognitoidentityprovider.NewListUsersInGroupPaginator(b.client, &cognitoidentityprovider.ListUsersInGroupInput{
 		UserPoolId: &b.config.PoolID,
+		GroupName:  awssdk.String(group),
 	})
 	for paginator.HasMorePages() {
-		output, err := paginator.NextPage(context.Background())
+		output, err := paginator.NextPage(ctx)
 		if err != nil {
 			return nil, err
 		}
-		groups = append(groups, output.Groups...)
+		for _, user := range output.Users {
+			members = append(members, *user.Username)
+		}
 	}
-	return groups, nil
+	sort.Strings(members)
+	return members, nil
 }
 
-func (b *Backup) getResourceServers() ([]types.ResourceServerType, error) {
-	output, err := b.client.ListResourceServers(context.Background(), &cognitoidentityprovider.ListResourceServersInput{
+func (b *Backup) getResourceServers(ctx context.Context) ([]types.ResourceServerType, error) {
+	output, err := b.client.ListResourceServers(ctx, &cognitoidentityprovider.ListResourceServersInput{
 		UserPoolId: &b.config.PoolID,
 		MaxResults: awssdk.Int32(b.config.GetMaxResults()),
 	})
@@ -167,13 +362,13 @@ func (b *Backup) getResourceServers() ([]types.ResourceServerType, error) {
 	return output.ResourceServers, nil
 }
 
-func (b *Backup) getClients() ([]types.UserPoolClientDescription, error) {
+func (b *Backup) getClients(ctx context.Context) ([]types.UserPoolClientDescription, error) {
 	var clients []types.UserPoolClientDescription
 	paginator := cognitoidentityprovider.NewListUserPoolClientsPaginator(b.client, &cognitoidentityprovider.ListUserPoolClientsInput{
 		UserPoolId: &b.config.PoolID,
 	})
 	for paginator.HasMorePages() {
-		output, err := paginator.NextPage(context.Background())
+		output, err := paginator.NextPage(ctx)
 		if err != nil {
 			return nil, err
 		}
@@ -182,12 +377,56 @@ func (b *Backup) getClients() ([]types.UserPoolClientDescription, error) {
 	return clients, nil
 }
 
-func (b *Backup) getIdentityProviders() ([]types.ProviderDescription, error) {
-	output, err := b.client.ListIdentityProviders(context.Background(), &cognitoidentityprovider.ListIdentityProvidersInput{
+// describeClient reads the client's settings. The client secret is left out
+// of backups; a restored client gets a new one.
+func (b *Backup) describeClient(ctx context.Context, client types.UserPoolClientDescription) (types.UserPoolClientType, error) {
+	output, err := b.client.DescribeUserPoolClient(ctx, &cognitoidentityprovider.DescribeUserPoolClientInput{
 		UserPoolId: &b.config.PoolID,
+		ClientId:   client.ClientId,
 	})
 	if err != nil {
-		return nil, err
+		return types.UserPoolClientType{}, err
+	}
+	if output.UserPoolClient == nil {
+		return types.UserPoolClientType{ClientId: client.ClientId, ClientName: client.ClientName, UserPoolId: client.UserPoolId}, nil
+	}
+
+	details := *output.UserPoolClient
+	details.ClientSecret = nil
+	return details, nil
+}
+
+func (b *Backup) getIdentityProviders(ctx context.Context) ([]types.ProviderDescription, error) {
+	var providers []types.ProviderDescription
+	paginator := cognitoidentityprovider.NewListIdentityProvidersPaginator(b.client, &cognitoidentityprovider.ListIdentityProvidersInput{
+		UserPoolId: &b.config.PoolID,
+	})
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		providers = append(providers, output.Providers...)
+	}
+	return providers, nil
+}
+
+// describeIdentityProvider reads the provider's details and attribute mapping
+func (b *Backup) describeIdentityProvider(ctx context.Context, provider types.ProviderDescription) (types.IdentityProviderType, error) {
+	output, err := b.client.DescribeIdentityProvider(ctx, &cognitoidentityprovider.DescribeIdentityProviderInput{
+		UserPoolId:   &b.config.PoolID,
+		ProviderName: provider.ProviderName,
+	})
+	if err != nil {
+		return types.IdentityProviderType{}, err
+	}
+	if output.IdentityProvider == nil {
+		return types.IdentityProviderType{
+			ProviderName:     provider.ProviderName,
+			ProviderType:     provider.ProviderType,
+			CreationDate:     provider.CreationDate,
+			LastModifiedDate: provider.LastModifiedDate,
+		}, nil
 	}
-	return output.Providers, nil
+	return *output.IdentityProvider, nil
 }
@@ -2,29 +2,90 @@ package backup
 
 import (
 	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
 
 	"acbr/config"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider"
+	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider/types"
 )
 
 type mockCognitoClient struct {
 	describeUserPoolOutput *cognitoidentityprovider.DescribeUserPoolOutput
 	describeUserPoolError  error
+
+	users []types.UserType
+	// unindexed attributes can't be used in ListUsers filters
+	unindexed map[string]bool
+
+	groups      map[string][]string
+	clients     []types.UserPoolClientType
+	providers   []types.IdentityProviderType
+	describeErr error
+
+	// pools are listed one per page, poolTags are returned by DescribeUserPool
+	pools    []types.UserPoolDescriptionType
+	poolTags map[string]map[string]string
 }
 
 func (m *mockCognitoClient) DescribeUserPool(ctx context.Context, params *cognitoidentityprovider.DescribeUserPoolInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.DescribeUserPoolOutput, error) {
+	if tags, ok := m.poolTags[aws.ToString(params.UserPoolId)]; ok {
+		return &cognitoidentityprovider.DescribeUserPoolOutput{UserPool: &types.UserPoolType{Id: params.UserPoolId, UserPoolTags: tags}}, nil
+	}
 	return m.describeUserPoolOutput, m.describeUserPoolError
 }
 
+func (m *mockCognitoClient) ListUserPools(ctx context.Context, params *cognitoidentityprovider.ListUserPoolsInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.ListUserPoolsOutput, error) {
+	page := 0
+	if params.NextToken != nil {
+		page, _ = strconv.Atoi(*params.NextToken)
+	}
+	if page >= len(m.pools) {
+		return &cognitoidentityprovider.ListUserPoolsOutput{}, nil
+	}
+	output := &cognitoidentityprovider.ListUserPoolsOutput{UserPools: m.pools[page : page+1]}
+	if page+1 < len(m.pools) {
+		output.NextToken = aws.String(strconv.Itoa(page + 1))
+	}
+	return output, nil
+}
+
 // Add all required methods
 func (m *mockCognitoClient) ListUsers(ctx context.Context, params *cognitoidentityprovider.ListUsersInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.ListUsersOutput, error) {
-	return &cognitoidentityprovider.ListUsersOutput{}, nil
+	if params.Filter == nil {
+		return &cognitoidentityprovider.ListUsersOutput{Users: m.users}, nil
+	}
+
+	attr, value, _ := strings.Cut(*params.Filter, " ^= ")
+	if m.unindexed[attr] {
+		return nil, &types.InvalidParameterException{Message: aws.String("unsupported filter")}
+	}
+	prefix, _ := strconv.Unquote(value)
+	var users []types.UserType
+	for _, user := range m.users {
+		value := *user.Username
+		if attr == "sub" {
+			value = indexEntry(user).Sub
+		}
+		if strings.HasPrefix(value, prefix) {
+			users = append(users, user)
+		}
+	}
+	return &cognitoidentityprovider.ListUsersOutput{Users: users}, nil
 }
 
 func (m *mockCognitoClient) ListGroups(ctx context.Context, params *cognitoidentityprovider.ListGroupsInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.ListGroupsOutput, error) {
-	return &cognitoidentityprovider.ListGroupsOutput{}, nil
+	var groups []types.GroupType
+	for name := range m.groups {
+		groups = append(groups, types.GroupType{GroupName: aws.String(name)})
+	}
+	return &cognitoidentityprovider.ListGroupsOutput{Groups: groups}, nil
 }
 
 func (m *mockCognitoClient) ListResourceServers(ctx context.Context, params *cognitoidentityprovider.ListResourceServersInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.ListResourceServersOutput, error) {
@@ -32,11 +93,19 @@ func (m *mockCognitoClient) ListResourceServers(ctx context.Context, params *cog
 }
 
 func (m *mockCognitoClient) ListUserPoolClients(ctx context.Context, params *cognitoidentityprovider.ListUserPoolClientsInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.ListUserPoolClientsOutput, error) {
-	return &cognitoidentityprovider.ListUserPoolClientsOutput{}, nil
+	var clients []types.UserPoolClientDescription
+	for _, client := range m.clients {
+		clients = append(clients, types.UserPoolClientDescription{ClientId: client.ClientId, ClientName: client.ClientName})
+	}
+	return &cognitoidentityprovider.ListUserPoolClientsOutput{UserPoolClients: clients}, nil
 }
 
 func (m *mockCognitoClient) ListIdentityProviders(ctx context.Context, params *cognitoidentityprovider.ListIdentityProvidersInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.ListIdentityProvidersOutput, error) {
-	return &cognitoidentityprovider.ListIdentityProvidersOutput{}, nil
+	var providers []types.ProviderDescription
+	for _, provider := range m.providers {
+		providers = append(providers, types.ProviderDescription{ProviderName: provider.ProviderName, ProviderType: provider.ProviderType})
+	}
+	return &cognitoidentityprovider.ListIdentityProvidersOutput{Providers: providers}, nil
 }
 
 func (m *mockCognitoClient) CreateUserPool(ctx context.Context, params *cognitoidentityprovider.CreateUserPoolInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.CreateUserPoolOutput, error) {
@@ -67,6 +136,109 @@ func (m *mockCognitoClient) CreateIdentityProvider(ctx context.Context, params *
 	return &cognitoidentityprovider.CreateIdentityProviderOutput{}, nil
 }
 
+func (m *mockCognitoClient) GetCSVHeader(ctx context.Context, params *cognitoidentityprovider.GetCSVHeaderInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.GetCSVHeaderOutput, error) {
+	return &cognitoidentityprovider.GetCSVHeaderOutput{}, nil
+}
+
+func (m *mockCognitoClient) CreateUserImportJob(ctx context.Context, params *cognitoidentityprovider.CreateUserImportJobInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.CreateUserImportJobOutput, error) {
+	return &cognitoidentityprovider.CreateUserImportJobOutput{}, nil
+}
+
+func (m *mockCognitoClient) StartUserImportJob(ctx context.Context, params *cognitoidentityprovider.StartUserImportJobInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.StartUserImportJobOutput, error) {
+	return &cognitoidentityprovider.StartUserImportJobOutput{}, nil
+}
+
+func (m *mockCognitoClient) DescribeUserImportJob(ctx context.Context, params *cognitoidentityprovider.DescribeUserImportJobInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.DescribeUserImportJobOutput, error) {
+	return &cognitoidentityprovider.DescribeUserImportJobOutput{}, nil
+}
+
+func (m *mockCognitoClient) ListUsersInGroup(ctx context.Context, params *cognitoidentityprovider.ListUsersInGroupInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.ListUsersInGroupOutput, error) {
+	var users []types.UserType
+	for _, username := range m.groups[*params.GroupName] {
+		users = append(users, types.UserType{Username: aws.String(username)})
+	}
+	return &cognitoidentityprovider.ListUsersInGroupOutput{Users: users}, nil
+}
+
+func (m *mockCognitoClient) AdminAddUserToGroup(ctx context.Context, params *cognitoidentityprovider.AdminAddUserToGroupInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.AdminAddUserToGroupOutput, error) {
+	return &cognitoidentityprovider.AdminAddUserToGroupOutput{}, nil
+}
+
+func (m *mockCognitoClient) CreateUserPoolDomain(ctx context.Context, params *cognitoidentityprovider.CreateUserPoolDomainInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.CreateUserPoolDomainOutput, error) {
+	return &cognitoidentityprovider.CreateUserPoolDomainOutput{}, nil
+}
+
+func (m *mockCognitoClient) AdminDisableUser(ctx context.Context, params *cognitoidentityprovider.AdminDisableUserInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.AdminDisableUserOutput, error) {
+	return &cognitoidentityprovider.AdminDisableUserOutput{}, nil
+}
+
+func (m *mockCognitoClient) AdminGetUser(ctx context.Context, params *cognitoidentityprovider.AdminGetUserInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.AdminGetUserOutput, error) {
+	for _, user := range m.users {
+		if *user.Username == *params.Username {
+			return &cognitoidentityprovider.AdminGetUserOutput{
+				Username:             user.Username,
+				UserAttributes:       user.Attributes,
+				Enabled:              user.Enabled,
+				UserLastModifiedDate: user.UserLastModifiedDate,
+			}, nil
+		}
+	}
+	return nil, &types.UserNotFoundException{}
+}
+
+func (m *mockCognitoClient) UpdateGroup(ctx context.Context, params *cognitoidentityprovider.UpdateGroupInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.UpdateGroupOutput, error) {
+	return &cognitoidentityprovider.UpdateGroupOutput{}, nil
+}
+
+func (m *mockCognitoClient) DeleteGroup(ctx context.Context, params *cognitoidentityprovider.DeleteGroupInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.DeleteGroupOutput, error) {
+	return &cognitoidentityprovider.DeleteGroupOutput{}, nil
+}
+
+func (m *mockCognitoClient) UpdateResourceServer(ctx context.Context, params *cognitoidentityprovider.UpdateResourceServerInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.UpdateResourceServerOutput, error) {
+	return &cognitoidentityprovider.UpdateResourceServerOutput{}, nil
+}
+
+func (m *mockCognitoClient) AdminUpdateUserAttributes(ctx context.Context, params *cognitoidentityprovider.AdminUpdateUserAttributesInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.AdminUpdateUserAttributesOutput, error) {
+	return &cognitoidentityprovider.AdminUpdateUserAttributesOutput{}, nil
+}
+
+func (m *mockCognitoClient) AdminDeleteUserAttributes(ctx context.Context, params *cognitoidentityprovider.AdminDeleteUserAttributesInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.AdminDeleteUserAttributesOutput, error) {
+	return &cognitoidentityprovider.AdminDeleteUserAttributesOutput{}, nil
+}
+
+func (m *mockCognitoClient) AdminEnableUser(ctx context.Context, params *cognitoidentityprovider.AdminEnableUserInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.AdminEnableUserOutput, error) {
+	return &cognitoidentityprovider.AdminEnableUserOutput{}, nil
+}
+
+func (m *mockCognitoClient) AdminDeleteUser(ctx context.Context, params *cognitoidentityprovider.AdminDeleteUserInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.AdminDeleteUserOutput, error) {
+	return &cognitoidentityprovider.AdminDeleteUserOutput{}, nil
+}
+
+func (m *mockCognitoClient) AdminRemoveUserFromGroup(ctx context.Context, params *cognitoidentityprovider.AdminRemoveUserFromGroupInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.AdminRemoveUserFromGroupOutput, error) {
+	return &cognitoidentityprovider.AdminRemoveUserFromGroupOutput{}, nil
+}
+
+func (m *mockCognitoClient) DescribeUserPoolClient(ctx context.Context, params *cognitoidentityprovider.DescribeUserPoolClientInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.DescribeUserPoolClientOutput, error) {
+	for _, client := range m.clients {
+		if *client.ClientId == *params.ClientId {
+			return &cognitoidentityprovider.DescribeUserPoolClientOutput{UserPoolClient: &client}, nil
+		}
+	}
+	return nil, &types.ResourceNotFoundException{}
+}
+
+func (m *mockCognitoClient) DescribeIdentityProvider(ctx context.Context, params *cognitoidentityprovider.DescribeIdentityProviderInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.DescribeIdentityProviderOutput, error) {
+	if m.describeErr != nil {
+		return nil, m.describeErr
+	}
+	for _, provider := range m.providers {
+		if *provider.ProviderName == *params.ProviderName {
+			return &cognitoidentityprovider.DescribeIdentityProviderOutput{IdentityProvider: &provider}, nil
+		}
+	}
+	return nil, &types.ResourceNotFoundException{}
+}
+
 func TestNewBackup(t *testing.T) {
 	client := &mockCognitoClient{}
 	cfg := &config.Config{
@@ -80,3 +252,94 @@ func TestNewBackup(t *testing.T) {
 		t.Error("NewBackup() returned nil")
 	}
 }
+
+func TestCollect(t *testing.T) {
+	newClient := func() *mockCognitoClient {
+		return &mockCognitoClient{
+			describeUserPoolOutput: &cognitoidentityprovider.DescribeUserPoolOutput{UserPool: &types.UserPoolType{Name: aws.String("pool")}},
+			users:                  []types.UserType{{Username: aws.String("alice")}, {Username: aws.String("bob")}},
+			groups: map[string][]string{
+				"admins": {"bob", "alice"},
+				"empty":  nil,
+			},
+			clients: []types.UserPoolClientType{
+				{ClientId: aws.String("id-web"), ClientName: aws.String("web"), ClientSecret: aws.String("secret"), CallbackURLs: []string{"https://example.com/cb"}},
+			},
+			providers: []types.IdentityProviderType{
+				{ProviderName: aws.String("Google"), ProviderType: types.IdentityProviderTypeTypeGoogle, AttributeMapping: map[string]string{"email": "email"}},
+			},
+		}
+	}
+
+	for _, workers := range []int{1, 8} {
+		backup, err := NewBackup(newClient(), &config.Config{PoolID: "test-pool", Workers: workers}).Collect(context.Background())
+		if err != nil {
+			t.Fatalf("Collect() with %d workers error = %v", workers, err)
+		}
+
+		if len(backup.Users) != 2 || len(backup.Groups) != 2 || *backup.UserPoolConfig.UserPool.Name != "pool" {
+			t.Errorf("Collect() = %d users, %d groups", len(backup.Users), len(backup.Groups))
+		}
+		if got := backup.GroupMemberships; len(got) != 1 || !reflect.DeepEqual(got["admins"], []string{"alice", "bob"}) {
+			t.Errorf("Collect() memberships = %v, want sorted admins only", got)
+		}
+		if len(backup.Clients) != 1 || backup.Clients[0].ClientSecret != nil || len(backup.Clients[0].CallbackURLs) != 1 {
+			t.Errorf("Collect() clients = %+v, want described client without secret", backup.Clients)
+		}
+		if len(backup.IdentityProviders) != 1 || backup.IdentityProviders[0].AttributeMapping["email"] != "email" {
+			t.Errorf("Collect() identity providers = %+v, want described provider", backup.IdentityProviders)
+		}
+	}
+
+	client := newClient()
+	client.describeErr = errors.New("access denied")
+	if _, err := NewBackup(client, &config.Config{PoolID: "test-pool"}).Collect(context.Background()); !errors.Is(err, client.describeErr) {
+		t.Errorf("Collect() error = %v, want %v", err, client.describeErr)
+	}
+}
+
+func TestSegmentedScan(t *testing.T) {
+	users := []types.UserType{
+		{Username: aws.String("alice"), Attributes: []types.AttributeType{{Name: aws.String("sub"), Value: aws.String("0a1b")}}},
+		{Username: aws.String("bob"), Attributes: []types.AttributeType{{Name: aws.String("sub"), Value: aws.String("f00d")}}},
+		{Username: aws.String("_svc"), Attributes: []types.AttributeType{{Name: aws.String("sub"), Value: aws.String("9c9c")}}},
+	}
+
+	tests := []struct {
+		name      string
+		scan      string
+		unindexed map[string]bool
+		wantErr   bool
+	}{
+		{name: "by sub", scan: ScanBySub},
+		{name: "by username falls back for uncovered usernames", scan: ScanByUsername},
+		{name: "unindexed attribute falls back", scan: ScanBySub, unindexed: map[string]bool{"sub": true}},
+		{name: "unknown attribute", scan: "email", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockCognitoClient{
+				describeUserPoolOutput: &cognitoidentityprovider.DescribeUserPoolOutput{UserPool: &types.UserPoolType{EstimatedNumberOfUsers: int32(len(users))}},
+				users:                  users,
+				unindexed:              tt.unindexed,
+			}
+			got, err := NewBackup(client, &config.Config{PoolID: "test-pool", ScanSegments: tt.scan}).getUsers(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getUsers() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			var names []string
+			for _, user := range got {
+				names = append(names, *user.Username)
+			}
+			sort.Strings(names)
+			if want := []string{"_svc", "alice", "bob"}; !reflect.DeepEqual(names, want) {
+				t.Errorf("getUsers() = %v, want %v", names, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,511 @@
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"acbr/storage"
+
+	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider/types"
+)
+
+// Backup types
+const (
+	BackupTypeFull        = "full"
+	BackupTypeIncremental = "incremental"
+)
+
+// Configuration sections tracked by hash, so incrementals only store those that changed
+const (
+	SectionPool              = "pool"
+	SectionGroups            = "groups"
+	SectionMemberships       = "memberships"
+	SectionResourceServers   = "resource-servers"
+	SectionClients           = "clients"
+	SectionIdentityProviders = "idps"
+	SectionIdentityPools     = "identity-pools"
+)
+
+var configSections = []string{
+	SectionPool,
+	SectionGroups,
+	SectionMemberships,
+	SectionResourceServers,
+	SectionClients,
+	SectionIdentityProviders,
+	SectionIdentityPools,
+}
+
+// Manifest describes a backup file and links incrementals to their parent
+type Manifest struct {
+	// ID is the backup's file name
+	ID        string
+	PoolID    string
+	Type      string
+	Parent    string `json:",omitempty"`
+	CreatedAt time.Time
+	// SectionHashes holds the hash of every configuration section as of CreatedAt
+	SectionHashes map[string]string
+	// Sections lists the configuration sections stored in an incremental
+	Sections []string `json:",omitempty"`
+	// Users counts the users stored in the file, DeletedUsers the tombstones
+	Users        int
+	DeletedUsers int `json:",omitempty"`
+}
+
+// UserIndexEntry is the lightweight record used to detect changed and deleted users
+type UserIndexEntry struct {
+	Username     string
+	Sub          string
+	LastModified time.Time
+}
+
+// section returns the value of a configuration section
+func (b *CognitoBackup) section(name string) any {
+	switch name {
+	case SectionPool:
+		return b.UserPoolConfig
+	case SectionGroups:
+		return b.Groups
+	case SectionMemberships:
+		return b.GroupMemberships
+	case SectionResourceServers:
+		return b.ResourceServers
+	case SectionClients:
+		return b.Clients
+	case SectionIdentityProviders:
+		return b.IdentityProviders
+	case SectionIdentityPools:
+		return b.IdentityPools
+	}
+	return nil
+}
+
+// copySection replaces a configuration section with the one from src
+func (b *CognitoBackup) copySection(name string, src *CognitoBackup) {
+	switch name {
+	case SectionPool:
+		b.UserPoolConfig = src.UserPoolConfig
+	case SectionGroups:
+		b.Groups = src.Groups
+	case SectionMemberships:
+		b.GroupMemberships = src.GroupMemberships
+	case SectionResourceServers:
+		b.ResourceServers = src.ResourceServers
+	case SectionClients:
+		b.Clients = src.Clients
+	case SectionIdentityProviders:
+		b.IdentityProviders = src.IdentityProviders
+	case SectionIdentityPools:
+		b.IdentityPools = src.IdentityPools
+	}
+}
+
+// sectionHashes hashes each configuration section of the backup
+func sectionHashes(b *CognitoBackup) map[string]string {
+	hashes := make(map[string]string, len(configSections))
+	for _, name := range configSections {
+		data, _ := json.Marshal(b.section(name))
+		sum := sha256.Sum256(data)
+		hashes[name] = hex.EncodeToString(sum[:])
+	}
+	return hashes
+}
+
+// userIndex returns the index of every user in the pool at backup time
+func userIndex(b *CognitoBackup) []UserIndexEntry {
+	if b.Manifest != nil && b.Manifest.Type == BackupTypeIncremental {
+		return b.UserIndex
+	}
+
+	index := make([]UserIndexEntry, 0, len(b.Users))
+	for _, user := range b.Users {
+		index = append(index, indexEntry(user))
+	}
+	return index
+}
+
+func indexEntry(user types.UserType) UserIndexEntry {
+	entry := UserIndexEntry{Username: *user.Username}
+	if user.UserLastModifiedDate != nil {
+		entry.LastModified = *user.UserLastModifiedDate
+	}
+	for _, attr := range user.Attributes {
+		if *attr.Name == "sub" {
+			entry.Sub = *attr.Value
+		}
+	}
+	return entry
+}
+
+func manifestName(id string) string {
+	return strings.TrimSuffix(id, ".json") + ".manifest.json"
+}
+
+func saveManifest(ctx context.Context, backupPath string, manifest *Manifest) error {
+	store, err := storage.NewStorage(ctx, backupPath)
+	if err != nil {
+		return fmt.Errorf("failed to create storage: %w", err)
+	}
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+
+	if err := store.Save(ctx, data, storage.JoinPath(backupPath, manifestName(manifest.ID))); err != nil {
+		return fmt.Errorf("failed to save manifest: %w", err)
+	}
+	return nil
+}
+
+// loadFile reads a backup file by name from the backupPath directory
+func loadFile(ctx context.Context, store storage.Storage, backupPath, name string) (*CognitoBackup, error) {
+	data, err := store.Load(ctx, storage.JoinPath(backupPath, name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load backup %s: %w", name, err)
+	}
+
+	var backup CognitoBackup
+	if err := json.Unmarshal(data, &backup); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal backup %s: %w", name, err)
+	}
+
+	// Backups from before manifests were introduced are full backups
+	if backup.Manifest == nil {
+		backup.Manifest = legacyManifest(name, &backup)
+	}
+	return &backup, nil
+}
+
+// legacyManifest describes a backup written without a manifest, dating it by its
+// file name. Those names hold time.Now().Format of the machine that took the
+// backup, without a zone, so they are read as local time.
+func legacyManifest(name string, backup *CognitoBackup) *Manifest {
+	manifest := &Manifest{
+		ID:            name,
+		Type:          BackupTypeFull,
+		SectionHashes: sectionHashes(backup),
+		Users:         len(backup.Users),
+	}
+	if backup.UserPoolConfig != nil && backup.UserPoolConfig.UserPool != nil && backup.UserPoolConfig.UserPool.Id != nil {
+		manifest.PoolID = *backup.UserPoolConfig.UserPool.Id
+	}
+	trimmed := strings.TrimSuffix(name, ".json")
+	if len(trimmed) >= len("20060102-150405") {
+		if t, err := time.ParseInLocation("20060102-150405", trimmed[len(trimmed)-len("20060102-150405"):], time.Local); err == nil {
+			manifest.CreatedAt = t
+		}
+	}
+	return manifest
+}
+
+// List returns the manifests of the pool's backups in backupPath, oldest first
+func List(ctx context.Context, backupPath, poolID string) ([]*Manifest, error) {
+	store, err := storage.NewStorage(ctx, backupPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage: %w", err)
+	}
+
+	names, err := store.List(ctx, storage.JoinPath(backupPath, ""))
+	if err != nil {
+		return nil, err
+	}
+
+	have := make(map[string]bool, len(names))
+	for _, name := range names {
+		have[name] = true
+	}
+
+	prefix := fmt.Sprintf("cognito-backup-%s-", poolID)
+	var manifests []*Manifest
+	for _, name := range names {
+		if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ".json") ||
+			strings.HasSuffix(name, ".manifest.json") || strings.HasSuffix(name, "-anonymized.json") {
+			continue
+		}
+
+		if have[manifestName(name)] {
+			data, err := store.Load(ctx, storage.JoinPath(backupPath, manifestName(name)))
+			if err != nil {
+				return nil, fmt.Errorf("failed to load manifest for %s: %w", name, err)
+			}
+			var manifest Manifest
+			if err := json.Unmarshal(data, &manifest); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal manifest for %s: %w", name, err)
+			}
+			manifests = append(manifests, &manifest)
+			continue
+		}
+
+		backup, err := loadFile(ctx, store, backupPath, name)
+		if err != nil {
+			return nil, err
+		}
+		manifests = append(manifests, backup.Manifest)
+	}
+
+	// A compacted full backup sorts after the incremental it was built from
+	sort.SliceStable(manifests, func(i, j int) bool {
+		if manifests[i].CreatedAt.Equal(manifests[j].CreatedAt) {
+			return manifests[i].Type == BackupTypeIncremental && manifests[j].Type == BackupTypeFull
+		}
+		return manifests[i].CreatedAt.Before(manifests[j].CreatedAt)
+	})
+	return manifests, nil
+}
+
+// chainTo returns the manifests from the full backup up to the given backup, in order
+func chainTo(manifests []*Manifest, id string) ([]*Manifest, error) {
+	byID := make(map[string]*Manifest, len(manifests))
+	for _, manifest := range manifests {
+		byID[manifest.ID] = manifest
+	}
+
+	var chain []*Manifest
+	for id != "" {
+		manifest, ok := byID[id]
+		if !ok {
+			return nil, fmt.Errorf("backup %s not found", id)
+		}
+		chain = append([]*Manifest{manifest}, chain...)
+		if manifest.Type == BackupTypeFull {
+			return chain, nil
+		}
+		if len(chain) > len(manifests) {
+			return nil, fmt.Errorf("backup chain of %s has a cycle", id)
+		}
+		id = manifest.Parent
+	}
+	return nil, fmt.Errorf("backup chain does not start with a full backup")
+}
+
+// LoadChain loads the backups from the full backup up to the given backup
+func LoadChain(ctx context.Context, backupPath, poolID, id string) ([]*CognitoBackup, error) {
+	manifests, err := List(ctx, backupPath, poolID)
+	if err != nil {
+		return nil, err
+	}
+	chain, err := chainTo(manifests, id)
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := storage.NewStorage(ctx, backupPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage: %w", err)
+	}
+
+	backups := make([]*CognitoBackup, 0, len(chain))
+	for _, manifest := range chain {
+		backup, err := loadFile(ctx, store, backupPath, manifest.ID)
+		if err != nil {
+			return nil, err
+		}
+		backups = append(backups, backup)
+	}
+	return backups, nil
+}
+
+// Merge applies a chain of backups, a full backup followed by its incrementals,
+// and returns the resulting pool state as a full backup
+func Merge(chain []*CognitoBackup) (*CognitoBackup, error) {
+	if len(chain) == 0 || chain[0].Manifest == nil || chain[0].Manifest.Type != BackupTypeFull {
+		return nil, fmt.Errorf("backup chain must start with a full backup")
+	}
+
+	merged := *chain[0]
+	var order []string
+	users := make(map[string]types.UserType, len(chain[0].Users))
+	for _, user := range chain[0].Users {
+		order = append(order, *user.Username)
+		users[*user.Username] = user
+	}
+
+	last := chain[0].Manifest
+	for _, incr := range chain[1:] {
+		if incr.Manifest.Parent != last.ID {
+			return nil, fmt.Errorf("backup %s does not follow %s", incr.Manifest.ID, last.ID)
+		}
+		for _, name := range incr.Manifest.Sections {
+			merged.copySection(name, incr)
+		}
+		for _, username := range incr.DeletedUsers {
+			delete(users, username)
+		}
+		for _, user := range incr.Users {
+			if _, ok := users[*user.Username]; !ok {
+				order = append(order, *user.Username)
+			}
+			users[*user.Username] = user
+		}
+		last = incr.Manifest
+	}
+
+	merged.Users = make([]types.UserType, 0, len(users))
+	for _, username := range order {
+		if user, ok := users[username]; ok {
+			merged.Users = append(merged.Users, user)
+			// order lists a username twice when it was deleted and re-created
+			delete(users, username)
+		}
+	}
+	merged.UserIndex = nil
+	merged.DeletedUsers = nil
+	merged.Manifest = &Manifest{
+		ID:            last.ID,
+		PoolID:        last.PoolID,
+		Type:          BackupTypeFull,
+		CreatedAt:     last.CreatedAt,
+		SectionHashes: sectionHashes(&merged),
+		Users:         len(merged.Users),
+	}
+	return &merged, nil
+}
+
+// Verify checks every backup of the pool: that incrementals reach a full backup
+// through their parents, and that stored sections and users match their manifest.
+// It returns one problem per line; none means the chains are intact.
+func Verify(ctx context.Context, backupPath, poolID string) ([]string, error) {
+	manifests, err := List(ctx, backupPath, poolID)
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := storage.NewStorage(ctx, backupPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage: %w", err)
+	}
+
+	var problems []string
+	byID := make(map[string]*Manifest, len(manifests))
+	for _, manifest := range manifests {
+		byID[manifest.ID] = manifest
+	}
+
+	for _, manifest := range manifests {
+		if _, err := chainTo(manifests, manifest.ID); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", manifest.ID, err))
+		}
+		if parent, ok := byID[manifest.Parent]; ok && !parent.CreatedAt.Before(manifest.CreatedAt) {
+			problems = append(problems, fmt.Sprintf("%s: parent %s is not older", manifest.ID, parent.ID))
+		}
+
+		backup, err := loadFile(ctx, store, backupPath, manifest.ID)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		if len(backup.Users) != manifest.Users {
+			problems = append(problems, fmt.Sprintf("%s: has %d users, manifest says %d", manifest.ID, len(backup.Users), manifest.Users))
+		}
+
+		stored := configSections
+		if manifest.Type == BackupTypeIncremental {
+			stored = manifest.Sections
+		}
+		hashes := sectionHashes(backup)
+		for _, name := range stored {
+			if hashes[name] != manifest.SectionHashes[name] {
+				problems = append(problems, fmt.Sprintf("%s: section %s does not match its hash", manifest.ID, name))
+			}
+		}
+	}
+
+	return problems, nil
+}
+
+// Compact merges the chain ending at the newest backup of the pool into a new
+// full backup. The chain's files are left in place. It returns the new backup's path.
+func Compact(ctx context.Context, backupPath, poolID string) (string, error) {
+	manifests, err := List(ctx, backupPath, poolID)
+	if err != nil {
+		return "", err
+	}
+	if len(manifests) == 0 {
+		return "", fmt.Errorf("no backups of pool %s in %s", poolID, backupPath)
+	}
+
+	latest := manifests[len(manifests)-1]
+	if latest.Type == BackupTypeFull {
+		return storage.JoinPath(backupPath, latest.ID), nil
+	}
+
+	chain, err := LoadChain(ctx, backupPath, poolID, latest.ID)
+	if err != nil {
+		return "", err
+	}
+	merged, err := Merge(chain)
+	if err != nil {
+		return "", err
+	}
+
+	// Named after the chain's last backup, marked as compacted
+	merged.Manifest.ID = strings.TrimSuffix(latest.ID, "-incr.json") + "-full.json"
+	path, err := Save(ctx, backupPath, merged.Manifest.ID, merged)
+	if err != nil {
+		return "", err
+	}
+	if err := saveManifest(ctx, backupPath, merged.Manifest); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// AsOf reconstructs the pool state as of the given time from the pool's
+// backups in backupPath. It returns the merged backup and the chain it was built from.
+func AsOf(ctx context.Context, backupPath, poolID string, asOf time.Time) (*CognitoBackup, []*Manifest, error) {
+	manifests, err := List(ctx, backupPath, poolID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var latest *Manifest
+	for _, manifest := range manifests {
+		if !manifest.CreatedAt.After(asOf) {
+			latest = manifest
+		}
+	}
+	if latest == nil {
+		return nil, nil, fmt.Errorf("no backup of pool %s at or before %s", poolID, asOf.Format(time.RFC3339))
+	}
+
+	return loadMerged(ctx, backupPath, poolID, latest.ID)
+}
+
+// Resolve returns the full pool state a backup file stands for: the file
+// itself for a full backup, or its merged chain for an incremental
+func Resolve(ctx context.Context, path string) (*CognitoBackup, []*Manifest, error) {
+	backup, err := Load(ctx, path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if backup.Manifest == nil || backup.Manifest.Type != BackupTypeIncremental {
+		return backup, nil, nil
+	}
+
+	return loadMerged(ctx, storage.Dir(path), backup.Manifest.PoolID, backup.Manifest.ID)
+}
+
+func loadMerged(ctx context.Context, backupPath, poolID, id string) (*CognitoBackup, []*Manifest, error) {
+	chain, err := LoadChain(ctx, backupPath, poolID, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	merged, err := Merge(chain)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	manifests := make([]*Manifest, len(chain))
+	for i, backup := range chain {
+		manifests[i] = backup.Manifest
+	}
+	return merged, manifests, nil
+}
@@ -0,0 +1,126 @@
+package backup
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"acbr/config"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider"
+	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider/types"
+)
+
+func testUser(username, sub string, modified time.Time) types.UserType {
+	return types.UserType{
+		Username:             aws.String(username),
+		Enabled:              true,
+		UserLastModifiedDate: aws.Time(modified),
+		Attributes:           []types.AttributeType{{Name: aws.String("sub"), Value: aws.String(sub)}},
+	}
+}
+
+func TestIncrementalChain(t *testing.T) {
+	dir := t.TempDir()
+	old := time.Now().Add(-time.Hour)
+	client := &mockCognitoClient{
+		describeUserPoolOutput: &cognitoidentityprovider.DescribeUserPoolOutput{UserPool: &types.UserPoolType{Name: aws.String("pool")}},
+		users: []types.UserType{
+			testUser("alice", "sub-alice", old),
+			testUser("bob", "sub-bob", old),
+		},
+	}
+	cfg := &config.Config{PoolID: "test-pool", BackupPath: dir}
+
+	if err := NewBackup(client, cfg).Execute(context.Background()); err != nil {
+		t.Fatalf("full Execute() error = %v", err)
+	}
+
+	// alice is deleted, bob modified and carol created
+	client.users = []types.UserType{
+		testUser("bob", "sub-bob", time.Now().Add(time.Hour)),
+		testUser("carol", "sub-carol", time.Now()),
+	}
+	cfg.Incremental = true
+	if err := NewBackup(client, cfg).Execute(context.Background()); err != nil {
+		t.Fatalf("incremental Execute() error = %v", err)
+	}
+
+	manifests, err := List(context.Background(), dir, "test-pool")
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(manifests) != 2 || manifests[0].Type != BackupTypeFull || manifests[1].Type != BackupTypeIncremental {
+		t.Fatalf("List() = %+v, want a full and an incremental backup", manifests)
+	}
+	incr := manifests[1]
+	if incr.Parent != manifests[0].ID || incr.Users != 2 || incr.DeletedUsers != 1 || len(incr.Sections) != 0 {
+		t.Errorf("incremental manifest = %+v", incr)
+	}
+
+	problems, err := Verify(context.Background(), dir, "test-pool")
+	if err != nil || len(problems) != 0 {
+		t.Errorf("Verify() = %v, %v, want no problems", problems, err)
+	}
+
+	path, err := Compact(context.Background(), dir, "test-pool")
+	if err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	compacted, err := Load(context.Background(), path)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	var names []string
+	for _, user := range compacted.Users {
+		names = append(names, *user.Username)
+	}
+	if len(names) != 2 || names[0] != "bob" || names[1] != "carol" {
+		t.Errorf("Compact() users = %v, want [bob carol]", names)
+	}
+	if compacted.UserPoolConfig == nil || *compacted.UserPoolConfig.UserPool.Name != "pool" {
+		t.Error("Compact() lost the unchanged pool configuration")
+	}
+}
+
+func TestMergeSections(t *testing.T) {
+	full := &CognitoBackup{
+		Manifest: &Manifest{ID: "full", Type: BackupTypeFull},
+		Groups:   []types.GroupType{{GroupName: aws.String("admins")}},
+		Clients:  []types.UserPoolClientType{{ClientName: aws.String("web")}},
+	}
+	incr := &CognitoBackup{
+		Manifest: &Manifest{ID: "incr", Type: BackupTypeIncremental, Parent: "full", Sections: []string{SectionClients}},
+	}
+
+	merged, err := Merge([]*CognitoBackup{full, incr})
+	if err != nil {
+		t.Fatalf("Merge() error = %v", err)
+	}
+	if len(merged.Groups) != 1 {
+		t.Errorf("Merge() groups = %v, want the unchanged groups", merged.Groups)
+	}
+	if len(merged.Clients) != 0 {
+		t.Errorf("Merge() clients = %v, want the emptied clients", merged.Clients)
+	}
+
+	if _, err := Merge([]*CognitoBackup{incr}); err == nil {
+		t.Error("Merge() without a full backup error = nil, want error")
+	}
+}
+
+func TestLegacyManifestLocalTime(t *testing.T) {
+	local := time.Local
+	time.Local = time.FixedZone("UTC+2", 2*60*60)
+	t.Cleanup(func() { time.Local = local })
+
+	manifest := legacyManifest("cognito-backup-pool-20240102-150405.json", &CognitoBackup{})
+	want := time.Date(2024, 1, 2, 13, 4, 5, 0, time.UTC)
+	if !manifest.CreatedAt.Equal(want) {
+		t.Errorf("legacyManifest() CreatedAt = %v, want %v", manifest.CreatedAt, want)
+	}
+	if manifest.Type != BackupTypeFull {
+		t.Errorf("legacyManifest() Type = %s, want %s", manifest.Type, BackupTypeFull)
+	}
+}
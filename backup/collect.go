@@ -0,0 +1,61 @@
+package backup
+
+import (
+	"context"
+	"sync"
+)
+
+// taskGroup runs tasks concurrently on up to limit goroutines. Tasks may add
+// further tasks. The first error cancels the context of the remaining tasks.
+type taskGroup struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	slots  chan struct{}
+	wg     sync.WaitGroup
+
+	once sync.Once
+	err  error
+}
+
+func newTaskGroup(ctx context.Context, limit int) *taskGroup {
+	ctx, cancel := context.WithCancel(ctx)
+	return &taskGroup{
+		ctx:    ctx,
+		cancel: cancel,
+		slots:  make(chan struct{}, limit),
+	}
+}
+
+// Go runs task once a slot is free, unless the group has failed by then
+func (g *taskGroup) Go(task func(ctx context.Context) error) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+
+		select {
+		case g.slots <- struct{}{}:
+		case <-g.ctx.Done():
+			g.fail(g.ctx.Err())
+			return
+		}
+		defer func() { <-g.slots }()
+
+		if err := task(g.ctx); err != nil {
+			g.fail(err)
+		}
+	}()
+}
+
+// Wait waits for all tasks and returns the first error
+func (g *taskGroup) Wait() error {
+	g.wg.Wait()
+	g.cancel()
+	return g.err
+}
+
+func (g *taskGroup) fail(err error) {
+	g.once.Do(func() {
+		g.err = err
+		g.cancel()
+	})
+}
@@ -0,0 +1,86 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+
+	"acbr/aws"
+
+	awssdk "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider"
+)
+
+// listUserPoolsPageSize is the most pools ListUserPools returns per page
+const listUserPoolsPageSize = 60
+
+// PoolFilter selects the user pools Discover returns. The zero filter
+// selects every pool.
+type PoolFilter struct {
+	// Name is a glob the pool name must match, such as prod-*
+	Name string
+	// Tags are the tags the pool must have, with these values
+	Tags map[string]string
+}
+
+// Discover returns the IDs of the user pools of the client's region that
+// match the filter, sorted
+func Discover(ctx context.Context, client aws.CognitoClient, filter PoolFilter) ([]string, error) {
+	if filter.Name != "" {
+		if _, err := path.Match(filter.Name, ""); err != nil {
+			return nil, fmt.Errorf("invalid pool name filter %q: %w", filter.Name, err)
+		}
+	}
+
+	var ids []string
+	var nextToken *string
+	for {
+		output, err := client.ListUserPools(ctx, &cognitoidentityprovider.ListUserPoolsInput{
+			MaxResults: awssdk.Int32(listUserPoolsPageSize),
+			NextToken:  nextToken,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list user pools: %w", err)
+		}
+		for _, pool := range output.UserPools {
+			if filter.Name != "" {
+				if ok, _ := path.Match(filter.Name, awssdk.ToString(pool.Name)); !ok {
+					continue
+				}
+			}
+			ids = append(ids, awssdk.ToString(pool.Id))
+		}
+		if output.NextToken == nil {
+			break
+		}
+		nextToken = output.NextToken
+	}
+
+	// ListUserPools doesn't return tags, each remaining pool is described
+	if len(filter.Tags) > 0 {
+		var tagged []string
+		for _, id := range ids {
+			output, err := client.DescribeUserPool(ctx, &cognitoidentityprovider.DescribeUserPoolInput{UserPoolId: awssdk.String(id)})
+			if err != nil {
+				return nil, fmt.Errorf("failed to describe user pool %s: %w", id, err)
+			}
+			if hasTags(output.UserPool.UserPoolTags, filter.Tags) {
+				tagged = append(tagged, id)
+			}
+		}
+		ids = tagged
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// hasTags reports whether tags has every wanted tag with its value
+func hasTags(tags, want map[string]string) bool {
+	for key, value := range want {
+		if got, ok := tags[key]; !ok || got != value {
+			return false
+		}
+	}
+	return true
+}
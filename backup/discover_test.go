@@ -0,0 +1,50 @@
+package backup
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider/types"
+)
+
+func TestDiscover(t *testing.T) {
+	client := &mockCognitoClient{
+		pools: []types.UserPoolDescriptionType{
+			{Id: aws.String("us-east-1_c"), Name: aws.String("prod-admin")},
+			{Id: aws.String("us-east-1_a"), Name: aws.String("prod-customers")},
+			{Id: aws.String("us-east-1_b"), Name: aws.String("staging-customers")},
+		},
+		poolTags: map[string]map[string]string{
+			"us-east-1_a": {"env": "prod", "backup": "true"},
+			"us-east-1_b": {"env": "staging", "backup": "true"},
+			"us-east-1_c": {"env": "prod"},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		filter  PoolFilter
+		want    []string
+		wantErr bool
+	}{
+		{name: "every pool", want: []string{"us-east-1_a", "us-east-1_b", "us-east-1_c"}},
+		{name: "name", filter: PoolFilter{Name: "prod-*"}, want: []string{"us-east-1_a", "us-east-1_c"}},
+		{name: "tag", filter: PoolFilter{Tags: map[string]string{"backup": "true"}}, want: []string{"us-east-1_a", "us-east-1_b"}},
+		{name: "name and tags", filter: PoolFilter{Name: "*-customers", Tags: map[string]string{"env": "prod", "backup": "true"}}, want: []string{"us-east-1_a"}},
+		{name: "no match", filter: PoolFilter{Name: "dev-*"}},
+		{name: "invalid name", filter: PoolFilter{Name: "prod-["}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Discover(context.Background(), client, tt.filter)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Discover() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Discover() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"acbr/aws"
+
+	awssdk "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cognitoidentity"
+	identitytypes "github.com/aws/aws-sdk-go-v2/service/cognitoidentity/types"
+	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider/types"
+)
+
+// listIdentityPoolsPageSize is the most identity pools ListIdentityPools returns per page
+const listIdentityPoolsPageSize = 60
+
+// IdentityPool is an identity pool (federated identities) that signs in
+// users of the backed up pool, with its roles
+type IdentityPool struct {
+	Settings *cognitoidentity.DescribeIdentityPoolOutput
+	// Roles maps authenticated and unauthenticated to their IAM role ARN;
+	// RoleMappings are keyed by provider, <provider name>:<client ID> for
+	// user pools
+	Roles        map[string]string
+	RoleMappings map[string]identitytypes.RoleMapping `json:",omitempty"`
+	// ClientNames names the backed up pool's clients that the identity pool
+	// trusts, by client ID, to find them again in a restored pool
+	ClientNames map[string]string `json:",omitempty"`
+}
+
+// UserPoolProviderName returns the name identity pools know a user pool by,
+// such as cognito-idp.us-east-1.amazonaws.com/us-east-1_xxxxx
+func UserPoolProviderName(poolID string) string {
+	region, _, _ := strings.Cut(poolID, "_")
+	return fmt.Sprintf("cognito-idp.%s.amazonaws.com/%s", region, poolID)
+}
+
+// UseIdentityClient makes the backup include the identity pools of the
+// client's region that sign in users of the pool
+func (b *Backup) UseIdentityClient(client aws.IdentityClient) {
+	b.identity = client
+}
+
+// getIdentityPools returns the identity pools that trust the pool, with their roles
+func (b *Backup) getIdentityPools(ctx context.Context) ([]IdentityPool, error) {
+	provider := UserPoolProviderName(b.config.PoolID)
+	var pools []IdentityPool
+	var nextToken *string
+	for {
+		output, err := b.identity.ListIdentityPools(ctx, &cognitoidentity.ListIdentityPoolsInput{
+			MaxResults: awssdk.Int32(listIdentityPoolsPageSize),
+			NextToken:  nextToken,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, summary := range output.IdentityPools {
+			settings, err := b.identity.DescribeIdentityPool(ctx, &cognitoidentity.DescribeIdentityPoolInput{IdentityPoolId: summary.IdentityPoolId})
+			if err != nil {
+				return nil, fmt.Errorf("identity pool %s: %w", awssdk.ToString(summary.IdentityPoolName), err)
+			}
+			if !trusts(settings, provider) {
+				continue
+			}
+			roles, err := b.identity.GetIdentityPoolRoles(ctx, &cognitoidentity.GetIdentityPoolRolesInput{IdentityPoolId: summary.IdentityPoolId})
+			if err != nil {
+				return nil, fmt.Errorf("identity pool %s roles: %w", awssdk.ToString(summary.IdentityPoolName), err)
+			}
+			pools = append(pools, IdentityPool{Settings: settings, Roles: roles.Roles, RoleMappings: roles.RoleMappings})
+		}
+		if output.NextToken == nil {
+			break
+		}
+		nextToken = output.NextToken
+	}
+	return pools, nil
+}
+
+// trusts reports whether the identity pool signs in users of the user pool provider
+func trusts(settings *cognitoidentity.DescribeIdentityPoolOutput, provider string) bool {
+	for _, p := range settings.CognitoIdentityProviders {
+		if awssdk.ToString(p.ProviderName) == provider {
+			return true
+		}
+	}
+	return false
+}
+
+// nameClients records the names of the clients each identity pool trusts
+func nameClients(pools []IdentityPool, clients []types.UserPoolClientType, provider string) {
+	names := make(map[string]string, len(clients))
+	for _, client := range clients {
+		names[awssdk.ToString(client.ClientId)] = awssdk.ToString(client.ClientName)
+	}
+	for i, pool := range pools {
+		for _, p := range pool.Settings.CognitoIdentityProviders {
+			name, ok := names[awssdk.ToString(p.ClientId)]
+			if awssdk.ToString(p.ProviderName) != provider || !ok {
+				continue
+			}
+			if pools[i].ClientNames == nil {
+				pools[i].ClientNames = make(map[string]string)
+			}
+			pools[i].ClientNames[awssdk.ToString(p.ClientId)] = name
+		}
+	}
+}
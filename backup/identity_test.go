@@ -0,0 +1,116 @@
+package backup
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"acbr/config"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cognitoidentity"
+	identitytypes "github.com/aws/aws-sdk-go-v2/service/cognitoidentity/types"
+	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider"
+	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider/types"
+)
+
+// mockIdentityClient lists its identity pools one per page
+type mockIdentityClient struct {
+	pools []*cognitoidentity.DescribeIdentityPoolOutput
+	roles map[string]*cognitoidentity.GetIdentityPoolRolesOutput
+}
+
+func (m *mockIdentityClient) ListIdentityPools(ctx context.Context, params *cognitoidentity.ListIdentityPoolsInput, optFns ...func(*cognitoidentity.Options)) (*cognitoidentity.ListIdentityPoolsOutput, error) {
+	page := 0
+	if params.NextToken != nil {
+		page, _ = strconv.Atoi(*params.NextToken)
+	}
+	output := &cognitoidentity.ListIdentityPoolsOutput{}
+	if page < len(m.pools) {
+		pool := m.pools[page]
+		output.IdentityPools = []identitytypes.IdentityPoolShortDescription{{IdentityPoolId: pool.IdentityPoolId, IdentityPoolName: pool.IdentityPoolName}}
+	}
+	if page+1 < len(m.pools) {
+		output.NextToken = aws.String(strconv.Itoa(page + 1))
+	}
+	return output, nil
+}
+
+func (m *mockIdentityClient) DescribeIdentityPool(ctx context.Context, params *cognitoidentity.DescribeIdentityPoolInput, optFns ...func(*cognitoidentity.Options)) (*cognitoidentity.DescribeIdentityPoolOutput, error) {
+	for _, pool := range m.pools {
+		if *pool.IdentityPoolId == *params.IdentityPoolId {
+			return pool, nil
+		}
+	}
+	return nil, &identitytypes.ResourceNotFoundException{}
+}
+
+func (m *mockIdentityClient) GetIdentityPoolRoles(ctx context.Context, params *cognitoidentity.GetIdentityPoolRolesInput, optFns ...func(*cognitoidentity.Options)) (*cognitoidentity.GetIdentityPoolRolesOutput, error) {
+	return m.roles[*params.IdentityPoolId], nil
+}
+
+func (m *mockIdentityClient) CreateIdentityPool(ctx context.Context, params *cognitoidentity.CreateIdentityPoolInput, optFns ...func(*cognitoidentity.Options)) (*cognitoidentity.CreateIdentityPoolOutput, error) {
+	return &cognitoidentity.CreateIdentityPoolOutput{}, nil
+}
+
+func (m *mockIdentityClient) UpdateIdentityPool(ctx context.Context, params *cognitoidentity.UpdateIdentityPoolInput, optFns ...func(*cognitoidentity.Options)) (*cognitoidentity.UpdateIdentityPoolOutput, error) {
+	return &cognitoidentity.UpdateIdentityPoolOutput{}, nil
+}
+
+func (m *mockIdentityClient) SetIdentityPoolRoles(ctx context.Context, params *cognitoidentity.SetIdentityPoolRolesInput, optFns ...func(*cognitoidentity.Options)) (*cognitoidentity.SetIdentityPoolRolesOutput, error) {
+	return &cognitoidentity.SetIdentityPoolRolesOutput{}, nil
+}
+
+func TestCollectIdentityPools(t *testing.T) {
+	const poolID = "us-east-1_pool"
+	provider := UserPoolProviderName(poolID)
+	client := &mockCognitoClient{
+		describeUserPoolOutput: &cognitoidentityprovider.DescribeUserPoolOutput{UserPool: &types.UserPoolType{Id: aws.String(poolID)}},
+		clients:                []types.UserPoolClientType{{ClientId: aws.String("id-web"), ClientName: aws.String("web")}},
+	}
+	identity := &mockIdentityClient{
+		pools: []*cognitoidentity.DescribeIdentityPoolOutput{
+			{IdentityPoolId: aws.String("us-east-1:other"), IdentityPoolName: aws.String("other"), CognitoIdentityProviders: []identitytypes.CognitoIdentityProvider{
+				{ProviderName: aws.String(UserPoolProviderName("us-east-1_other")), ClientId: aws.String("id-other")},
+			}},
+			{IdentityPoolId: aws.String("us-east-1:app"), IdentityPoolName: aws.String("app"), CognitoIdentityProviders: []identitytypes.CognitoIdentityProvider{
+				{ProviderName: aws.String(provider), ClientId: aws.String("id-web")},
+			}},
+		},
+		roles: map[string]*cognitoidentity.GetIdentityPoolRolesOutput{
+			"us-east-1:app": {
+				Roles:        map[string]string{"authenticated": "arn:aws:iam::111111111111:role/auth"},
+				RoleMappings: map[string]identitytypes.RoleMapping{provider + ":id-web": {Type: identitytypes.RoleMappingTypeToken}},
+			},
+		},
+	}
+
+	b := NewBackup(client, &config.Config{PoolID: poolID})
+	b.UseIdentityClient(identity)
+	backup, err := b.Collect(context.Background())
+	if err != nil {
+		t.Fatalf("Collect() error = %v", err)
+	}
+	if len(backup.IdentityPools) != 1 {
+		t.Fatalf("Collect() identity pools = %+v, want the pool trusting %s", backup.IdentityPools, poolID)
+	}
+	pool := backup.IdentityPools[0]
+	if *pool.Settings.IdentityPoolName != "app" || pool.Roles["authenticated"] == "" || len(pool.RoleMappings) != 1 {
+		t.Errorf("Collect() identity pool = %+v, want app with its roles", pool)
+	}
+	if pool.ClientNames["id-web"] != "web" {
+		t.Errorf("Collect() client names = %v, want id-web named web", pool.ClientNames)
+	}
+
+	// Without an identity client, identity pools are left out
+	backup, err = NewBackup(client, &config.Config{PoolID: poolID}).Collect(context.Background())
+	if err != nil || backup.IdentityPools != nil {
+		t.Errorf("Collect() = %v, %v, want no identity pools", backup.IdentityPools, err)
+	}
+}
+
+func TestUserPoolProviderName(t *testing.T) {
+	if got, want := UserPoolProviderName("eu-west-1_abc"), "cognito-idp.eu-west-1.amazonaws.com/eu-west-1_abc"; got != want {
+		t.Errorf("UserPoolProviderName() = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,192 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"time"
+
+	"acbr/logging"
+	"acbr/report"
+
+	awssdk "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider"
+	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider/types"
+)
+
+// listUsersPageSize is the most users a ListUsers page returns
+const listUsersPageSize = 60
+
+// executeIncremental stores the users created or modified since the parent
+// backup, the usernames deleted since then and the configuration sections
+// that changed
+func (b *Backup) executeIncremental(ctx context.Context, startedAt time.Time) error {
+	loadCtx, loaded := b.report.Phase(ctx, "load-parent")
+	parent, err := b.loadParent(loadCtx)
+	loaded()
+	if err != nil {
+		return err
+	}
+
+	collectCtx, collected := b.report.Phase(ctx, "collect")
+	backup, err := b.collectConfig(collectCtx)
+	collected()
+	if err != nil {
+		return err
+	}
+
+	// Lightweight pass over every user to find changes and deletions
+	indexCtx, indexed := b.report.Phase(ctx, "index")
+	index, err := b.getUserIndex(indexCtx)
+	indexed()
+	if err != nil {
+		return fmt.Errorf("failed to index users: %w", err)
+	}
+
+	previous := make(map[string]UserIndexEntry)
+	for _, entry := range userIndex(parent) {
+		previous[entry.Username] = entry
+	}
+
+	var changed []string
+	current := make(map[string]bool, len(index))
+	for _, entry := range index {
+		current[entry.Username] = true
+		old, ok := previous[entry.Username]
+		if !ok || old.Sub != entry.Sub || entry.LastModified.After(parent.Manifest.CreatedAt) {
+			changed = append(changed, entry.Username)
+		}
+	}
+	for _, entry := range userIndex(parent) {
+		if !current[entry.Username] {
+			backup.DeletedUsers = append(backup.DeletedUsers, entry.Username)
+		}
+	}
+
+	fetchCtx, fetched := b.report.Phase(ctx, "changed-users")
+	users, err := b.getChangedUsers(fetchCtx, changed, len(index))
+	fetched()
+	if err != nil {
+		return fmt.Errorf("failed to get changed users: %w", err)
+	}
+	backup.Users = users
+	backup.UserIndex = index
+
+	// Keep only the configuration sections that changed
+	hashes := sectionHashes(backup)
+	var sections []string
+	for _, name := range configSections {
+		if hashes[name] != parent.Manifest.SectionHashes[name] {
+			sections = append(sections, name)
+			continue
+		}
+		backup.copySection(name, &CognitoBackup{})
+	}
+
+	backup.Manifest = &Manifest{
+		ID:            b.filename(BackupTypeIncremental, startedAt),
+		PoolID:        b.config.PoolID,
+		Type:          BackupTypeIncremental,
+		Parent:        parent.Manifest.ID,
+		CreatedAt:     startedAt,
+		SectionHashes: hashes,
+		Sections:      sections,
+		Users:         len(backup.Users),
+		DeletedUsers:  len(backup.DeletedUsers),
+	}
+
+	b.recordCounts(backup)
+	b.report.Add("user", report.Counts{Deleted: len(backup.DeletedUsers)})
+	b.log().Info("incremental backup", "parent", parent.Manifest.ID, "changed_users", len(backup.Users),
+		"deleted_users", len(backup.DeletedUsers), "changed_sections", sections)
+	return b.saveBackup(ctx, backup)
+}
+
+// loadParent loads the configured parent backup, or the newest backup of the pool
+func (b *Backup) loadParent(ctx context.Context) (*CognitoBackup, error) {
+	manifests, err := List(ctx, b.config.BackupPath, b.config.PoolID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backups: %w", err)
+	}
+	if len(manifests) == 0 {
+		return nil, fmt.Errorf("incremental backup needs a previous backup of pool %s in %s", b.config.PoolID, b.config.BackupPath)
+	}
+
+	id := manifests[len(manifests)-1].ID
+	if b.config.Parent != "" {
+		id = path.Base(b.config.Parent)
+	}
+
+	chain, err := LoadChain(ctx, b.config.BackupPath, b.config.PoolID, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load parent backup: %w", err)
+	}
+	return chain[len(chain)-1], nil
+}
+
+// getUserIndex lists every user with only the sub attribute
+func (b *Backup) getUserIndex(ctx context.Context) ([]UserIndexEntry, error) {
+	users, err := b.scanUsers(ctx, []string{"sub"})
+	if err != nil {
+		return nil, err
+	}
+
+	index := make([]UserIndexEntry, 0, len(users))
+	for _, user := range users {
+		index = append(index, indexEntry(user))
+	}
+	return index, nil
+}
+
+// getChangedUsers fetches the given users. When that takes more calls than
+// listing the whole pool, the pool is listed instead.
+func (b *Backup) getChangedUsers(ctx context.Context, usernames []string, total int) ([]types.UserType, error) {
+	if len(usernames) == 0 {
+		return nil, nil
+	}
+
+	if len(usernames) > (total+listUsersPageSize-1)/listUsersPageSize {
+		wanted := make(map[string]bool, len(usernames))
+		for _, username := range usernames {
+			wanted[username] = true
+		}
+		all, err := b.getUsers(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var users []types.UserType
+		for _, user := range all {
+			if wanted[*user.Username] {
+				users = append(users, user)
+			}
+		}
+		return users, nil
+	}
+
+	users := make([]types.UserType, 0, len(usernames))
+	for _, username := range usernames {
+		output, err := b.client.AdminGetUser(ctx, &cognitoidentityprovider.AdminGetUserInput{
+			UserPoolId: &b.config.PoolID,
+			Username:   awssdk.String(username),
+		})
+		if err != nil {
+			var notFound *types.UserNotFoundException
+			if errors.As(err, &notFound) {
+				// Deleted after the index pass; the next incremental records it
+				continue
+			}
+			return nil, fmt.Errorf("user %s: %w", logging.User(username), err)
+		}
+		users = append(users, types.UserType{
+			Username:             output.Username,
+			Attributes:           output.UserAttributes,
+			Enabled:              output.Enabled,
+			MFAOptions:           output.MFAOptions,
+			UserCreateDate:       output.UserCreateDate,
+			UserLastModifiedDate: output.UserLastModifiedDate,
+			UserStatus:           output.UserStatus,
+		})
+	}
+	return users, nil
+}
@@ -0,0 +1,91 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"acbr/storage"
+)
+
+// Retention decides which backups of a pool are kept. The newest backup, and
+// the backups that a kept incremental builds on, are always kept.
+type Retention struct {
+	// Keep is the number of newest backups kept, 0 for no limit
+	Keep int `yaml:"keep"`
+	// MaxAge is the age past which backups are deleted, 0 for no limit
+	MaxAge time.Duration `yaml:"maxAge"`
+}
+
+// IsZero reports whether the retention keeps every backup
+func (r Retention) IsZero() bool {
+	return r.Keep <= 0 && r.MaxAge <= 0
+}
+
+// retained returns the IDs of the backups kept at now, given the manifests oldest first
+func (r Retention) retained(manifests []*Manifest, now time.Time) map[string]bool {
+	keep := make(map[string]bool, len(manifests))
+	for i, manifest := range manifests {
+		newer := len(manifests) - 1 - i
+		if newer == 0 ||
+			((r.Keep <= 0 || newer < r.Keep) && (r.MaxAge <= 0 || now.Sub(manifest.CreatedAt) <= r.MaxAge)) {
+			keep[manifest.ID] = true
+		}
+	}
+
+	// Deleting a parent would break the chains of the incrementals kept. A
+	// broken chain keeps what is left of it, for Verify to report.
+	byID := make(map[string]*Manifest, len(manifests))
+	for _, manifest := range manifests {
+		byID[manifest.ID] = manifest
+	}
+	for _, manifest := range manifests {
+		if !keep[manifest.ID] {
+			continue
+		}
+		link := manifest
+		for steps := 0; link.Type != BackupTypeFull && link.Parent != "" && steps < len(manifests); steps++ {
+			parent, ok := byID[link.Parent]
+			if !ok {
+				break
+			}
+			keep[parent.ID] = true
+			link = parent
+		}
+	}
+	return keep
+}
+
+// Prune deletes the pool's backups in backupPath that the retention doesn't
+// keep, with their manifests. It returns the IDs deleted, oldest first.
+func Prune(ctx context.Context, backupPath, poolID string, retention Retention, now time.Time) ([]string, error) {
+	if retention.IsZero() {
+		return nil, nil
+	}
+	manifests, err := List(ctx, backupPath, poolID)
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := storage.NewStorage(ctx, backupPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage: %w", err)
+	}
+
+	keep := retention.retained(manifests, now)
+	var deleted []string
+	for _, manifest := range manifests {
+		if keep[manifest.ID] {
+			continue
+		}
+		if err := store.Delete(ctx, storage.JoinPath(backupPath, manifest.ID)); err != nil {
+			return deleted, fmt.Errorf("failed to delete backup %s: %w", manifest.ID, err)
+		}
+		// Legacy backups have no manifest file
+		if err := store.Delete(ctx, storage.JoinPath(backupPath, manifestName(manifest.ID))); err != nil && !storage.IsNotFound(err) {
+			return deleted, fmt.Errorf("failed to delete manifest of %s: %w", manifest.ID, err)
+		}
+		deleted = append(deleted, manifest.ID)
+	}
+	return deleted, nil
+}
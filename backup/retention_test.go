@@ -0,0 +1,84 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRetained(t *testing.T) {
+	now := time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC)
+	day := func(n int) time.Time { return now.AddDate(0, 0, -n) }
+	manifests := []*Manifest{
+		{ID: "full-1", Type: BackupTypeFull, CreatedAt: day(9)},
+		{ID: "incr-1", Type: BackupTypeIncremental, Parent: "full-1", CreatedAt: day(8)},
+		{ID: "full-2", Type: BackupTypeFull, CreatedAt: day(5)},
+		{ID: "incr-2", Type: BackupTypeIncremental, Parent: "full-2", CreatedAt: day(4)},
+		{ID: "incr-3", Type: BackupTypeIncremental, Parent: "incr-2", CreatedAt: day(3)},
+	}
+
+	tests := []struct {
+		name      string
+		retention Retention
+		want      []string
+	}{
+		{"keep newest", Retention{Keep: 1}, []string{"full-2", "incr-2", "incr-3"}},
+		{"keep three", Retention{Keep: 3}, []string{"full-2", "incr-2", "incr-3"}},
+		{"keep four", Retention{Keep: 4}, []string{"full-1", "incr-1", "full-2", "incr-2", "incr-3"}},
+		{"max age", Retention{MaxAge: 7 * 24 * time.Hour}, []string{"full-2", "incr-2", "incr-3"}},
+		{"always keeps the newest", Retention{MaxAge: time.Hour}, []string{"full-2", "incr-2", "incr-3"}},
+		{"both", Retention{Keep: 5, MaxAge: 85 * time.Hour}, []string{"full-2", "incr-2", "incr-3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keep := tt.retention.retained(manifests, now)
+			var got []string
+			for _, manifest := range manifests {
+				if keep[manifest.ID] {
+					got = append(got, manifest.ID)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("retained() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrune(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	for i, id := range []string{
+		"cognito-backup-pool-20240101-000000.json",
+		"cognito-backup-pool-20240102-000000.json",
+		"cognito-backup-pool-20240103-000000.json",
+	} {
+		manifest, _ := json.Marshal(Manifest{ID: id, PoolID: "pool", Type: BackupTypeFull, CreatedAt: now.AddDate(0, 0, i-3)})
+		if err := os.WriteFile(filepath.Join(dir, id), []byte("{}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, manifestName(id)), manifest, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deleted, err := Prune(context.Background(), dir, "pool", Retention{Keep: 2}, now)
+	if err != nil {
+		t.Fatalf("Prune() error = %v", err)
+	}
+	if !reflect.DeepEqual(deleted, []string{"cognito-backup-pool-20240101-000000.json"}) {
+		t.Errorf("Prune() deleted %v", deleted)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 4 {
+		t.Errorf("Prune() left %d files, want the 2 kept backups and their manifests", len(entries))
+	}
+}
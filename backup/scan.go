@@ -0,0 +1,127 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"acbr/logging"
+
+	awssdk "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider"
+	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider/types"
+)
+
+// Attributes a segmented user scan can partition on
+const (
+	ScanBySub      = "sub"
+	ScanByUsername = "username"
+)
+
+// scanPrefixes are the first characters the segments of a scan cover. Subs
+// are lowercase hex; usernames starting with other characters are only found
+// by the serial scan that follows an incomplete segmented one.
+var scanPrefixes = map[string]string{
+	ScanBySub:      "0123456789abcdef",
+	ScanByUsername: "abcdefghijklmnopqrstuvwxyz0123456789",
+}
+
+func (b *Backup) getUsers(ctx context.Context) ([]types.UserType, error) {
+	return b.scanUsers(ctx, nil)
+}
+
+// scanUsers lists every user, with only the given attributes if any. With a
+// configured scan attribute, the users are listed in concurrent segments by
+// prefix of that attribute.
+func (b *Backup) scanUsers(ctx context.Context, attributes []string) ([]types.UserType, error) {
+	if b.config.ScanSegments == "" {
+		return b.listUsers(ctx, "", attributes)
+	}
+
+	users, err := b.segmentedScan(ctx, attributes)
+	var invalid *types.InvalidParameterException
+	if errors.As(err, &invalid) {
+		b.log().Warn("segmented scan is not supported, scanning users serially", "scan", b.config.ScanSegments, logging.Error, err)
+		return b.listUsers(ctx, "", attributes)
+	}
+	return users, err
+}
+
+func (b *Backup) segmentedScan(ctx context.Context, attributes []string) ([]types.UserType, error) {
+	attribute := b.config.ScanSegments
+	prefixes, ok := scanPrefixes[attribute]
+	if !ok {
+		return nil, fmt.Errorf("unsupported scan attribute %q, want %s or %s", attribute, ScanBySub, ScanByUsername)
+	}
+
+	segments := make([][]types.UserType, len(prefixes))
+	g := newTaskGroup(ctx, b.config.GetWorkers())
+	for i, prefix := range prefixes {
+		g.Go(func(ctx context.Context) error {
+			users, err := b.listUsers(ctx, fmt.Sprintf("%s ^= %q", attribute, string(prefix)), attributes)
+			if err != nil {
+				return fmt.Errorf("segment %s ^= %q: %w", attribute, string(prefix), err)
+			}
+			segments[i] = users
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	// A user can match more than one segment, e.g. with case-insensitive usernames
+	var users []types.UserType
+	seen := make(map[string]bool)
+	for _, segment := range segments {
+		for _, user := range segment {
+			key := "sub:" + indexEntry(user).Sub
+			if key == "sub:" {
+				key = "username:" + awssdk.ToString(user.Username)
+			}
+			if !seen[key] {
+				seen[key] = true
+				users = append(users, user)
+			}
+		}
+	}
+
+	pool, err := b.getUserPool(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user pool: %w", err)
+	}
+	estimated := 0
+	if pool.UserPool != nil {
+		estimated = int(pool.UserPool.EstimatedNumberOfUsers)
+	}
+	if len(users) < estimated {
+		if attribute == ScanByUsername {
+			b.log().Warn("segmented scan missed users, scanning users serially", "users", len(users), "estimated", estimated)
+			return b.listUsers(ctx, "", attributes)
+		}
+		b.log().Warn("segmented scan missed users", "users", len(users), "estimated", estimated)
+	}
+	return users, nil
+}
+
+// listUsers pages through the users matching filter, or all users
+func (b *Backup) listUsers(ctx context.Context, filter string, attributes []string) ([]types.UserType, error) {
+	input := &cognitoidentityprovider.ListUsersInput{
+		UserPoolId:      &b.config.PoolID,
+		AttributesToGet: attributes,
+	}
+	if filter != "" {
+		input.Filter = awssdk.String(filter)
+	}
+
+	var users []types.UserType
+	paginator := cognitoidentityprovider.NewListUsersPaginator(b.client, input)
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, output.Users...)
+	}
+	return users, nil
+}
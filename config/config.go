@@ -1,14 +1,223 @@
 package config
 
-// Config holds the configuration for backup/restore operations
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the configuration for backup/restore operations. It is loaded
+// from a YAML or JSON file, ACBR_* environment variables and flags, see Load;
+// Lambda events and API jobs set the fields with a json name.
 type Config struct {
-	Mode       string
-	PoolID     string // Single pool ID field
-	Region     string
-	BackupPath string
-	UsersOnly  bool
-	MaxResults int32
-	DefaultPwd string // Add default password field
+	Mode       string `json:"mode" yaml:"mode"`
+	PoolID     string `json:"poolId" yaml:"poolId"` // Single pool ID field
+	Region     string `json:"region" yaml:"region"`
+	BackupPath string `json:"backupPath" yaml:"backupPath"`
+	UsersOnly  bool   `json:"usersOnly" yaml:"usersOnly"`
+	MaxResults int32  `json:"maxResults" yaml:"maxResults"`
+	DefaultPwd string `json:"defaultPwd" yaml:"defaultPwd"` // Add default password field
+	// ImportRoleArn is the CloudWatch Logs role used by user import jobs
+	ImportRoleArn string `json:"importRoleArn" yaml:"importRoleArn"`
+	// Include and Exclude select the sections to restore, Filters the items within them
+	Include []string `json:"include" yaml:"include"`
+	Exclude []string `json:"exclude" yaml:"exclude"`
+	Filters []string `json:"filters" yaml:"filters"`
+	// TransformFile is a local or S3 rules file rewriting user attributes on restore
+	TransformFile string `json:"transformFile" yaml:"transformFile"`
+	// Incremental backups store only changes since Parent, or since the newest backup
+	Incremental bool   `json:"incremental" yaml:"incremental"`
+	Parent      string `json:"parent" yaml:"parent"`
+	// IdentityPools backs up the identity pools trusting the pool along with it
+	IdentityPools bool `json:"identityPools" yaml:"identityPools"`
+	// Pools, or the pools of DiscoverRegions matching PoolName and PoolTags,
+	// are backed up in one run, PoolConcurrency at a time, each into its own
+	// directory of BackupPath
+	Pools           []string          `json:"pools" yaml:"pools"`
+	DiscoverRegions []string          `json:"discoverRegions" yaml:"discoverRegions"`
+	PoolName        string            `json:"poolName" yaml:"poolName"`
+	PoolTags        map[string]string `json:"poolTags" yaml:"poolTags"`
+	PoolConcurrency int               `json:"poolConcurrency" yaml:"poolConcurrency"`
+	// AnonymizeKey is the HMAC key for anonymize mode, AnonymizeAttributes the
+	// extra attributes to pseudonymize and OutputPath where the result is written
+	AnonymizeKey        string   `json:"-" yaml:"anonymizeKey"`
+	AnonymizeAttributes []string `json:"anonymizeAttributes" yaml:"anonymizeAttributes"`
+	OutputPath          string   `json:"outputPath" yaml:"outputPath"`
+	// AsOf restores the pool state at that time from the backup chain of
+	// SourcePoolID; Preview only prints what would be restored
+	AsOf         time.Time `json:"asOf" yaml:"asOf"`
+	SourcePoolID string    `json:"sourcePoolId" yaml:"sourcePoolId"`
+	Preview      bool      `json:"preview" yaml:"preview"`
+	// Sync mode reconciles TargetPoolID to match SourcePoolID, once or every
+	// Interval; SyncDelete also removes what the source doesn't have
+	TargetPoolID string        `json:"targetPoolId" yaml:"targetPoolId"`
+	SourceRegion string        `json:"sourceRegion" yaml:"sourceRegion"`
+	TargetRegion string        `json:"targetRegion" yaml:"targetRegion"`
+	Interval     time.Duration `json:"-" yaml:"interval"`
+	SyncDelete   bool          `json:"syncDelete" yaml:"syncDelete"`
+	// Role is assumed for the pools and storage unless SourceRole (backup,
+	// sync, clone), TargetRole (restore, sync, clone) or StorageRole (S3) is set
+	Role        AssumeRole `json:"role" yaml:"role"`
+	SourceRole  AssumeRole `json:"sourceRole" yaml:"sourceRole"`
+	TargetRole  AssumeRole `json:"targetRole" yaml:"targetRole"`
+	StorageRole AssumeRole `json:"storageRole" yaml:"storageRole"`
+	// Workers is the number of concurrent backup and restore workers;
+	// RateLimits overrides the requests per second of Cognito quota categories
+	Workers    int                `json:"workers" yaml:"workers"`
+	RateLimits map[string]float64 `json:"rateLimits" yaml:"rateLimits"`
+	// ScanSegments is the attribute, sub or username, by whose prefixes users
+	// are listed in concurrent segments; empty lists them serially
+	ScanSegments string `json:"segmentedScan" yaml:"segmentedScan"`
+	// MaxAttempts is the most calls made for one Cognito request when it is
+	// throttled or fails transiently
+	MaxAttempts int `json:"maxAttempts" yaml:"maxAttempts"`
+	// Users holds the usernames, emails or subs to bring back in restore-user mode
+	Users []string `json:"users" yaml:"users"`
+	// ContinueOnError lets a restore succeed despite failed groups, users and
+	// memberships, as long as they stay within ErrorBudget (nil for no limit)
+	ContinueOnError bool         `json:"continueOnError" yaml:"continueOnError"`
+	ErrorBudget     *ErrorBudget `json:"errorBudget" yaml:"errorBudget"`
+	// MetricsAddr serves Prometheus metrics while the run lasts; MetricsPushURL
+	// (a Pushgateway) and MetricsFile (for the textfile collector) get them
+	// when it ends
+	MetricsAddr    string `json:"-" yaml:"metricsAddr"`
+	MetricsPushURL string `json:"metricsPushUrl" yaml:"metricsPushUrl"`
+	MetricsFile    string `json:"-" yaml:"metricsFile"`
+	// LogLevel and LogFormat configure logging, see logging.Setup
+	LogLevel  string `json:"logLevel" yaml:"logLevel"`
+	LogFormat string `json:"logFormat" yaml:"logFormat"`
+	// Schedule is the schedule file of daemon mode
+	Schedule string `json:"-" yaml:"schedule"`
+	// Listen, APIToken, QueueSize and MaxJobs configure serve mode's API
+	Listen    string `json:"-" yaml:"listen"`
+	APIToken  string `json:"-" yaml:"apiToken"`
+	QueueSize int    `json:"-" yaml:"queueSize"`
+	MaxJobs   int    `json:"-" yaml:"maxJobs"`
+	// File is the configuration file loaded, Version asks for the version only
+	File    string `json:"-" yaml:"-"`
+	Version bool   `json:"-" yaml:"-"`
+}
+
+// DefaultWorkers is the number of workers unless configured
+const DefaultWorkers = 4
+
+// GetWorkers returns the configured number of workers or a default value
+func (c *Config) GetWorkers() int {
+	if c.Workers < 1 {
+		return DefaultWorkers
+	}
+	return c.Workers
+}
+
+// DefaultPoolConcurrency is the number of pools backed up at once unless configured
+const DefaultPoolConcurrency = 2
+
+// GetPoolConcurrency returns the configured number of pools backed up at once
+// or a default value
+func (c *Config) GetPoolConcurrency() int {
+	if c.PoolConcurrency < 1 {
+		return DefaultPoolConcurrency
+	}
+	return c.PoolConcurrency
+}
+
+// MultiPool reports whether a backup covers a list of pools or the pools
+// discovered in regions, rather than PoolID
+func (c *Config) MultiPool() bool {
+	return len(c.Pools) > 0 || len(c.DiscoverRegions) > 0
+}
+
+// AssumeRole holds STS assume-role settings; without a RoleArn the default
+// credentials are used as they are
+type AssumeRole struct {
+	RoleArn     string `json:"roleArn,omitempty" yaml:"roleArn"`
+	ExternalID  string `json:"externalId,omitempty" yaml:"externalId"`
+	SessionName string `json:"sessionName,omitempty" yaml:"sessionName"`
+}
+
+// Or returns the role, or fallback when no role ARN is set
+func (r AssumeRole) Or(fallback AssumeRole) AssumeRole {
+	if r.RoleArn == "" {
+		return fallback
+	}
+	return r
+}
+
+// GetSourceRole returns the role for the source pool
+func (c *Config) GetSourceRole() AssumeRole {
+	return c.SourceRole.Or(c.Role)
+}
+
+// GetTargetRole returns the role for the target pool
+func (c *Config) GetTargetRole() AssumeRole {
+	return c.TargetRole.Or(c.Role)
+}
+
+// GetStorageRole returns the role for S3 storage
+func (c *Config) GetStorageRole() AssumeRole {
+	return c.StorageRole.Or(c.Role)
+}
+
+// ErrorBudget is the most failures a restore accepts, as a count or as a
+// percentage of the items it restores
+type ErrorBudget struct {
+	Count   int
+	Percent float64
+}
+
+// ParseErrorBudget reads a budget such as 25 or 2.5%. An empty value means no limit.
+func ParseErrorBudget(value string) (*ErrorBudget, error) {
+	if value == "" {
+		return nil, nil
+	}
+	if percent, ok := strings.CutSuffix(value, "%"); ok {
+		p, err := strconv.ParseFloat(percent, 64)
+		if err != nil || p < 0 || p > 100 {
+			return nil, fmt.Errorf("invalid error budget %q, want a count or a percentage between 0%% and 100%%", value)
+		}
+		return &ErrorBudget{Percent: p}, nil
+	}
+	count, err := strconv.Atoi(value)
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("invalid error budget %q, want a count or a percentage between 0%% and 100%%", value)
+	}
+	return &ErrorBudget{Count: count}, nil
+}
+
+// UnmarshalText reads a budget from a file or event. An empty value means no limit.
+func (b *ErrorBudget) UnmarshalText(text []byte) error {
+	parsed, err := ParseErrorBudget(string(text))
+	if err != nil {
+		return err
+	}
+	if parsed == nil {
+		parsed = &ErrorBudget{Percent: 100}
+	}
+	*b = *parsed
+	return nil
+}
+
+// String returns the budget as ParseErrorBudget reads it
+func (b *ErrorBudget) String() string {
+	switch {
+	case b == nil:
+		return ""
+	case b.Percent > 0:
+		return strconv.FormatFloat(b.Percent, 'f', -1, 64) + "%"
+	}
+	return strconv.Itoa(b.Count)
+}
+
+// Limit returns the most failures allowed out of total items
+func (b *ErrorBudget) Limit(total int) int {
+	if b == nil {
+		return total
+	}
+	if b.Percent > 0 {
+		return int(float64(total) * b.Percent / 100)
+	}
+	return b.Count
 }
 
 // GetMaxResults returns the configured MaxResults or a default value
@@ -38,3 +38,61 @@ func TestGetMaxResults(t *testing.T) {
 		})
 	}
 }
+
+func TestAssumeRoleOr(t *testing.T) {
+	shared := AssumeRole{RoleArn: "arn:aws:iam::111111111111:role/acbr", ExternalID: "shared"}
+	tests := []struct {
+		name string
+		role AssumeRole
+		want AssumeRole
+	}{
+		{
+			name: "unset role falls back",
+			role: AssumeRole{SessionName: "ignored"},
+			want: shared,
+		},
+		{
+			name: "set role is kept",
+			role: AssumeRole{RoleArn: "arn:aws:iam::222222222222:role/backup"},
+			want: AssumeRole{RoleArn: "arn:aws:iam::222222222222:role/backup"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.role.Or(shared); got != tt.want {
+				t.Errorf("AssumeRole.Or() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseErrorBudget(t *testing.T) {
+	tests := []struct {
+		value   string
+		total   int
+		want    int
+		wantErr bool
+	}{
+		{value: "", total: 200, want: 200},
+		{value: "0", total: 200, want: 0},
+		{value: "25", total: 200, want: 25},
+		{value: "2.5%", total: 200, want: 5},
+		{value: "1%", total: 50, want: 0},
+		{value: "-1", wantErr: true},
+		{value: "150%", wantErr: true},
+		{value: "some", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			budget, err := ParseErrorBudget(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseErrorBudget(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			}
+			if err == nil && budget.Limit(tt.total) != tt.want {
+				t.Errorf("ParseErrorBudget(%q).Limit(%d) = %d, want %d", tt.value, tt.total, budget.Limit(tt.total), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,277 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FlagSet returns the command-line flags setting c, whose current values are
+// the flags' defaults. Each flag can also be set by an environment variable,
+// see EnvName.
+func (c *Config) FlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(&c.File, "config", c.File, "YAML or JSON configuration file, local or on S3")
+	fs.StringVar(&c.Mode, "mode", c.Mode, "Operation mode: "+strings.Join(Modes, ", "))
+	fs.StringVar(&c.PoolID, "pool", c.PoolID, "Pool ID (source for backup, target for restore)")
+	fs.StringVar(&c.Region, "region", c.Region, "AWS Region")
+	fs.StringVar(&c.BackupPath, "backup-path", c.BackupPath, "Path to store/read backup files")
+	fs.BoolVar(&c.Incremental, "incremental", c.Incremental, "Back up only changes since the parent backup")
+	fs.BoolVar(&c.IdentityPools, "identity-pools", c.IdentityPools, "Also back up the identity pools of the region that trust the pool")
+	fs.StringVar(&c.Parent, "parent", c.Parent, "Parent backup file for incremental backups (defaults to the newest backup of the pool)")
+	fs.Var(&listValue{&c.Pools}, "pools", "Comma-separated pool IDs to back up in one run, each into its own directory of -backup-path")
+	fs.Var(&listValue{&c.DiscoverRegions}, "discover-regions", "Comma-separated regions whose user pools are all backed up, narrowed by -pool-name and -pool-tag")
+	fs.StringVar(&c.PoolName, "pool-name", c.PoolName, "Back up only the discovered pools whose name matches this glob, e.g. prod-*")
+	fs.Var(&tagValue{p: &c.PoolTags}, "pool-tag", "Back up only the discovered pools with this tag, as <key>=<value> (repeatable)")
+	fs.IntVar(&c.PoolConcurrency, "pool-concurrency", c.PoolConcurrency, "Number of pools backed up at once with -pools or -discover-regions")
+	fs.BoolVar(&c.UsersOnly, "users-only", c.UsersOnly, "Restore only users and groups")
+	fs.Var(&listValue{&c.Include}, "include", "Comma-separated sections to restore (pool, triggers, domain, resource-servers, clients, idps, identity-pools, groups, users, memberships)")
+	fs.Var(&listValue{&c.Exclude}, "exclude", "Comma-separated sections to skip during restore")
+	fs.StringVar(&c.TransformFile, "transform-file", c.TransformFile, "YAML or JSON rules rewriting user attributes during restore")
+	fs.StringVar(&c.AnonymizeKey, "anonymize-key", c.AnonymizeKey, "HMAC key for anonymize mode")
+	fs.Var(&listValue{&c.AnonymizeAttributes}, "anonymize-attrs", "Comma-separated extra attributes to pseudonymize, e.g. custom:ssn")
+	fs.StringVar(&c.OutputPath, "output-path", c.OutputPath, "Where anonymize mode writes the new backup (defaults to next to the input)")
+	fs.Var(&listValue{&c.Users}, "users", "Comma-separated usernames, emails or subs to restore in restore-user mode")
+	fs.Var(&repeatedValue{p: &c.Filters}, "filter", "Restore only matching items, as <section>:<field>=<glob> or <section>:<field>~<regex> (repeatable)")
+	fs.Var(&timeValue{&c.AsOf}, "as-of", "Restore the pool state at this RFC3339 time from the backup chain in -backup-path")
+	fs.StringVar(&c.SourcePoolID, "source", c.SourcePoolID, "Source pool ID for sync and clone, or whose backups -as-of restores from (defaults to the pool of the -backup-path file)")
+	fs.BoolVar(&c.Preview, "preview", c.Preview, "Print the merged backup counts without restoring")
+	fs.StringVar(&c.TargetPoolID, "target", c.TargetPoolID, "Target pool ID for sync, or pool ID or new pool name for clone")
+	fs.StringVar(&c.SourceRegion, "source-region", c.SourceRegion, "Source pool region for sync and clone (defaults to -region)")
+	fs.StringVar(&c.TargetRegion, "target-region", c.TargetRegion, "Target pool region for sync and clone (defaults to -region)")
+	fs.DurationVar(&c.Interval, "interval", c.Interval, "Repeat sync at this interval, e.g. 5m (runs once if unset)")
+	fs.BoolVar(&c.SyncDelete, "sync-delete", c.SyncDelete, "Delete users, groups and memberships missing from the source during sync")
+	fs.StringVar(&c.Schedule, "schedule", c.Schedule, "YAML or JSON file of the pools daemon mode backs up, with their cron schedules and retention")
+	fs.StringVar(&c.Listen, "listen", c.Listen, "Address the serve mode API listens on")
+	fs.StringVar(&c.APIToken, "api-token", c.APIToken, "Bearer token required by the serve mode API")
+	fs.IntVar(&c.QueueSize, "queue-size", c.QueueSize, "Most jobs waiting to run in serve mode")
+	fs.IntVar(&c.MaxJobs, "max-jobs", c.MaxJobs, "Most jobs running at once in serve mode")
+	roleFlags(fs, &c.Role, "", "the pools and storage")
+	roleFlags(fs, &c.SourceRole, "source-", "the source pool")
+	roleFlags(fs, &c.TargetRole, "target-", "the target pool")
+	roleFlags(fs, &c.StorageRole, "storage-", "backup storage")
+	fs.StringVar(&c.ScanSegments, "segmented-scan", c.ScanSegments, "List users in concurrent segments by prefix of sub or username (serial if unset)")
+	fs.IntVar(&c.MaxAttempts, "max-attempts", c.MaxAttempts, "Maximum attempts per Cognito call when throttled or failing transiently (8 if unset)")
+	fs.IntVar(&c.Workers, "workers", c.Workers, "Number of concurrent backup and restore workers")
+	fs.Var(&rateValue{p: &c.RateLimits}, "rate", "Requests per second for a Cognito quota category, e.g. UserCreation=100 (repeatable)")
+	fs.Var((*int32Value)(&c.MaxResults), "max-results", "Maximum results per page for AWS API calls (max 50)")
+	fs.StringVar(&c.DefaultPwd, "default-pwd", c.DefaultPwd, "Default password for Cognito-created users (required for non-SSO users)")
+	fs.StringVar(&c.ImportRoleArn, "import-role-arn", c.ImportRoleArn, "CloudWatch Logs role ARN for user import jobs (required for import)")
+	fs.BoolVar(&c.ContinueOnError, "continue-on-error", c.ContinueOnError, "Let a restore succeed when items fail, up to -error-budget")
+	fs.Var(&budgetValue{&c.ErrorBudget}, "error-budget", "Failed items a -continue-on-error restore allows, as a count or a percentage such as 1% (no limit if unset)")
+	fs.StringVar(&c.MetricsAddr, "metrics-addr", c.MetricsAddr, "Serve Prometheus metrics on this address, e.g. :9090, while the run lasts (and /healthz in daemon mode)")
+	fs.StringVar(&c.MetricsPushURL, "metrics-push", c.MetricsPushURL, "Push the run's metrics to this Pushgateway URL when it ends")
+	fs.StringVar(&c.MetricsFile, "metrics-file", c.MetricsFile, "Write the run's metrics to this file for the node exporter's textfile collector when it ends")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "Log level: debug, info, warn or error")
+	fs.StringVar(&c.LogFormat, "log-format", c.LogFormat, "Log format: text or json")
+	fs.BoolVar(&c.Version, "version", c.Version, "Show version information")
+	return fs
+}
+
+// roleFlags registers the assume-role flags, prefixed for source, target or storage
+func roleFlags(fs *flag.FlagSet, role *AssumeRole, prefix, what string) {
+	fs.StringVar(&role.RoleArn, prefix+"role-arn", role.RoleArn, "IAM role to assume for "+what)
+	fs.StringVar(&role.ExternalID, prefix+"external-id", role.ExternalID, "External ID for assuming the role for "+what)
+	fs.StringVar(&role.SessionName, prefix+"session-name", role.SessionName, "Session name for assuming the role for "+what+" (default acbr)")
+}
+
+// EnvName returns the environment variable setting a flag, e.g.
+// ACBR_BACKUP_PATH for -backup-path
+func EnvName(flagName string) string {
+	return "ACBR_" + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// listValue is a comma-separated list flag
+type listValue struct {
+	p *[]string
+}
+
+func (v *listValue) String() string {
+	if v.p == nil {
+		return ""
+	}
+	return strings.Join(*v.p, ",")
+}
+
+func (v *listValue) Set(value string) error {
+	*v.p = splitList(value)
+	return nil
+}
+
+// repeatedValue is a flag collecting every value it is given. Its first value
+// replaces those set from a file or the environment.
+type repeatedValue struct {
+	p   *[]string
+	set bool
+}
+
+func (v *repeatedValue) String() string {
+	if v.p == nil {
+		return ""
+	}
+	return strings.Join(*v.p, " ")
+}
+
+func (v *repeatedValue) Set(value string) error {
+	if !v.set {
+		*v.p = nil
+		v.set = true
+	}
+	*v.p = append(*v.p, value)
+	return nil
+}
+
+// rateValue collects <category>=<requests per second> rate limits, repeated
+// or comma-separated
+type rateValue struct {
+	p   *map[string]float64
+	set bool
+}
+
+func (v *rateValue) String() string {
+	if v.p == nil {
+		return ""
+	}
+	var rates []string
+	for category, rate := range *v.p {
+		rates = append(rates, category+"="+strconv.FormatFloat(rate, 'f', -1, 64))
+	}
+	return strings.Join(rates, ",")
+}
+
+func (v *rateValue) Set(value string) error {
+	if !v.set || *v.p == nil {
+		*v.p = make(map[string]float64)
+		v.set = true
+	}
+	for _, rate := range splitList(value) {
+		category, perSecond, err := ParseRate(rate)
+		if err != nil {
+			return err
+		}
+		(*v.p)[category] = perSecond
+	}
+	return nil
+}
+
+// ParseRate parses a <category>=<requests per second> rate limit
+func ParseRate(value string) (string, float64, error) {
+	category, rate, ok := strings.Cut(value, "=")
+	if !ok {
+		return "", 0, fmt.Errorf("invalid rate %q, want <category>=<requests per second>", value)
+	}
+	perSecond, err := strconv.ParseFloat(rate, 64)
+	if err != nil || perSecond <= 0 {
+		return "", 0, fmt.Errorf("invalid rate %q, want a positive number of requests per second", value)
+	}
+	return category, perSecond, nil
+}
+
+// tagValue collects <key>=<value> tags, repeated or comma-separated
+type tagValue struct {
+	p   *map[string]string
+	set bool
+}
+
+func (v *tagValue) String() string {
+	if v.p == nil {
+		return ""
+	}
+	var tags []string
+	for key, value := range *v.p {
+		tags = append(tags, key+"="+value)
+	}
+	return strings.Join(tags, ",")
+}
+
+func (v *tagValue) Set(value string) error {
+	if !v.set || *v.p == nil {
+		*v.p = make(map[string]string)
+		v.set = true
+	}
+	for _, tag := range splitList(value) {
+		key, tagValue, ok := strings.Cut(tag, "=")
+		if !ok || key == "" {
+			return fmt.Errorf("invalid tag %q, want <key>=<value>", tag)
+		}
+		(*v.p)[key] = tagValue
+	}
+	return nil
+}
+
+// timeValue is an RFC3339 time flag
+type timeValue struct {
+	p *time.Time
+}
+
+func (v *timeValue) String() string {
+	if v.p == nil || v.p.IsZero() {
+		return ""
+	}
+	return v.p.Format(time.RFC3339)
+}
+
+func (v *timeValue) Set(value string) error {
+	if value == "" {
+		*v.p = time.Time{}
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return fmt.Errorf("invalid time %q, want RFC3339: %w", value, err)
+	}
+	*v.p = t
+	return nil
+}
+
+// budgetValue is an error budget flag
+type budgetValue struct {
+	p **ErrorBudget
+}
+
+func (v *budgetValue) String() string {
+	if v.p == nil {
+		return ""
+	}
+	return (*v.p).String()
+}
+
+func (v *budgetValue) Set(value string) error {
+	budget, err := ParseErrorBudget(value)
+	if err != nil {
+		return err
+	}
+	*v.p = budget
+	return nil
+}
+
+type int32Value int32
+
+func (v *int32Value) String() string {
+	if v == nil {
+		return "0"
+	}
+	return strconv.Itoa(int(*v))
+}
+
+func (v *int32Value) Set(value string) error {
+	n, err := strconv.ParseInt(value, 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid number %q", value)
+	}
+	*v = int32Value(n)
+	return nil
+}
+
+// splitList splits a comma-separated value, ignoring empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
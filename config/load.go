@@ -0,0 +1,236 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+
+	"acbr/storage"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Modes lists the operation modes
+var Modes = []string{
+	"backup", "restore", "restore-user", "export", "import", "sync", "clone",
+	"anonymize", "list", "verify", "compact", "daemon", "serve",
+}
+
+// Defaults of serve mode unless configured
+const (
+	DefaultListen    = ":8080"
+	DefaultQueueSize = 16
+	DefaultMaxJobs   = 2
+)
+
+// Default returns the configuration before any file, environment variable,
+// flag or event is applied
+func Default() *Config {
+	return &Config{
+		MaxResults: 50,
+		Workers:    DefaultWorkers,
+		LogLevel:   "info",
+		LogFormat:  "text",
+		Listen:     DefaultListen,
+		QueueSize:  DefaultQueueSize,
+		MaxJobs:    DefaultMaxJobs,
+	}
+}
+
+// Load reads the command-line configuration. Each setting is taken from, in
+// increasing precedence: the defaults, the file of -config or $ACBR_CONFIG,
+// the ACBR_* environment variables and the flags in args. The result is not
+// validated, as -version needs no other setting. Errors, including
+// flag.ErrHelp for -h, are returned rather than printed.
+func Load(ctx context.Context, args []string, getenv func(string) string) (*Config, error) {
+	// A first pass finds the configuration file, then the flags are applied
+	// again over the file and the environment
+	c := Default()
+	if err := c.parseFlags(args); err != nil {
+		return nil, err
+	}
+	file := c.File
+	if file == "" {
+		file = getenv(EnvName("config"))
+	}
+
+	c = Default()
+	if err := c.LoadFile(ctx, file); err != nil {
+		return nil, err
+	}
+	if err := c.LoadEnv(getenv); err != nil {
+		return nil, err
+	}
+	if err := c.parseFlags(args); err != nil {
+		return nil, err
+	}
+	c.File = file
+	return c, nil
+}
+
+func (c *Config) parseFlags(args []string) error {
+	fs := c.FlagSet("acbr")
+	fs.SetOutput(io.Discard)
+	return fs.Parse(args)
+}
+
+// LoadFile applies a local or S3 YAML or JSON file, whose keys are the json
+// names of the fields, e.g. backupPath. An empty path is ignored.
+func (c *Config) LoadFile(ctx context.Context, path string) error {
+	if path == "" {
+		return nil
+	}
+	data, err := storage.ReadFile(ctx, path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	// JSON is accepted as it is a subset of YAML
+	decoder := yaml.NewDecoder(strings.NewReader(string(data)))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// LoadEnv applies the environment variables named after the flags, see EnvName
+func (c *Config) LoadEnv(getenv func(string) string) error {
+	var err error
+	c.FlagSet("acbr").VisitAll(func(f *flag.Flag) {
+		if err != nil || f.Name == "config" || f.Name == "version" {
+			return
+		}
+		if value := getenv(EnvName(f.Name)); value != "" {
+			if setErr := f.Value.Set(value); setErr != nil {
+				err = fmt.Errorf("invalid %s: %w", EnvName(f.Name), setErr)
+			}
+		}
+	})
+	return err
+}
+
+// Event returns the configuration of a Lambda event or API job: a copy of c
+// with the fields the JSON event sets, validated. c is left unchanged.
+func (c *Config) Event(data []byte) (*Config, error) {
+	event := c.clone()
+	event.Mode = ""
+	if err := json.Unmarshal(data, event); err != nil {
+		return nil, fmt.Errorf("invalid event: %w", err)
+	}
+	if event.Mode == "daemon" || event.Mode == "serve" {
+		return nil, fmt.Errorf("invalid event: mode %s can't be run from an event", event.Mode)
+	}
+	if err := event.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid event: %w", err)
+	}
+	return event, nil
+}
+
+// clone returns a copy of c sharing no slices or maps, which decoding would change
+func (c *Config) clone() *Config {
+	clone := *c
+	clone.Include = slices.Clone(c.Include)
+	clone.Exclude = slices.Clone(c.Exclude)
+	clone.Filters = slices.Clone(c.Filters)
+	clone.AnonymizeAttributes = slices.Clone(c.AnonymizeAttributes)
+	clone.Users = slices.Clone(c.Users)
+	clone.Pools = slices.Clone(c.Pools)
+	clone.DiscoverRegions = slices.Clone(c.DiscoverRegions)
+	clone.PoolTags = maps.Clone(c.PoolTags)
+	clone.RateLimits = maps.Clone(c.RateLimits)
+	if c.ErrorBudget != nil {
+		budget := *c.ErrorBudget
+		clone.ErrorBudget = &budget
+	}
+	return &clone
+}
+
+// Validate checks that the settings the mode needs are set
+func (c *Config) Validate() error {
+	var missing []string
+	require := func(set bool, name string) {
+		if !set {
+			missing = append(missing, name)
+		}
+	}
+
+	if c.MultiPool() && c.Mode != "" && c.Mode != "backup" {
+		return fmt.Errorf("pools and discover-regions only apply to backup mode, not %s", c.Mode)
+	}
+
+	switch c.Mode {
+	case "":
+		return errors.New("mode is required")
+	case "backup", "restore", "restore-user", "export", "import":
+		if c.Mode == "backup" && c.MultiPool() {
+			// Each pool's region is the prefix of its ID
+			require(c.BackupPath != "", "backup-path")
+			break
+		}
+		require(c.PoolID != "", "pool")
+		require(c.Region != "", "region")
+		require(c.BackupPath != "", "backup-path")
+		if c.Mode == "restore-user" {
+			require(len(c.Users) > 0, "users")
+		}
+		if c.Mode == "import" {
+			require(c.ImportRoleArn != "", "import-role-arn")
+		}
+	case "sync", "clone":
+		// Sync and clone work on two live pools, possibly in different regions
+		require(c.SourcePoolID != "", "source")
+		require(c.TargetPoolID != "", "target")
+		require(c.Region != "" || (c.SourceRegion != "" && c.TargetRegion != ""), "region")
+	case "anonymize":
+		require(c.BackupPath != "", "backup-path")
+		require(c.AnonymizeKey != "", "anonymize-key")
+	case "list", "verify", "compact":
+		// Backup chain management only works on backup files
+		require(c.PoolID != "", "pool")
+		require(c.BackupPath != "", "backup-path")
+	case "daemon":
+		// The schedule file lists the pools, destinations and regions
+		require(c.Schedule != "", "schedule")
+	case "serve":
+		// Every job brings its own settings
+		require(c.APIToken != "", "api-token")
+	default:
+		return fmt.Errorf("invalid mode: %s", c.Mode)
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%s mode requires %s", c.Mode, strings.Join(missing, ", "))
+	}
+
+	if len(c.Pools) > 0 && len(c.DiscoverRegions) > 0 {
+		return errors.New("pools and discover-regions can't be used together")
+	}
+	if c.MultiPool() && c.Parent != "" {
+		return errors.New("parent names one pool's backup and can't be used with pools or discover-regions")
+	}
+	if (c.PoolName != "" || len(c.PoolTags) > 0) && len(c.DiscoverRegions) == 0 {
+		return errors.New("pool-name and pool-tag require discover-regions")
+	}
+	for _, pool := range c.Pools {
+		if _, _, ok := strings.Cut(pool, "_"); !ok {
+			return fmt.Errorf("invalid pool %q, want an ID such as us-east-1_xxxxx", pool)
+		}
+	}
+	if c.Workers < 0 || c.MaxAttempts < 0 || c.QueueSize < 0 || c.MaxJobs < 0 || c.PoolConcurrency < 0 {
+		return errors.New("workers, max-attempts, queue-size, max-jobs and pool-concurrency can't be negative")
+	}
+	if c.ScanSegments != "" && c.ScanSegments != "sub" && c.ScanSegments != "username" {
+		return fmt.Errorf("invalid segmented-scan %q, want sub or username", c.ScanSegments)
+	}
+	for category, rate := range c.RateLimits {
+		if rate <= 0 {
+			return fmt.Errorf("invalid rate for %s, want a positive number of requests per second", category)
+		}
+	}
+	return nil
+}
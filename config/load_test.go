@@ -0,0 +1,203 @@
+package config
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, name, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	file := writeFile(t, "acbr.yaml", `
+mode: restore
+poolId: us-east-1_file
+region: us-east-1
+backupPath: s3://bucket/file/
+workers: 2
+include: [users, groups]
+errorBudget: 1%
+interval: 5m
+role:
+  roleArn: arn:aws:iam::111111111111:role/file
+rateLimits:
+  UserCreation: 10
+`)
+	env := map[string]string{
+		"ACBR_CONFIG":      file,
+		"ACBR_POOL":        "us-east-1_env",
+		"ACBR_WORKERS":     "6",
+		"ACBR_DEFAULT_PWD": "from-env",
+		"ACBR_RATE":        "UserCreation=20,UserAuthentication=30",
+	}
+
+	cfg, err := Load(context.Background(), []string{"-workers", "8", "-rate", "UserCreation=40", "-filter", "users:email=*@example.com"}, func(key string) string { return env[key] })
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	checks := []struct {
+		name      string
+		got, want any
+	}{
+		{"mode from the file", cfg.Mode, "restore"},
+		{"pool from the environment", cfg.PoolID, "us-east-1_env"},
+		{"workers from the flags", cfg.Workers, 8},
+		{"default password from the environment", cfg.DefaultPwd, "from-env"},
+		{"include from the file", cfg.Include, []string{"users", "groups"}},
+		{"filters from the flags", cfg.Filters, []string{"users:email=*@example.com"}},
+		{"rates replaced by the flags", cfg.RateLimits, map[string]float64{"UserCreation": 40}},
+		{"error budget from the file", cfg.ErrorBudget, &ErrorBudget{Percent: 1}},
+		{"interval from the file", cfg.Interval, 5 * time.Minute},
+		{"source role defaults to role", cfg.GetSourceRole().RoleArn, "arn:aws:iam::111111111111:role/file"},
+		{"max results default", cfg.MaxResults, int32(50)},
+		{"file", cfg.File, file},
+	}
+	for _, check := range checks {
+		if !reflect.DeepEqual(check.got, check.want) {
+			t.Errorf("%s: got %v, want %v", check.name, check.got, check.want)
+		}
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validate() error = %v", err)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	noEnv := func(string) string { return "" }
+	tests := []struct {
+		name   string
+		args   []string
+		getenv func(string) string
+	}{
+		{"unknown flag", []string{"-bogus"}, noEnv},
+		{"invalid flag value", []string{"-as-of", "yesterday"}, noEnv},
+		{"invalid environment value", nil, func(key string) string {
+			if key == "ACBR_ERROR_BUDGET" {
+				return "lots"
+			}
+			return ""
+		}},
+		{"missing file", []string{"-config", filepath.Join(t.TempDir(), "missing.yaml")}, noEnv},
+		{"unknown file key", []string{"-config", writeFile(t, "acbr.yaml", "poolID: typo\n")}, noEnv},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Load(context.Background(), tt.args, tt.getenv); err == nil {
+				t.Error("Load() error = nil, want error")
+			}
+		})
+	}
+}
+
+func TestEvent(t *testing.T) {
+	base := Default()
+	base.Mode = "serve"
+	base.Region = "us-east-1"
+	base.BackupPath = "s3://bucket/backups/"
+	base.Include = []string{"users"}
+	base.RateLimits = map[string]float64{"UserCreation": 10}
+	base.Role = AssumeRole{RoleArn: "arn:aws:iam::111111111111:role/base"}
+
+	cfg, err := base.Event([]byte(`{"mode": "restore", "poolId": "us-east-1_x", "defaultPwd": "Secret1!",
+		"include": ["groups"], "rateLimits": {"UserAuthentication": 5}, "errorBudget": "10",
+		"role": {"roleArn": "arn:aws:iam::222222222222:role/event"}}`))
+	if err != nil {
+		t.Fatalf("Event() error = %v", err)
+	}
+	if cfg.Mode != "restore" || cfg.PoolID != "us-east-1_x" || cfg.Region != "us-east-1" || cfg.DefaultPwd != "Secret1!" ||
+		cfg.ErrorBudget.Count != 10 || cfg.GetTargetRole().RoleArn != "arn:aws:iam::222222222222:role/event" {
+		t.Errorf("Event() = %+v", cfg)
+	}
+	// The base is left as it was
+	if base.Mode != "serve" || !reflect.DeepEqual(base.Include, []string{"users"}) || len(base.RateLimits) != 1 {
+		t.Errorf("Event() changed the base: %+v", base)
+	}
+
+	for _, event := range []string{
+		`{"poolId": "us-east-1_x"}`,
+		`{"mode": "serve"}`,
+		`{"mode": "restore"}`,
+		`{"mode": "backup", "poolId": 5}`,
+	} {
+		if _, err := base.Event([]byte(event)); err == nil {
+			t.Errorf("Event(%s) error = nil, want error", event)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr string
+	}{
+		{"backup", Config{Mode: "backup", PoolID: "p", Region: "r", BackupPath: "/b"}, ""},
+		{"no mode", Config{}, "mode is required"},
+		{"unknown mode", Config{Mode: "copy"}, "invalid mode"},
+		{"backup without region", Config{Mode: "backup", PoolID: "p", BackupPath: "/b"}, "requires region"},
+		{"restore-user without users", Config{Mode: "restore-user", PoolID: "p", Region: "r", BackupPath: "/b"}, "requires users"},
+		{"sync with both regions", Config{Mode: "sync", SourcePoolID: "s", TargetPoolID: "t", SourceRegion: "a", TargetRegion: "b"}, ""},
+		{"sync with one region", Config{Mode: "sync", SourcePoolID: "s", TargetPoolID: "t", SourceRegion: "a"}, "requires region"},
+		{"list without region", Config{Mode: "list", PoolID: "p", BackupPath: "/b"}, ""},
+		{"daemon", Config{Mode: "daemon"}, "requires schedule"},
+		{"serve", Config{Mode: "serve"}, "requires api-token"},
+		{"pools", Config{Mode: "backup", Pools: []string{"us-east-1_a", "eu-west-1_b"}, BackupPath: "/b"}, ""},
+		{"discovery", Config{Mode: "backup", DiscoverRegions: []string{"us-east-1"}, PoolName: "prod-*", PoolTags: map[string]string{"env": "prod"}, BackupPath: "/b"}, ""},
+		{"pools without backup path", Config{Mode: "backup", Pools: []string{"us-east-1_a"}}, "requires backup-path"},
+		{"pools outside backup", Config{Mode: "restore", Pools: []string{"us-east-1_a"}, BackupPath: "/b"}, "only apply to backup"},
+		{"pools and discovery", Config{Mode: "backup", Pools: []string{"us-east-1_a"}, DiscoverRegions: []string{"us-east-1"}, BackupPath: "/b"}, "can't be used together"},
+		{"filter without discovery", Config{Mode: "backup", Pools: []string{"us-east-1_a"}, PoolName: "prod-*", BackupPath: "/b"}, "require discover-regions"},
+		{"pool without region", Config{Mode: "backup", Pools: []string{"a"}, BackupPath: "/b"}, "invalid pool"},
+		{"segmented scan", Config{Mode: "backup", PoolID: "p", Region: "r", BackupPath: "/b", ScanSegments: "email"}, "invalid segmented-scan"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.Validate()
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("Validate() error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("Validate() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadPoolFlags(t *testing.T) {
+	env := map[string]string{"ACBR_POOL_TAG": "team=identity"}
+	cfg, err := Load(context.Background(), []string{"-mode", "backup", "-backup-path", "/b",
+		"-discover-regions", "us-east-1,eu-west-1", "-pool-name", "prod-*", "-pool-tag", "env=prod", "-pool-tag", "backup=true,tier=1"},
+		func(key string) string { return env[key] })
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if want := []string{"us-east-1", "eu-west-1"}; !reflect.DeepEqual(cfg.DiscoverRegions, want) {
+		t.Errorf("DiscoverRegions = %v, want %v", cfg.DiscoverRegions, want)
+	}
+	// The tag flags replace those of the environment
+	if want := map[string]string{"env": "prod", "backup": "true", "tier": "1"}; !reflect.DeepEqual(cfg.PoolTags, want) {
+		t.Errorf("PoolTags = %v, want %v", cfg.PoolTags, want)
+	}
+	if !cfg.MultiPool() || cfg.GetPoolConcurrency() != DefaultPoolConcurrency {
+		t.Errorf("MultiPool() = %v, GetPoolConcurrency() = %d", cfg.MultiPool(), cfg.GetPoolConcurrency())
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validate() error = %v", err)
+	}
+
+	if _, err := Load(context.Background(), []string{"-pool-tag", "env"}, func(string) string { return "" }); err == nil {
+		t.Error("Load() with an invalid tag error = nil, want error")
+	}
+}
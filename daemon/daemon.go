@@ -0,0 +1,282 @@
+// Package daemon backs up pools on cron schedules, applying retention after
+// each backup, until it is stopped.
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"acbr/backup"
+	"acbr/config"
+	"acbr/logging"
+	"acbr/report"
+	"acbr/storage"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Schedule lists the backups the daemon runs
+type Schedule struct {
+	Jobs []Job `yaml:"jobs"`
+}
+
+// Job backs up one pool to one destination on a cron schedule
+type Job struct {
+	PoolID string `yaml:"pool"`
+	// Region defaults to -region
+	Region string `yaml:"region"`
+	// Schedule is a cron expression or a macro such as @daily, in the daemon's time zone
+	Schedule    string `yaml:"schedule"`
+	BackupPath  string `yaml:"backupPath"`
+	Incremental bool   `yaml:"incremental"`
+	// Retention is applied after each successful backup
+	Retention backup.Retention `yaml:"retention"`
+
+	cron *cronSpec
+}
+
+// Load reads a local or S3 schedule file
+func Load(ctx context.Context, path string) (*Schedule, error) {
+	data, err := storage.ReadFile(ctx, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schedule file: %w", err)
+	}
+	return Parse(data)
+}
+
+// Parse reads a schedule file. JSON is accepted as it is a subset of YAML.
+func Parse(data []byte) (*Schedule, error) {
+	var schedule Schedule
+	if err := yaml.Unmarshal(data, &schedule); err != nil {
+		return nil, fmt.Errorf("failed to parse schedule: %w", err)
+	}
+	if len(schedule.Jobs) == 0 {
+		return nil, fmt.Errorf("schedule has no jobs")
+	}
+	for n := range schedule.Jobs {
+		job := &schedule.Jobs[n]
+		if job.PoolID == "" || job.BackupPath == "" || job.Schedule == "" {
+			return nil, fmt.Errorf("job %d: pool, backupPath and schedule are required", n+1)
+		}
+		cron, err := parseCron(job.Schedule)
+		if err != nil {
+			return nil, fmt.Errorf("job %d: %w", n+1, err)
+		}
+		if cron.next(time.Now()).IsZero() {
+			return nil, fmt.Errorf("job %d: schedule %q never runs", n+1, job.Schedule)
+		}
+		job.cron = cron
+	}
+	return &schedule, nil
+}
+
+// config returns the configuration of the job's backups, based on base
+func (j *Job) config(base *config.Config) *config.Config {
+	cfg := *base
+	cfg.Mode = "backup"
+	cfg.PoolID = j.PoolID
+	if j.Region != "" {
+		cfg.Region = j.Region
+	}
+	cfg.BackupPath = j.BackupPath
+	cfg.Incremental = j.Incremental
+	cfg.Parent = ""
+	return &cfg
+}
+
+// Runner runs one backup with the given configuration, reporting its outcome
+type Runner func(ctx context.Context, cfg *config.Config) error
+
+// JobStatus is what the health endpoint reports of a job
+type JobStatus struct {
+	PoolID     string     `json:"pool"`
+	BackupPath string     `json:"backupPath"`
+	Schedule   string     `json:"schedule"`
+	Running    bool       `json:"running"`
+	NextRun    time.Time  `json:"nextRun"`
+	LastRun    *time.Time `json:"lastRun,omitempty"`
+	LastStatus string     `json:"lastStatus,omitempty"`
+	LastError  string     `json:"lastError,omitempty"`
+	// Skipped counts the runs skipped because a backup of the pool was still going
+	Skipped int `json:"skipped,omitempty"`
+}
+
+// Daemon runs the backups of a schedule
+type Daemon struct {
+	schedule *Schedule
+	base     *config.Config
+	run      Runner
+	now      func() time.Time
+
+	mu       sync.Mutex
+	status   []JobStatus
+	busy     map[string]bool // pools with a backup in progress
+	stopping bool
+	runs     sync.WaitGroup
+}
+
+// NewDaemon creates a daemon running the schedule's backups with run. Settings
+// the jobs don't have, such as roles and rate limits, come from base.
+func NewDaemon(schedule *Schedule, base *config.Config, run Runner) *Daemon {
+	d := &Daemon{
+		schedule: schedule,
+		base:     base,
+		run:      run,
+		now:      time.Now,
+		status:   make([]JobStatus, len(schedule.Jobs)),
+		busy:     make(map[string]bool),
+	}
+	for n, job := range schedule.Jobs {
+		d.status[n] = JobStatus{PoolID: job.PoolID, BackupPath: job.BackupPath, Schedule: job.Schedule}
+	}
+	return d
+}
+
+// Run runs the backups as scheduled until ctx is canceled. Backups in
+// progress then finish before it returns; none are started.
+func (d *Daemon) Run(ctx context.Context) error {
+	for n, job := range d.schedule.Jobs {
+		if job.Region == "" && d.base.Region == "" {
+			return fmt.Errorf("job %d: region is required when -region is unset", n+1)
+		}
+	}
+
+	slog.Info("daemon started", "jobs", len(d.schedule.Jobs))
+	var schedulers sync.WaitGroup
+	for n := range d.schedule.Jobs {
+		schedulers.Add(1)
+		go func() {
+			defer schedulers.Done()
+			d.loop(ctx, n)
+		}()
+	}
+	<-ctx.Done()
+	schedulers.Wait()
+
+	d.mu.Lock()
+	d.stopping = true
+	running := len(d.busy)
+	d.mu.Unlock()
+	if running > 0 {
+		slog.Info("waiting for backups in progress", "runs", running)
+	}
+	d.runs.Wait()
+	slog.Info("daemon stopped")
+	return nil
+}
+
+// loop starts the job's backups at its scheduled times until ctx is canceled
+func (d *Daemon) loop(ctx context.Context, n int) {
+	job := &d.schedule.Jobs[n]
+	var last time.Time
+	for {
+		after := d.now()
+		if after.Before(last) {
+			after = last
+		}
+		next := job.cron.next(after)
+		d.mu.Lock()
+		d.status[n].NextRun = next
+		d.mu.Unlock()
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+			d.start(ctx, n)
+			last = next
+		}
+	}
+}
+
+// start runs the job's backup in the background, unless a backup of its
+// pool is in progress
+func (d *Daemon) start(ctx context.Context, n int) {
+	job := &d.schedule.Jobs[n]
+	log := slog.With(logging.PoolID, job.PoolID, "backup_path", job.BackupPath)
+
+	d.mu.Lock()
+	if d.busy[job.PoolID] {
+		d.status[n].Skipped++
+		d.mu.Unlock()
+		log.Warn("skipping scheduled backup, the previous backup of the pool is still running")
+		return
+	}
+	d.busy[job.PoolID] = true
+	d.status[n].Running = true
+	d.runs.Add(1)
+	d.mu.Unlock()
+
+	go func() {
+		defer d.runs.Done()
+		// A backup in progress finishes when the daemon is stopping
+		err := d.runJob(context.WithoutCancel(ctx), job)
+		if err != nil {
+			log.Error("scheduled backup failed", logging.Error, err)
+		}
+
+		finished := d.now()
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		delete(d.busy, job.PoolID)
+		d.status[n].Running = false
+		d.status[n].LastRun = &finished
+		d.status[n].LastStatus = report.StatusOf(err)
+		d.status[n].LastError = ""
+		if err != nil {
+			d.status[n].LastError = err.Error()
+		}
+	}()
+}
+
+// runJob backs up the job's pool, then deletes the backups its retention doesn't keep
+func (d *Daemon) runJob(ctx context.Context, job *Job) error {
+	cfg := job.config(d.base)
+	if err := d.run(ctx, cfg); err != nil {
+		return err
+	}
+
+	deleted, err := backup.Prune(ctx, cfg.BackupPath, cfg.PoolID, job.Retention, d.now())
+	if err != nil {
+		return fmt.Errorf("failed to apply retention: %w", err)
+	}
+	if len(deleted) > 0 {
+		slog.Info("deleted backups past retention", logging.PoolID, cfg.PoolID, "backups", len(deleted))
+	}
+	return nil
+}
+
+// Status returns the status of every job
+func (d *Daemon) Status() []JobStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	status := make([]JobStatus, len(d.status))
+	copy(status, d.status)
+	return status
+}
+
+// ServeHTTP reports the daemon's health and its jobs. It answers 503 once
+// the daemon is stopping.
+func (d *Daemon) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	d.mu.Lock()
+	stopping := d.stopping
+	d.mu.Unlock()
+
+	health := struct {
+		Status string      `json:"status"`
+		Jobs   []JobStatus `json:"jobs"`
+	}{Status: "ok", Jobs: d.Status()}
+	w.Header().Set("Content-Type", "application/json")
+	if stopping {
+		health.Status = "stopping"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(health)
+}
@@ -0,0 +1,167 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"acbr/backup"
+	"acbr/config"
+)
+
+func TestParse(t *testing.T) {
+	schedule, err := Parse([]byte(`
+jobs:
+  - pool: us-east-1_abc
+    schedule: "0 2 * * *"
+    backupPath: s3://bucket/backups/
+    incremental: true
+    retention:
+      keep: 7
+      maxAge: 720h
+`))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	job := schedule.Jobs[0]
+	if job.PoolID != "us-east-1_abc" || !job.Incremental || job.Retention != (backup.Retention{Keep: 7, MaxAge: 720 * time.Hour}) || job.cron == nil {
+		t.Errorf("Parse() job = %+v", job)
+	}
+
+	cfg := job.config(&config.Config{Region: "us-east-1", Workers: 8, Parent: "other.json"})
+	if cfg.Mode != "backup" || cfg.PoolID != "us-east-1_abc" || cfg.Region != "us-east-1" || cfg.Workers != 8 || cfg.Parent != "" {
+		t.Errorf("config() = %+v", cfg)
+	}
+
+	for _, data := range []string{
+		`jobs: []`,
+		`{"jobs": [{"pool": "p", "backupPath": "/b"}]}`,
+		`{"jobs": [{"pool": "p", "backupPath": "/b", "schedule": "every day"}]}`,
+		`{"jobs": [{"pool": "p", "backupPath": "/b", "schedule": "0 0 31 2 *"}]}`,
+	} {
+		if _, err := Parse([]byte(data)); err == nil {
+			t.Errorf("Parse(%s) error = nil, want error", data)
+		}
+	}
+}
+
+func TestStartSkipsBusyPool(t *testing.T) {
+	schedule, err := Parse([]byte(`{"jobs": [
+		{"pool": "pool-1", "backupPath": "/a", "schedule": "@daily"},
+		{"pool": "pool-1", "backupPath": "/b", "schedule": "@daily"}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	var runs atomic.Int32
+	d := NewDaemon(schedule, &config.Config{Region: "us-east-1"}, func(ctx context.Context, cfg *config.Config) error {
+		runs.Add(1)
+		<-release
+		return errors.New("throttled")
+	})
+
+	d.start(context.Background(), 0)
+	d.start(context.Background(), 1)
+	close(release)
+	d.runs.Wait()
+
+	if runs.Load() != 1 {
+		t.Errorf("ran %d backups of the busy pool, want 1", runs.Load())
+	}
+	status := d.Status()
+	if status[0].LastStatus != "failed" || status[0].LastError != "throttled" || status[0].Running {
+		t.Errorf("status of the job run = %+v", status[0])
+	}
+	if status[1].Skipped != 1 || status[1].LastRun != nil {
+		t.Errorf("status of the job skipped = %+v", status[1])
+	}
+
+	// Once the backup is done the pool can be backed up again
+	d.start(context.Background(), 1)
+	d.runs.Wait()
+	if runs.Load() != 2 {
+		t.Errorf("ran %d backups, want 2", runs.Load())
+	}
+}
+
+func TestRunJobAppliesRetention(t *testing.T) {
+	dir := t.TempDir()
+	schedule, err := Parse([]byte(`{"jobs": [{"pool": "pool", "backupPath": "` + dir + `", "schedule": "@daily", "retention": {"keep": 1}}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var backups int
+	d := NewDaemon(schedule, &config.Config{Region: "us-east-1"}, func(ctx context.Context, cfg *config.Config) error {
+		backups++
+		id := "cognito-backup-pool-2024010" + string(rune('0'+backups)) + "-000000.json"
+		manifest, _ := json.Marshal(backup.Manifest{ID: id, PoolID: "pool", Type: backup.BackupTypeFull, CreatedAt: time.Now()})
+		if err := os.WriteFile(filepath.Join(cfg.BackupPath, id), []byte("{}"), 0644); err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(cfg.BackupPath, strings.TrimSuffix(id, ".json")+".manifest.json"), manifest, 0644)
+	})
+
+	for i := 0; i < 3; i++ {
+		if err := d.runJob(context.Background(), &schedule.Jobs[0]); err != nil {
+			t.Fatalf("runJob() error = %v", err)
+		}
+	}
+	manifests, err := backup.List(context.Background(), dir, "pool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifests) != 1 || manifests[0].ID != "cognito-backup-pool-20240103-000000.json" {
+		t.Errorf("backups left = %+v, want only the newest", manifests)
+	}
+}
+
+func TestRunStopsBetweenRuns(t *testing.T) {
+	schedule, err := Parse([]byte(`{"jobs": [{"pool": "pool", "backupPath": "/b", "schedule": "@yearly"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewDaemon(schedule, &config.Config{Region: "us-east-1"}, func(ctx context.Context, cfg *config.Config) error {
+		t.Error("no backup is due")
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- d.Run(ctx) }()
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() did not return once canceled")
+	}
+
+	rec := httptest.NewRecorder()
+	d.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), `"status":"stopping"`) {
+		t.Errorf("ServeHTTP() = %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestRunRequiresRegion(t *testing.T) {
+	schedule, err := Parse([]byte(`{"jobs": [{"pool": "pool", "backupPath": "/b", "schedule": "@daily"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewDaemon(schedule, &config.Config{}, nil)
+	if err := d.Run(context.Background()); err == nil {
+		t.Error("Run() error = nil, want a missing region error")
+	}
+}
@@ -0,0 +1,81 @@
+// Package logging sets up the structured logger of a run and names the fields
+// its records share. Records never hold passwords or user attributes; users
+// are identified by a pseudonym of their username.
+package logging
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// Field names shared by all records
+const (
+	RunID    = "run_id"
+	PoolID   = "pool_id"
+	Phase    = "phase"
+	Resource = "resource"
+	Name     = "name"
+	Error    = "error"
+)
+
+// Log formats
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// New creates a logger writing records of level and above to w as text or JSON
+func New(w io.Writer, level, format string) (*slog.Logger, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q, want debug, info, warn or error", level)
+	}
+
+	options := &slog.HandlerOptions{Level: l}
+	switch strings.ToLower(format) {
+	case FormatText:
+		return slog.New(slog.NewTextHandler(w, options)), nil
+	case FormatJSON:
+		return slog.New(slog.NewJSONHandler(w, options)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q, want %s or %s", format, FormatText, FormatJSON)
+	}
+}
+
+// Setup makes a logger created by New the default one
+func Setup(w io.Writer, level, format string) error {
+	logger, err := New(w, level, format)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logger)
+	return nil
+}
+
+// User returns the pseudonym a user is logged under. Usernames are often
+// email addresses, so they are hashed; the same username always gives the
+// same pseudonym, which lets a known user be found in the logs.
+func User(username string) string {
+	sum := sha256.Sum256([]byte(username))
+	return "user-" + hex.EncodeToString(sum[:6])
+}
+
+// ResourceName returns the name a resource of kind is logged under: users by
+// their pseudonym and memberships, named <group>/<username>, by their group
+// and the user's pseudonym
+func ResourceName(kind, name string) string {
+	switch kind {
+	case "user":
+		return User(name)
+	case "membership":
+		if group, username, ok := strings.Cut(name, "/"); ok {
+			return group + "/" + User(username)
+		}
+		return User(name)
+	}
+	return name
+}
@@ -0,0 +1,98 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		level   string
+		format  string
+		wantErr bool
+		want    string
+	}{
+		{"json", "info", "json", false, `"msg":"restored"`},
+		{"text", "INFO", "text", false, "msg=restored"},
+		{"below level", "error", "text", false, ""},
+		{"invalid level", "verbose", "text", true, ""},
+		{"invalid format", "info", "xml", true, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger, err := New(&buf, tt.level, tt.format)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			logger.Info("restored", RunID, "run-1", Resource, "group", Name, "admins")
+			if tt.want == "" {
+				if buf.Len() != 0 {
+					t.Errorf("New() logged %q below its level", buf.String())
+				}
+				return
+			}
+			if !strings.Contains(buf.String(), tt.want) || !strings.Contains(buf.String(), "run-1") {
+				t.Errorf("New() logged %q, want %q", buf.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestNewJSONFields(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, "debug", "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Debug("created", RunID, "run-1", PoolID, "pool", Phase, "users", Resource, "user", Name, User("alice@example.com"))
+
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{"run_id", "pool_id", "phase", "resource", "name"} {
+		if _, ok := record[field]; !ok {
+			t.Errorf("record %v has no %s", record, field)
+		}
+	}
+	if strings.Contains(buf.String(), "alice") {
+		t.Errorf("record %s holds the username", buf.String())
+	}
+}
+
+func TestUser(t *testing.T) {
+	if User("alice") != User("alice") {
+		t.Error("User() isn't stable")
+	}
+	if User("alice") == User("bob") {
+		t.Error("User() gives two users the same pseudonym")
+	}
+	if got := User("alice@example.com"); !strings.HasPrefix(got, "user-") || strings.Contains(got, "alice") {
+		t.Errorf("User() = %q", got)
+	}
+}
+
+func TestResourceName(t *testing.T) {
+	tests := []struct {
+		kind, name, want string
+	}{
+		{"group", "admins", "admins"},
+		{"client", "web", "web"},
+		{"user", "alice", User("alice")},
+		{"membership", "admins/alice", "admins/" + User("alice")},
+	}
+
+	for _, tt := range tests {
+		if got := ResourceName(tt.kind, tt.name); got != tt.want {
+			t.Errorf("ResourceName(%q, %q) = %q, want %q", tt.kind, tt.name, got, tt.want)
+		}
+	}
+}
@@ -1,110 +1,753 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/aws/aws-lambda-go/lambda"
+	"go.opentelemetry.io/otel/attribute"
 
+	"acbr/anonymize"
 	"acbr/aws"
 	"acbr/backup"
 	"acbr/config"
+	"acbr/daemon"
+	"acbr/logging"
+	"acbr/metrics"
+	"acbr/replicate"
+	"acbr/report"
 	"acbr/restore"
+	"acbr/server"
+	"acbr/storage"
+	"acbr/tracing"
 )
 
-// Add this type at the top of main.go
-type LambdaEvent struct {
-	Mode       string `json:"mode"`
-	PoolID     string `json:"poolId"`
-	Region     string `json:"region"`
-	BackupPath string `json:"backupPath"`
-	UsersOnly  bool   `json:"usersOnly,omitempty"`
-	MaxResults int32  `json:"maxResults,omitempty"`
+// newCognitoClient creates a client sharing the configured rate limits and retries
+func newCognitoClient(config *config.Config, region string, role config.AssumeRole) (*aws.LimitedClient, error) {
+	rates := make(map[aws.Category]float64, len(config.RateLimits))
+	for category, rate := range config.RateLimits {
+		if _, ok := aws.DefaultRates[aws.Category(category)]; !ok {
+			return nil, fmt.Errorf("unknown rate limit category: %s", category)
+		}
+		rates[aws.Category(category)] = rate
+	}
+
+	client, err := aws.NewCognitoClient(region, role)
+	if err != nil {
+		return nil, err
+	}
+	limited := aws.NewLimitedClient(client, rates, aws.RetryOptions{MaxAttempts: config.MaxAttempts})
+	limited.OnCall(metrics.Default.CountCall)
+	return limited, nil
+}
+
+// printRetries reports the operations the client had to retry
+func printRetries(name string, client *aws.LimitedClient) {
+	if summary := client.RetrySummary(); len(summary) > 0 {
+		slog.Info("retried operations", "client", name, "retries", strings.Join(summary, ", "))
+	}
 }
 
 var Version = "dev" // This will be set during build
 
 /*
 # Local storage
-./acbr -mode backup -source us-east-1_xxxxx -region us-east-1 -backup-path ./backups/
-./acbr -mode backup -source us-east-1_xxxxx -region us-east-1 -backup-path /absolute/path/backups/
+./acbr -mode backup -pool us-east-1_xxxxx -region us-east-1 -backup-path ./backups/
+./acbr -mode backup -pool us-east-1_xxxxx -region us-east-1 -backup-path /absolute/path/backups/
 
 # S3 storage
-./acbr -mode backup -source us-east-1_xxxxx -region us-east-1 -backup-path s3://my-bucket/cognito/backups/
+./acbr -mode backup -pool us-east-1_xxxxx -region us-east-1 -backup-path s3://my-bucket/cognito/backups/
 */
 func main() {
-	cfg := &config.Config{}
-
-	// Check if running as Lambda
+	// Check if running as Lambda, where CloudWatch gets JSON logs by default
 	if os.Getenv("AWS_LAMBDA_FUNCTION_NAME") != "" {
-		lambda.Start(handleLambda)
+		base, err := lambdaConfig(context.Background())
+		if err == nil {
+			err = logging.Setup(os.Stderr, base.LogLevel, base.LogFormat)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if err := tracing.Setup(context.Background(), Version); err != nil {
+			fatal(err)
+		}
+		lambda.Start(func(ctx context.Context, event json.RawMessage) (*report.Report, error) {
+			return handleLambda(ctx, base, event)
+		})
 		return
 	}
 
-	// CLI flags
-	flag.StringVar(&cfg.Mode, "mode", "", "Operation mode: backup or restore")
-	flag.StringVar(&cfg.PoolID, "pool", "", "Pool ID (source for backup, target for restore)")
-	flag.StringVar(&cfg.Region, "region", "", "AWS Region")
-	flag.StringVar(&cfg.BackupPath, "backup-path", "", "Path to store/read backup files")
-	flag.BoolVar(&cfg.UsersOnly, "users-only", false, "Restore only users and groups")
-	var maxResults int
-	flag.IntVar(&maxResults, "max-results", 50, "Maximum results per page for AWS API calls (max 50)")
-	flag.StringVar(&cfg.DefaultPwd, "default-pwd", "", "Default password for Cognito-created users (required for non-SSO users)")
-	showVersion := flag.Bool("version", false, "Show version information")
-
-	flag.Parse()
-
-	if *showVersion {
+	cfg, err := config.Load(context.Background(), os.Args[1:], os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		printUsage()
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if cfg.Version {
 		fmt.Printf("acbr version %s\n", Version)
 		os.Exit(0)
 	}
-
-	if cfg.Mode == "" || cfg.PoolID == "" || cfg.Region == "" || cfg.BackupPath == "" {
-		flag.Usage()
+	if err := logging.Setup(os.Stderr, cfg.LogLevel, cfg.LogFormat); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		printUsage()
 		os.Exit(1)
 	}
 
-	cfg.MaxResults = int32(maxResults)
+	// Ctrl-C or SIGTERM stops the run cleanly; a second one exits at once
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
 
-	if err := run(cfg); err != nil {
-		log.Fatal(err)
+	if err := tracing.Setup(ctx, Version); err != nil {
+		fatal(err)
+	}
+	switch cfg.Mode {
+	case "daemon", "serve":
+		if cfg.Mode == "daemon" {
+			err = runDaemon(ctx, cfg)
+		} else {
+			err = runServer(ctx, cfg)
+		}
+		shutdownTracing()
+		if err != nil {
+			fatal(err)
+		}
+		return
 	}
+
+	stopMetrics := func() {}
+	if cfg.MetricsAddr != "" {
+		stopMetrics = serveMetrics(cfg.MetricsAddr, nil)
+	}
+	ctx, err = withStorage(ctx, cfg)
+	if err != nil {
+		fatal(err)
+	}
+	rep, err := runTraced(ctx, cfg, run)
+	finishReport(ctx, cfg, rep, err)
+	stopMetrics()
+	shutdownTracing()
+	if err != nil {
+		if interrupted(ctx, err) {
+			slog.Warn("interrupted", logging.Error, err)
+			os.Exit(exitInterrupted)
+		}
+		fatal(err)
+	}
+}
+
+// printUsage prints the flags with their defaults
+func printUsage() {
+	fs := config.Default().FlagSet("acbr")
+	fmt.Fprintf(os.Stderr, "Usage of acbr:\n")
+	fs.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "\nEvery flag can also be set by an environment variable, such as %s for -backup-path.\n", config.EnvName("backup-path"))
+}
+
+// fatal logs err and exits with a failure
+func fatal(err error) {
+	slog.Error("run failed", logging.Error, err)
+	os.Exit(1)
 }
 
-// Add this function to main.go
-func handleLambda(event LambdaEvent) error {
-	cfg := &config.Config{
-		Mode:       event.Mode,
-		PoolID:     event.PoolID,
-		Region:     event.Region,
-		BackupPath: event.BackupPath,
-		UsersOnly:  event.UsersOnly,
-		MaxResults: event.MaxResults,
+// exitInterrupted is the exit code of a run stopped by a signal
+const exitInterrupted = 130
+
+// reportTimeout bounds saving the report once the run has ended
+const reportTimeout = 30 * time.Second
+
+// lambdaDeadlineMargin is the time kept before the Lambda deadline to stop
+// the run and write its checkpoint
+const lambdaDeadlineMargin = 45 * time.Second
+
+// interrupted reports whether the run failed because ctx was canceled
+func interrupted(ctx context.Context, err error) bool {
+	return ctx.Err() != nil && (errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded))
+}
+
+// lambdaConfig returns the configuration events apply to: the defaults, with
+// JSON logs, then the file of $ACBR_CONFIG and the ACBR_* environment variables
+func lambdaConfig(ctx context.Context) (*config.Config, error) {
+	cfg := config.Default()
+	cfg.LogFormat = logging.FormatJSON
+	if err := cfg.LoadFile(ctx, os.Getenv(config.EnvName("config"))); err != nil {
+		return nil, err
 	}
+	if err := cfg.LoadEnv(os.Getenv); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
 
-	if cfg.MaxResults == 0 || cfg.MaxResults > 50 {
-		cfg.MaxResults = 50
+// handleLambda runs the event's mode over the base configuration and returns
+// its report. A run that fails or is interrupted returns an error instead, so
+// that Lambda counts the invocation as failed for retries, dead-letter queues
+// and error alarms. Lambda drops the response of a failed invocation, so the
+// error carries the run's counts and the path of its saved report.
+func handleLambda(ctx context.Context, base *config.Config, event json.RawMessage) (*report.Report, error) {
+	cfg, err := base.Event(event)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.LogLevel != base.LogLevel || cfg.LogFormat != base.LogFormat {
+		if err := logging.Setup(os.Stderr, cfg.LogLevel, cfg.LogFormat); err != nil {
+			return nil, err
+		}
 	}
 
-	return run(cfg)
+	// Stop before Lambda kills the function, leaving time for the checkpoint
+	if deadline, ok := ctx.Deadline(); ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline.Add(-lambdaDeadlineMargin))
+		defer cancel()
+	}
+
+	// Spans are exported before the invocation returns, as Lambda may freeze
+	// the process right after
+	defer flushTraces(ctx)
+
+	ctx, err = withStorage(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	rep, err := runTraced(ctx, cfg, run)
+	if rep == nil {
+		return nil, err
+	}
+	path := finishReport(ctx, cfg, rep, err)
+	if rep.Status != report.StatusSucceeded {
+		msg := fmt.Sprintf("run %s %s", rep.RunID, rep.Status)
+		if summary := rep.Summary(); summary != "" {
+			msg += " (" + summary + ")"
+		}
+		if path != "" {
+			msg += ", report " + path
+		}
+		return nil, fmt.Errorf("%s: %w", msg, err)
+	}
+	return rep, nil
+}
+
+// withStorage returns ctx carrying the AWS configuration of the run's S3
+// storage, with the credentials of its storage role when it has one. It is kept
+// in the context, not the process, as runs of daemon and serve mode or warm
+// Lambda invocations may use different roles.
+func withStorage(ctx context.Context, config *config.Config) (context.Context, error) {
+	role := config.GetStorageRole()
+	if role.RoleArn == "" {
+		return ctx, nil
+	}
+	awsConfig, err := aws.LoadConfig("", role)
+	if err != nil {
+		return ctx, fmt.Errorf("failed to load AWS config for storage: %w", err)
+	}
+	return storage.WithAWSConfig(ctx, awsConfig), nil
+}
+
+// runFunc runs the configured mode, like run
+type runFunc func(ctx context.Context, config *config.Config) (*report.Report, error)
+
+// runTraced runs the configured mode with fn inside the run's root span
+func runTraced(ctx context.Context, config *config.Config, fn runFunc) (rep *report.Report, err error) {
+	ctx, span := tracing.Start(ctx, "acbr "+config.Mode, attribute.String("acbr.mode", config.Mode))
+	defer func() {
+		if rep != nil {
+			span.SetAttributes(attribute.String("acbr.run_id", rep.RunID), attribute.String("acbr.pool_id", metrics.RunOf(rep).PoolID))
+			span.SetAttributes(rep.Attributes()...)
+		}
+		tracing.End(span, err)
+	}()
+	return fn(ctx, config)
+}
+
+// flushTraces exports the spans ended so far
+func flushTraces(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), reportTimeout)
+	defer cancel()
+	if err := tracing.Flush(ctx); err != nil {
+		slog.Error("failed to export traces", logging.Error, err)
+	}
 }
 
-func run(config *config.Config) error {
-	client, err := aws.NewCognitoClient(config.Region)
+// shutdownTracing exports the remaining spans and stops the exporter
+func shutdownTracing() {
+	ctx, cancel := context.WithTimeout(context.Background(), reportTimeout)
+	defer cancel()
+	if err := tracing.Shutdown(ctx); err != nil {
+		slog.Error("failed to export traces", logging.Error, err)
+	}
+}
+
+// run executes the configured mode. It returns the run's report, or nil for
+// the modes that only work on backup files.
+func run(ctx context.Context, config *config.Config) (*report.Report, error) {
+	switch config.Mode {
+	case "anonymize":
+		_, err := anonymize.Execute(ctx, config)
+		return nil, err
+	case "list", "verify", "compact":
+		return nil, runChain(ctx, config)
+	case "sync", "clone":
+		return runPoolToPool(ctx, config)
+	}
+	if config.MultiPool() {
+		return runPools(ctx, config)
+	}
+
+	// Backups read the pool as a source, everything else writes to it as a target
+	role := config.GetTargetRole()
+	if config.Mode == "backup" {
+		role = config.GetSourceRole()
+	}
+	client, err := newCognitoClient(config, config.Region, role)
 	if err != nil {
-		return fmt.Errorf("failed to create AWS client: %w", err)
+		return nil, fmt.Errorf("failed to create AWS client: %w", err)
 	}
+	defer printRetries("Cognito", client)
 
+	var rep *report.Report
 	switch config.Mode {
 	case "backup":
-		b := backup.NewBackup(client, config)
-		return b.Execute()
+		b, backupErr := newBackup(config, client, role)
+		if backupErr != nil {
+			return nil, backupErr
+		}
+		rep, err = b.Report(), b.Execute(ctx)
 	case "restore":
 		r := restore.NewRestore(client, config)
-		return r.Execute()
+		identity, identityErr := aws.NewIdentityClient(config.Region, role)
+		if identityErr != nil {
+			return nil, fmt.Errorf("failed to create AWS identity client: %w", identityErr)
+		}
+		r.UseIdentityClient(identity)
+		rep, err = r.Report(), r.Execute(ctx)
+	case "restore-user":
+		r := restore.NewRestore(client, config)
+		_, err = r.RestoreUsers(ctx, config.Users)
+		rep = r.Report()
+	case "export":
+		importer := restore.NewImporter(client, nil, config)
+		_, err = importer.Export(ctx)
+		rep = importer.Report()
+	case "import":
+		logs, logsErr := aws.NewLogsClient(config.Region, role)
+		if logsErr != nil {
+			return nil, fmt.Errorf("failed to create AWS logs client: %w", logsErr)
+		}
+		importer := restore.NewImporter(client, logs, config)
+		_, err = importer.Execute(ctx)
+		rep = importer.Report()
+	default:
+		return nil, fmt.Errorf("invalid mode: %s", config.Mode)
+	}
+	rep.AddRetries("", client.Retries())
+	return rep, err
+}
+
+// newBackup creates the backup of the configured pool through client, with
+// the identity pools trusting it when configured
+func newBackup(config *config.Config, client *aws.LimitedClient, role config.AssumeRole) (*backup.Backup, error) {
+	b := backup.NewBackup(client, config)
+	if config.IdentityPools {
+		identity, err := aws.NewIdentityClient(config.Region, role)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create AWS identity client: %w", err)
+		}
+		b.UseIdentityClient(identity)
+	}
+	return b, nil
+}
+
+// runPoolToPool syncs or clones the source pool into the target pool
+func runPoolToPool(ctx context.Context, config *config.Config) (*report.Report, error) {
+	sourceRegion, targetRegion := config.SourceRegion, config.TargetRegion
+	if sourceRegion == "" {
+		sourceRegion = config.Region
+	}
+	if targetRegion == "" {
+		targetRegion = config.Region
+	}
+
+	source, err := newCognitoClient(config, sourceRegion, config.GetSourceRole())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create source AWS client: %w", err)
+	}
+	target, err := newCognitoClient(config, targetRegion, config.GetTargetRole())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create target AWS client: %w", err)
+	}
+	defer printRetries("source pool", source)
+	defer printRetries("target pool", target)
+
+	var rep *report.Report
+	if config.Mode == "clone" {
+		rep, err = restore.Clone(ctx, source, target, config)
+	} else {
+		r := replicate.NewReplicator(source, target, config)
+		r.OnSync(func(startedAt time.Time, _ []replicate.Change, err error) {
+			metrics.Default.Record(metrics.Run{
+				Mode:       config.Mode,
+				PoolID:     config.TargetPoolID,
+				StartedAt:  startedAt,
+				FinishedAt: time.Now(),
+				Status:     report.StatusOf(err),
+			})
+		})
+		rep, err = r.Report(), r.Execute(ctx)
+	}
+	rep.AddRetries("source/", source.Retries())
+	rep.AddRetries("target/", target.Retries())
+	return rep, err
+}
+
+// runPools backs up the listed or discovered pools, each into its own
+// directory of the backup path and a few at a time, and returns the combined
+// report. A pool that fails doesn't stop the others. The pools of a region
+// share one client, so that together they keep to the region's rate limits.
+func runPools(ctx context.Context, config *config.Config) (*report.Report, error) {
+	role := config.GetSourceRole()
+	clients := make(map[string]*aws.LimitedClient)
+	clientOf := func(region string) (*aws.LimitedClient, error) {
+		if client, ok := clients[region]; ok {
+			return client, nil
+		}
+		client, err := newCognitoClient(config, region, role)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create AWS client for %s: %w", region, err)
+		}
+		clients[region] = client
+		return client, nil
+	}
+
+	pools, err := discoverPools(ctx, config, clientOf)
+	if err != nil {
+		return nil, err
+	}
+	for _, pool := range pools {
+		if _, err := clientOf(poolConfig(config, pool).Region); err != nil {
+			return nil, err
+		}
+	}
+	rep := report.New(config)
+	slog.Info("backing up pools", logging.RunID, rep.RunID, "pools", len(pools), "concurrency", config.GetPoolConcurrency())
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		errs    []error
+		started int
+	)
+	slots := make(chan struct{}, config.GetPoolConcurrency())
+	for _, pool := range pools {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		poolConfig := poolConfig(config, pool)
+		client := clients[poolConfig.Region]
+		started++
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			poolRep, err := reportRun(ctx, poolConfig, backupWith(client, role))
+			if poolRep != nil {
+				rep.AddPool(poolRep)
+			}
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("pool %s: %w", pool, err))
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	for region, client := range clients {
+		printRetries("Cognito "+region, client)
+		rep.AddRetries("", client.Retries())
+	}
+	if started < len(pools) {
+		errs = append(errs, fmt.Errorf("%d of %d pools not backed up: %w", len(pools)-started, len(pools), ctx.Err()))
+	}
+	return rep, errors.Join(errs...)
+}
+
+// backupWith returns a run backing up the configured pool through client
+func backupWith(client *aws.LimitedClient, role config.AssumeRole) runFunc {
+	return func(ctx context.Context, config *config.Config) (*report.Report, error) {
+		b, err := newBackup(config, client, role)
+		if err != nil {
+			return nil, err
+		}
+		return b.Report(), b.Execute(ctx)
+	}
+}
+
+// discoverPools returns the pools of a multi-pool backup: those listed, or
+// those of the discovery regions that match the name and tag filters
+func discoverPools(ctx context.Context, config *config.Config, clientOf func(region string) (*aws.LimitedClient, error)) ([]string, error) {
+	if len(config.Pools) > 0 {
+		return config.Pools, nil
+	}
+	filter := backup.PoolFilter{Name: config.PoolName, Tags: config.PoolTags}
+	var pools []string
+	for _, region := range config.DiscoverRegions {
+		client, err := clientOf(region)
+		if err != nil {
+			return nil, err
+		}
+		found, err := backup.Discover(ctx, client, filter)
+		if err != nil {
+			return nil, fmt.Errorf("failed to discover pools in %s: %w", region, err)
+		}
+		slog.Info("discovered pools", "region", region, "pools", strings.Join(found, ", "))
+		pools = append(pools, found...)
+	}
+	return pools, nil
+}
+
+// poolConfig returns the configuration backing up one pool of a multi-pool
+// run, in the region its ID starts with
+func poolConfig(cfg *config.Config, poolID string) *config.Config {
+	pool := *cfg
+	pool.PoolID = poolID
+	pool.Region, _, _ = strings.Cut(poolID, "_")
+	pool.BackupPath = storage.SubDir(cfg.BackupPath, poolID)
+	pool.Pools, pool.DiscoverRegions = nil, nil
+	return &pool
+}
+
+// finishReport completes the run's report, records its metrics and saves it
+// next to the backup. It returns the path the report was saved under, if any.
+func finishReport(ctx context.Context, config *config.Config, rep *report.Report, err error) string {
+	if rep == nil {
+		return ""
+	}
+	rep.Finish(err)
+	// The pools of a multi-pool run recorded and pushed their own metrics
+	if len(rep.Pools) == 0 {
+		metrics.Default.Record(metrics.RunOf(rep))
+	}
+
+	// The run's context may be canceled already, the report is still written
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), reportTimeout)
+	defer cancel()
+	publishMetrics(ctx, config, rep)
+	if config.BackupPath == "" {
+		return ""
+	}
+	path, saveErr := rep.Save(ctx, config.BackupPath)
+	if saveErr != nil {
+		slog.Error("failed to save report", logging.RunID, rep.RunID, logging.Error, saveErr)
+		return ""
+	}
+	slog.Info("report saved", logging.RunID, rep.RunID, "path", path, "status", rep.Status)
+	return path
+}
+
+// publishMetrics pushes the metrics to the Pushgateway and writes the
+// textfile collector file, when configured. Failures are logged only.
+func publishMetrics(ctx context.Context, config *config.Config, rep *report.Report) {
+	if config.MetricsPushURL != "" && len(rep.Pools) == 0 {
+		run := metrics.RunOf(rep)
+		if err := metrics.Default.Push(ctx, config.MetricsPushURL, "acbr", "mode", run.Mode, "pool", run.PoolID); err != nil {
+			slog.Error("failed to push metrics", logging.RunID, rep.RunID, logging.Error, err)
+		}
+	}
+	if config.MetricsFile != "" {
+		if err := metrics.Default.WriteFile(config.MetricsFile); err != nil {
+			slog.Error("failed to write metrics file", logging.RunID, rep.RunID, logging.Error, err)
+		}
+	}
+}
+
+// serveMetrics serves the metrics on addr at /metrics, and health at
+// /healthz when given, until the returned function is called
+func serveMetrics(addr string, health http.Handler) func() {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Default)
+	if health != nil {
+		mux.Handle("/healthz", health)
+	}
+	server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("metrics server failed", "addr", addr, logging.Error, err)
+		}
+	}()
+	slog.Info("serving metrics", "addr", addr)
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(ctx)
+	}
+}
+
+// runReported runs the configured mode and finishes its report
+func runReported(ctx context.Context, config *config.Config) (*report.Report, error) {
+	return reportRun(ctx, config, run)
+}
+
+// reportRun runs the configured mode with fn and finishes its report
+func reportRun(ctx context.Context, config *config.Config, fn runFunc) (*report.Report, error) {
+	ctx, err := withStorage(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	rep, err := runTraced(ctx, config, fn)
+	finishReport(ctx, config, rep, err)
+	return rep, err
+}
+
+// decodeJob reads an API job request, which has the fields of a Lambda event
+// and defaults to the server's configuration
+func decodeJob(base *config.Config) server.Decoder {
+	return func(data []byte) (*config.Config, error) {
+		// Unlike Lambda events, which may be wrapped, jobs are checked for typos
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&config.Config{}); err != nil {
+			return nil, fmt.Errorf("invalid job: %w", err)
+		}
+		return base.Event(data)
+	}
+}
+
+// runServer serves the job API until ctx is canceled, which interrupts the
+// running jobs
+func runServer(ctx context.Context, cfg *config.Config) error {
+	// Backups are listed with the server's storage role, jobs with their own
+	storageCtx, err := withStorage(context.Background(), cfg)
+	if err != nil {
+		return err
+	}
+	s := server.NewServer(decodeJob(cfg), runReported, server.Options{
+		Token:       cfg.APIToken,
+		QueueSize:   cfg.QueueSize,
+		Concurrency: cfg.MaxJobs,
+		BackupPath:  cfg.BackupPath,
+	})
+	mux := http.NewServeMux()
+	mux.Handle("/", s.Handler())
+	mux.Handle("GET /metrics", metrics.Default)
+	httpServer := &http.Server{
+		Addr:              cfg.Listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return storageCtx },
+	}
+
+	listenErr := make(chan error, 1)
+	go func() {
+		listenErr <- httpServer.ListenAndServe()
+	}()
+	slog.Info("serving API", "addr", cfg.Listen)
+
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		s.Run(runCtx)
+		close(done)
+	}()
+
+	select {
+	case <-ctx.Done():
+	case err = <-listenErr:
+		err = fmt.Errorf("failed to serve API: %w", err)
+	}
+	cancel()
+	<-done
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelShutdown()
+	_ = httpServer.Shutdown(shutdownCtx)
+	return err
+}
+
+// runDaemon backs up the pools of the schedule file as scheduled until ctx
+// is canceled, then waits for the backups in progress
+func runDaemon(ctx context.Context, cfg *config.Config) error {
+	schedule, err := daemon.Load(ctx, cfg.Schedule)
+	if err != nil {
+		return err
+	}
+	// Retention deletes backups with the storage role of the schedule's runs
+	ctx, err = withStorage(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	d := daemon.NewDaemon(schedule, cfg, func(ctx context.Context, config *config.Config) error {
+		_, err := runReported(ctx, config)
+		return err
+	})
+	if cfg.MetricsAddr != "" {
+		defer serveMetrics(cfg.MetricsAddr, d)()
+	}
+	return d.Run(ctx)
+}
+
+// runChain lists, verifies or compacts the pool's backup chains
+func runChain(ctx context.Context, config *config.Config) error {
+	switch config.Mode {
+	case "list":
+		manifests, err := backup.List(ctx, config.BackupPath, config.PoolID)
+		if err != nil {
+			return err
+		}
+		for _, m := range manifests {
+			fmt.Printf("%s\t%s\t%s\tusers=%d\tdeleted=%d\tparent=%s\n",
+				m.CreatedAt.Format(time.RFC3339), m.Type, m.ID, m.Users, m.DeletedUsers, m.Parent)
+		}
+		return nil
+	case "verify":
+		problems, err := backup.Verify(ctx, config.BackupPath, config.PoolID)
+		if err != nil {
+			return err
+		}
+		for _, problem := range problems {
+			fmt.Println(problem)
+		}
+		if len(problems) > 0 {
+			return fmt.Errorf("%d problems found in backups of pool %s", len(problems), config.PoolID)
+		}
+		slog.Info("backups verified", logging.PoolID, config.PoolID)
+		return nil
 	default:
-		return fmt.Errorf("invalid mode: %s", config.Mode)
+		path, err := backup.Compact(ctx, config.BackupPath, config.PoolID)
+		if err != nil {
+			return err
+		}
+		slog.Info("compacted backup chain", logging.PoolID, config.PoolID, "path", path)
+		return nil
 	}
 }
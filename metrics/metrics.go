@@ -0,0 +1,345 @@
+// Package metrics keeps Prometheus metrics of the runs of this process. They
+// are served over HTTP by long-running modes, or pushed to a Pushgateway or
+// written for the node exporter's textfile collector at the end of a run.
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"acbr/report"
+	"acbr/storage"
+)
+
+// Default holds the metrics of this process
+var Default = NewRegistry()
+
+// Run is the outcome of a run, or of one sync of a sync loop
+type Run struct {
+	Mode       string
+	PoolID     string
+	StartedAt  time.Time
+	FinishedAt time.Time
+	Status     string
+	// Counts are keyed by resource kind, as in the run report
+	Counts map[string]report.Counts
+}
+
+// RunOf returns the outcome of a finished run from its report
+func RunOf(rep *report.Report) Run {
+	run := Run{
+		Mode:       rep.Mode,
+		PoolID:     rep.PoolID,
+		StartedAt:  rep.StartedAt,
+		FinishedAt: rep.FinishedAt,
+		Status:     rep.Status,
+		Counts:     make(map[string]report.Counts, len(rep.Counts)),
+	}
+	if run.PoolID == "" {
+		// Sync and clone runs are about their target pool
+		run.PoolID = rep.TargetPoolID
+	}
+	for kind, counts := range rep.Counts {
+		run.Counts[kind] = *counts
+	}
+	return run
+}
+
+// Registry holds the metrics of the runs recorded and the Cognito calls counted
+type Registry struct {
+	mu        sync.Mutex
+	runs      map[runKey]*runMetrics
+	calls     map[string]int
+	throttles map[string]int
+}
+
+type runKey struct {
+	mode string
+	pool string
+}
+
+type runMetrics struct {
+	total       map[string]int // runs by status
+	lastRun     time.Time
+	lastSuccess time.Time
+	duration    float64
+	counts      map[string]report.Counts
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		runs:      make(map[runKey]*runMetrics),
+		calls:     make(map[string]int),
+		throttles: make(map[string]int),
+	}
+}
+
+// Record adds a finished run
+func (r *Registry) Record(run Run) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := runKey{mode: run.Mode, pool: run.PoolID}
+	m, ok := r.runs[key]
+	if !ok {
+		m = &runMetrics{total: make(map[string]int)}
+		r.runs[key] = m
+	}
+	m.total[run.Status]++
+	m.lastRun = run.FinishedAt
+	m.duration = run.FinishedAt.Sub(run.StartedAt).Seconds()
+	m.counts = run.Counts
+	if run.Status == report.StatusSucceeded {
+		m.lastSuccess = run.FinishedAt
+	}
+}
+
+// CountCall counts a Cognito call, as made by aws.LimitedClient
+func (r *Registry) CountCall(op string, throttled bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls[op]++
+	if throttled {
+		r.throttles[op]++
+	}
+}
+
+// keepLastSuccess sets the last success of mode and pool when this process
+// hasn't recorded one, so a failed run doesn't hide an earlier success
+func (r *Registry) keepLastSuccess(mode, pool string, at time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := runKey{mode: mode, pool: pool}
+	m, ok := r.runs[key]
+	if !ok {
+		m = &runMetrics{total: make(map[string]int)}
+		r.runs[key] = m
+	}
+	if m.lastSuccess.IsZero() {
+		m.lastSuccess = at
+	}
+}
+
+// family is a metric with its samples
+type family struct {
+	name    string
+	help    string
+	typ     string
+	samples []sample
+}
+
+type sample struct {
+	labels []string // name, value pairs
+	value  float64
+}
+
+func (f *family) add(value float64, labels ...string) {
+	f.samples = append(f.samples, sample{labels: labels, value: value})
+}
+
+// families returns the current metrics
+func (r *Registry) families() []*family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	runs := &family{name: "acbr_runs_total", help: "Runs by mode, pool and status.", typ: "counter"}
+	lastRun := &family{name: "acbr_last_run_timestamp_seconds", help: "When the last run ended.", typ: "gauge"}
+	lastSuccess := &family{name: "acbr_last_success_timestamp_seconds", help: "When the last successful run ended.", typ: "gauge"}
+	duration := &family{name: "acbr_last_run_duration_seconds", help: "How long the last run took.", typ: "gauge"}
+	resources := &family{name: "acbr_last_run_resources", help: "Resources handled by the last run, by kind and outcome.", typ: "gauge"}
+	for key, m := range r.runs {
+		for status, n := range m.total {
+			runs.add(float64(n), "mode", key.mode, "pool", key.pool, "status", status)
+		}
+		if !m.lastRun.IsZero() {
+			lastRun.add(seconds(m.lastRun), "mode", key.mode, "pool", key.pool)
+			duration.add(m.duration, "mode", key.mode, "pool", key.pool)
+		}
+		if !m.lastSuccess.IsZero() {
+			lastSuccess.add(seconds(m.lastSuccess), "mode", key.mode, "pool", key.pool)
+		}
+		for kind, c := range m.counts {
+			for _, outcome := range []struct {
+				name  string
+				count int
+			}{
+				{"backed_up", c.BackedUp}, {"created", c.Created}, {"updated", c.Updated},
+				{"deleted", c.Deleted}, {"skipped", c.Skipped}, {"failed", c.Failed},
+			} {
+				if outcome.count > 0 {
+					resources.add(float64(outcome.count), "mode", key.mode, "pool", key.pool, "kind", kind, "outcome", outcome.name)
+				}
+			}
+		}
+	}
+
+	calls := &family{name: "acbr_api_calls_total", help: "Cognito calls made, including retries, by operation.", typ: "counter"}
+	for op, n := range r.calls {
+		calls.add(float64(n), "operation", op)
+	}
+	throttles := &family{name: "acbr_api_throttles_total", help: "Cognito calls throttled, by operation.", typ: "counter"}
+	for op, n := range r.throttles {
+		throttles.add(float64(n), "operation", op)
+	}
+	written := &family{name: "acbr_storage_written_bytes_total", help: "Bytes written to local or S3 storage.", typ: "counter"}
+	written.add(float64(storage.BytesWritten()))
+
+	return []*family{runs, lastRun, lastSuccess, duration, resources, calls, throttles, written}
+}
+
+func seconds(t time.Time) float64 {
+	return float64(t.UnixNano()) / float64(time.Second)
+}
+
+// Write writes the metrics in the Prometheus text format
+func (r *Registry) Write(w io.Writer) error {
+	return r.write(w, nil)
+}
+
+// write writes the metrics whose samples have, of the label pairs in match,
+// every label they carry with its value
+func (r *Registry) write(w io.Writer, match []string) error {
+	var buf bytes.Buffer
+	for _, f := range r.families() {
+		lines := make([]string, 0, len(f.samples))
+		for _, s := range f.samples {
+			if !s.matches(match) {
+				continue
+			}
+			lines = append(lines, f.name+formatLabels(s.labels)+" "+strconv.FormatFloat(s.value, 'f', -1, 64))
+		}
+		if len(lines) == 0 {
+			continue
+		}
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.typ)
+		sort.Strings(lines)
+		for _, line := range lines {
+			buf.WriteString(line + "\n")
+		}
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// matches reports whether the sample has no label of the pairs in match with
+// another value
+func (s sample) matches(match []string) bool {
+	for i := 0; i+1 < len(match); i += 2 {
+		for j := 0; j+1 < len(s.labels); j += 2 {
+			if s.labels[j] == match[i] && s.labels[j+1] != match[i+1] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", labels[i], labelEscaper.Replace(labels[i+1])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// ServeHTTP serves the metrics to a Prometheus scrape
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_ = r.Write(w)
+}
+
+// Push sends the metrics to the Pushgateway at gateway, grouped by job and
+// the given label pairs. Only the run metrics of the group's mode and pool are
+// sent, as the Pushgateway would relabel those of other runs of this process
+// with the group's labels. Metrics that are pushed replace those with the same
+// name in the group and others are kept, so a failed run leaves the last
+// success in place.
+func (r *Registry) Push(ctx context.Context, gateway, job string, grouping ...string) error {
+	path := "/metrics/job/" + url.PathEscape(job)
+	for i := 0; i+1 < len(grouping); i += 2 {
+		if grouping[i+1] != "" {
+			path += "/" + url.PathEscape(grouping[i]) + "/" + url.PathEscape(grouping[i+1])
+		}
+	}
+
+	var body bytes.Buffer
+	if err := r.write(&body, grouping); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(gateway, "/")+path, &body)
+	if err != nil {
+		return fmt.Errorf("failed to create push request: %w", err)
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to push metrics: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("failed to push metrics: %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+var lastSuccessLine = regexp.MustCompile(`^acbr_last_success_timestamp_seconds\{mode="([^"]*)",pool="([^"]*)"\} (\S+)$`)
+
+// WriteFile writes the metrics to path for the node exporter's textfile
+// collector. The last successes in an earlier file are kept, and the file is
+// replaced at once so the collector never reads it half written.
+func (r *Registry) WriteFile(path string) error {
+	if previous, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(previous)
+		for scanner.Scan() {
+			match := lastSuccessLine.FindStringSubmatch(scanner.Text())
+			if match == nil {
+				continue
+			}
+			if at, err := strconv.ParseFloat(match[3], 64); err == nil {
+				r.keepLastSuccess(match[1], match[2], time.Unix(0, int64(at*float64(time.Second))))
+			}
+		}
+		previous.Close()
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to create metrics file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if err := r.Write(tmp); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write metrics file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write metrics file: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("failed to write metrics file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write metrics file: %w", err)
+	}
+	return nil
+}
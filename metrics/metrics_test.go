@@ -0,0 +1,178 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"acbr/config"
+	"acbr/report"
+)
+
+func TestWrite(t *testing.T) {
+	started := time.Unix(1704067200, 0)
+	r := NewRegistry()
+	r.Record(Run{
+		Mode: "backup", PoolID: "pool-1", StartedAt: started, FinishedAt: started.Add(90 * time.Second),
+		Status: report.StatusSucceeded,
+		Counts: map[string]report.Counts{"user": {BackedUp: 120}, "client": {BackedUp: 3}},
+	})
+	r.Record(Run{Mode: "backup", PoolID: "pool-1", StartedAt: started.Add(time.Hour), FinishedAt: started.Add(time.Hour + time.Minute), Status: report.StatusFailed})
+	r.CountCall("ListUsers", false)
+	r.CountCall("ListUsers", true)
+
+	var out strings.Builder
+	if err := r.Write(&out); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		"# TYPE acbr_runs_total counter\n",
+		`acbr_runs_total{mode="backup",pool="pool-1",status="failed"} 1`,
+		`acbr_runs_total{mode="backup",pool="pool-1",status="succeeded"} 1`,
+		`acbr_last_success_timestamp_seconds{mode="backup",pool="pool-1"} 1704067290`,
+		`acbr_last_run_timestamp_seconds{mode="backup",pool="pool-1"} 1704070860`,
+		`acbr_last_run_duration_seconds{mode="backup",pool="pool-1"} 60`,
+		`acbr_api_calls_total{operation="ListUsers"} 2`,
+		`acbr_api_throttles_total{operation="ListUsers"} 1`,
+		"acbr_storage_written_bytes_total ",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Write() is missing %q in\n%s", want, out.String())
+		}
+	}
+	// The counts are those of the last run, which had none
+	if strings.Contains(out.String(), "acbr_last_run_resources") {
+		t.Errorf("Write() kept the counts of an earlier run:\n%s", out.String())
+	}
+}
+
+func TestRunOf(t *testing.T) {
+	rep := report.New(&config.Config{Mode: "sync", SourcePoolID: "source", TargetPoolID: "target"})
+	rep.BackedUp("user", 2)
+	rep.Finish(nil)
+
+	run := RunOf(rep)
+	if run.PoolID != "target" || run.Status != report.StatusSucceeded || run.Counts["user"].BackedUp != 2 {
+		t.Errorf("RunOf() = %+v", run)
+	}
+}
+
+func TestPush(t *testing.T) {
+	var method, path, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		method, path = req.Method, req.URL.Path
+		data, _ := io.ReadAll(req.Body)
+		body = string(data)
+	}))
+	defer server.Close()
+
+	r := NewRegistry()
+	r.CountCall("AdminCreateUser", false)
+	if err := r.Push(context.Background(), server.URL+"/", "acbr", "mode", "restore", "pool", "pool-1"); err != nil {
+		t.Fatalf("Push() error = %v", err)
+	}
+	if method != http.MethodPost || path != "/metrics/job/acbr/mode/restore/pool/pool-1" {
+		t.Errorf("Push() sent %s %s", method, path)
+	}
+	if !strings.Contains(body, `acbr_api_calls_total{operation="AdminCreateUser"} 1`) {
+		t.Errorf("Push() body = %s", body)
+	}
+}
+
+func TestPushOnlyGroupRuns(t *testing.T) {
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		data, _ := io.ReadAll(req.Body)
+		body = string(data)
+	}))
+	defer server.Close()
+
+	started := time.Unix(1704067200, 0)
+	r := NewRegistry()
+	r.Record(Run{Mode: "backup", PoolID: "pool-1", StartedAt: started, FinishedAt: started, Status: report.StatusSucceeded,
+		Counts: map[string]report.Counts{"user": {BackedUp: 2}}})
+	r.Record(Run{Mode: "backup", PoolID: "pool-2", StartedAt: started, FinishedAt: started, Status: report.StatusFailed,
+		Counts: map[string]report.Counts{"user": {BackedUp: 5}}})
+	r.Record(Run{Mode: "restore", PoolID: "pool-2", StartedAt: started, FinishedAt: started, Status: report.StatusSucceeded})
+	r.CountCall("ListUsers", false)
+
+	if err := r.Push(context.Background(), server.URL, "acbr", "mode", "backup", "pool", "pool-2"); err != nil {
+		t.Fatalf("Push() error = %v", err)
+	}
+	for _, want := range []string{
+		`acbr_runs_total{mode="backup",pool="pool-2",status="failed"} 1`,
+		`acbr_last_run_resources{mode="backup",pool="pool-2",kind="user",outcome="backed_up"} 5`,
+		`acbr_api_calls_total{operation="ListUsers"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Push() body =\n%s\nwant %q", body, want)
+		}
+	}
+	for _, unwanted := range []string{`pool="pool-1"`, `mode="restore"`, "acbr_last_success_timestamp_seconds"} {
+		if strings.Contains(body, unwanted) {
+			t.Errorf("Push() body =\n%s\nwant no %s", body, unwanted)
+		}
+	}
+}
+
+func TestPushError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "inconsistent labels", http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	err := NewRegistry().Push(context.Background(), server.URL, "acbr")
+	if err == nil || !strings.Contains(err.Error(), "inconsistent labels") {
+		t.Errorf("Push() error = %v, want the gateway's message", err)
+	}
+}
+
+func TestWriteFileKeepsLastSuccess(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acbr.prom")
+	started := time.Unix(1704067200, 0)
+
+	succeeded := NewRegistry()
+	succeeded.Record(Run{Mode: "backup", PoolID: "pool-1", StartedAt: started, FinishedAt: started, Status: report.StatusSucceeded})
+	if err := succeeded.WriteFile(path); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	// A later process whose run failed still reports the earlier success
+	failed := NewRegistry()
+	failed.Record(Run{Mode: "backup", PoolID: "pool-1", StartedAt: started.Add(time.Hour), FinishedAt: started.Add(time.Hour), Status: report.StatusFailed})
+	if err := failed.WriteFile(path); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`acbr_last_success_timestamp_seconds{mode="backup",pool="pool-1"} 1704067200`,
+		`acbr_runs_total{mode="backup",pool="pool-1",status="failed"} 1`,
+	} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("WriteFile() wrote\n%s\nwant %q", data, want)
+		}
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	r := NewRegistry()
+	r.CountCall("DescribeUserPool", false)
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain") ||
+		!strings.Contains(rec.Body.String(), `acbr_api_calls_total{operation="DescribeUserPool"} 1`) {
+		t.Errorf("ServeHTTP() = %s %q", rec.Header().Get("Content-Type"), rec.Body.String())
+	}
+}
@@ -0,0 +1,556 @@
+package replicate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+
+	"acbr/aws"
+	"acbr/backup"
+	"acbr/config"
+	"acbr/logging"
+	"acbr/report"
+	"acbr/restore"
+
+	awssdk "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider"
+	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider/types"
+)
+
+// Change is a single modification made to the target pool
+type Change struct {
+	Action string // create, update, delete, enable, disable, add or remove
+	Kind   string // pool, resource-server, client, idp, group, user or membership
+	Name   string
+}
+
+func (c Change) String() string {
+	return fmt.Sprintf("%s %s %s", c.Action, c.Kind, c.Name)
+}
+
+// Replicator reconciles a target pool to match a source pool, typically a warm
+// standby in another region
+type Replicator struct {
+	source aws.CognitoClient
+	target aws.CognitoClient
+	config *config.Config
+	// report accumulates the changes and failures of every sync
+	report *report.Report
+	// onSync is told about every sync of a loop
+	onSync func(startedAt time.Time, changes []Change, err error)
+}
+
+func NewReplicator(source, target aws.CognitoClient, config *config.Config) *Replicator {
+	return &Replicator{
+		source: source,
+		target: target,
+		config: config,
+		report: report.New(config),
+	}
+}
+
+// Report returns the report of the syncs run so far
+func (r *Replicator) Report() *report.Report {
+	return r.report
+}
+
+// OnSync makes Execute call fn after each sync when it syncs in a loop
+func (r *Replicator) OnSync(fn func(startedAt time.Time, changes []Change, err error)) {
+	r.onSync = fn
+}
+
+// log returns the logger of the run, with its run ID and target pool ID
+func (r *Replicator) log() *slog.Logger {
+	return slog.With(logging.RunID, r.report.RunID, logging.PoolID, r.config.TargetPoolID, "source_pool_id", r.config.SourcePoolID)
+}
+
+// logChanges logs every change, then how the sync ended
+func (r *Replicator) logChanges(changes []Change, err error) {
+	for _, change := range changes {
+		r.log().Info("synced", "action", change.Action, logging.Resource, change.Kind, logging.Name, logging.ResourceName(change.Kind, change.Name))
+	}
+	if err != nil {
+		r.log().Warn("sync stopped", "changes", len(changes), logging.Error, err)
+		return
+	}
+	r.log().Info("sync finished", "changes", len(changes))
+}
+
+// Execute syncs once, or every config.Interval when set. Failed runs in a loop
+// are reported and retried on the next tick; the loop ends when ctx is canceled.
+func (r *Replicator) Execute(ctx context.Context) error {
+	if r.config.Interval <= 0 {
+		_, err := r.Sync(ctx)
+		return err
+	}
+
+	ticker := time.NewTicker(r.config.Interval)
+	defer ticker.Stop()
+	for {
+		startedAt := time.Now()
+		changes, err := r.Sync(ctx)
+		if r.onSync != nil {
+			r.onSync(startedAt, changes, err)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			r.log().Error("sync failed, retrying on the next tick", logging.Error, err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sync reconciles the target pool once and returns the changes it made
+func (r *Replicator) Sync(ctx context.Context) ([]Change, error) {
+	readCtx, read := r.report.Phase(ctx, "read")
+	source, err := r.collect(readCtx, r.source, r.config.SourcePoolID)
+	if err != nil {
+		read()
+		r.report.Failed("pool", r.config.SourcePoolID, err)
+		return nil, fmt.Errorf("failed to read source pool: %w", err)
+	}
+	target, err := r.collect(readCtx, r.target, r.config.TargetPoolID)
+	read()
+	if err != nil {
+		r.report.Failed("pool", r.config.TargetPoolID, err)
+		return nil, fmt.Errorf("failed to read target pool: %w", err)
+	}
+
+	ctx, synced := r.report.Phase(ctx, "sync")
+	defer synced()
+	s := &syncRun{Replicator: r, from: source, to: target}
+	steps := []func(context.Context) error{s.syncPool, s.syncResourceServers, s.syncClients, s.syncIdentityProviders, s.syncGroups, s.syncUsers, s.syncMemberships}
+	for _, step := range steps {
+		if err := step(ctx); err != nil {
+			r.report.Failed("pool", r.config.TargetPoolID, err)
+			// Report what was changed before the failure or cancellation
+			r.logChanges(s.changes, err)
+			return s.changes, err
+		}
+	}
+
+	r.logChanges(s.changes, nil)
+	return s.changes, nil
+}
+
+func (r *Replicator) collect(ctx context.Context, client aws.CognitoClient, poolID string) (*backup.CognitoBackup, error) {
+	cfg := *r.config
+	cfg.PoolID = poolID
+	return backup.NewBackup(client, &cfg).Collect(ctx)
+}
+
+// syncRun holds the state of one reconciliation
+type syncRun struct {
+	*Replicator
+	// from and to are the source and target pool states
+	from    *backup.CognitoBackup
+	to      *backup.CognitoBackup
+	changes []Change
+	// skipped users were not created in the target
+	skipped map[string]bool
+}
+
+func (s *syncRun) record(action, kind, name string) {
+	s.changes = append(s.changes, Change{Action: action, Kind: kind, Name: name})
+	switch action {
+	case "create", "add":
+		s.report.Created(kind)
+	case "delete", "remove":
+		s.report.Deleted(kind)
+	default:
+		s.report.Updated(kind)
+	}
+}
+
+// syncPool copies the pool settings. Lambda triggers are region specific and
+// stay as configured on the target.
+func (s *syncRun) syncPool(ctx context.Context) error {
+	if s.from.UserPoolConfig == nil || s.to.UserPoolConfig == nil {
+		return nil
+	}
+	want, have := s.from.UserPoolConfig.UserPool, s.to.UserPoolConfig.UserPool
+	if want == nil || have == nil {
+		return nil
+	}
+
+	if equalJSON(poolSettings(want, nil), poolSettings(have, nil)) {
+		return nil
+	}
+
+	input := poolSettings(want, have.LambdaConfig)
+	input.UserPoolId = &s.config.TargetPoolID
+	if _, err := s.target.UpdateUserPool(ctx, input); err != nil {
+		return fmt.Errorf("failed to update user pool: %w", err)
+	}
+	s.record("update", "pool", s.config.TargetPoolID)
+	return nil
+}
+
+// poolSettings are the replicated pool settings, as restore applies them
+func poolSettings(pool *types.UserPoolType, triggers *types.LambdaConfigType) *cognitoidentityprovider.UpdateUserPoolInput {
+	return &cognitoidentityprovider.UpdateUserPoolInput{
+		Policies:               pool.Policies,
+		AutoVerifiedAttributes: pool.AutoVerifiedAttributes,
+		MfaConfiguration:       pool.MfaConfiguration,
+		EmailConfiguration:     pool.EmailConfiguration,
+		SmsConfiguration:       pool.SmsConfiguration,
+		LambdaConfig:           triggers,
+	}
+}
+
+func (s *syncRun) syncResourceServers(ctx context.Context) error {
+	existing := make(map[string]types.ResourceServerType)
+	for _, server := range s.to.ResourceServers {
+		existing[*server.Identifier] = server
+	}
+
+	for _, server := range s.from.ResourceServers {
+		current, ok := existing[*server.Identifier]
+		switch {
+		case !ok:
+			_, err := s.target.CreateResourceServer(ctx, &cognitoidentityprovider.CreateResourceServerInput{
+				UserPoolId: &s.config.TargetPoolID,
+				Identifier: server.Identifier,
+				Name:       server.Name,
+				Scopes:     server.Scopes,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to create resource server %s: %w", *server.Identifier, err)
+			}
+			s.record("create", "resource-server", *server.Identifier)
+		case awssdk.ToString(current.Name) != awssdk.ToString(server.Name) || !equalJSON(current.Scopes, server.Scopes):
+			_, err := s.target.UpdateResourceServer(ctx, &cognitoidentityprovider.UpdateResourceServerInput{
+				UserPoolId: &s.config.TargetPoolID,
+				Identifier: server.Identifier,
+				Name:       server.Name,
+				Scopes:     server.Scopes,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to update resource server %s: %w", *server.Identifier, err)
+			}
+			s.record("update", "resource-server", *server.Identifier)
+		}
+	}
+	return nil
+}
+
+// syncClients creates missing app clients. Client IDs differ between pools,
+// so clients are matched by name.
+func (s *syncRun) syncClients(ctx context.Context) error {
+	existing := make(map[string]bool)
+	for _, client := range s.to.Clients {
+		existing[awssdk.ToString(client.ClientName)] = true
+	}
+
+	for _, client := range s.from.Clients {
+		if existing[awssdk.ToString(client.ClientName)] {
+			continue
+		}
+		_, err := s.target.CreateUserPoolClient(ctx, &cognitoidentityprovider.CreateUserPoolClientInput{
+			UserPoolId: &s.config.TargetPoolID,
+			ClientName: client.ClientName,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create client %s: %w", *client.ClientName, err)
+		}
+		s.record("create", "client", *client.ClientName)
+	}
+	return nil
+}
+
+func (s *syncRun) syncIdentityProviders(ctx context.Context) error {
+	existing := make(map[string]bool)
+	for _, provider := range s.to.IdentityProviders {
+		existing[awssdk.ToString(provider.ProviderName)] = true
+	}
+
+	for _, provider := range s.from.IdentityProviders {
+		if existing[awssdk.ToString(provider.ProviderName)] {
+			continue
+		}
+		_, err := s.target.CreateIdentityProvider(ctx, &cognitoidentityprovider.CreateIdentityProviderInput{
+			UserPoolId:   &s.config.TargetPoolID,
+			ProviderName: provider.ProviderName,
+			ProviderType: provider.ProviderType,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create identity provider %s: %w", *provider.ProviderName, err)
+		}
+		s.record("create", "idp", *provider.ProviderName)
+	}
+	return nil
+}
+
+func (s *syncRun) syncGroups(ctx context.Context) error {
+	existing := make(map[string]types.GroupType)
+	for _, group := range s.to.Groups {
+		existing[*group.GroupName] = group
+	}
+
+	wanted := make(map[string]bool)
+	for _, group := range s.from.Groups {
+		wanted[*group.GroupName] = true
+		current, ok := existing[*group.GroupName]
+		switch {
+		case !ok:
+			_, err := s.target.CreateGroup(ctx, &cognitoidentityprovider.CreateGroupInput{
+				UserPoolId:  &s.config.TargetPoolID,
+				GroupName:   group.GroupName,
+				Description: group.Description,
+				Precedence:  group.Precedence,
+				RoleArn:     group.RoleArn,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to create group %s: %w", *group.GroupName, err)
+			}
+			s.record("create", "group", *group.GroupName)
+		case awssdk.ToString(current.Description) != awssdk.ToString(group.Description) ||
+			awssdk.ToInt32(current.Precedence) != awssdk.ToInt32(group.Precedence) ||
+			awssdk.ToString(current.RoleArn) != awssdk.ToString(group.RoleArn):
+			_, err := s.target.UpdateGroup(ctx, &cognitoidentityprovider.UpdateGroupInput{
+				UserPoolId:  &s.config.TargetPoolID,
+				GroupName:   group.GroupName,
+				Description: group.Description,
+				Precedence:  group.Precedence,
+				RoleArn:     group.RoleArn,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to update group %s: %w", *group.GroupName, err)
+			}
+			s.record("update", "group", *group.GroupName)
+		}
+	}
+
+	if !s.config.SyncDelete {
+		return nil
+	}
+	for _, name := range sortedKeys(existing) {
+		if wanted[name] {
+			continue
+		}
+		_, err := s.target.DeleteGroup(ctx, &cognitoidentityprovider.DeleteGroupInput{
+			UserPoolId: &s.config.TargetPoolID,
+			GroupName:  awssdk.String(name),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to delete group %s: %w", name, err)
+		}
+		s.record("delete", "group", name)
+	}
+	return nil
+}
+
+func (s *syncRun) syncUsers(ctx context.Context) error {
+	existing := make(map[string]types.UserType)
+	for _, user := range s.to.Users {
+		existing[*user.Username] = user
+	}
+
+	cfg := *s.config
+	cfg.PoolID = s.config.TargetPoolID
+	creator := restore.NewRestore(s.target, &cfg)
+
+	s.skipped = make(map[string]bool)
+	wanted := make(map[string]bool)
+	for _, user := range s.from.Users {
+		wanted[*user.Username] = true
+		current, ok := existing[*user.Username]
+		if !ok {
+			created, err := creator.CreateUser(ctx, &user)
+			if err != nil {
+				return fmt.Errorf("failed to create user %s: %w", logging.User(*user.Username), err)
+			}
+			if created == nil {
+				s.skipped[*user.Username] = true
+				s.report.Skipped("user")
+				continue
+			}
+			s.record("create", "user", *user.Username)
+			continue
+		}
+
+		if err := s.updateUser(ctx, current, user); err != nil {
+			return fmt.Errorf("failed to update user %s: %w", logging.User(*user.Username), err)
+		}
+	}
+
+	if !s.config.SyncDelete {
+		return nil
+	}
+	for _, username := range sortedKeys(existing) {
+		if wanted[username] {
+			continue
+		}
+		_, err := s.target.AdminDeleteUser(ctx, &cognitoidentityprovider.AdminDeleteUserInput{
+			UserPoolId: &s.config.TargetPoolID,
+			Username:   awssdk.String(username),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to delete user %s: %w", logging.User(username), err)
+		}
+		s.record("delete", "user", username)
+	}
+	return nil
+}
+
+// updateUser brings the target user's attributes and enabled state in line
+// with the source user
+func (s *syncRun) updateUser(ctx context.Context, current, user types.UserType) error {
+	have := mutableAttributes(current)
+	want := mutableAttributes(user)
+
+	var updates []types.AttributeType
+	for _, name := range sortedKeys(want) {
+		if value, ok := have[name]; !ok || value != want[name] {
+			updates = append(updates, types.AttributeType{Name: awssdk.String(name), Value: awssdk.String(want[name])})
+		}
+	}
+	var removed []string
+	for _, name := range sortedKeys(have) {
+		if _, ok := want[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+
+	if len(updates) > 0 {
+		_, err := s.target.AdminUpdateUserAttributes(ctx, &cognitoidentityprovider.AdminUpdateUserAttributesInput{
+			UserPoolId:     &s.config.TargetPoolID,
+			Username:       user.Username,
+			UserAttributes: updates,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if len(removed) > 0 {
+		_, err := s.target.AdminDeleteUserAttributes(ctx, &cognitoidentityprovider.AdminDeleteUserAttributesInput{
+			UserPoolId:         &s.config.TargetPoolID,
+			Username:           user.Username,
+			UserAttributeNames: removed,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if len(updates) > 0 || len(removed) > 0 {
+		s.record("update", "user", *user.Username)
+	}
+
+	switch {
+	case user.Enabled && !current.Enabled:
+		_, err := s.target.AdminEnableUser(ctx, &cognitoidentityprovider.AdminEnableUserInput{
+			UserPoolId: &s.config.TargetPoolID,
+			Username:   user.Username,
+		})
+		if err != nil {
+			return err
+		}
+		s.record("enable", "user", *user.Username)
+	case !user.Enabled && current.Enabled:
+		_, err := s.target.AdminDisableUser(ctx, &cognitoidentityprovider.AdminDisableUserInput{
+			UserPoolId: &s.config.TargetPoolID,
+			Username:   user.Username,
+		})
+		if err != nil {
+			return err
+		}
+		s.record("disable", "user", *user.Username)
+	}
+	return nil
+}
+
+// syncMemberships adds the source's group members to the target and, with
+// SyncDelete, removes the members the source doesn't have
+func (s *syncRun) syncMemberships(ctx context.Context) error {
+	have := membershipSet(s.to.GroupMemberships)
+	want := membershipSet(s.from.GroupMemberships)
+
+	for _, key := range sortedKeys(want) {
+		m := want[key]
+		if have[key] != (membership{}) || s.skipped[m.username] {
+			continue
+		}
+		_, err := s.target.AdminAddUserToGroup(ctx, &cognitoidentityprovider.AdminAddUserToGroupInput{
+			UserPoolId: &s.config.TargetPoolID,
+			Username:   awssdk.String(m.username),
+			GroupName:  awssdk.String(m.group),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to add user %s to group %s: %w", logging.User(m.username), m.group, err)
+		}
+		s.record("add", "membership", key)
+	}
+
+	if !s.config.SyncDelete {
+		return nil
+	}
+	for _, key := range sortedKeys(have) {
+		m := have[key]
+		if want[key] != (membership{}) {
+			continue
+		}
+		_, err := s.target.AdminRemoveUserFromGroup(ctx, &cognitoidentityprovider.AdminRemoveUserFromGroupInput{
+			UserPoolId: &s.config.TargetPoolID,
+			Username:   awssdk.String(m.username),
+			GroupName:  awssdk.String(m.group),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to remove user %s from group %s: %w", logging.User(m.username), m.group, err)
+		}
+		s.record("remove", "membership", key)
+	}
+	return nil
+}
+
+type membership struct {
+	group    string
+	username string
+}
+
+func membershipSet(memberships map[string][]string) map[string]membership {
+	set := make(map[string]membership)
+	for group, usernames := range memberships {
+		for _, username := range usernames {
+			set[group+"/"+username] = membership{group: group, username: username}
+		}
+	}
+	return set
+}
+
+// mutableAttributes are the attributes sync can write; sub and identities are
+// managed by Cognito
+func mutableAttributes(user types.UserType) map[string]string {
+	attrs := make(map[string]string, len(user.Attributes))
+	for _, attr := range user.Attributes {
+		name := awssdk.ToString(attr.Name)
+		if name == "sub" || name == "identities" {
+			continue
+		}
+		attrs[name] = awssdk.ToString(attr.Value)
+	}
+	return attrs
+}
+
+func equalJSON(a, b any) bool {
+	left, _ := json.Marshal(a)
+	right, _ := json.Marshal(b)
+	return string(left) == string(right)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
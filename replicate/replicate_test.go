@@ -0,0 +1,327 @@
+package replicate
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"acbr/config"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider"
+	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider/types"
+)
+
+// mockCognitoClient serves a pool state and records the changes made to it
+type mockCognitoClient struct {
+	users       []types.UserType
+	groups      []types.GroupType
+	memberships map[string][]string
+
+	calls []string
+}
+
+func (m *mockCognitoClient) record(call string, args ...string) {
+	for _, arg := range args {
+		call += " " + arg
+	}
+	m.calls = append(m.calls, call)
+}
+
+func (m *mockCognitoClient) DescribeUserPool(ctx context.Context, params *cognitoidentityprovider.DescribeUserPoolInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.DescribeUserPoolOutput, error) {
+	return &cognitoidentityprovider.DescribeUserPoolOutput{UserPool: &types.UserPoolType{}}, nil
+}
+
+func (m *mockCognitoClient) ListUserPools(ctx context.Context, params *cognitoidentityprovider.ListUserPoolsInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.ListUserPoolsOutput, error) {
+	return &cognitoidentityprovider.ListUserPoolsOutput{}, nil
+}
+
+func (m *mockCognitoClient) ListUsers(ctx context.Context, params *cognitoidentityprovider.ListUsersInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.ListUsersOutput, error) {
+	return &cognitoidentityprovider.ListUsersOutput{Users: m.users}, nil
+}
+
+func (m *mockCognitoClient) ListGroups(ctx context.Context, params *cognitoidentityprovider.ListGroupsInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.ListGroupsOutput, error) {
+	return &cognitoidentityprovider.ListGroupsOutput{Groups: m.groups}, nil
+}
+
+func (m *mockCognitoClient) ListUsersInGroup(ctx context.Context, params *cognitoidentityprovider.ListUsersInGroupInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.ListUsersInGroupOutput, error) {
+	var users []types.UserType
+	for _, username := range m.memberships[*params.GroupName] {
+		users = append(users, types.UserType{Username: aws.String(username)})
+	}
+	return &cognitoidentityprovider.ListUsersInGroupOutput{Users: users}, nil
+}
+
+func (m *mockCognitoClient) CreateGroup(ctx context.Context, params *cognitoidentityprovider.CreateGroupInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.CreateGroupOutput, error) {
+	m.record("CreateGroup", *params.GroupName)
+	return &cognitoidentityprovider.CreateGroupOutput{}, nil
+}
+
+func (m *mockCognitoClient) UpdateGroup(ctx context.Context, params *cognitoidentityprovider.UpdateGroupInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.UpdateGroupOutput, error) {
+	m.record("UpdateGroup", *params.GroupName)
+	return &cognitoidentityprovider.UpdateGroupOutput{}, nil
+}
+
+func (m *mockCognitoClient) DeleteGroup(ctx context.Context, params *cognitoidentityprovider.DeleteGroupInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.DeleteGroupOutput, error) {
+	m.record("DeleteGroup", *params.GroupName)
+	return &cognitoidentityprovider.DeleteGroupOutput{}, nil
+}
+
+func (m *mockCognitoClient) AdminCreateUser(ctx context.Context, params *cognitoidentityprovider.AdminCreateUserInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.AdminCreateUserOutput, error) {
+	m.record("AdminCreateUser", *params.Username)
+	return &cognitoidentityprovider.AdminCreateUserOutput{User: &types.UserType{Username: params.Username}}, nil
+}
+
+func (m *mockCognitoClient) AdminUpdateUserAttributes(ctx context.Context, params *cognitoidentityprovider.AdminUpdateUserAttributesInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.AdminUpdateUserAttributesOutput, error) {
+	args := []string{*params.Username}
+	for _, attr := range params.UserAttributes {
+		args = append(args, *attr.Name+"="+*attr.Value)
+	}
+	m.record("AdminUpdateUserAttributes", args...)
+	return &cognitoidentityprovider.AdminUpdateUserAttributesOutput{}, nil
+}
+
+func (m *mockCognitoClient) AdminDeleteUserAttributes(ctx context.Context, params *cognitoidentityprovider.AdminDeleteUserAttributesInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.AdminDeleteUserAttributesOutput, error) {
+	m.record("AdminDeleteUserAttributes", append([]string{*params.Username}, params.UserAttributeNames...)...)
+	return &cognitoidentityprovider.AdminDeleteUserAttributesOutput{}, nil
+}
+
+func (m *mockCognitoClient) AdminEnableUser(ctx context.Context, params *cognitoidentityprovider.AdminEnableUserInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.AdminEnableUserOutput, error) {
+	m.record("AdminEnableUser", *params.Username)
+	return &cognitoidentityprovider.AdminEnableUserOutput{}, nil
+}
+
+func (m *mockCognitoClient) AdminDisableUser(ctx context.Context, params *cognitoidentityprovider.AdminDisableUserInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.AdminDisableUserOutput, error) {
+	m.record("AdminDisableUser", *params.Username)
+	return &cognitoidentityprovider.AdminDisableUserOutput{}, nil
+}
+
+func (m *mockCognitoClient) AdminDeleteUser(ctx context.Context, params *cognitoidentityprovider.AdminDeleteUserInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.AdminDeleteUserOutput, error) {
+	m.record("AdminDeleteUser", *params.Username)
+	return &cognitoidentityprovider.AdminDeleteUserOutput{}, nil
+}
+
+func (m *mockCognitoClient) AdminAddUserToGroup(ctx context.Context, params *cognitoidentityprovider.AdminAddUserToGroupInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.AdminAddUserToGroupOutput, error) {
+	m.record("AdminAddUserToGroup", *params.GroupName, *params.Username)
+	return &cognitoidentityprovider.AdminAddUserToGroupOutput{}, nil
+}
+
+func (m *mockCognitoClient) AdminRemoveUserFromGroup(ctx context.Context, params *cognitoidentityprovider.AdminRemoveUserFromGroupInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.AdminRemoveUserFromGroupOutput, error) {
+	m.record("AdminRemoveUserFromGroup", *params.GroupName, *params.Username)
+	return &cognitoidentityprovider.AdminRemoveUserFromGroupOutput{}, nil
+}
+
+func (m *mockCognitoClient) ListResourceServers(ctx context.Context, params *cognitoidentityprovider.ListResourceServersInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.ListResourceServersOutput, error) {
+	return &cognitoidentityprovider.ListResourceServersOutput{}, nil
+}
+
+func (m *mockCognitoClient) ListUserPoolClients(ctx context.Context, params *cognitoidentityprovider.ListUserPoolClientsInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.ListUserPoolClientsOutput, error) {
+	return &cognitoidentityprovider.ListUserPoolClientsOutput{}, nil
+}
+
+func (m *mockCognitoClient) ListIdentityProviders(ctx context.Context, params *cognitoidentityprovider.ListIdentityProvidersInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.ListIdentityProvidersOutput, error) {
+	return &cognitoidentityprovider.ListIdentityProvidersOutput{}, nil
+}
+
+func (m *mockCognitoClient) CreateUserPool(ctx context.Context, params *cognitoidentityprovider.CreateUserPoolInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.CreateUserPoolOutput, error) {
+	return &cognitoidentityprovider.CreateUserPoolOutput{}, nil
+}
+
+func (m *mockCognitoClient) UpdateUserPool(ctx context.Context, params *cognitoidentityprovider.UpdateUserPoolInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.UpdateUserPoolOutput, error) {
+	return &cognitoidentityprovider.UpdateUserPoolOutput{}, nil
+}
+
+func (m *mockCognitoClient) CreateResourceServer(ctx context.Context, params *cognitoidentityprovider.CreateResourceServerInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.CreateResourceServerOutput, error) {
+	return &cognitoidentityprovider.CreateResourceServerOutput{}, nil
+}
+
+func (m *mockCognitoClient) CreateUserPoolClient(ctx context.Context, params *cognitoidentityprovider.CreateUserPoolClientInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.CreateUserPoolClientOutput, error) {
+	return &cognitoidentityprovider.CreateUserPoolClientOutput{}, nil
+}
+
+func (m *mockCognitoClient) CreateIdentityProvider(ctx context.Context, params *cognitoidentityprovider.CreateIdentityProviderInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.CreateIdentityProviderOutput, error) {
+	return &cognitoidentityprovider.CreateIdentityProviderOutput{}, nil
+}
+
+func (m *mockCognitoClient) GetCSVHeader(ctx context.Context, params *cognitoidentityprovider.GetCSVHeaderInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.GetCSVHeaderOutput, error) {
+	return &cognitoidentityprovider.GetCSVHeaderOutput{}, nil
+}
+
+func (m *mockCognitoClient) CreateUserImportJob(ctx context.Context, params *cognitoidentityprovider.CreateUserImportJobInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.CreateUserImportJobOutput, error) {
+	return &cognitoidentityprovider.CreateUserImportJobOutput{}, nil
+}
+
+func (m *mockCognitoClient) StartUserImportJob(ctx context.Context, params *cognitoidentityprovider.StartUserImportJobInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.StartUserImportJobOutput, error) {
+	return &cognitoidentityprovider.StartUserImportJobOutput{}, nil
+}
+
+func (m *mockCognitoClient) DescribeUserImportJob(ctx context.Context, params *cognitoidentityprovider.DescribeUserImportJobInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.DescribeUserImportJobOutput, error) {
+	return &cognitoidentityprovider.DescribeUserImportJobOutput{}, nil
+}
+
+func (m *mockCognitoClient) CreateUserPoolDomain(ctx context.Context, params *cognitoidentityprovider.CreateUserPoolDomainInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.CreateUserPoolDomainOutput, error) {
+	return &cognitoidentityprovider.CreateUserPoolDomainOutput{}, nil
+}
+
+func (m *mockCognitoClient) AdminGetUser(ctx context.Context, params *cognitoidentityprovider.AdminGetUserInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.AdminGetUserOutput, error) {
+	return &cognitoidentityprovider.AdminGetUserOutput{}, nil
+}
+
+func (m *mockCognitoClient) UpdateResourceServer(ctx context.Context, params *cognitoidentityprovider.UpdateResourceServerInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.UpdateResourceServerOutput, error) {
+	return &cognitoidentityprovider.UpdateResourceServerOutput{}, nil
+}
+
+func (m *mockCognitoClient) DescribeUserPoolClient(ctx context.Context, params *cognitoidentityprovider.DescribeUserPoolClientInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.DescribeUserPoolClientOutput, error) {
+	return &cognitoidentityprovider.DescribeUserPoolClientOutput{}, nil
+}
+
+func (m *mockCognitoClient) DescribeIdentityProvider(ctx context.Context, params *cognitoidentityprovider.DescribeIdentityProviderInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.DescribeIdentityProviderOutput, error) {
+	return &cognitoidentityprovider.DescribeIdentityProviderOutput{}, nil
+}
+
+func user(username string, enabled bool, attrs ...string) types.UserType {
+	u := types.UserType{Username: aws.String(username), Enabled: enabled}
+	for i := 0; i+1 < len(attrs); i += 2 {
+		u.Attributes = append(u.Attributes, types.AttributeType{Name: aws.String(attrs[i]), Value: aws.String(attrs[i+1])})
+	}
+	return u
+}
+
+func TestSync(t *testing.T) {
+	newSource := func() *mockCognitoClient {
+		return &mockCognitoClient{
+			users: []types.UserType{
+				user("alice", true, "sub", "s1", "email", "alice@new.example.com"),
+				user("bob", false, "sub", "s2"),
+				user("carol", true, "sub", "s3"),
+			},
+			groups: []types.GroupType{
+				{GroupName: aws.String("admins"), Description: aws.String("Admins")},
+				{GroupName: aws.String("staff")},
+			},
+			memberships: map[string][]string{"admins": {"alice", "carol"}},
+		}
+	}
+	newTarget := func() *mockCognitoClient {
+		return &mockCognitoClient{
+			users: []types.UserType{
+				user("alice", true, "sub", "t1", "email", "alice@example.com", "locale", "en"),
+				user("bob", true, "sub", "t2"),
+				user("dave", true, "sub", "t4"),
+			},
+			groups: []types.GroupType{
+				{GroupName: aws.String("admins")},
+				{GroupName: aws.String("old")},
+			},
+			memberships: map[string][]string{"admins": {"alice", "bob"}},
+		}
+	}
+
+	tests := []struct {
+		name   string
+		delete bool
+		want   []string
+	}{
+		{
+			name: "reconciles without deletes",
+			want: []string{
+				"UpdateGroup admins",
+				"CreateGroup staff",
+				"AdminUpdateUserAttributes alice email=alice@new.example.com",
+				"AdminDeleteUserAttributes alice locale",
+				"AdminDisableUser bob",
+				"AdminCreateUser carol",
+				"AdminAddUserToGroup admins carol",
+			},
+		},
+		{
+			name:   "deletes missing users, groups and memberships",
+			delete: true,
+			want: []string{
+				"UpdateGroup admins",
+				"CreateGroup staff",
+				"DeleteGroup old",
+				"AdminUpdateUserAttributes alice email=alice@new.example.com",
+				"AdminDeleteUserAttributes alice locale",
+				"AdminDisableUser bob",
+				"AdminCreateUser carol",
+				"AdminDeleteUser dave",
+				"AdminAddUserToGroup admins carol",
+				"AdminRemoveUserFromGroup admins bob",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source, target := newSource(), newTarget()
+			r := NewReplicator(source, target, &config.Config{
+				SourcePoolID: "source-pool",
+				TargetPoolID: "target-pool",
+				DefaultPwd:   "Temp123!",
+				SyncDelete:   tt.delete,
+			})
+
+			changes, err := r.Sync(context.Background())
+			if err != nil {
+				t.Fatalf("Sync() error = %v", err)
+			}
+			if !reflect.DeepEqual(target.calls, tt.want) {
+				t.Errorf("Sync() calls =\n%v\nwant\n%v", target.calls, tt.want)
+			}
+			if len(changes) != len(tt.want)-1 {
+				// The attribute update and removal of alice are one change
+				t.Errorf("Sync() returned %d changes, want %d", len(changes), len(tt.want)-1)
+			}
+			if len(source.calls) != 0 {
+				t.Errorf("Sync() changed the source pool: %v", source.calls)
+			}
+		})
+	}
+}
+
+func TestExecuteStopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	target := &mockCognitoClient{users: []types.UserType{user("dave", true, "sub", "t4")}}
+	r := NewReplicator(&mockCognitoClient{}, target, &config.Config{
+		SourcePoolID: "source-pool",
+		TargetPoolID: "target-pool",
+		SyncDelete:   true,
+		Interval:     time.Hour,
+	})
+	if err := r.Execute(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Execute() error = %v, want %v", err, context.Canceled)
+	}
+	if len(target.calls) != 0 {
+		t.Errorf("Execute() changed the target pool after cancel: %v", target.calls)
+	}
+}
+
+func TestExecuteOnSync(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := NewReplicator(&mockCognitoClient{}, &mockCognitoClient{}, &config.Config{
+		SourcePoolID: "source-pool",
+		TargetPoolID: "target-pool",
+		Interval:     time.Hour,
+	})
+	syncs := 0
+	r.OnSync(func(startedAt time.Time, changes []Change, err error) {
+		syncs++
+		if err != nil || startedAt.IsZero() {
+			t.Errorf("OnSync() got startedAt %v, error %v", startedAt, err)
+		}
+		cancel()
+	})
+	if err := r.Execute(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Execute() error = %v, want %v", err, context.Canceled)
+	}
+	if syncs != 1 {
+		t.Errorf("Execute() reported %d syncs, want 1", syncs)
+	}
+}
@@ -0,0 +1,352 @@
+package report
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"acbr/config"
+	"acbr/logging"
+	"acbr/storage"
+	"acbr/tracing"
+
+	"github.com/aws/smithy-go"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Run statuses
+const (
+	StatusSucceeded   = "succeeded"
+	StatusFailed      = "failed"
+	StatusInterrupted = "interrupted"
+)
+
+// Report is the machine-readable summary of a run: what it did to each kind of
+// resource, how long each phase took and every failure with its AWS error code
+type Report struct {
+	RunID        string
+	Mode         string
+	PoolID       string `json:",omitempty"`
+	SourcePoolID string `json:",omitempty"`
+	TargetPoolID string `json:",omitempty"`
+	StartedAt    time.Time
+	FinishedAt   time.Time
+	Status       string
+	Error        string `json:",omitempty"`
+	// Backup is the backup file written or restored from
+	Backup string `json:",omitempty"`
+	// FailedItems is the file of items a restore couldn't create, to retry them
+	FailedItems string `json:",omitempty"`
+	Phases      []Phase
+	// Counts are keyed by resource kind: pool, group, user, membership, ...
+	Counts   map[string]*Counts
+	Failures []Failure `json:",omitempty"`
+	// Retries counts the retried Cognito calls by operation
+	Retries map[string]int `json:",omitempty"`
+	// Pools are the reports of each pool of a multi-pool run, whose Counts
+	// and Retries are their totals
+	Pools []*Report `json:",omitempty"`
+
+	mu sync.Mutex
+}
+
+// Phase is a timed step of a run
+type Phase struct {
+	Name    string
+	Seconds float64
+}
+
+// Counts tallies the outcome for one kind of resource
+type Counts struct {
+	BackedUp int `json:",omitempty"`
+	Created  int `json:",omitempty"`
+	Updated  int `json:",omitempty"`
+	Deleted  int `json:",omitempty"`
+	Skipped  int `json:",omitempty"`
+	Failed   int `json:",omitempty"`
+}
+
+// Failure is one resource that couldn't be backed up, restored or synced
+type Failure struct {
+	Kind    string
+	Name    string
+	Code    string `json:",omitempty"`
+	Message string
+}
+
+// New starts the report of a run with the given configuration
+func New(cfg *config.Config) *Report {
+	startedAt := time.Now().UTC()
+	id := make([]byte, 4)
+	_, _ = rand.Read(id)
+
+	return &Report{
+		RunID:        fmt.Sprintf("%s-%s", startedAt.Format("20060102-150405"), hex.EncodeToString(id)),
+		Mode:         cfg.Mode,
+		PoolID:       cfg.PoolID,
+		SourcePoolID: cfg.SourcePoolID,
+		TargetPoolID: cfg.TargetPoolID,
+		StartedAt:    startedAt,
+		Counts:       make(map[string]*Counts),
+	}
+}
+
+// Phase starts timing a phase and its span, which is a child of the span in
+// ctx and the parent of the calls made with the returned context. Calling the
+// returned function ends it, recording the counts so far on the span.
+func (r *Report) Phase(ctx context.Context, name string) (context.Context, func()) {
+	start := time.Now()
+	ctx, span := tracing.Start(ctx, "phase "+name, attribute.String("acbr.phase", name), attribute.String("acbr.run_id", r.RunID))
+	return ctx, func() {
+		seconds := time.Since(start).Seconds()
+		r.mu.Lock()
+		r.Phases = append(r.Phases, Phase{Name: name, Seconds: seconds})
+		poolID := r.PoolID
+		span.SetAttributes(r.attributes()...)
+		r.mu.Unlock()
+		span.End()
+		slog.Info("phase finished", logging.RunID, r.RunID, logging.PoolID, poolID, logging.Phase, name, "seconds", seconds)
+	}
+}
+
+// attributes returns the counts and retries so far as span attributes, such
+// as acbr.user.created; the caller holds the lock
+func (r *Report) attributes() []attribute.KeyValue {
+	var attrs []attribute.KeyValue
+	for kind, c := range r.Counts {
+		for _, outcome := range []struct {
+			name  string
+			count int
+		}{
+			{"backed_up", c.BackedUp}, {"created", c.Created}, {"updated", c.Updated},
+			{"deleted", c.Deleted}, {"skipped", c.Skipped}, {"failed", c.Failed},
+		} {
+			if outcome.count > 0 {
+				attrs = append(attrs, attribute.Int("acbr."+kind+"."+outcome.name, outcome.count))
+			}
+		}
+	}
+	for op, n := range r.Retries {
+		attrs = append(attrs, attribute.Int("acbr.retries."+op, n))
+	}
+	return attrs
+}
+
+// Attributes returns the counts and retries so far as span attributes
+func (r *Report) Attributes() []attribute.KeyValue {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.attributes()
+}
+
+// counts returns the tally of kind; the caller holds the lock
+func (r *Report) counts(kind string) *Counts {
+	c, ok := r.Counts[kind]
+	if !ok {
+		c = &Counts{}
+		r.Counts[kind] = c
+	}
+	return c
+}
+
+// BackedUp records n resources of kind read into a backup
+func (r *Report) BackedUp(kind string, n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counts(kind).BackedUp += n
+}
+
+// Created records a resource of kind created in the target pool
+func (r *Report) Created(kind string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counts(kind).Created++
+}
+
+// Updated records a resource of kind changed in the target pool
+func (r *Report) Updated(kind string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counts(kind).Updated++
+}
+
+// Deleted records a resource of kind removed from the target pool
+func (r *Report) Deleted(kind string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counts(kind).Deleted++
+}
+
+// Skipped records a resource of kind left out on purpose
+func (r *Report) Skipped(kind string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counts(kind).Skipped++
+}
+
+// Failed records the failure of the named resource of kind
+func (r *Report) Failed(kind, name string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counts(kind).Failed++
+	r.Failures = append(r.Failures, Failure{Kind: kind, Name: name, Code: ErrorCode(err), Message: err.Error()})
+}
+
+// Add adds counts for kind and failures that were tallied elsewhere, such as
+// by a user import job
+func (r *Report) Add(kind string, counts Counts, failures ...Failure) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.add(kind, counts)
+	r.Failures = append(r.Failures, failures...)
+}
+
+// add adds counts to the tally of kind; the caller holds the lock
+func (r *Report) add(kind string, counts Counts) {
+	c := r.counts(kind)
+	c.BackedUp += counts.BackedUp
+	c.Created += counts.Created
+	c.Updated += counts.Updated
+	c.Deleted += counts.Deleted
+	c.Skipped += counts.Skipped
+	c.Failed += counts.Failed
+}
+
+// AddRetries adds retried call counts by operation, prefixing each operation
+func (r *Report) AddRetries(prefix string, retries map[string]int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for op, count := range retries {
+		if r.Retries == nil {
+			r.Retries = make(map[string]int)
+		}
+		r.Retries[prefix+op] += count
+	}
+}
+
+// AddPool adds the finished report of one pool of a multi-pool run, adding
+// its counts and retries to the totals
+func (r *Report) AddPool(pool *Report) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Pools = append(r.Pools, pool)
+	for kind, counts := range pool.Counts {
+		r.add(kind, *counts)
+	}
+	for op, count := range pool.Retries {
+		if r.Retries == nil {
+			r.Retries = make(map[string]int)
+		}
+		r.Retries[op] += count
+	}
+}
+
+// Finish ends the report with the outcome of the run
+func (r *Report) Finish(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.FinishedAt = time.Now().UTC()
+	r.Status = StatusOf(err)
+	if err != nil {
+		r.Error = err.Error()
+	}
+	sort.SliceStable(r.Failures, func(i, j int) bool {
+		if r.Failures[i].Kind != r.Failures[j].Kind {
+			return r.Failures[i].Kind < r.Failures[j].Kind
+		}
+		return r.Failures[i].Name < r.Failures[j].Name
+	})
+	sort.Slice(r.Pools, func(i, j int) bool { return r.Pools[i].PoolID < r.Pools[j].PoolID })
+}
+
+// Summary lists the counts by kind on one line, such as
+// "group: 2 created; user: 3 created, 1 failed"
+func (r *Report) Summary() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	kinds := make([]string, 0, len(r.Counts))
+	for kind := range r.Counts {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	var parts []string
+	for _, kind := range kinds {
+		c := r.Counts[kind]
+		var counts []string
+		for _, n := range []struct {
+			count int
+			label string
+		}{
+			{c.BackedUp, "backed up"},
+			{c.Created, "created"},
+			{c.Updated, "updated"},
+			{c.Deleted, "deleted"},
+			{c.Skipped, "skipped"},
+			{c.Failed, "failed"},
+		} {
+			if n.count > 0 {
+				counts = append(counts, fmt.Sprintf("%d %s", n.count, n.label))
+			}
+		}
+		if len(counts) > 0 {
+			parts = append(parts, kind+": "+strings.Join(counts, ", "))
+		}
+	}
+	return strings.Join(parts, "; ")
+}
+
+// StatusOf returns the status of a run that ended with err
+func StatusOf(err error) string {
+	switch {
+	case err == nil:
+		return StatusSucceeded
+	case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+		return StatusInterrupted
+	default:
+		return StatusFailed
+	}
+}
+
+// Save writes the report as JSON into the directory of backupPath, which is a
+// backup file or a backup directory, and returns the path it was stored under
+func (r *Report) Save(ctx context.Context, backupPath string) (string, error) {
+	dir := storage.BackupDir(backupPath)
+	store, err := storage.NewStorage(ctx, dir)
+	if err != nil {
+		return "", fmt.Errorf("failed to create storage: %w", err)
+	}
+
+	r.mu.Lock()
+	data, err := json.MarshalIndent(r, "", "  ")
+	r.mu.Unlock()
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal report: %w", err)
+	}
+
+	path := storage.JoinPath(dir, fmt.Sprintf("acbr-report-%s-%s.json", r.Mode, r.RunID))
+	if err := store.Save(ctx, data, path); err != nil {
+		return "", fmt.Errorf("failed to save report: %w", err)
+	}
+	return path, nil
+}
+
+// ErrorCode returns the AWS error code of err, such as InvalidParameterException,
+// or an empty string for errors that didn't come from AWS
+func ErrorCode(err error) string {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.ErrorCode()
+	}
+	return ""
+}
@@ -0,0 +1,116 @@
+package report
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"acbr/config"
+
+	"github.com/aws/smithy-go"
+)
+
+func TestReport(t *testing.T) {
+	r := New(&config.Config{Mode: "restore", PoolID: "test-pool"})
+	_, done := r.Phase(context.Background(), "users")
+	r.Created("user")
+	r.Created("user")
+	r.Skipped("user")
+	r.Failed("user", "bob", fmt.Errorf("failed to create user: %w",
+		&smithy.GenericAPIError{Code: "InvalidParameterException", Message: "Invalid phone number format."}))
+	r.Failed("user", "alice", errors.New("default-pwd is required"))
+	done()
+	r.AddRetries("", map[string]int{"AdminCreateUser": 3})
+	r.Finish(errors.New("failed to restore users and groups"))
+
+	if got := *r.Counts["user"]; got != (Counts{Created: 2, Skipped: 1, Failed: 2}) {
+		t.Errorf("Counts[user] = %+v", got)
+	}
+	if len(r.Failures) != 2 || r.Failures[0].Name != "alice" || r.Failures[1].Code != "InvalidParameterException" {
+		t.Errorf("Failures = %+v, want alice, then bob with its error code", r.Failures)
+	}
+	if len(r.Phases) != 1 || r.Phases[0].Name != "users" {
+		t.Errorf("Phases = %+v, want users", r.Phases)
+	}
+	if r.Status != StatusFailed || r.Retries["AdminCreateUser"] != 3 {
+		t.Errorf("Status = %s, Retries = %v", r.Status, r.Retries)
+	}
+
+	r.BackedUp("group", 2)
+	if got, want := r.Summary(), "group: 2 backed up; user: 2 created, 1 skipped, 2 failed"; got != want {
+		t.Errorf("Summary() = %q, want %q", got, want)
+	}
+}
+
+func TestReportFinish(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{name: "success", want: StatusSucceeded},
+		{name: "failure", err: errors.New("boom"), want: StatusFailed},
+		{name: "canceled", err: fmt.Errorf("failed to create user: %w", context.Canceled), want: StatusInterrupted},
+		{name: "deadline", err: context.DeadlineExceeded, want: StatusInterrupted},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := New(&config.Config{Mode: "backup"})
+			r.Finish(tt.err)
+			if r.Status != tt.want {
+				t.Errorf("Finish(%v) status = %s, want %s", tt.err, r.Status, tt.want)
+			}
+		})
+	}
+}
+
+func TestReportSave(t *testing.T) {
+	dir := t.TempDir()
+	r := New(&config.Config{Mode: "restore"})
+	r.Created("group")
+	r.Finish(nil)
+
+	path, err := r.Save(context.Background(), filepath.Join(dir, "cognito-backup-pool.json"))
+	if err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	if filepath.Dir(path) != dir {
+		t.Errorf("Save() path = %s, want next to the backup in %s", path, dir)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved Report
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatalf("saved report is not JSON: %v", err)
+	}
+	if saved.RunID != r.RunID || saved.Counts["group"].Created != 1 {
+		t.Errorf("saved report = %+v", &saved)
+	}
+}
+
+func TestReportAddPool(t *testing.T) {
+	r := New(&config.Config{Mode: "backup"})
+	for _, pool := range []string{"us-west-2_b", "us-east-1_a"} {
+		p := New(&config.Config{Mode: "backup", PoolID: pool})
+		p.BackedUp("user", 10)
+		p.AddRetries("", map[string]int{"ListUsers": 1})
+		p.Finish(nil)
+		r.AddPool(p)
+	}
+	r.Finish(nil)
+
+	if r.Counts["user"].BackedUp != 20 || r.Retries["ListUsers"] != 2 {
+		t.Errorf("Counts[user] = %+v, Retries = %v, want the totals", r.Counts["user"], r.Retries)
+	}
+	if len(r.Pools) != 2 || r.Pools[0].PoolID != "us-east-1_a" {
+		t.Errorf("Pools = %v, want both pools sorted", r.Pools)
+	}
+}
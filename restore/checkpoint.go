@@ -0,0 +1,156 @@
+package restore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"acbr/storage"
+)
+
+// checkpointTimeout bounds writing a checkpoint after the run's context ended
+const checkpointTimeout = 30 * time.Second
+
+// checkpoint records what a restore into a pool has completed, so a restore
+// that was interrupted or failed can be run again without recreating what
+// already exists. It is stored next to the backup and removed once a restore
+// of the same backup into the same pool succeeds.
+type checkpoint struct {
+	BackupPath string
+	// PoolID is the target pool, as created when the restore created it
+	PoolID string
+	// Completed holds pool, group/<name>, user/<name> and membership/<group>/<user>
+	Completed []string
+
+	mu      sync.Mutex
+	dir     string // empty when there is no backup path to store it next to
+	path    string
+	done    map[string]bool
+	resumed int            // items completed before this run
+	counts  map[string]int // items completed in this run, by kind
+}
+
+func newCheckpoint(backupPath, poolID string) *checkpoint {
+	return &checkpoint{
+		BackupPath: backupPath,
+		PoolID:     poolID,
+		done:       make(map[string]bool),
+		counts:     make(map[string]int),
+	}
+}
+
+// loadCheckpoint reads the checkpoint of an earlier restore of the same backup
+// into the same pool, or starts an empty one
+func (r *Restore) loadCheckpoint(ctx context.Context) (*checkpoint, error) {
+	cp := newCheckpoint(r.config.BackupPath, r.config.PoolID)
+	if r.config.BackupPath == "" {
+		return cp, nil
+	}
+	cp.dir = storage.BackupDir(r.config.BackupPath)
+	cp.path = storage.JoinPath(cp.dir, fmt.Sprintf("acbr-restore-%s.checkpoint.json", r.config.PoolID))
+
+	store, err := storage.NewStorage(ctx, cp.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage: %w", err)
+	}
+	data, err := store.Load(ctx, cp.path)
+	if storage.IsNotFound(err) {
+		return cp, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load checkpoint: %w", err)
+	}
+
+	var saved checkpoint
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal checkpoint: %w", err)
+	}
+	if saved.BackupPath != r.config.BackupPath {
+		// Left by a restore of another backup
+		return cp, nil
+	}
+
+	cp.PoolID = saved.PoolID
+	for _, item := range saved.Completed {
+		cp.done[item] = true
+	}
+	cp.resumed = len(cp.done)
+	r.config.PoolID = saved.PoolID
+	r.log().Info("resuming restore from checkpoint", "restored_items", cp.resumed)
+	return cp, nil
+}
+
+// isDone reports whether an earlier run already restored item
+func (c *checkpoint) isDone(item string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.done[item]
+}
+
+// complete records item as restored
+func (c *checkpoint) complete(item string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.done[item] {
+		c.done[item] = true
+		c.counts[strings.SplitN(item, "/", 2)[0]]++
+	}
+}
+
+// summary returns the log fields of what this run restored
+func (c *checkpoint) summary() []any {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return []any{"groups", c.counts["group"], "users", c.counts["user"],
+		"memberships", c.counts["membership"], "earlier_items", c.resumed}
+}
+
+// save stores the checkpoint. It runs after the restore stopped, so it gets
+// its own deadline rather than the possibly canceled context of the run.
+func (c *checkpoint) save(ctx context.Context) error {
+	if c.dir == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), checkpointTimeout)
+	defer cancel()
+
+	c.mu.Lock()
+	c.Completed = make([]string, 0, len(c.done))
+	for item := range c.done {
+		c.Completed = append(c.Completed, item)
+	}
+	sort.Strings(c.Completed)
+	data, err := json.Marshal(c)
+	c.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to marshal checkpoint: %w", err)
+	}
+
+	store, err := storage.NewStorage(ctx, c.dir)
+	if err != nil {
+		return fmt.Errorf("failed to create storage: %w", err)
+	}
+	if err := store.Save(ctx, data, c.path); err != nil {
+		return fmt.Errorf("failed to save checkpoint: %w", err)
+	}
+	return nil
+}
+
+// clear removes the checkpoint of a resumed restore once it has succeeded
+func (c *checkpoint) clear(ctx context.Context) error {
+	if c.dir == "" || c.resumed == 0 {
+		return nil
+	}
+	store, err := storage.NewStorage(ctx, c.dir)
+	if err != nil {
+		return fmt.Errorf("failed to create storage: %w", err)
+	}
+	if err := store.Delete(ctx, c.path); err != nil {
+		return fmt.Errorf("failed to delete checkpoint: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package restore
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"acbr/backup"
+	"acbr/config"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider/types"
+)
+
+func TestRestoreCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	b := &backup.CognitoBackup{
+		Groups:           []types.GroupType{{GroupName: aws.String("admins")}},
+		GroupMemberships: map[string][]string{"admins": {"alice", "bob"}},
+	}
+	for _, username := range []string{"alice", "bob", "carol"} {
+		b.Users = append(b.Users, types.UserType{Username: aws.String(username), Enabled: true})
+	}
+	path, err := backup.Save(context.Background(), dir, "cognito-backup-src.json", b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := func() *config.Config {
+		return &config.Config{PoolID: "test-pool", BackupPath: path, DefaultPwd: "Temp123!", UsersOnly: true, Workers: 1}
+	}
+	checkpointPath := filepath.Join(dir, "acbr-restore-test-pool.checkpoint.json")
+
+	// The first run fails on bob and records what it restored
+	failure := errors.New("limit exceeded")
+	first := &mockCognitoClient{createUserErrors: map[string]error{"bob": failure}}
+	if err := NewRestore(first, cfg()).Execute(context.Background()); !errors.Is(err, failure) {
+		t.Fatalf("Execute() error = %v, want %v", err, failure)
+	}
+	if _, err := os.Stat(checkpointPath); err != nil {
+		t.Fatalf("checkpoint not saved: %v", err)
+	}
+
+	// The second run only restores what is missing, then drops the checkpoint
+	second := &mockCognitoClient{}
+	if err := NewRestore(second, cfg()).Execute(context.Background()); err != nil {
+		t.Fatalf("Execute() resumed error = %v", err)
+	}
+	if want := []string{"bob"}; !reflect.DeepEqual(second.createdUsers, want) {
+		t.Errorf("resumed restore created users %v, want %v", second.createdUsers, want)
+	}
+	if want := []string{"admins/bob"}; !reflect.DeepEqual(second.memberships, want) {
+		t.Errorf("resumed restore memberships = %v, want %v", second.memberships, want)
+	}
+	if _, err := os.Stat(checkpointPath); !os.IsNotExist(err) {
+		t.Errorf("checkpoint left after a successful restore: %v", err)
+	}
+}
+
+func TestRestoreCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	client := &mockCognitoClient{}
+	b := &backup.CognitoBackup{Users: []types.UserType{{Username: aws.String("alice"), Enabled: true}}}
+	err := NewRestore(client, &config.Config{PoolID: "test-pool", DefaultPwd: "Temp123!", UsersOnly: true}).RestoreBackup(ctx, b)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("RestoreBackup() error = %v, want %v", err, context.Canceled)
+	}
+	if len(client.createdUsers) != 0 {
+		t.Errorf("RestoreBackup() created users %v after cancel", client.createdUsers)
+	}
+}
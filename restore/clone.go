@@ -0,0 +1,32 @@
+package restore
+
+import (
+	"context"
+	"fmt"
+
+	"acbr/aws"
+	"acbr/backup"
+	"acbr/config"
+	"acbr/report"
+)
+
+// Clone copies config.SourcePoolID into config.TargetPoolID without writing a
+// backup file. A target that doesn't exist is created with that name. The
+// usual restore options apply. It returns the report of the restore.
+func Clone(ctx context.Context, source, target aws.CognitoClient, config *config.Config) (*report.Report, error) {
+	targetConfig := *config
+	targetConfig.PoolID = config.TargetPoolID
+	r := NewRestore(target, &targetConfig)
+
+	sourceConfig := *config
+	sourceConfig.PoolID = config.SourcePoolID
+	readCtx, read := r.report.Phase(ctx, "read-source")
+	snapshot, err := backup.NewBackup(source, &sourceConfig).Collect(readCtx)
+	read()
+	if err != nil {
+		return r.report, fmt.Errorf("failed to read source pool: %w", err)
+	}
+	r.log().Info("read source pool", "source_pool_id", config.SourcePoolID, "users", len(snapshot.Users), "groups", len(snapshot.Groups))
+
+	return r.report, r.RestoreBackup(ctx, snapshot)
+}
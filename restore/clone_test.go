@@ -0,0 +1,47 @@
+package restore
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"acbr/config"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider/types"
+)
+
+func TestClone(t *testing.T) {
+	source := &mockCognitoClient{
+		users: []types.UserType{
+			{Username: aws.String("alice"), Enabled: true},
+			{Username: aws.String("bob"), Enabled: false},
+			{Username: aws.String("carol"), Enabled: true},
+		},
+	}
+	target := &mockCognitoClient{}
+
+	_, err := Clone(context.Background(), source, target, &config.Config{
+		SourcePoolID: "source-pool",
+		TargetPoolID: "target-pool",
+		UsersOnly:    true,
+		Filters:      []string{"users:name=[ab]*"},
+		DefaultPwd:   "Temp123!",
+	})
+	if err != nil {
+		t.Fatalf("Clone() error = %v", err)
+	}
+
+	if want := []string{"alice", "bob"}; !reflect.DeepEqual(sorted(target.createdUsers), want) {
+		t.Errorf("Clone() created users %v, want %v", target.createdUsers, want)
+	}
+	if want := []string{"bob"}; !reflect.DeepEqual(target.disabledUsers, want) {
+		t.Errorf("Clone() disabled users %v, want %v", target.disabledUsers, want)
+	}
+	if len(source.createdUsers) != 0 {
+		t.Errorf("Clone() created users in the source pool: %v", source.createdUsers)
+	}
+	if *target.createInputs[0].UserPoolId != "target-pool" {
+		t.Errorf("Clone() created users in pool %s, want target-pool", *target.createInputs[0].UserPoolId)
+	}
+}
@@ -0,0 +1,84 @@
+package restore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"acbr/backup"
+	"acbr/report"
+	"acbr/storage"
+)
+
+// errBudgetExceeded stops a restore with ContinueOnError once more items
+// failed than the error budget allows
+var errBudgetExceeded = errors.New("error budget exceeded")
+
+// failedItems returns the groups, users and memberships of b that failed, in
+// backup format, with the reason each failed. Memberships of failed groups and
+// users are included, as they were never attempted. The pool settings are kept
+// so the file restores with the same options; the domain is left out as it
+// already exists.
+func failedItems(b *backup.CognitoBackup, failed map[string]error) *backup.CognitoBackup {
+	out := &backup.CognitoBackup{GroupMemberships: make(map[string][]string)}
+	if b.UserPoolConfig != nil && b.UserPoolConfig.UserPool != nil {
+		poolConfig := *b.UserPoolConfig
+		pool := *b.UserPoolConfig.UserPool
+		pool.Domain = nil
+		pool.CustomDomain = nil
+		poolConfig.UserPool = &pool
+		out.UserPoolConfig = &poolConfig
+	}
+
+	for _, group := range b.Groups {
+		if failed["group/"+*group.GroupName] != nil {
+			out.Groups = append(out.Groups, group)
+		}
+	}
+	for _, user := range b.Users {
+		if failed["user/"+*user.Username] != nil {
+			out.Users = append(out.Users, user)
+		}
+	}
+	for group, usernames := range b.GroupMemberships {
+		for _, username := range usernames {
+			if failed["group/"+group] != nil || failed["user/"+username] != nil ||
+				failed["membership/"+group+"/"+username] != nil {
+				out.GroupMemberships[group] = append(out.GroupMemberships[group], username)
+			}
+		}
+	}
+
+	for item, err := range failed {
+		kind, name, _ := strings.Cut(item, "/")
+		out.Failures = append(out.Failures, report.Failure{Kind: kind, Name: name, Code: report.ErrorCode(err), Message: err.Error()})
+	}
+	sort.Slice(out.Failures, func(i, j int) bool {
+		if out.Failures[i].Kind != out.Failures[j].Kind {
+			return out.Failures[i].Kind < out.Failures[j].Kind
+		}
+		return out.Failures[i].Name < out.Failures[j].Name
+	})
+	return out
+}
+
+// saveFailedItems writes the failed items next to the backup. Restoring that
+// file with the same options retries just those items.
+func (r *Restore) saveFailedItems(ctx context.Context, b *backup.CognitoBackup, failed map[string]error) error {
+	if r.config.BackupPath == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), checkpointTimeout)
+	defer cancel()
+
+	filename := fmt.Sprintf("acbr-failed-%s-%s.json", r.config.PoolID, r.report.RunID)
+	path, err := backup.Save(ctx, storage.BackupDir(r.config.BackupPath), filename, failedItems(b, failed))
+	if err != nil {
+		return err
+	}
+	r.report.FailedItems = path
+	r.log().Info("saved failed items, restore the file to retry them", "items", len(failed), "path", path)
+	return nil
+}
@@ -0,0 +1,124 @@
+package restore
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"acbr/backup"
+	"acbr/config"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider/types"
+)
+
+func TestContinueOnError(t *testing.T) {
+	failure := errors.New("invalid phone number format")
+	newBackup := func() *backup.CognitoBackup {
+		b := &backup.CognitoBackup{
+			Groups:           []types.GroupType{{GroupName: aws.String("admins")}},
+			GroupMemberships: map[string][]string{"admins": {"alice", "bob", "carol"}},
+		}
+		for _, username := range []string{"alice", "bob", "carol", "dave"} {
+			b.Users = append(b.Users, types.UserType{Username: aws.String(username), Enabled: true})
+		}
+		return b
+	}
+
+	tests := []struct {
+		name            string
+		continueOnError bool
+		budget          string
+		wantErr         error
+		wantUsers       []string
+	}{
+		{"fails without the option", false, "", failure, []string{"alice", "carol", "dave"}},
+		{"succeeds without a budget", true, "", nil, []string{"alice", "carol", "dave"}},
+		{"succeeds within a count", true, "1", nil, []string{"alice", "carol", "dave"}},
+		{"succeeds within a percentage", true, "20%", nil, []string{"alice", "carol", "dave"}},
+		{"stops past the budget", true, "0", errBudgetExceeded, []string{"alice"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			budget, err := config.ParseErrorBudget(tt.budget)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dir := t.TempDir()
+			client := &mockCognitoClient{createUserErrors: map[string]error{"bob": failure}}
+			r := NewRestore(client, &config.Config{
+				PoolID:          "test-pool",
+				BackupPath:      filepath.Join(dir, "cognito-backup.json"),
+				DefaultPwd:      "Temp123!",
+				Workers:         1,
+				ContinueOnError: tt.continueOnError,
+				ErrorBudget:     budget,
+			})
+			selection, err := NewSelection(&config.Config{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = r.restoreUsersAndGroups(context.Background(), newBackup(), selection, newCheckpoint("", "test-pool"))
+			if tt.wantErr == nil && err != nil || tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("restoreUsersAndGroups() error = %v, want %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(sorted(client.createdUsers), tt.wantUsers) {
+				t.Errorf("created users = %v, want %v", sorted(client.createdUsers), tt.wantUsers)
+			}
+
+			// The failed-items file retries bob and his membership
+			path := r.Report().FailedItems
+			if want := filepath.Join(dir, "acbr-failed-test-pool-"+r.Report().RunID+".json"); path != want {
+				t.Fatalf("failed items path = %q, want %q", path, want)
+			}
+			failed, err := backup.Load(context.Background(), path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(failed.Users) != 1 || *failed.Users[0].Username != "bob" || len(failed.Groups) != 0 {
+				t.Errorf("failed users = %+v, groups = %+v, want only bob", failed.Users, failed.Groups)
+			}
+			if want := map[string][]string{"admins": {"bob"}}; !reflect.DeepEqual(failed.GroupMemberships, want) {
+				t.Errorf("failed memberships = %v, want %v", failed.GroupMemberships, want)
+			}
+			if len(failed.Failures) != 1 || failed.Failures[0].Name != "bob" || !strings.Contains(failed.Failures[0].Message, failure.Error()) {
+				t.Errorf("failures = %+v, want bob with %q", failed.Failures, failure)
+			}
+		})
+	}
+}
+
+func TestFailedItems(t *testing.T) {
+	b := &backup.CognitoBackup{
+		Groups: []types.GroupType{{GroupName: aws.String("admins")}, {GroupName: aws.String("staff")}},
+		Users: []types.UserType{
+			{Username: aws.String("alice")},
+			{Username: aws.String("bob")},
+		},
+		GroupMemberships: map[string][]string{
+			"admins": {"alice", "bob"},
+			"staff":  {"alice", "bob"},
+		},
+	}
+	failed := map[string]error{
+		"group/staff":             errors.New("group exists"),
+		"membership/admins/alice": errors.New("throttled"),
+	}
+
+	got := failedItems(b, failed)
+	if len(got.Groups) != 1 || *got.Groups[0].GroupName != "staff" || len(got.Users) != 0 {
+		t.Errorf("failedItems() groups = %+v, users = %+v, want only staff", got.Groups, got.Users)
+	}
+	want := map[string][]string{"admins": {"alice"}, "staff": {"alice", "bob"}}
+	if !reflect.DeepEqual(got.GroupMemberships, want) {
+		t.Errorf("failedItems() memberships = %v, want %v", got.GroupMemberships, want)
+	}
+	if len(got.Failures) != 2 || got.Failures[0].Kind != "group" || got.Failures[1].Name != "admins/alice" {
+		t.Errorf("failedItems() failures = %+v", got.Failures)
+	}
+}
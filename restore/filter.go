@@ -0,0 +1,303 @@
+package restore
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"acbr/backup"
+	"acbr/config"
+
+	awssdk "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider/types"
+)
+
+// Sections of a backup that can be included in or excluded from a restore
+const (
+	SectionPool              = "pool"
+	SectionGroups            = "groups"
+	SectionUsers             = "users"
+	SectionMemberships       = "memberships"
+	SectionClients           = "clients"
+	SectionResourceServers   = "resource-servers"
+	SectionIdentityProviders = "idps"
+	SectionDomain            = "domain"
+	SectionTriggers          = "triggers"
+	SectionIdentityPools     = "identity-pools"
+)
+
+// Sections lists every restorable section in restore order
+var Sections = []string{
+	SectionPool,
+	SectionTriggers,
+	SectionDomain,
+	SectionResourceServers,
+	SectionClients,
+	SectionIdentityProviders,
+	SectionIdentityPools,
+	SectionGroups,
+	SectionUsers,
+	SectionMemberships,
+}
+
+// defaultSections are restored unless -include names the sections. The hosted
+// UI domain prefix is unique across AWS and often still held by the source
+// pool, so the domain is only restored on request.
+var defaultSections = []string{
+	SectionPool,
+	SectionTriggers,
+	SectionResourceServers,
+	SectionClients,
+	SectionIdentityProviders,
+	SectionIdentityPools,
+	SectionGroups,
+	SectionUsers,
+	SectionMemberships,
+}
+
+// poolSections need the target pool configuration to be in place
+var poolSections = []string{
+	SectionPool,
+	SectionTriggers,
+	SectionDomain,
+	SectionResourceServers,
+	SectionClients,
+	SectionIdentityProviders,
+	SectionIdentityPools,
+}
+
+// Selection decides which sections and which named items of a backup are restored
+type Selection struct {
+	sections map[string]bool
+	filters  map[string][]filter
+}
+
+// filter matches one field of an item. For users the field is "name"
+// (username), "group" or a user attribute; other sections only support "name".
+type filter struct {
+	field string
+	match func(string) bool
+}
+
+// NewSelection builds a Selection from the include, exclude and filter options.
+// Filters have the form <section>:<field>=<glob> or <section>:<field>~<regex>,
+// e.g. clients:name=mobile-app, users:group=admins or users:email~@example\.com$.
+func NewSelection(cfg *config.Config) (*Selection, error) {
+	s := &Selection{
+		sections: make(map[string]bool),
+		filters:  make(map[string][]filter),
+	}
+
+	include := cfg.Include
+	if len(include) == 0 && cfg.UsersOnly {
+		include = []string{SectionGroups, SectionUsers, SectionMemberships}
+	}
+	if len(include) == 0 {
+		include = defaultSections
+	}
+	for _, section := range include {
+		if !isSection(section) {
+			return nil, fmt.Errorf("unknown section to include: %s", section)
+		}
+		s.sections[section] = true
+	}
+	for _, section := range cfg.Exclude {
+		if !isSection(section) {
+			return nil, fmt.Errorf("unknown section to exclude: %s", section)
+		}
+		delete(s.sections, section)
+	}
+
+	for _, expr := range cfg.Filters {
+		section, f, err := parseFilter(expr)
+		if err != nil {
+			return nil, err
+		}
+		s.filters[section] = append(s.filters[section], f)
+	}
+
+	return s, nil
+}
+
+func isSection(name string) bool {
+	for _, section := range Sections {
+		if section == name {
+			return true
+		}
+	}
+	return false
+}
+
+func parseFilter(expr string) (string, filter, error) {
+	section, rest, ok := strings.Cut(expr, ":")
+	if !ok || !isSection(section) {
+		return "", filter{}, fmt.Errorf("invalid filter %q: expected <section>:<field>=<glob> or <section>:<field>~<regex>", expr)
+	}
+
+	n := strings.IndexAny(rest, "=~")
+	if n <= 0 {
+		return "", filter{}, fmt.Errorf("invalid filter %q: missing field or operator", expr)
+	}
+	field, op, pattern := rest[:n], rest[n], rest[n+1:]
+	if section != SectionUsers && field != "name" {
+		return "", filter{}, fmt.Errorf("invalid filter %q: %s can only be filtered by name", expr, section)
+	}
+
+	if op == '~' {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return "", filter{}, fmt.Errorf("invalid filter %q: %w", expr, err)
+		}
+		return section, filter{field: field, match: re.MatchString}, nil
+	}
+
+	if _, err := path.Match(pattern, ""); err != nil {
+		return "", filter{}, fmt.Errorf("invalid filter %q: %w", expr, err)
+	}
+	return section, filter{field: field, match: func(value string) bool {
+		matched, _ := path.Match(pattern, value)
+		return matched
+	}}, nil
+}
+
+// Includes reports whether a section is restored
+func (s *Selection) Includes(section string) bool {
+	return s.sections[section]
+}
+
+// IncludesPoolConfig reports whether any section needing the pool configuration is restored
+func (s *Selection) IncludesPoolConfig() bool {
+	for _, section := range poolSections {
+		if s.sections[section] {
+			return true
+		}
+	}
+	return false
+}
+
+// matchName applies the name filters of a section
+func (s *Selection) matchName(section, name string) bool {
+	for _, f := range s.filters[section] {
+		if !f.match(name) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchUser applies the user filters. groups holds the groups the user belongs to.
+func (s *Selection) matchUser(user types.UserType, groups []string) bool {
+	for _, f := range s.filters[SectionUsers] {
+		switch f.field {
+		case "name", "username":
+			if !f.match(awssdk.ToString(user.Username)) {
+				return false
+			}
+		case "group":
+			matched := false
+			for _, group := range groups {
+				if f.match(group) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return false
+			}
+		default:
+			matched := false
+			for _, attr := range user.Attributes {
+				if awssdk.ToString(attr.Name) == f.field && f.match(awssdk.ToString(attr.Value)) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Apply returns a copy of the backup holding only the selected sections and items.
+// Memberships are kept only when both the user and the group are kept.
+func (s *Selection) Apply(b *backup.CognitoBackup) *backup.CognitoBackup {
+	out := &backup.CognitoBackup{
+		UserPoolConfig: b.UserPoolConfig,
+	}
+
+	userGroups := make(map[string][]string)
+	for group, usernames := range b.GroupMemberships {
+		for _, username := range usernames {
+			userGroups[username] = append(userGroups[username], group)
+		}
+	}
+
+	if s.Includes(SectionGroups) || s.Includes(SectionMemberships) {
+		for _, group := range b.Groups {
+			if s.matchName(SectionGroups, awssdk.ToString(group.GroupName)) {
+				out.Groups = append(out.Groups, group)
+			}
+		}
+	}
+	if s.Includes(SectionUsers) || s.Includes(SectionMemberships) {
+		for _, user := range b.Users {
+			if s.matchUser(user, userGroups[awssdk.ToString(user.Username)]) {
+				out.Users = append(out.Users, user)
+			}
+		}
+	}
+	if s.Includes(SectionMemberships) {
+		keptGroups := make(map[string]bool, len(out.Groups))
+		for _, group := range out.Groups {
+			keptGroups[awssdk.ToString(group.GroupName)] = true
+		}
+		keptUsers := make(map[string]bool, len(out.Users))
+		for _, user := range out.Users {
+			keptUsers[awssdk.ToString(user.Username)] = true
+		}
+		out.GroupMemberships = make(map[string][]string)
+		for group, usernames := range b.GroupMemberships {
+			if !keptGroups[group] {
+				continue
+			}
+			for _, username := range usernames {
+				if keptUsers[username] {
+					out.GroupMemberships[group] = append(out.GroupMemberships[group], username)
+				}
+			}
+		}
+	}
+	if s.Includes(SectionResourceServers) {
+		for _, server := range b.ResourceServers {
+			if s.matchName(SectionResourceServers, awssdk.ToString(server.Name)) {
+				out.ResourceServers = append(out.ResourceServers, server)
+			}
+		}
+	}
+	if s.Includes(SectionClients) {
+		for _, client := range b.Clients {
+			if s.matchName(SectionClients, awssdk.ToString(client.ClientName)) {
+				out.Clients = append(out.Clients, client)
+			}
+		}
+	}
+	if s.Includes(SectionIdentityProviders) {
+		for _, provider := range b.IdentityProviders {
+			if s.matchName(SectionIdentityProviders, awssdk.ToString(provider.ProviderName)) {
+				out.IdentityProviders = append(out.IdentityProviders, provider)
+			}
+		}
+	}
+	if s.Includes(SectionIdentityPools) {
+		for _, pool := range b.IdentityPools {
+			if s.matchName(SectionIdentityPools, awssdk.ToString(pool.Settings.IdentityPoolName)) {
+				out.IdentityPools = append(out.IdentityPools, pool)
+			}
+		}
+	}
+
+	return out
+}
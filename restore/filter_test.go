@@ -0,0 +1,146 @@
+package restore
+
+import (
+	"testing"
+
+	"acbr/backup"
+	"acbr/config"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider/types"
+)
+
+func testBackup() *backup.CognitoBackup {
+	return &backup.CognitoBackup{
+		Users: []types.UserType{
+			{Username: aws.String("alice"), Attributes: []types.AttributeType{{Name: aws.String("email"), Value: aws.String("alice@example.com")}}},
+			{Username: aws.String("bob"), Attributes: []types.AttributeType{{Name: aws.String("email"), Value: aws.String("bob@other.org")}}},
+			{Username: aws.String("carol"), Attributes: []types.AttributeType{{Name: aws.String("email"), Value: aws.String("carol@example.com")}}},
+		},
+		Groups: []types.GroupType{
+			{GroupName: aws.String("admins")},
+			{GroupName: aws.String("staff")},
+		},
+		GroupMemberships: map[string][]string{
+			"admins": {"alice", "bob"},
+			"staff":  {"carol"},
+		},
+		Clients: []types.UserPoolClientType{
+			{ClientName: aws.String("mobile-app")},
+			{ClientName: aws.String("web-app")},
+		},
+	}
+}
+
+func usernames(users []types.UserType) []string {
+	var names []string
+	for _, user := range users {
+		names = append(names, *user.Username)
+	}
+	return names
+}
+
+func TestSelectionApply(t *testing.T) {
+	tests := []struct {
+		name        string
+		cfg         config.Config
+		wantUsers   []string
+		wantClients int
+		wantGroups  int
+	}{
+		{
+			name:        "everything by default",
+			cfg:         config.Config{},
+			wantUsers:   []string{"alice", "bob", "carol"},
+			wantClients: 2,
+			wantGroups:  2,
+		},
+		{
+			name:        "single client by name",
+			cfg:         config.Config{Include: []string{SectionClients}, Filters: []string{"clients:name=mobile-app"}},
+			wantClients: 1,
+		},
+		{
+			name:        "users in group",
+			cfg:         config.Config{Filters: []string{"users:group=admins"}},
+			wantUsers:   []string{"alice", "bob"},
+			wantClients: 2,
+			wantGroups:  2,
+		},
+		{
+			name:       "users by email regex",
+			cfg:        config.Config{UsersOnly: true, Filters: []string{`users:email~@example\.com$`}},
+			wantUsers:  []string{"alice", "carol"},
+			wantGroups: 2,
+		},
+		{
+			name:        "excluded users by glob",
+			cfg:         config.Config{Exclude: []string{SectionClients}, Filters: []string{"users:name=[ab]*"}},
+			wantUsers:   []string{"alice", "bob"},
+			wantGroups:  2,
+			wantClients: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			selection, err := NewSelection(&tt.cfg)
+			if err != nil {
+				t.Fatalf("NewSelection() error = %v", err)
+			}
+			got := selection.Apply(testBackup())
+			if names := usernames(got.Users); len(names) != len(tt.wantUsers) {
+				t.Errorf("Apply() users = %v, want %v", names, tt.wantUsers)
+			} else {
+				for i := range names {
+					if names[i] != tt.wantUsers[i] {
+						t.Errorf("Apply() users = %v, want %v", names, tt.wantUsers)
+						break
+					}
+				}
+			}
+			if len(got.Clients) != tt.wantClients {
+				t.Errorf("Apply() clients = %d, want %d", len(got.Clients), tt.wantClients)
+			}
+			if len(got.Groups) != tt.wantGroups {
+				t.Errorf("Apply() groups = %d, want %d", len(got.Groups), tt.wantGroups)
+			}
+		})
+	}
+}
+
+func TestSelectionMemberships(t *testing.T) {
+	selection, err := NewSelection(&config.Config{Filters: []string{"users:name=alice"}})
+	if err != nil {
+		t.Fatalf("NewSelection() error = %v", err)
+	}
+	got := selection.Apply(testBackup())
+	if members := got.GroupMemberships["admins"]; len(members) != 1 || members[0] != "alice" {
+		t.Errorf("Apply() admins members = %v, want [alice]", members)
+	}
+	if members := got.GroupMemberships["staff"]; len(members) != 0 {
+		t.Errorf("Apply() staff members = %v, want none", members)
+	}
+}
+
+func TestNewSelectionErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.Config
+	}{
+		{name: "unknown include", cfg: config.Config{Include: []string{"widgets"}}},
+		{name: "unknown exclude", cfg: config.Config{Exclude: []string{"widgets"}}},
+		{name: "missing operator", cfg: config.Config{Filters: []string{"users:alice"}}},
+		{name: "unknown section", cfg: config.Config{Filters: []string{"widgets:name=x"}}},
+		{name: "non-name field", cfg: config.Config{Filters: []string{"clients:id=x"}}},
+		{name: "bad regex", cfg: config.Config{Filters: []string{"users:email~("}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewSelection(&tt.cfg); err == nil {
+				t.Error("NewSelection() error = nil, want error")
+			}
+		})
+	}
+}
@@ -0,0 +1,218 @@
+package restore
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"acbr/aws"
+	"acbr/backup"
+	"acbr/logging"
+
+	awssdk "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cognitoidentity"
+	identitytypes "github.com/aws/aws-sdk-go-v2/service/cognitoidentity/types"
+	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider"
+)
+
+// listPageSize is the most clients or identity pools listed per page
+const listPageSize = 60
+
+// UseIdentityClient lets the restore recreate the backup's identity pools in
+// the client's region. Without it they are skipped.
+func (r *Restore) UseIdentityClient(client aws.IdentityClient) {
+	r.identity = client
+}
+
+// restoreIdentityPools creates or updates, by name, the identity pools of the
+// backup, bound to the target pool and its clients instead of the backed up ones
+func (r *Restore) restoreIdentityPools(ctx context.Context, b *backup.CognitoBackup) error {
+	if r.identity == nil {
+		for _, pool := range b.IdentityPools {
+			r.log().Warn("skipping identity pool, no identity client", logging.Resource, "identity-pool", logging.Name, awssdk.ToString(pool.Settings.IdentityPoolName))
+			r.report.Skipped("identity-pool")
+		}
+		return nil
+	}
+
+	source := r.config.PoolID
+	if b.UserPoolConfig != nil && b.UserPoolConfig.UserPool != nil && b.UserPoolConfig.UserPool.Id != nil {
+		source = *b.UserPoolConfig.UserPool.Id
+	}
+	clientIDs, err := r.clientIDs(ctx, b.IdentityPools)
+	if err != nil {
+		return err
+	}
+	existing, err := r.identityPoolIDs(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, pool := range b.IdentityPools {
+		pool, unbound := rewriteIdentityPool(pool, source, r.config.PoolID, clientIDs)
+		settings := pool.Settings
+		name := awssdk.ToString(settings.IdentityPoolName)
+		for _, client := range unbound {
+			r.log().Warn("identity pool client not found in the target pool, dropping it", logging.Resource, "identity-pool", logging.Name, name, "client", client)
+		}
+
+		id, ok := existing[name]
+		if ok {
+			_, err = r.identity.UpdateIdentityPool(ctx, &cognitoidentity.UpdateIdentityPoolInput{
+				IdentityPoolId:                 awssdk.String(id),
+				IdentityPoolName:               settings.IdentityPoolName,
+				AllowUnauthenticatedIdentities: settings.AllowUnauthenticatedIdentities,
+				AllowClassicFlow:               settings.AllowClassicFlow,
+				CognitoIdentityProviders:       settings.CognitoIdentityProviders,
+				DeveloperProviderName:          settings.DeveloperProviderName,
+				IdentityPoolTags:               settings.IdentityPoolTags,
+				OpenIdConnectProviderARNs:      settings.OpenIdConnectProviderARNs,
+				SamlProviderARNs:               settings.SamlProviderARNs,
+				SupportedLoginProviders:        settings.SupportedLoginProviders,
+			})
+		} else {
+			var created *cognitoidentity.CreateIdentityPoolOutput
+			created, err = r.identity.CreateIdentityPool(ctx, &cognitoidentity.CreateIdentityPoolInput{
+				IdentityPoolName:               settings.IdentityPoolName,
+				AllowUnauthenticatedIdentities: settings.AllowUnauthenticatedIdentities,
+				AllowClassicFlow:               settings.AllowClassicFlow,
+				CognitoIdentityProviders:       settings.CognitoIdentityProviders,
+				DeveloperProviderName:          settings.DeveloperProviderName,
+				IdentityPoolTags:               settings.IdentityPoolTags,
+				OpenIdConnectProviderARNs:      settings.OpenIdConnectProviderARNs,
+				SamlProviderARNs:               settings.SamlProviderARNs,
+				SupportedLoginProviders:        settings.SupportedLoginProviders,
+			})
+			if err == nil {
+				id = awssdk.ToString(created.IdentityPoolId)
+			}
+		}
+		if err != nil {
+			r.report.Failed("identity-pool", name, err)
+			return fmt.Errorf("failed to restore identity pool %s: %w", name, err)
+		}
+
+		if len(pool.Roles) > 0 || len(pool.RoleMappings) > 0 {
+			_, err := r.identity.SetIdentityPoolRoles(ctx, &cognitoidentity.SetIdentityPoolRolesInput{
+				IdentityPoolId: awssdk.String(id),
+				Roles:          pool.Roles,
+				RoleMappings:   pool.RoleMappings,
+			})
+			if err != nil {
+				r.report.Failed("identity-pool", name, err)
+				return fmt.Errorf("failed to set roles of identity pool %s: %w", name, err)
+			}
+		}
+		if ok {
+			r.report.Updated("identity-pool")
+		} else {
+			r.report.Created("identity-pool")
+		}
+	}
+	return nil
+}
+
+// clientIDs maps the client IDs the identity pools trust in the backed up pool
+// to the IDs of the target pool's clients of the same name
+func (r *Restore) clientIDs(ctx context.Context, pools []backup.IdentityPool) (map[string]string, error) {
+	byName := make(map[string]string)
+	var nextToken *string
+	for {
+		output, err := r.client.ListUserPoolClients(ctx, &cognitoidentityprovider.ListUserPoolClientsInput{
+			UserPoolId: &r.config.PoolID,
+			MaxResults: awssdk.Int32(listPageSize),
+			NextToken:  nextToken,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list clients: %w", err)
+		}
+		for _, client := range output.UserPoolClients {
+			byName[awssdk.ToString(client.ClientName)] = awssdk.ToString(client.ClientId)
+		}
+		if output.NextToken == nil {
+			break
+		}
+		nextToken = output.NextToken
+	}
+
+	ids := make(map[string]string)
+	for _, pool := range pools {
+		for id, name := range pool.ClientNames {
+			if target, ok := byName[name]; ok {
+				ids[id] = target
+			}
+		}
+	}
+	return ids, nil
+}
+
+// identityPoolIDs returns the IDs of the region's identity pools by name
+func (r *Restore) identityPoolIDs(ctx context.Context) (map[string]string, error) {
+	ids := make(map[string]string)
+	var nextToken *string
+	for {
+		output, err := r.identity.ListIdentityPools(ctx, &cognitoidentity.ListIdentityPoolsInput{
+			MaxResults: awssdk.Int32(listPageSize),
+			NextToken:  nextToken,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list identity pools: %w", err)
+		}
+		for _, pool := range output.IdentityPools {
+			ids[awssdk.ToString(pool.IdentityPoolName)] = awssdk.ToString(pool.IdentityPoolId)
+		}
+		if output.NextToken == nil {
+			break
+		}
+		nextToken = output.NextToken
+	}
+	return ids, nil
+}
+
+// rewriteIdentityPool returns the identity pool with its bindings to the
+// source user pool pointed at the target pool: provider names, client IDs and
+// role mapping keys. clientIDs maps source client IDs to target ones; the
+// bindings of clients missing from it are dropped and returned by name.
+// Bindings to other providers are kept as they are.
+func rewriteIdentityPool(pool backup.IdentityPool, source, target string, clientIDs map[string]string) (backup.IdentityPool, []string) {
+	from, to := backup.UserPoolProviderName(source), backup.UserPoolProviderName(target)
+	clientName := func(id string) string {
+		if name, ok := pool.ClientNames[id]; ok {
+			return name
+		}
+		return id
+	}
+
+	settings := *pool.Settings
+	settings.CognitoIdentityProviders = nil
+	var unbound []string
+	for _, provider := range pool.Settings.CognitoIdentityProviders {
+		if awssdk.ToString(provider.ProviderName) == from {
+			id, ok := clientIDs[awssdk.ToString(provider.ClientId)]
+			if !ok {
+				unbound = append(unbound, clientName(awssdk.ToString(provider.ClientId)))
+				continue
+			}
+			provider.ProviderName = awssdk.String(to)
+			provider.ClientId = awssdk.String(id)
+		}
+		settings.CognitoIdentityProviders = append(settings.CognitoIdentityProviders, provider)
+	}
+	pool.Settings = &settings
+
+	if pool.RoleMappings != nil {
+		mappings := make(map[string]identitytypes.RoleMapping, len(pool.RoleMappings))
+		for key, mapping := range pool.RoleMappings {
+			if client, ok := strings.CutPrefix(key, from+":"); ok {
+				id, ok := clientIDs[client]
+				if !ok {
+					continue
+				}
+				key = to + ":" + id
+			}
+			mappings[key] = mapping
+		}
+		pool.RoleMappings = mappings
+	}
+	return pool, unbound
+}
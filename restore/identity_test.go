@@ -0,0 +1,153 @@
+package restore
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"acbr/backup"
+	"acbr/config"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cognitoidentity"
+	identitytypes "github.com/aws/aws-sdk-go-v2/service/cognitoidentity/types"
+	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider"
+	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider/types"
+)
+
+// mockIdentityClient records the identity pools created and updated
+type mockIdentityClient struct {
+	existing []identitytypes.IdentityPoolShortDescription
+	created  []*cognitoidentity.CreateIdentityPoolInput
+	updated  []*cognitoidentity.UpdateIdentityPoolInput
+	roles    []*cognitoidentity.SetIdentityPoolRolesInput
+}
+
+func (m *mockIdentityClient) ListIdentityPools(ctx context.Context, params *cognitoidentity.ListIdentityPoolsInput, optFns ...func(*cognitoidentity.Options)) (*cognitoidentity.ListIdentityPoolsOutput, error) {
+	return &cognitoidentity.ListIdentityPoolsOutput{IdentityPools: m.existing}, nil
+}
+
+func (m *mockIdentityClient) DescribeIdentityPool(ctx context.Context, params *cognitoidentity.DescribeIdentityPoolInput, optFns ...func(*cognitoidentity.Options)) (*cognitoidentity.DescribeIdentityPoolOutput, error) {
+	return &cognitoidentity.DescribeIdentityPoolOutput{}, nil
+}
+
+func (m *mockIdentityClient) GetIdentityPoolRoles(ctx context.Context, params *cognitoidentity.GetIdentityPoolRolesInput, optFns ...func(*cognitoidentity.Options)) (*cognitoidentity.GetIdentityPoolRolesOutput, error) {
+	return &cognitoidentity.GetIdentityPoolRolesOutput{}, nil
+}
+
+func (m *mockIdentityClient) CreateIdentityPool(ctx context.Context, params *cognitoidentity.CreateIdentityPoolInput, optFns ...func(*cognitoidentity.Options)) (*cognitoidentity.CreateIdentityPoolOutput, error) {
+	m.created = append(m.created, params)
+	return &cognitoidentity.CreateIdentityPoolOutput{IdentityPoolId: aws.String("us-west-2:new-" + *params.IdentityPoolName)}, nil
+}
+
+func (m *mockIdentityClient) UpdateIdentityPool(ctx context.Context, params *cognitoidentity.UpdateIdentityPoolInput, optFns ...func(*cognitoidentity.Options)) (*cognitoidentity.UpdateIdentityPoolOutput, error) {
+	m.updated = append(m.updated, params)
+	return &cognitoidentity.UpdateIdentityPoolOutput{}, nil
+}
+
+func (m *mockIdentityClient) SetIdentityPoolRoles(ctx context.Context, params *cognitoidentity.SetIdentityPoolRolesInput, optFns ...func(*cognitoidentity.Options)) (*cognitoidentity.SetIdentityPoolRolesOutput, error) {
+	m.roles = append(m.roles, params)
+	return &cognitoidentity.SetIdentityPoolRolesOutput{}, nil
+}
+
+const (
+	sourcePool = "us-east-1_source"
+	targetPool = "us-west-2_target"
+)
+
+// identityPool trusts the web and admin clients of the source pool, and Google
+func identityPool(name string) backup.IdentityPool {
+	from := backup.UserPoolProviderName(sourcePool)
+	return backup.IdentityPool{
+		Settings: &cognitoidentity.DescribeIdentityPoolOutput{
+			IdentityPoolId:   aws.String("us-east-1:" + name),
+			IdentityPoolName: aws.String(name),
+			CognitoIdentityProviders: []identitytypes.CognitoIdentityProvider{
+				{ProviderName: aws.String(from), ClientId: aws.String("old-web")},
+				{ProviderName: aws.String(from), ClientId: aws.String("old-admin")},
+				{ProviderName: aws.String(backup.UserPoolProviderName("us-east-1_other")), ClientId: aws.String("other")},
+			},
+			SupportedLoginProviders: map[string]string{"accounts.google.com": "google-client"},
+		},
+		Roles: map[string]string{"authenticated": "arn:aws:iam::111111111111:role/auth"},
+		RoleMappings: map[string]identitytypes.RoleMapping{
+			from + ":old-web":   {Type: identitytypes.RoleMappingTypeToken},
+			from + ":old-admin": {Type: identitytypes.RoleMappingTypeRules},
+		},
+		ClientNames: map[string]string{"old-web": "web", "old-admin": "admin"},
+	}
+}
+
+func TestRewriteIdentityPool(t *testing.T) {
+	to := backup.UserPoolProviderName(targetPool)
+	got, unbound := rewriteIdentityPool(identityPool("app"), sourcePool, targetPool, map[string]string{"old-web": "new-web"})
+
+	wantProviders := []identitytypes.CognitoIdentityProvider{
+		{ProviderName: aws.String(to), ClientId: aws.String("new-web")},
+		{ProviderName: aws.String(backup.UserPoolProviderName("us-east-1_other")), ClientId: aws.String("other")},
+	}
+	if !reflect.DeepEqual(got.Settings.CognitoIdentityProviders, wantProviders) {
+		t.Errorf("providers = %+v, want %+v", got.Settings.CognitoIdentityProviders, wantProviders)
+	}
+	if want := map[string]identitytypes.RoleMapping{to + ":new-web": {Type: identitytypes.RoleMappingTypeToken}}; !reflect.DeepEqual(got.RoleMappings, want) {
+		t.Errorf("role mappings = %v, want %v", got.RoleMappings, want)
+	}
+	if want := []string{"admin"}; !reflect.DeepEqual(unbound, want) {
+		t.Errorf("unbound = %v, want %v", unbound, want)
+	}
+	if got.Settings.SupportedLoginProviders["accounts.google.com"] != "google-client" {
+		t.Errorf("login providers = %v, want them kept", got.Settings.SupportedLoginProviders)
+	}
+
+	// The backed up pool is left as it was
+	if original := identityPool("app"); *original.Settings.CognitoIdentityProviders[0].ClientId != "old-web" {
+		t.Errorf("rewriteIdentityPool() changed its input")
+	}
+}
+
+func TestRestoreIdentityPools(t *testing.T) {
+	client := &mockCognitoClient{
+		clients: []types.UserPoolClientDescription{
+			{ClientId: aws.String("new-web"), ClientName: aws.String("web")},
+			{ClientId: aws.String("new-admin"), ClientName: aws.String("admin")},
+		},
+	}
+	identity := &mockIdentityClient{
+		existing: []identitytypes.IdentityPoolShortDescription{{IdentityPoolId: aws.String("us-west-2:existing"), IdentityPoolName: aws.String("portal")}},
+	}
+	r := NewRestore(client, &config.Config{PoolID: targetPool, Region: "us-west-2", Include: []string{SectionIdentityPools}})
+	r.UseIdentityClient(identity)
+
+	err := r.RestoreBackup(context.Background(), &backup.CognitoBackup{
+		UserPoolConfig: &cognitoidentityprovider.DescribeUserPoolOutput{UserPool: &types.UserPoolType{Id: aws.String(sourcePool)}},
+		IdentityPools:  []backup.IdentityPool{identityPool("app"), identityPool("portal")},
+	})
+	if err != nil {
+		t.Fatalf("RestoreBackup() error = %v", err)
+	}
+
+	if len(identity.created) != 1 || *identity.created[0].IdentityPoolName != "app" {
+		t.Fatalf("created = %+v, want app", identity.created)
+	}
+	if len(identity.updated) != 1 || *identity.updated[0].IdentityPoolId != "us-west-2:existing" {
+		t.Fatalf("updated = %+v, want the existing portal", identity.updated)
+	}
+	if got := *identity.created[0].CognitoIdentityProviders[1].ClientId; got != "new-admin" {
+		t.Errorf("created provider client = %s, want new-admin", got)
+	}
+	if len(identity.roles) != 2 || *identity.roles[0].IdentityPoolId != "us-west-2:new-app" {
+		t.Errorf("roles set = %+v, want both pools", identity.roles)
+	}
+	if counts := r.Report().Counts["identity-pool"]; counts.Created != 1 || counts.Updated != 1 {
+		t.Errorf("identity-pool counts = %+v", counts)
+	}
+
+	// Without an identity client, the identity pools are skipped
+	r = NewRestore(client, &config.Config{PoolID: targetPool, Include: []string{SectionIdentityPools}})
+	if err := r.RestoreBackup(context.Background(), &backup.CognitoBackup{IdentityPools: []backup.IdentityPool{identityPool("app")}}); err != nil {
+		t.Fatalf("RestoreBackup() without identity client error = %v", err)
+	}
+	if counts := r.Report().Counts["identity-pool"]; counts == nil || counts.Skipped != 1 {
+		t.Errorf("identity-pool counts = %+v, want 1 skipped", counts)
+	}
+}
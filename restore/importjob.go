@@ -0,0 +1,342 @@
+package restore
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"acbr/aws"
+	"acbr/backup"
+	"acbr/config"
+	"acbr/logging"
+	"acbr/report"
+	"acbr/storage"
+
+	awssdk "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider"
+	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider/types"
+)
+
+// Importer restores users through Cognito user import jobs instead of
+// creating them one at a time with AdminCreateUser
+type Importer struct {
+	client       aws.CognitoClient
+	logs         aws.LogsClient
+	config       *config.Config
+	httpClient   *http.Client
+	pollInterval time.Duration
+	report       *report.Report
+}
+
+// ImportResult summarizes a finished user import job
+type ImportResult struct {
+	JobID             string
+	Status            types.UserImportJobStatusType
+	ImportedUsers     int64
+	SkippedUsers      int64
+	FailedUsers       int64
+	CompletionMessage string
+	// FailureRows holds the CloudWatch log lines reported for failed rows
+	FailureRows []string
+}
+
+// NewImporter creates an Importer. logs may be nil, in which case failure rows
+// are not fetched from CloudWatch Logs.
+func NewImporter(client aws.CognitoClient, logs aws.LogsClient, config *config.Config) *Importer {
+	return &Importer{
+		client:       client,
+		logs:         logs,
+		config:       config,
+		httpClient:   http.DefaultClient,
+		pollInterval: 5 * time.Second,
+		report:       report.New(config),
+	}
+}
+
+// Report returns the report of the export or import
+func (i *Importer) Report() *report.Report {
+	return i.report
+}
+
+// log returns the logger of the run, with its run and target pool IDs
+func (i *Importer) log() *slog.Logger {
+	return slog.With(logging.RunID, i.report.RunID, logging.PoolID, i.config.PoolID)
+}
+
+// Export writes the users of the backup as a user import CSV for the target
+// pool, next to the backup file. It returns the path of the CSV.
+func (i *Importer) Export(ctx context.Context) (string, error) {
+	ctx, done := i.report.Phase(ctx, "export")
+	defer done()
+	i.report.Backup = i.config.BackupPath
+	backup, err := backup.Load(ctx, i.config.BackupPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to load backup: %w", err)
+	}
+
+	data, skipped, err := i.buildCSV(ctx, backup)
+	if err != nil {
+		return "", err
+	}
+
+	store, err := storage.NewStorage(ctx, i.config.BackupPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to create storage: %w", err)
+	}
+
+	filename := fmt.Sprintf("cognito-import-%s-%s.csv",
+		i.config.PoolID,
+		time.Now().Format("20060102-150405"))
+	path := storage.SiblingPath(i.config.BackupPath, filename)
+	if err := store.Save(ctx, data, path); err != nil {
+		return "", fmt.Errorf("failed to save csv: %w", err)
+	}
+
+	i.report.Add("user", report.Counts{Skipped: skipped})
+	i.log().Info("exported users", "users", len(backup.Users)-skipped, "skipped_sso_users", skipped, "path", path)
+	return path, nil
+}
+
+// Execute imports the users of the backup into the target pool with a user
+// import job and waits for the job to finish
+func (i *Importer) Execute(ctx context.Context) (*ImportResult, error) {
+	if i.config.ImportRoleArn == "" {
+		return nil, fmt.Errorf("import-role-arn is required for user import jobs")
+	}
+
+	loadCtx, loaded := i.report.Phase(ctx, "load")
+	i.report.Backup = i.config.BackupPath
+	backup, err := backup.Load(loadCtx, i.config.BackupPath)
+	if err != nil {
+		loaded()
+		return nil, fmt.Errorf("failed to load backup: %w", err)
+	}
+
+	data, skipped, err := i.buildCSV(loadCtx, backup)
+	loaded()
+	if err != nil {
+		return nil, err
+	}
+	i.report.Add("user", report.Counts{Skipped: skipped})
+	ctx, imported := i.report.Phase(ctx, "import")
+	defer imported()
+	if skipped > 0 {
+		i.log().Warn("skipping SSO users, they cannot be imported", "users", skipped)
+	}
+
+	created, err := i.client.CreateUserImportJob(ctx, &cognitoidentityprovider.CreateUserImportJobInput{
+		UserPoolId:            &i.config.PoolID,
+		JobName:               awssdk.String(fmt.Sprintf("acbr-%s", time.Now().Format("20060102-150405"))),
+		CloudWatchLogsRoleArn: &i.config.ImportRoleArn,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create user import job: %w", err)
+	}
+	jobID := *created.UserImportJob.JobId
+
+	if err := i.upload(ctx, *created.UserImportJob.PreSignedUrl, data); err != nil {
+		return nil, fmt.Errorf("failed to upload users for job %s: %w", jobID, err)
+	}
+
+	_, err = i.client.StartUserImportJob(ctx, &cognitoidentityprovider.StartUserImportJobInput{
+		UserPoolId: &i.config.PoolID,
+		JobId:      &jobID,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to start user import job %s: %w", jobID, err)
+	}
+	i.log().Info("started user import job", "job_id", jobID)
+
+	job, err := i.wait(ctx, jobID)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ImportResult{
+		JobID:             jobID,
+		Status:            job.Status,
+		ImportedUsers:     job.ImportedUsers,
+		SkippedUsers:      job.SkippedUsers,
+		FailedUsers:       job.FailedUsers,
+		CompletionMessage: awssdk.ToString(job.CompletionMessage),
+	}
+
+	if result.FailedUsers > 0 && i.logs != nil {
+		rows, err := i.failureRows(ctx, jobID)
+		if err != nil {
+			i.log().Error("failed to read import job logs", "job_id", jobID, logging.Error, err)
+		}
+		result.FailureRows = rows
+	}
+
+	var failures []report.Failure
+	for _, row := range result.FailureRows {
+		failures = append(failures, report.Failure{Kind: "user", Message: row})
+	}
+	i.report.Add("user", report.Counts{
+		Created: int(result.ImportedUsers),
+		Skipped: int(result.SkippedUsers),
+		Failed:  int(result.FailedUsers),
+	}, failures...)
+
+	// The failed rows hold user attributes, so they go to the report only
+	i.log().Info("user import job finished", "job_id", jobID, "status", result.Status, "imported", result.ImportedUsers,
+		"skipped", result.SkippedUsers, "failed", result.FailedUsers)
+
+	if result.Status != types.UserImportJobStatusTypeSucceeded {
+		return result, fmt.Errorf("user import job %s ended with status %s: %s", jobID, result.Status, result.CompletionMessage)
+	}
+	return result, nil
+}
+
+// buildCSV renders the backup users in the CSV layout expected by the target
+// pool. Users with linked identities are skipped and counted.
+func (i *Importer) buildCSV(ctx context.Context, backup *backup.CognitoBackup) ([]byte, int, error) {
+	header, err := i.client.GetCSVHeader(ctx, &cognitoidentityprovider.GetCSVHeaderInput{
+		UserPoolId: &i.config.PoolID,
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get csv header: %w", err)
+	}
+
+	return UsersToCSV(header.CSVHeader, backup.Users)
+}
+
+// UsersToCSV converts users into a user import CSV with the given header. SSO
+// users cannot be imported and are left out; their count is returned.
+func UsersToCSV(header []string, users []types.UserType) ([]byte, int, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	if err := w.Write(header); err != nil {
+		return nil, 0, fmt.Errorf("failed to write csv header: %w", err)
+	}
+
+	skipped := 0
+	for _, user := range users {
+		attrs := make(map[string]string, len(user.Attributes))
+		for _, attr := range user.Attributes {
+			attrs[awssdk.ToString(attr.Name)] = awssdk.ToString(attr.Value)
+		}
+		if _, ok := attrs["identities"]; ok {
+			skipped++
+			continue
+		}
+
+		row := make([]string, len(header))
+		for n, column := range header {
+			switch column {
+			case "cognito:username":
+				row[n] = awssdk.ToString(user.Username)
+			case "cognito:mfa_enabled":
+				row[n] = fmt.Sprintf("%t", len(user.MFAOptions) > 0)
+			case "email_verified", "phone_number_verified":
+				row[n] = "false"
+				if v, ok := attrs[column]; ok {
+					row[n] = v
+				}
+			default:
+				row[n] = attrs[column]
+			}
+		}
+		if err := w.Write(row); err != nil {
+			return nil, 0, fmt.Errorf("failed to write csv row for %s: %w", logging.User(awssdk.ToString(user.Username)), err)
+		}
+	}
+
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return nil, 0, fmt.Errorf("failed to write csv: %w", err)
+	}
+	return buf.Bytes(), skipped, nil
+}
+
+func (i *Importer) upload(ctx context.Context, url string, data []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/csv")
+	req.Header.Set("x-amz-server-side-encryption", "aws:kms")
+
+	resp, err := i.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
+
+// wait polls the import job until it reaches a final status. A canceled
+// context stops the polling only; the job keeps running in Cognito.
+func (i *Importer) wait(ctx context.Context, jobID string) (*types.UserImportJobType, error) {
+	for {
+		output, err := i.client.DescribeUserImportJob(ctx, &cognitoidentityprovider.DescribeUserImportJobInput{
+			UserPoolId: &i.config.PoolID,
+			JobId:      &jobID,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe user import job %s: %w", jobID, err)
+		}
+
+		switch output.UserImportJob.Status {
+		case types.UserImportJobStatusTypeSucceeded,
+			types.UserImportJobStatusTypeFailed,
+			types.UserImportJobStatusTypeStopped,
+			types.UserImportJobStatusTypeExpired:
+			return output.UserImportJob, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("stopped waiting for user import job %s, it is still running: %w", jobID, ctx.Err())
+		case <-time.After(i.pollInterval):
+		}
+	}
+}
+
+// failedRowMarker starts the log events of the rows an import job failed, such
+// as "[ERROR] Line Number 2 - The username already exists."; the stream also
+// holds the job's progress and summary events
+const failedRowMarker = "[ERROR]"
+
+// failureRows reads the failed rows from the import job log stream, which
+// Cognito writes to a log group under /aws/cognito/userpools/<pool id>
+func (i *Importer) failureRows(ctx context.Context, jobID string) ([]string, error) {
+	groups, err := i.logs.DescribeLogGroups(ctx, &cloudwatchlogs.DescribeLogGroupsInput{
+		LogGroupNamePrefix: awssdk.String("/aws/cognito/userpools/" + i.config.PoolID),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []string
+	for _, group := range groups.LogGroups {
+		paginator := cloudwatchlogs.NewFilterLogEventsPaginator(i.logs, &cloudwatchlogs.FilterLogEventsInput{
+			LogGroupName:        group.LogGroupName,
+			LogStreamNamePrefix: &jobID,
+			FilterPattern:       awssdk.String(`"ERROR"`),
+		})
+		for paginator.HasMorePages() {
+			output, err := paginator.NextPage(ctx)
+			if err != nil {
+				return rows, err
+			}
+			for _, event := range output.Events {
+				if message := awssdk.ToString(event.Message); strings.HasPrefix(message, failedRowMarker) {
+					rows = append(rows, message)
+				}
+			}
+		}
+	}
+	return rows, nil
+}
@@ -0,0 +1,153 @@
+package restore
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"acbr/backup"
+	"acbr/config"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	logtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider/types"
+)
+
+// mockLogsClient serves the events of one import job log stream
+type mockLogsClient struct {
+	events        []string
+	filterPattern string
+}
+
+func (m *mockLogsClient) DescribeLogGroups(ctx context.Context, params *cloudwatchlogs.DescribeLogGroupsInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.DescribeLogGroupsOutput, error) {
+	return &cloudwatchlogs.DescribeLogGroupsOutput{
+		LogGroups: []logtypes.LogGroup{{LogGroupName: aws.String("/aws/cognito/userpools/test-pool")}},
+	}, nil
+}
+
+func (m *mockLogsClient) FilterLogEvents(ctx context.Context, params *cloudwatchlogs.FilterLogEventsInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.FilterLogEventsOutput, error) {
+	m.filterPattern = aws.ToString(params.FilterPattern)
+	var events []logtypes.FilteredLogEvent
+	for _, message := range m.events {
+		events = append(events, logtypes.FilteredLogEvent{Message: aws.String(message)})
+	}
+	return &cloudwatchlogs.FilterLogEventsOutput{Events: events}, nil
+}
+
+func TestUsersToCSV(t *testing.T) {
+	header := []string{"name", "email", "email_verified", "cognito:mfa_enabled", "cognito:username"}
+	users := []types.UserType{
+		{
+			Username: aws.String("alice"),
+			Attributes: []types.AttributeType{
+				{Name: aws.String("email"), Value: aws.String("alice@example.com")},
+				{Name: aws.String("email_verified"), Value: aws.String("true")},
+				{Name: aws.String("name"), Value: aws.String("Alice, A.")},
+			},
+		},
+		{
+			Username: aws.String("google_123"),
+			Attributes: []types.AttributeType{
+				{Name: aws.String("identities"), Value: aws.String("[]")},
+			},
+		},
+		{
+			Username:   aws.String("bob"),
+			MFAOptions: []types.MFAOptionType{{AttributeName: aws.String("phone_number")}},
+		},
+	}
+
+	data, skipped, err := UsersToCSV(header, users)
+	if err != nil {
+		t.Fatalf("UsersToCSV() error = %v", err)
+	}
+	if skipped != 1 {
+		t.Errorf("UsersToCSV() skipped = %d, want 1", skipped)
+	}
+
+	want := "name,email,email_verified,cognito:mfa_enabled,cognito:username\n" +
+		"\"Alice, A.\",alice@example.com,true,false,alice\n" +
+		",,false,true,bob\n"
+	if string(data) != want {
+		t.Errorf("UsersToCSV() =\n%s\nwant\n%s", data, want)
+	}
+}
+
+func TestImporterExecute(t *testing.T) {
+	var uploaded string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			t.Errorf("upload method = %s, want PUT", r.Method)
+		}
+		if got := r.Header.Get("x-amz-server-side-encryption"); got != "aws:kms" {
+			t.Errorf("upload encryption header = %q, want aws:kms", got)
+		}
+		body, _ := io.ReadAll(r.Body)
+		uploaded = string(body)
+	}))
+	defer server.Close()
+
+	path := writeBackup(t, &backup.CognitoBackup{
+		Users: []types.UserType{{Username: aws.String("alice")}},
+	})
+
+	client := &mockCognitoClient{
+		csvHeader:    []string{"cognito:username"},
+		preSignedURL: server.URL,
+		importStatuses: []types.UserImportJobType{
+			{Status: types.UserImportJobStatusTypeInProgress},
+			{Status: types.UserImportJobStatusTypeSucceeded, ImportedUsers: 1},
+		},
+	}
+	importer := NewImporter(client, nil, &config.Config{
+		PoolID:        "test-pool",
+		BackupPath:    path,
+		ImportRoleArn: "arn:aws:iam::123456789012:role/import",
+	})
+	importer.pollInterval = 0
+
+	result, err := importer.Execute(context.Background())
+	if err != nil {
+		t.Fatalf("Execute() error = %v", err)
+	}
+	if !client.importStarted {
+		t.Error("Execute() did not start the import job")
+	}
+	if result.ImportedUsers != 1 {
+		t.Errorf("Execute() imported = %d, want 1", result.ImportedUsers)
+	}
+	if !strings.Contains(uploaded, "alice") {
+		t.Errorf("uploaded csv = %q, want it to contain alice", uploaded)
+	}
+}
+
+func TestImporterFailureRows(t *testing.T) {
+	logs := &mockLogsClient{events: []string{
+		"[INFO] Import job import-1 started.",
+		"[ERROR] Line Number 2 - The username already exists.",
+		"[INFO] Line Number 3 - The user was imported.",
+		"[ERROR] Line Number 4 - Invalid email address format.",
+		"[INFO] Import job import-1 finished: 1 imported, 2 failed.",
+	}}
+	importer := NewImporter(&mockCognitoClient{}, logs, &config.Config{PoolID: "test-pool"})
+
+	rows, err := importer.failureRows(context.Background(), "import-1")
+	if err != nil {
+		t.Fatalf("failureRows() error = %v", err)
+	}
+	want := []string{
+		"[ERROR] Line Number 2 - The username already exists.",
+		"[ERROR] Line Number 4 - Invalid email address format.",
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("failureRows() = %v, want %v", rows, want)
+	}
+	if logs.filterPattern == "" {
+		t.Error("failureRows() read the log stream without a filter pattern")
+	}
+}
@@ -0,0 +1,71 @@
+package restore
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"acbr/backup"
+	"acbr/storage"
+)
+
+// loadBackup loads the backup to restore. Incremental backups are merged with
+// their chain, and with AsOf set the pool state at that time is rebuilt from
+// the backups in BackupPath.
+func (r *Restore) loadBackup(ctx context.Context) (*backup.CognitoBackup, error) {
+	var (
+		merged *backup.CognitoBackup
+		chain  []*backup.Manifest
+		err    error
+	)
+	if r.config.AsOf.IsZero() {
+		merged, chain, err = backup.Resolve(ctx, r.config.BackupPath)
+	} else {
+		merged, chain, err = r.loadAsOf(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if chain != nil || r.config.Preview {
+		r.logBackup(merged, chain)
+	}
+	return merged, nil
+}
+
+// loadAsOf merges the chain of the newest backup taken at or before AsOf.
+// BackupPath is the backup directory, or one of the pool's backups in it.
+func (r *Restore) loadAsOf(ctx context.Context) (*backup.CognitoBackup, []*backup.Manifest, error) {
+	dir, poolID := r.config.BackupPath, r.config.SourcePoolID
+	if strings.HasSuffix(dir, ".json") {
+		b, err := backup.Load(ctx, dir)
+		if err != nil {
+			return nil, nil, err
+		}
+		if poolID == "" && b.Manifest != nil {
+			poolID = b.Manifest.PoolID
+		}
+		dir = storage.Dir(dir)
+	}
+	if poolID == "" {
+		return nil, nil, fmt.Errorf("source pool is required to restore as of a time from %s", dir)
+	}
+
+	return backup.AsOf(ctx, dir, poolID, r.config.AsOf)
+}
+
+// logBackup logs the backups merged and what the result holds
+func (r *Restore) logBackup(b *backup.CognitoBackup, chain []*backup.Manifest) {
+	for _, manifest := range chain {
+		r.log().Info("merging backup", "backup", manifest.ID, "type", manifest.Type, "created_at", manifest.CreatedAt.Format(time.RFC3339))
+	}
+
+	memberships := 0
+	for _, usernames := range b.GroupMemberships {
+		memberships += len(usernames)
+	}
+	r.log().Info("loaded backup", "backups", len(chain), "users", len(b.Users), "groups", len(b.Groups),
+		"memberships", memberships, "clients", len(b.Clients), "resource_servers", len(b.ResourceServers),
+		"identity_providers", len(b.IdentityProviders))
+}
@@ -0,0 +1,83 @@
+package restore
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"acbr/backup"
+	"acbr/config"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider/types"
+)
+
+func TestRestoreAsOf(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	chain := []*backup.CognitoBackup{
+		{
+			Manifest: &backup.Manifest{ID: "cognito-backup-src-1.json", PoolID: "src", Type: backup.BackupTypeFull, CreatedAt: start},
+			Users:    []types.UserType{{Username: aws.String("alice")}, {Username: aws.String("bob")}},
+		},
+		{
+			Manifest:     &backup.Manifest{ID: "cognito-backup-src-2-incr.json", PoolID: "src", Type: backup.BackupTypeIncremental, Parent: "cognito-backup-src-1.json", CreatedAt: start.Add(time.Hour)},
+			Users:        []types.UserType{{Username: aws.String("carol")}},
+			DeletedUsers: []string{"alice"},
+		},
+		{
+			Manifest: &backup.Manifest{ID: "cognito-backup-src-3-incr.json", PoolID: "src", Type: backup.BackupTypeIncremental, Parent: "cognito-backup-src-2-incr.json", CreatedAt: start.Add(2 * time.Hour)},
+			Users:    []types.UserType{{Username: aws.String("dave")}},
+		},
+	}
+	var last string
+	for _, b := range chain {
+		path, err := backup.Save(context.Background(), dir, b.Manifest.ID, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		last = path
+	}
+
+	tests := []struct {
+		name       string
+		backupPath string
+		source     string
+		asOf       time.Time
+		preview    bool
+		want       []string
+		wantErr    bool
+	}{
+		{name: "full backup only", backupPath: dir, source: "src", asOf: start.Add(30 * time.Minute), want: []string{"alice", "bob"}},
+		{name: "applies tombstones", backupPath: dir, source: "src", asOf: start.Add(90 * time.Minute), want: []string{"bob", "carol"}},
+		{name: "pool from backup file", backupPath: last, asOf: start.Add(3 * time.Hour), want: []string{"bob", "carol", "dave"}},
+		{name: "incremental without as-of", backupPath: last, want: []string{"bob", "carol", "dave"}},
+		{name: "preview", backupPath: dir, source: "src", asOf: start.Add(3 * time.Hour), preview: true},
+		{name: "before first backup", backupPath: dir, source: "src", asOf: start.Add(-time.Hour), wantErr: true},
+		{name: "directory without source", backupPath: dir, asOf: start, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockCognitoClient{}
+			r := NewRestore(client, &config.Config{
+				PoolID:       "target",
+				BackupPath:   tt.backupPath,
+				SourcePoolID: tt.source,
+				AsOf:         tt.asOf,
+				Preview:      tt.preview,
+				UsersOnly:    true,
+				DefaultPwd:   "Temp123!",
+			})
+
+			err := r.Execute(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Execute() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(sorted(client.createdUsers), tt.want) {
+				t.Errorf("Execute() created users %v, want %v", client.createdUsers, tt.want)
+			}
+		})
+	}
+}
@@ -2,14 +2,19 @@ package restore
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
 	"strings"
+	"sync"
 
 	"acbr/aws"
 	"acbr/backup"
 	"acbr/config"
+	"acbr/logging"
+	"acbr/report"
 	"acbr/storage"
+	"acbr/transform"
 
 	awssdk "github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider"
@@ -17,111 +22,286 @@ import (
 )
 
 type Restore struct {
-	client aws.CognitoClient
-	config *config.Config
+	client      aws.CognitoClient
+	identity    aws.IdentityClient
+	config      *config.Config
+	transformer *transform.Transformer
+	report      *report.Report
 }
 
 func NewRestore(client aws.CognitoClient, config *config.Config) *Restore {
 	return &Restore{
 		client: client,
 		config: config,
+		report: report.New(config),
 	}
 }
 
-func (r *Restore) Execute() error {
+// Report returns the report of what the restore did so far
+func (r *Restore) Report() *report.Report {
+	return r.report
+}
+
+// log returns the logger of the run, with its run and target pool IDs
+func (r *Restore) log() *slog.Logger {
+	return slog.With(logging.RunID, r.report.RunID, logging.PoolID, r.config.PoolID)
+}
+
+func (r *Restore) Execute(ctx context.Context) error {
 	// Load backup
-	backup, err := r.loadBackup()
+	loadCtx, loaded := r.report.Phase(ctx, "load")
+	backup, err := r.loadBackup(loadCtx)
+	loaded()
+	r.report.Backup = r.config.BackupPath
 	if err != nil {
 		return fmt.Errorf("failed to load backup: %w", err)
 	}
+	if r.config.Preview {
+		return nil
+	}
+
+	return r.RestoreBackup(ctx, backup)
+}
 
-	// If users-only mode, only restore users and groups
-	if r.config.UsersOnly {
-		return r.restoreUsersAndGroups(backup)
+// RestoreBackup restores an already loaded backup, applying the configured
+// section selection, filters and transformation rules
+func (r *Restore) RestoreBackup(ctx context.Context, backup *backup.CognitoBackup) error {
+	// Keep only the selected sections and items
+	selection, err := NewSelection(r.config)
+	if err != nil {
+		return err
 	}
+	backup = selection.Apply(backup)
 
-	// Check if target pool exists
-	_, err = r.client.DescribeUserPool(context.Background(), &cognitoidentityprovider.DescribeUserPoolInput{
-		UserPoolId: &r.config.PoolID,
-	})
+	if err := r.loadTransformer(ctx); err != nil {
+		return err
+	}
+
+	progress, err := r.loadCheckpoint(ctx)
 	if err != nil {
-		// If pool doesn't exist, create new one with provided name
-		backup.UserPoolConfig.UserPool.Name = awssdk.String(r.config.PoolID)
-		poolID, err := r.createUserPool(backup.UserPoolConfig)
-		if err != nil {
-			return fmt.Errorf("failed to create user pool: %w", err)
+		return err
+	}
+	if err := r.restoreSections(ctx, backup, selection, progress); err != nil {
+		// Keep what was done so running the restore again picks up from here
+		r.log().Warn("restore stopped", progress.summary()...)
+		if saveErr := progress.save(ctx); saveErr != nil {
+			return errors.Join(err, saveErr)
 		}
-		r.config.PoolID = poolID
-		fmt.Printf("Created new pool: %s\n", poolID)
-	} else {
-		fmt.Printf("Using existing pool: %s\n", r.config.PoolID)
+		if progress.dir != "" {
+			r.log().Info("checkpoint saved, run the restore again to resume", "path", progress.path)
+		}
+		return err
+	}
+	if err := progress.clear(ctx); err != nil {
+		return err
 	}
 
-	// Restore full configuration
-	if err := r.restoreUserPool(backup); err != nil {
-		return fmt.Errorf("failed to restore user pool: %w", err)
+	r.log().Info("restore finished")
+	return nil
+}
+
+// restoreSections restores the selected sections, skipping those the
+// checkpoint records as done and recording the ones it restores
+func (r *Restore) restoreSections(ctx context.Context, backup *backup.CognitoBackup, selection *Selection, progress *checkpoint) error {
+	// Pool configuration sections need the target pool to exist
+	if selection.IncludesPoolConfig() && !progress.isDone("pool") {
+		poolCtx, done := r.report.Phase(ctx, "pool")
+		if err := r.ensureUserPool(poolCtx, backup); err != nil {
+			done()
+			return err
+		}
+		progress.PoolID = r.config.PoolID
+		r.report.PoolID = r.config.PoolID
+
+		err := r.restoreUserPool(poolCtx, backup, selection)
+		done()
+		if err != nil {
+			return fmt.Errorf("failed to restore user pool: %w", err)
+		}
+		progress.complete("pool")
 	}
 
-	// Always restore users and groups after pool configuration
-	if err := r.restoreUsersAndGroups(backup); err != nil {
+	// Restore users and groups after pool configuration
+	if err := r.restoreUsersAndGroups(ctx, backup, selection, progress); err != nil {
 		return fmt.Errorf("failed to restore users and groups: %w", err)
 	}
+	return nil
+}
 
-	fmt.Printf("Successfully restored to pool: %s\n", r.config.PoolID)
+// ensureUserPool creates the target pool from the backup if it doesn't exist
+func (r *Restore) ensureUserPool(ctx context.Context, backup *backup.CognitoBackup) error {
+	// Check if target pool exists
+	_, err := r.client.DescribeUserPool(ctx, &cognitoidentityprovider.DescribeUserPoolInput{
+		UserPoolId: &r.config.PoolID,
+	})
+	if err == nil {
+		r.log().Info("using existing pool")
+		return nil
+	}
+
+	// If pool doesn't exist, create new one with provided name
+	backup.UserPoolConfig.UserPool.Name = awssdk.String(r.config.PoolID)
+	poolID, err := r.createUserPool(ctx, backup.UserPoolConfig)
+	if err != nil {
+		r.report.Failed("pool", r.config.PoolID, err)
+		return fmt.Errorf("failed to create user pool: %w", err)
+	}
+	r.report.Created("pool")
+	r.config.PoolID = poolID
+	r.log().Info("created pool", logging.Resource, "pool", logging.Name, *backup.UserPoolConfig.UserPool.Name)
 	return nil
 }
 
-func (r *Restore) restoreUsersAndGroups(backup *backup.CognitoBackup) error {
+// restoreUsersAndGroups creates groups, then users, then memberships, each on
+// the configured number of workers. A failure doesn't stop the other items;
+// memberships of failed users and groups are left out and all errors returned.
+// With ContinueOnError, failures within the error budget don't fail the
+// restore and the first failure past it stops starting new items. Failed
+// items are written to a file in backup format to retry them.
+func (r *Restore) restoreUsersAndGroups(ctx context.Context, backup *backup.CognitoBackup, selection *Selection, progress *checkpoint) error {
+	workers := r.config.GetWorkers()
+	var (
+		mu      sync.Mutex
+		failed  = make(map[string]error) // groups, users and memberships that couldn't be restored
+		skipped = make(map[string]bool)  // users skipped by transform rules
+	)
+
+	total := len(backup.Groups) + len(backup.Users)
+	for _, usernames := range backup.GroupMemberships {
+		total += len(usernames)
+	}
+	limit := r.config.ErrorBudget.Limit(total)
+	ctx, stop := context.WithCancelCause(ctx)
+	defer stop(nil)
+	// fail records a failed item; the caller holds mu
+	fail := func(item string, err error) {
+		failed[item] = err
+		kind, name, _ := strings.Cut(item, "/")
+		r.log().Warn("failed to restore", logging.Resource, kind, logging.Name, logging.ResourceName(kind, name), logging.Error, err)
+		if r.config.ContinueOnError && len(failed) > limit {
+			stop(fmt.Errorf("%w: %d failures, the budget is %d", errBudgetExceeded, len(failed), limit))
+		}
+	}
 
-	fmt.Printf("Restoring groups: %v\n", backup.Groups)
 	// Restore groups first
-	for _, group := range backup.Groups {
-		if err := r.createGroup(&group); err != nil {
-			return fmt.Errorf("failed to create group %s: %w", *group.GroupName, err)
-		}
+	var groupErr error
+	if selection.Includes(SectionGroups) {
+		ctx, done := r.report.Phase(ctx, "groups")
+		groupErr = forEach(ctx, workers, backup.Groups, func(group types.GroupType) error {
+			if progress.isDone("group/" + *group.GroupName) {
+				r.report.Skipped("group")
+				return nil
+			}
+			if err := r.createGroup(ctx, &group); err != nil {
+				mu.Lock()
+				fail("group/"+*group.GroupName, err)
+				mu.Unlock()
+				r.report.Failed("group", *group.GroupName, err)
+				return fmt.Errorf("failed to create group %s: %w", *group.GroupName, err)
+			}
+			progress.complete("group/" + *group.GroupName)
+			r.report.Created("group")
+			return nil
+		})
+		done()
 	}
 
 	// Restore users
-	for _, user := range backup.Users {
-		if err := r.createUser(&user); err != nil {
-			return fmt.Errorf("failed to create user %s: %w", *user.Username, err)
+	var userErr error
+	if selection.Includes(SectionUsers) {
+		ctx, done := r.report.Phase(ctx, "users")
+		userErr = forEach(ctx, workers, backup.Users, func(user types.UserType) error {
+			if progress.isDone("user/" + *user.Username) {
+				r.report.Skipped("user")
+				return nil
+			}
+			created, err := r.CreateUser(ctx, &user)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				fail("user/"+*user.Username, err)
+				r.report.Failed("user", *user.Username, err)
+				return fmt.Errorf("failed to create user %s: %w", logging.User(*user.Username), err)
+			}
+			if created == nil {
+				skipped[*user.Username] = true
+				r.report.Skipped("user")
+				return nil
+			}
+			progress.complete("user/" + *user.Username)
+			r.report.Created("user")
+			return nil
+		})
+		done()
+	}
+
+	// Restore group memberships once both sides exist
+	var membershipErr error
+	if selection.Includes(SectionMemberships) {
+		var memberships []membership
+		for group, usernames := range backup.GroupMemberships {
+			for _, username := range usernames {
+				if skipped[username] || failed["user/"+username] != nil || failed["group/"+group] != nil ||
+					progress.isDone("membership/"+group+"/"+username) {
+					r.report.Skipped("membership")
+					continue
+				}
+				memberships = append(memberships, membership{group: group, username: username})
+			}
 		}
+		ctx, done := r.report.Phase(ctx, "memberships")
+		membershipErr = forEach(ctx, workers, memberships, func(m membership) error {
+			if err := r.addUserToGroup(ctx, m.username, m.group); err != nil {
+				mu.Lock()
+				fail("membership/"+m.group+"/"+m.username, err)
+				mu.Unlock()
+				r.report.Failed("membership", m.group+"/"+m.username, err)
+				return fmt.Errorf("failed to add user %s to group %s: %w", logging.User(m.username), m.group, err)
+			}
+			progress.complete("membership/" + m.group + "/" + m.username)
+			r.report.Created("membership")
+			return nil
+		})
+		done()
 	}
 
-	return nil
+	if len(failed) > 0 {
+		if err := r.saveFailedItems(ctx, backup, failed); err != nil {
+			r.log().Error("failed to save the failed items", logging.Error, err)
+		}
+	}
+	err := errors.Join(groupErr, userErr, membershipErr)
+	if err != nil && r.config.ContinueOnError && ctx.Err() == nil {
+		r.log().Warn("continuing past failed items within the error budget", "failed", len(failed), "budget", limit)
+		return nil
+	}
+	return err
 }
 
-func (r *Restore) loadBackup() (*backup.CognitoBackup, error) {
-	// Create storage based on backup path
-	storage, err := storage.NewStorage(r.config.BackupPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create storage: %w", err)
-	}
+type membership struct {
+	group    string
+	username string
+}
 
-	// For S3, use just the filename
-	path := r.config.BackupPath
-	if strings.HasPrefix(path, "s3://") {
-		parts := strings.Split(path, "/")
-		// Get the last part (filename)
-		path = parts[len(parts)-1]
+// loadTransformer reads the attribute transformation rules, if configured
+func (r *Restore) loadTransformer(ctx context.Context) error {
+	if r.config.TransformFile == "" || r.transformer != nil {
+		return nil
 	}
 
-	// Load backup data
-	data, err := storage.Load(context.Background(), path)
+	data, err := storage.ReadFile(ctx, r.config.TransformFile)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load backup: %w", err)
+		return fmt.Errorf("failed to load transform rules: %w", err)
 	}
-
-	// Unmarshal backup data
-	var backup backup.CognitoBackup
-	if err := json.Unmarshal(data, &backup); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal backup: %w", err)
+	transformer, err := transform.Parse(data)
+	if err != nil {
+		return fmt.Errorf("failed to load transform rules: %w", err)
 	}
-
-	return &backup, nil
+	r.transformer = transformer
+	return nil
 }
 
-func (r *Restore) createUserPool(config *cognitoidentityprovider.DescribeUserPoolOutput) (string, error) {
+func (r *Restore) createUserPool(ctx context.Context, config *cognitoidentityprovider.DescribeUserPoolOutput) (string, error) {
 	input := &cognitoidentityprovider.CreateUserPoolInput{
 		PoolName: config.UserPool.Name,
 		// Copy relevant settings from config.UserPool
@@ -133,7 +313,7 @@ func (r *Restore) createUserPool(config *cognitoidentityprovider.DescribeUserPoo
 		// Add other configurations as needed
 	}
 
-	result, err := r.client.CreateUserPool(context.Background(), input)
+	result, err := r.client.CreateUserPool(ctx, input)
 	if err != nil {
 		return "", fmt.Errorf("failed to create user pool: %w", err)
 	}
@@ -141,7 +321,7 @@ func (r *Restore) createUserPool(config *cognitoidentityprovider.DescribeUserPoo
 	return *result.UserPool.Id, nil
 }
 
-func (r *Restore) createGroup(group *types.GroupType) error {
+func (r *Restore) createGroup(ctx context.Context, group *types.GroupType) error {
 	input := &cognitoidentityprovider.CreateGroupInput{
 		GroupName:   group.GroupName,
 		UserPoolId:  &r.config.PoolID,
@@ -150,7 +330,7 @@ func (r *Restore) createGroup(group *types.GroupType) error {
 		RoleArn:     group.RoleArn,
 	}
 
-	_, err := r.client.CreateGroup(context.Background(), input)
+	_, err := r.client.CreateGroup(ctx, input)
 	if err != nil {
 		return fmt.Errorf("failed to create group: %w", err)
 	}
@@ -158,7 +338,25 @@ func (r *Restore) createGroup(group *types.GroupType) error {
 	return nil
 }
 
-func (r *Restore) createUser(user *types.UserType) error {
+// CreateUser recreates a backed up user, disabled if it was disabled before.
+// It returns the user as created in the target pool, or nil when a transform
+// rule skipped the user.
+func (r *Restore) CreateUser(ctx context.Context, user *types.UserType) (*types.UserType, error) {
+	// Apply transformation rules before anything is sent, so that
+	// skipped users need no password
+	attrs := user.Attributes
+	if r.transformer != nil {
+		transformed, skip, err := r.transformer.Apply(*user.Username, attrs)
+		if err != nil {
+			return nil, fmt.Errorf("failed to transform user: %w", err)
+		}
+		if skip {
+			r.log().Info("skipping user by transform rule", logging.Resource, "user", logging.Name, logging.User(*user.Username))
+			return nil, nil
+		}
+		attrs = transformed
+	}
+
 	// Check if user is from SSO (has identities attribute)
 	isSSO := false
 	for _, attr := range user.Attributes {
@@ -169,14 +367,14 @@ func (r *Restore) createUser(user *types.UserType) error {
 	}
 
 	if isSSO {
-		fmt.Printf("Skipping password for SSO user: %s\n", *user.Username)
+		r.log().Debug("skipping password for SSO user", logging.Resource, "user", logging.Name, logging.User(*user.Username))
 	} else if r.config.DefaultPwd == "" {
-		return fmt.Errorf("default-pwd is required for non-SSO user: %s", *user.Username)
+		return nil, fmt.Errorf("default-pwd is required for non-SSO user: %s", logging.User(*user.Username))
 	}
 
 	// Filter out non-mutable attributes
 	var filteredAttrs []types.AttributeType
-	for _, attr := range user.Attributes {
+	for _, attr := range attrs {
 		if *attr.Name != "sub" && *attr.Name != "identities" {
 			filteredAttrs = append(filteredAttrs, attr)
 		}
@@ -194,59 +392,80 @@ func (r *Restore) createUser(user *types.UserType) error {
 		input.TemporaryPassword = awssdk.String(r.config.DefaultPwd)
 	}
 
-	_, err := r.client.AdminCreateUser(context.Background(), input)
+	output, err := r.client.AdminCreateUser(ctx, input)
 	if err != nil {
-		return fmt.Errorf("failed to create user: %w", err)
+		return nil, fmt.Errorf("failed to create user: %w", err)
 	}
 
-	return nil
+	// New users are enabled, carry over the disabled state
+	if !user.Enabled {
+		_, err := r.client.AdminDisableUser(ctx, &cognitoidentityprovider.AdminDisableUserInput{
+			UserPoolId: &r.config.PoolID,
+			Username:   user.Username,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to disable user: %w", err)
+		}
+	}
+
+	return output.User, nil
 }
 
-func (r *Restore) restoreUserPool(backup *backup.CognitoBackup) error {
-	// Update user pool settings
-	updateInput := &cognitoidentityprovider.UpdateUserPoolInput{
+func (r *Restore) addUserToGroup(ctx context.Context, username, group string) error {
+	_, err := r.client.AdminAddUserToGroup(ctx, &cognitoidentityprovider.AdminAddUserToGroupInput{
 		UserPoolId: &r.config.PoolID,
-		// Copy settings from backup.UserPoolConfig.UserPool
-		Policies:               backup.UserPoolConfig.UserPool.Policies,
-		AutoVerifiedAttributes: backup.UserPoolConfig.UserPool.AutoVerifiedAttributes,
-		MfaConfiguration:       backup.UserPoolConfig.UserPool.MfaConfiguration,
-		EmailConfiguration:     backup.UserPoolConfig.UserPool.EmailConfiguration,
-		SmsConfiguration:       backup.UserPoolConfig.UserPool.SmsConfiguration,
-		// Add other configurations as needed
+		Username:   &username,
+		GroupName:  &group,
+	})
+	return err
+}
+
+func (r *Restore) restoreUserPool(ctx context.Context, backup *backup.CognitoBackup, selection *Selection) error {
+	// Update user pool settings and triggers
+	if selection.Includes(SectionPool) || selection.Includes(SectionTriggers) {
+		if err := r.updateUserPool(ctx, backup, selection); err != nil {
+			return err
+		}
 	}
 
-	_, err := r.client.UpdateUserPool(context.Background(), updateInput)
-	if err != nil {
-		return fmt.Errorf("failed to update user pool: %w", err)
+	// Restore hosted UI domain
+	if selection.Includes(SectionDomain) {
+		if err := r.restoreDomain(ctx, backup); err != nil {
+			return err
+		}
 	}
 
 	// Restore resource servers
 	for _, server := range backup.ResourceServers {
-		_, err := r.client.CreateResourceServer(context.Background(), &cognitoidentityprovider.CreateResourceServerInput{
+		_, err := r.client.CreateResourceServer(ctx, &cognitoidentityprovider.CreateResourceServerInput{
 			UserPoolId: &r.config.PoolID,
 			Identifier: server.Identifier,
 			Name:       server.Name,
 			Scopes:     server.Scopes,
 		})
 		if err != nil {
+			r.report.Failed("resource-server", *server.Identifier, err)
 			return fmt.Errorf("failed to create resource server %s: %w", *server.Identifier, err)
 		}
+		r.report.Created("resource-server")
 	}
 
 	// Restore app clients
 	for _, client := range backup.Clients {
-		_, err := r.client.CreateUserPoolClient(context.Background(), &cognitoidentityprovider.CreateUserPoolClientInput{
+		_, err := r.client.CreateUserPoolClient(ctx, &cognitoidentityprovider.CreateUserPoolClientInput{
 			UserPoolId: &r.config.PoolID,
 			ClientName: client.ClientName,
 		})
 		if err != nil {
+			r.report.Failed("client", *client.ClientName, err)
 			return fmt.Errorf("failed to create client %s: %w", *client.ClientName, err)
 		}
+		r.report.Created("client")
 	}
 
 	// Restore identity providers
 	for _, provider := range backup.IdentityProviders {
-		_, err := r.client.CreateIdentityProvider(context.Background(), &cognitoidentityprovider.CreateIdentityProviderInput{
+		_, err := r.client.CreateIdentityProvider(ctx, &cognitoidentityprovider.CreateIdentityProviderInput{
 			UserPoolId:   &r.config.PoolID,
 			ProviderName: provider.ProviderName,
 			ProviderType: provider.ProviderType,
@@ -254,9 +473,112 @@ func (r *Restore) restoreUserPool(backup *backup.CognitoBackup) error {
 			// These fields need to be fetched separately if needed
 		})
 		if err != nil {
+			r.report.Failed("idp", *provider.ProviderName, err)
 			return fmt.Errorf("failed to create identity provider %s: %w", *provider.ProviderName, err)
 		}
+		r.report.Created("idp")
+	}
+
+	// Identity pools bind to the clients restored above
+	if len(backup.IdentityPools) > 0 {
+		if err := r.restoreIdentityPools(ctx, backup); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// updateUserPool applies the pool settings and/or Lambda triggers of the backup.
+// UpdateUserPool resets omitted settings, so whatever isn't restored is carried
+// over from the target pool's current configuration.
+func (r *Restore) updateUserPool(ctx context.Context, backup *backup.CognitoBackup, selection *Selection) error {
+	current, err := r.client.DescribeUserPool(ctx, &cognitoidentityprovider.DescribeUserPoolInput{
+		UserPoolId: &r.config.PoolID,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to describe user pool: %w", err)
+	}
+
+	settings := &types.UserPoolType{}
+	if current != nil && current.UserPool != nil {
+		settings = current.UserPool
+	}
+	triggers := settings.LambdaConfig
+	if selection.Includes(SectionPool) {
+		settings = backup.UserPoolConfig.UserPool
+	}
+	if selection.Includes(SectionTriggers) {
+		triggers = backup.UserPoolConfig.UserPool.LambdaConfig
+	}
+
+	updateInput := &cognitoidentityprovider.UpdateUserPoolInput{
+		UserPoolId: &r.config.PoolID,
+		// Copy settings from the selected source
+		Policies:               settings.Policies,
+		AutoVerifiedAttributes: settings.AutoVerifiedAttributes,
+		MfaConfiguration:       settings.MfaConfiguration,
+		EmailConfiguration:     settings.EmailConfiguration,
+		SmsConfiguration:       settings.SmsConfiguration,
+		LambdaConfig:           triggers,
+		// Add other configurations as needed
 	}
 
+	_, err = r.client.UpdateUserPool(ctx, updateInput)
+	if err != nil {
+		r.report.Failed("pool", r.config.PoolID, err)
+		return fmt.Errorf("failed to update user pool: %w", err)
+	}
+	r.report.Updated("pool")
 	return nil
 }
+
+// restoreDomain recreates the pool's prefix domain. Custom domains need their
+// certificate and are left to be configured by hand. The prefix is unique
+// across AWS, so when the target pool already has a domain or another pool
+// holds the prefix, the domain is skipped rather than failing the restore.
+func (r *Restore) restoreDomain(ctx context.Context, backup *backup.CognitoBackup) error {
+	pool := backup.UserPoolConfig.UserPool
+	if pool.CustomDomain != nil {
+		r.log().Warn("skipping custom domain, it must be recreated with its certificate", logging.Resource, "domain", logging.Name, *pool.CustomDomain)
+		r.report.Skipped("domain")
+	}
+	if pool.Domain == nil {
+		return nil
+	}
+
+	current, err := r.client.DescribeUserPool(ctx, &cognitoidentityprovider.DescribeUserPoolInput{
+		UserPoolId: &r.config.PoolID,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to describe user pool: %w", err)
+	}
+	if current != nil && current.UserPool != nil && current.UserPool.Domain != nil {
+		r.log().Warn("skipping domain, the target pool already has one", logging.Resource, "domain", logging.Name, *pool.Domain, "current", *current.UserPool.Domain)
+		r.report.Skipped("domain")
+		return nil
+	}
+
+	_, err = r.client.CreateUserPoolDomain(ctx, &cognitoidentityprovider.CreateUserPoolDomainInput{
+		UserPoolId: &r.config.PoolID,
+		Domain:     pool.Domain,
+	})
+	if domainTaken(err) {
+		r.log().Warn("skipping domain, the prefix is held by another pool", logging.Resource, "domain", logging.Name, *pool.Domain)
+		r.report.Skipped("domain")
+		return nil
+	}
+	if err != nil {
+		r.report.Failed("domain", *pool.Domain, err)
+		return fmt.Errorf("failed to create domain %s: %w", *pool.Domain, err)
+	}
+	r.report.Created("domain")
+	return nil
+}
+
+// domainTaken reports whether CreateUserPoolDomain failed because the prefix
+// belongs to another pool
+func domainTaken(err error) bool {
+	var invalid *types.InvalidParameterException
+	return errors.As(err, &invalid) && strings.Contains(invalid.ErrorMessage(), "already")
+}
@@ -2,24 +2,54 @@ package restore
 
 import (
 	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
 	"testing"
 
+	"acbr/backup"
 	"acbr/config"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider"
+	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider/types"
 )
 
 type mockCognitoClient struct {
 	describeUserPoolOutput *cognitoidentityprovider.DescribeUserPoolOutput
 	describeUserPoolError  error
+
+	users   []types.UserType
+	clients []types.UserPoolClientDescription
+
+	domainErr error
+	domains   []string
+
+	csvHeader      []string
+	preSignedURL   string
+	importStarted  bool
+	importStatuses []types.UserImportJobType
+
+	mu               sync.Mutex
+	createUserErrors map[string]error
+	createdUsers     []string
+	createInputs     []*cognitoidentityprovider.AdminCreateUserInput
+	disabledUsers    []string
+	memberships      []string
 }
 
 func (m *mockCognitoClient) DescribeUserPool(ctx context.Context, params *cognitoidentityprovider.DescribeUserPoolInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.DescribeUserPoolOutput, error) {
 	return m.describeUserPoolOutput, m.describeUserPoolError
 }
 
+func (m *mockCognitoClient) ListUserPools(ctx context.Context, params *cognitoidentityprovider.ListUserPoolsInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.ListUserPoolsOutput, error) {
+	return &cognitoidentityprovider.ListUserPoolsOutput{}, nil
+}
+
 func (m *mockCognitoClient) ListUsers(ctx context.Context, params *cognitoidentityprovider.ListUsersInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.ListUsersOutput, error) {
-	return &cognitoidentityprovider.ListUsersOutput{}, nil
+	return &cognitoidentityprovider.ListUsersOutput{Users: m.users}, nil
 }
 
 func (m *mockCognitoClient) ListGroups(ctx context.Context, params *cognitoidentityprovider.ListGroupsInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.ListGroupsOutput, error) {
@@ -31,7 +61,7 @@ func (m *mockCognitoClient) ListResourceServers(ctx context.Context, params *cog
 }
 
 func (m *mockCognitoClient) ListUserPoolClients(ctx context.Context, params *cognitoidentityprovider.ListUserPoolClientsInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.ListUserPoolClientsOutput, error) {
-	return &cognitoidentityprovider.ListUserPoolClientsOutput{}, nil
+	return &cognitoidentityprovider.ListUserPoolClientsOutput{UserPoolClients: m.clients}, nil
 }
 
 func (m *mockCognitoClient) ListIdentityProviders(ctx context.Context, params *cognitoidentityprovider.ListIdentityProvidersInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.ListIdentityProvidersOutput, error) {
@@ -51,7 +81,17 @@ func (m *mockCognitoClient) CreateGroup(ctx context.Context, params *cognitoiden
 }
 
 func (m *mockCognitoClient) AdminCreateUser(ctx context.Context, params *cognitoidentityprovider.AdminCreateUserInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.AdminCreateUserOutput, error) {
-	return &cognitoidentityprovider.AdminCreateUserOutput{}, nil
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.createUserErrors[*params.Username]; err != nil {
+		return nil, err
+	}
+	m.createdUsers = append(m.createdUsers, *params.Username)
+	m.createInputs = append(m.createInputs, params)
+	return &cognitoidentityprovider.AdminCreateUserOutput{User: &types.UserType{
+		Username:   params.Username,
+		Attributes: []types.AttributeType{{Name: aws.String("sub"), Value: aws.String("new-" + *params.Username)}},
+	}}, nil
 }
 
 func (m *mockCognitoClient) CreateResourceServer(ctx context.Context, params *cognitoidentityprovider.CreateResourceServerInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.CreateResourceServerOutput, error) {
@@ -66,6 +106,102 @@ func (m *mockCognitoClient) CreateIdentityProvider(ctx context.Context, params *
 	return &cognitoidentityprovider.CreateIdentityProviderOutput{}, nil
 }
 
+func (m *mockCognitoClient) GetCSVHeader(ctx context.Context, params *cognitoidentityprovider.GetCSVHeaderInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.GetCSVHeaderOutput, error) {
+	return &cognitoidentityprovider.GetCSVHeaderOutput{CSVHeader: m.csvHeader}, nil
+}
+
+func (m *mockCognitoClient) CreateUserImportJob(ctx context.Context, params *cognitoidentityprovider.CreateUserImportJobInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.CreateUserImportJobOutput, error) {
+	return &cognitoidentityprovider.CreateUserImportJobOutput{UserImportJob: &types.UserImportJobType{
+		JobId:        aws.String("import-job"),
+		PreSignedUrl: aws.String(m.preSignedURL),
+		Status:       types.UserImportJobStatusTypeCreated,
+	}}, nil
+}
+
+func (m *mockCognitoClient) StartUserImportJob(ctx context.Context, params *cognitoidentityprovider.StartUserImportJobInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.StartUserImportJobOutput, error) {
+	m.importStarted = true
+	return &cognitoidentityprovider.StartUserImportJobOutput{}, nil
+}
+
+func (m *mockCognitoClient) DescribeUserImportJob(ctx context.Context, params *cognitoidentityprovider.DescribeUserImportJobInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.DescribeUserImportJobOutput, error) {
+	if len(m.importStatuses) == 0 {
+		return nil, errors.New("unexpected DescribeUserImportJob call")
+	}
+	job := m.importStatuses[0]
+	m.importStatuses = m.importStatuses[1:]
+	return &cognitoidentityprovider.DescribeUserImportJobOutput{UserImportJob: &job}, nil
+}
+
+func (m *mockCognitoClient) ListUsersInGroup(ctx context.Context, params *cognitoidentityprovider.ListUsersInGroupInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.ListUsersInGroupOutput, error) {
+	return &cognitoidentityprovider.ListUsersInGroupOutput{}, nil
+}
+
+func (m *mockCognitoClient) AdminAddUserToGroup(ctx context.Context, params *cognitoidentityprovider.AdminAddUserToGroupInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.AdminAddUserToGroupOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.memberships = append(m.memberships, *params.GroupName+"/"+*params.Username)
+	return &cognitoidentityprovider.AdminAddUserToGroupOutput{}, nil
+}
+
+func (m *mockCognitoClient) CreateUserPoolDomain(ctx context.Context, params *cognitoidentityprovider.CreateUserPoolDomainInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.CreateUserPoolDomainOutput, error) {
+	if m.domainErr != nil {
+		return nil, m.domainErr
+	}
+	m.domains = append(m.domains, *params.Domain)
+	return &cognitoidentityprovider.CreateUserPoolDomainOutput{}, nil
+}
+
+func (m *mockCognitoClient) AdminDisableUser(ctx context.Context, params *cognitoidentityprovider.AdminDisableUserInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.AdminDisableUserOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.disabledUsers = append(m.disabledUsers, *params.Username)
+	return &cognitoidentityprovider.AdminDisableUserOutput{}, nil
+}
+
+func (m *mockCognitoClient) AdminGetUser(ctx context.Context, params *cognitoidentityprovider.AdminGetUserInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.AdminGetUserOutput, error) {
+	return &cognitoidentityprovider.AdminGetUserOutput{}, nil
+}
+
+func (m *mockCognitoClient) UpdateGroup(ctx context.Context, params *cognitoidentityprovider.UpdateGroupInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.UpdateGroupOutput, error) {
+	return &cognitoidentityprovider.UpdateGroupOutput{}, nil
+}
+
+func (m *mockCognitoClient) DeleteGroup(ctx context.Context, params *cognitoidentityprovider.DeleteGroupInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.DeleteGroupOutput, error) {
+	return &cognitoidentityprovider.DeleteGroupOutput{}, nil
+}
+
+func (m *mockCognitoClient) UpdateResourceServer(ctx context.Context, params *cognitoidentityprovider.UpdateResourceServerInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.UpdateResourceServerOutput, error) {
+	return &cognitoidentityprovider.UpdateResourceServerOutput{}, nil
+}
+
+func (m *mockCognitoClient) AdminUpdateUserAttributes(ctx context.Context, params *cognitoidentityprovider.AdminUpdateUserAttributesInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.AdminUpdateUserAttributesOutput, error) {
+	return &cognitoidentityprovider.AdminUpdateUserAttributesOutput{}, nil
+}
+
+func (m *mockCognitoClient) AdminDeleteUserAttributes(ctx context.Context, params *cognitoidentityprovider.AdminDeleteUserAttributesInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.AdminDeleteUserAttributesOutput, error) {
+	return &cognitoidentityprovider.AdminDeleteUserAttributesOutput{}, nil
+}
+
+func (m *mockCognitoClient) AdminEnableUser(ctx context.Context, params *cognitoidentityprovider.AdminEnableUserInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.AdminEnableUserOutput, error) {
+	return &cognitoidentityprovider.AdminEnableUserOutput{}, nil
+}
+
+func (m *mockCognitoClient) AdminDeleteUser(ctx context.Context, params *cognitoidentityprovider.AdminDeleteUserInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.AdminDeleteUserOutput, error) {
+	return &cognitoidentityprovider.AdminDeleteUserOutput{}, nil
+}
+
+func (m *mockCognitoClient) AdminRemoveUserFromGroup(ctx context.Context, params *cognitoidentityprovider.AdminRemoveUserFromGroupInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.AdminRemoveUserFromGroupOutput, error) {
+	return &cognitoidentityprovider.AdminRemoveUserFromGroupOutput{}, nil
+}
+
+func (m *mockCognitoClient) DescribeUserPoolClient(ctx context.Context, params *cognitoidentityprovider.DescribeUserPoolClientInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.DescribeUserPoolClientOutput, error) {
+	return &cognitoidentityprovider.DescribeUserPoolClientOutput{}, nil
+}
+
+func (m *mockCognitoClient) DescribeIdentityProvider(ctx context.Context, params *cognitoidentityprovider.DescribeIdentityProviderInput, optFns ...func(*cognitoidentityprovider.Options)) (*cognitoidentityprovider.DescribeIdentityProviderOutput, error) {
+	return &cognitoidentityprovider.DescribeIdentityProviderOutput{}, nil
+}
+
 func TestNewRestore(t *testing.T) {
 	client := &mockCognitoClient{}
 	cfg := &config.Config{
@@ -79,3 +215,127 @@ func TestNewRestore(t *testing.T) {
 		t.Error("NewRestore() returned nil")
 	}
 }
+
+func TestCreateUserTransform(t *testing.T) {
+	rules := filepath.Join(t.TempDir(), "rules.yaml")
+	err := os.WriteFile(rules, []byte(`
+rules:
+  - action: skip-user
+    pattern: '^svc-'
+  - attribute: email
+    action: replace
+    pattern: '@'
+    replacement: '+staging@'
+  - attribute: phone_number
+    action: drop
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &mockCognitoClient{}
+	r := NewRestore(client, &config.Config{PoolID: "test-pool", DefaultPwd: "Temp123!", TransformFile: rules})
+	if err := r.loadTransformer(context.Background()); err != nil {
+		t.Fatalf("loadTransformer() error = %v", err)
+	}
+
+	created, err := r.CreateUser(context.Background(), &types.UserType{
+		Username: aws.String("alice"),
+		Enabled:  true,
+		Attributes: []types.AttributeType{
+			{Name: aws.String("sub"), Value: aws.String("sub-alice")},
+			{Name: aws.String("email"), Value: aws.String("alice@x.com")},
+			{Name: aws.String("phone_number"), Value: aws.String("+15555550100")},
+		},
+	})
+	if err != nil || created == nil {
+		t.Fatalf("CreateUser() = %v, %v", created, err)
+	}
+	attrs := client.createInputs[0].UserAttributes
+	if len(attrs) != 1 || *attrs[0].Name != "email" || *attrs[0].Value != "alice+staging@x.com" {
+		t.Errorf("CreateUser() sent attributes %v, want only the rewritten email", attrs)
+	}
+
+	created, err = r.CreateUser(context.Background(), &types.UserType{Username: aws.String("svc-batch"), Enabled: true})
+	if err != nil || created != nil {
+		t.Errorf("CreateUser() = %v, %v for skipped user, want nil, nil", created, err)
+	}
+	if len(client.createdUsers) != 1 {
+		t.Errorf("created users = %v, want only alice", client.createdUsers)
+	}
+
+	// Without a default password only the users to create fail
+	r.config.DefaultPwd = ""
+	created, err = r.CreateUser(context.Background(), &types.UserType{Username: aws.String("svc-batch"), Enabled: true})
+	if err != nil || created != nil {
+		t.Errorf("CreateUser() = %v, %v for skipped user without default-pwd, want nil, nil", created, err)
+	}
+	if _, err := r.CreateUser(context.Background(), &types.UserType{Username: aws.String("bob"), Enabled: true}); err == nil {
+		t.Error("CreateUser() error = nil without default-pwd, want error")
+	}
+}
+
+func TestRestoreDomain(t *testing.T) {
+	withDomain := &backup.CognitoBackup{UserPoolConfig: &cognitoidentityprovider.DescribeUserPoolOutput{UserPool: &types.UserPoolType{Domain: aws.String("acme")}}}
+	tests := []struct {
+		name        string
+		current     *string
+		domainErr   error
+		wantCreated []string
+		wantErr     bool
+	}{
+		{name: "created", wantCreated: []string{"acme"}},
+		{name: "target has a domain", current: aws.String("acme-old")},
+		{name: "prefix taken", domainErr: &types.InvalidParameterException{Message: aws.String("Domain already associated with another user pool.")}},
+		{name: "other failure", domainErr: errors.New("access denied"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockCognitoClient{
+				describeUserPoolOutput: &cognitoidentityprovider.DescribeUserPoolOutput{UserPool: &types.UserPoolType{Domain: tt.current}},
+				domainErr:              tt.domainErr,
+			}
+			r := NewRestore(client, &config.Config{PoolID: "test-pool"})
+			err := r.restoreDomain(context.Background(), withDomain)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("restoreDomain() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(client.domains, tt.wantCreated) {
+				t.Errorf("created domains = %v, want %v", client.domains, tt.wantCreated)
+			}
+			if skipped := tt.wantCreated == nil && !tt.wantErr; skipped && r.Report().Counts["domain"].Skipped != 1 {
+				t.Errorf("domain counts = %+v, want 1 skipped", r.Report().Counts["domain"])
+			}
+		})
+	}
+
+	// The domain is only restored on request
+	selection, err := NewSelection(&config.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if selection.Includes(SectionDomain) {
+		t.Error("default selection includes the domain")
+	}
+}
+
+func TestRestorePhases(t *testing.T) {
+	client := &mockCognitoClient{describeUserPoolOutput: &cognitoidentityprovider.DescribeUserPoolOutput{UserPool: &types.UserPoolType{Id: aws.String("test-pool")}}}
+	r := NewRestore(client, &config.Config{PoolID: "test-pool", DefaultPwd: "Temp123!", Include: []string{SectionPool, SectionUsers}})
+	err := r.RestoreBackup(context.Background(), &backup.CognitoBackup{
+		UserPoolConfig: &cognitoidentityprovider.DescribeUserPoolOutput{UserPool: &types.UserPoolType{}},
+		Users:          []types.UserType{{Username: aws.String("alice"), Enabled: true}},
+	})
+	if err != nil {
+		t.Fatalf("RestoreBackup() error = %v", err)
+	}
+
+	// The pool phase ends before the users phase starts
+	var phases []string
+	for _, phase := range r.Report().Phases {
+		phases = append(phases, phase.Name)
+	}
+	if want := []string{"pool", "users"}; !reflect.DeepEqual(phases, want) {
+		t.Errorf("phases = %v, want %v", phases, want)
+	}
+}
@@ -0,0 +1,133 @@
+package restore
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"acbr/backup"
+	"acbr/logging"
+
+	awssdk "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider/types"
+)
+
+// UserResult describes one user brought back by RestoreUsers
+type UserResult struct {
+	Identifier string
+	Username   string
+	OldSub     string
+	NewSub     string
+	Enabled    bool
+	Groups     []string
+}
+
+// RestoreUsers recreates individual users from the backup. Each identifier is
+// matched against usernames, emails and subs. The users get their attributes,
+// enabled state and group memberships back; groups must already exist.
+func (r *Restore) RestoreUsers(ctx context.Context, identifiers []string) ([]UserResult, error) {
+	if len(identifiers) == 0 {
+		return nil, fmt.Errorf("at least one user is required")
+	}
+
+	loadCtx, loaded := r.report.Phase(ctx, "load")
+	backup, err := r.loadBackup(loadCtx)
+	loaded()
+	r.report.Backup = r.config.BackupPath
+	if err != nil {
+		return nil, fmt.Errorf("failed to load backup: %w", err)
+	}
+
+	if err := r.loadTransformer(ctx); err != nil {
+		return nil, err
+	}
+
+	ctx, done := r.report.Phase(ctx, "users")
+	defer done()
+
+	var results []UserResult
+	for _, identifier := range identifiers {
+		users := findUsers(backup, identifier)
+		if len(users) == 0 {
+			return results, fmt.Errorf("user %s not found in backup", logging.User(identifier))
+		}
+
+		for _, user := range users {
+			result, err := r.restoreUser(ctx, backup, identifier, user)
+			if err != nil {
+				return results, err
+			}
+			results = append(results, *result)
+		}
+	}
+
+	for _, result := range results {
+		r.log().Info("restored user", logging.Resource, "user", logging.Name, logging.User(result.Username),
+			"old_sub", result.OldSub, "new_sub", result.NewSub, "enabled", result.Enabled, "groups", result.Groups)
+	}
+	return results, nil
+}
+
+func (r *Restore) restoreUser(ctx context.Context, backup *backup.CognitoBackup, identifier string, user types.UserType) (*UserResult, error) {
+	username := awssdk.ToString(user.Username)
+	created, err := r.CreateUser(ctx, &user)
+	if err != nil {
+		r.report.Failed("user", username, err)
+		return nil, fmt.Errorf("failed to create user %s: %w", logging.User(username), err)
+	}
+
+	result := &UserResult{
+		Identifier: identifier,
+		Username:   username,
+		OldSub:     attributeValue(user.Attributes, "sub"),
+		Enabled:    user.Enabled,
+	}
+	if created == nil {
+		// Skipped by a transform rule
+		r.report.Skipped("user")
+		return result, nil
+	}
+	r.report.Created("user")
+	result.NewSub = attributeValue(created.Attributes, "sub")
+
+	for group, usernames := range backup.GroupMemberships {
+		for _, member := range usernames {
+			if member != username {
+				continue
+			}
+			if err := r.addUserToGroup(ctx, username, group); err != nil {
+				r.report.Failed("membership", group+"/"+username, err)
+				return nil, fmt.Errorf("failed to add user %s to group %s: %w", logging.User(username), group, err)
+			}
+			r.report.Created("membership")
+			result.Groups = append(result.Groups, group)
+		}
+	}
+
+	sort.Strings(result.Groups)
+
+	return result, nil
+}
+
+// findUsers returns the backup users whose username, email or sub equals identifier
+func findUsers(backup *backup.CognitoBackup, identifier string) []types.UserType {
+	var users []types.UserType
+	for _, user := range backup.Users {
+		if awssdk.ToString(user.Username) == identifier ||
+			strings.EqualFold(attributeValue(user.Attributes, "email"), identifier) ||
+			attributeValue(user.Attributes, "sub") == identifier {
+			users = append(users, user)
+		}
+	}
+	return users
+}
+
+func attributeValue(attrs []types.AttributeType, name string) string {
+	for _, attr := range attrs {
+		if awssdk.ToString(attr.Name) == name {
+			return awssdk.ToString(attr.Value)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,84 @@
+package restore
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"acbr/backup"
+	"acbr/config"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider/types"
+)
+
+func writeBackup(t *testing.T, b *backup.CognitoBackup) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "backup.json")
+	data, err := json.Marshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRestoreUsers(t *testing.T) {
+	path := writeBackup(t, &backup.CognitoBackup{
+		Users: []types.UserType{
+			{
+				Username: aws.String("alice"),
+				Enabled:  true,
+				Attributes: []types.AttributeType{
+					{Name: aws.String("sub"), Value: aws.String("sub-alice")},
+					{Name: aws.String("email"), Value: aws.String("alice@example.com")},
+				},
+			},
+			{
+				Username: aws.String("bob"),
+				Enabled:  false,
+				Attributes: []types.AttributeType{
+					{Name: aws.String("sub"), Value: aws.String("sub-bob")},
+				},
+			},
+			{Username: aws.String("carol"), Enabled: true},
+		},
+		GroupMemberships: map[string][]string{
+			"admins": {"alice", "carol"},
+			"staff":  {"alice", "bob"},
+		},
+	})
+
+	client := &mockCognitoClient{}
+	r := NewRestore(client, &config.Config{PoolID: "test-pool", BackupPath: path, DefaultPwd: "Temp123!"})
+
+	results, err := r.RestoreUsers(context.Background(), []string{"ALICE@example.com", "sub-bob"})
+	if err != nil {
+		t.Fatalf("RestoreUsers() error = %v", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("RestoreUsers() returned %d results, want 2", len(results))
+	}
+
+	alice := results[0]
+	if alice.Username != "alice" || alice.OldSub != "sub-alice" || alice.NewSub != "new-alice" {
+		t.Errorf("RestoreUsers() alice = %+v", alice)
+	}
+	if len(alice.Groups) != 2 || alice.Groups[0] != "admins" || alice.Groups[1] != "staff" {
+		t.Errorf("RestoreUsers() alice groups = %v, want [admins staff]", alice.Groups)
+	}
+	if len(client.createdUsers) != 2 {
+		t.Errorf("created users = %v, want alice and bob only", client.createdUsers)
+	}
+	if len(client.disabledUsers) != 1 || client.disabledUsers[0] != "bob" {
+		t.Errorf("disabled users = %v, want [bob]", client.disabledUsers)
+	}
+
+	if _, err := r.RestoreUsers(context.Background(), []string{"nobody"}); err == nil {
+		t.Error("RestoreUsers() error = nil for unknown user, want error")
+	}
+}
@@ -0,0 +1,51 @@
+package restore
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// forEach calls fn for every item on up to workers goroutines. It waits for
+// all calls and returns every error, joined. Once ctx is canceled no further
+// items are started and the cause of the cancellation is returned with the others.
+func forEach[T any](ctx context.Context, workers int, items []T, fn func(T) error) error {
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+
+	work := make(chan T)
+	for i := 0; i < min(workers, len(items)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range work {
+				if err := fn(item); err != nil {
+					mu.Lock()
+					errs = append(errs, err)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+dispatch:
+	for _, item := range items {
+		if ctx.Err() != nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			break dispatch
+		case work <- item:
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		errs = append(errs, context.Cause(ctx))
+	}
+	return errors.Join(errs...)
+}
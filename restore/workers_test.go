@@ -0,0 +1,104 @@
+package restore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"acbr/backup"
+	"acbr/config"
+	"acbr/report"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider/types"
+)
+
+func sorted(items []string) []string {
+	out := append([]string(nil), items...)
+	sort.Strings(out)
+	return out
+}
+
+func TestForEach(t *testing.T) {
+	var calls atomic.Int32
+	items := []int{1, 2, 3, 4, 5, 6, 7, 8}
+	err := forEach(context.Background(), 3, items, func(i int) error {
+		calls.Add(1)
+		if i%4 == 0 {
+			return fmt.Errorf("item %d", i)
+		}
+		return nil
+	})
+
+	if calls.Load() != int32(len(items)) {
+		t.Errorf("forEach() made %d calls, want %d", calls.Load(), len(items))
+	}
+	if err == nil || !strings.Contains(err.Error(), "item 4") || !strings.Contains(err.Error(), "item 8") {
+		t.Errorf("forEach() error = %v, want both item errors", err)
+	}
+}
+
+func TestForEachCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var calls atomic.Int32
+	err := forEach(ctx, 1, []int{1, 2, 3, 4}, func(i int) error {
+		if calls.Add(1) == 2 {
+			cancel()
+		}
+		return nil
+	})
+
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("forEach() error = %v, want %v", err, context.Canceled)
+	}
+	if calls.Load() > 3 {
+		t.Errorf("forEach() made %d calls after cancel, want no more items started", calls.Load())
+	}
+}
+
+func TestRestoreUsersAndGroupsWorkers(t *testing.T) {
+	failure := errors.New("limit exceeded")
+	client := &mockCognitoClient{createUserErrors: map[string]error{"bob": failure}}
+	r := NewRestore(client, &config.Config{PoolID: "test-pool", DefaultPwd: "Temp123!", Workers: 3})
+
+	b := &backup.CognitoBackup{
+		Groups: []types.GroupType{{GroupName: aws.String("admins")}, {GroupName: aws.String("staff")}},
+		GroupMemberships: map[string][]string{
+			"admins": {"alice", "bob"},
+			"staff":  {"carol", "dave"},
+		},
+	}
+	for _, username := range []string{"alice", "bob", "carol", "dave", "erin"} {
+		b.Users = append(b.Users, types.UserType{Username: aws.String(username), Enabled: true})
+	}
+
+	selection, err := NewSelection(&config.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.restoreUsersAndGroups(context.Background(), b, selection, newCheckpoint("", "test-pool"))
+	if !errors.Is(err, failure) {
+		t.Fatalf("restoreUsersAndGroups() error = %v, want %v", err, failure)
+	}
+
+	if want := []string{"alice", "carol", "dave", "erin"}; !reflect.DeepEqual(sorted(client.createdUsers), want) {
+		t.Errorf("created users = %v, want %v", sorted(client.createdUsers), want)
+	}
+	// bob's membership is left out as bob couldn't be created
+	if want := []string{"admins/alice", "staff/carol", "staff/dave"}; !reflect.DeepEqual(sorted(client.memberships), want) {
+		t.Errorf("memberships = %v, want %v", sorted(client.memberships), want)
+	}
+
+	counts := r.Report().Counts
+	if *counts["user"] != (report.Counts{Created: 4, Failed: 1}) || *counts["membership"] != (report.Counts{Created: 3, Skipped: 1}) {
+		t.Errorf("report counts = users %+v, memberships %+v", *counts["user"], *counts["membership"])
+	}
+	if failures := r.Report().Failures; len(failures) != 1 || failures[0].Name != "bob" {
+		t.Errorf("report failures = %+v, want bob", failures)
+	}
+}
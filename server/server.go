@@ -0,0 +1,512 @@
+// Package server is an HTTP API to queue runs, follow them and cancel them,
+// and to list the backups of a pool.
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"acbr/backup"
+	"acbr/config"
+	"acbr/logging"
+	"acbr/report"
+)
+
+// Job statuses besides the run statuses of the report package
+const (
+	StatusQueued   = "queued"
+	StatusRunning  = "running"
+	StatusCanceled = "canceled"
+)
+
+// Defaults unless configured
+const (
+	DefaultQueueSize   = 16
+	DefaultConcurrency = 2
+)
+
+// historyLimit is the number of finished jobs kept for their status
+const historyLimit = 1000
+
+// maxBodySize bounds the job request bodies read
+const maxBodySize = 1 << 20
+
+// Decoder reads a job request into the configuration of its run
+type Decoder func(data []byte) (*config.Config, error)
+
+// Runner runs the configured mode and finishes its report. The report is nil
+// for the modes that only work on backup files.
+type Runner func(ctx context.Context, cfg *config.Config) (*report.Report, error)
+
+// Options configure the server
+type Options struct {
+	// Token is the bearer token every request but /healthz must carry
+	Token string
+	// QueueSize is the most jobs waiting to run, Concurrency the most running
+	QueueSize   int
+	Concurrency int
+	// BackupPath is where backups are listed when a request doesn't say
+	BackupPath string
+}
+
+// Job is a queued, running or finished run
+type Job struct {
+	ID         string         `json:"id"`
+	Mode       string         `json:"mode"`
+	PoolID     string         `json:"poolId,omitempty"`
+	Pools      []string       `json:"pools,omitempty"`
+	Status     string         `json:"status"`
+	Error      string         `json:"error,omitempty"`
+	CreatedAt  time.Time      `json:"createdAt"`
+	StartedAt  *time.Time     `json:"startedAt,omitempty"`
+	FinishedAt *time.Time     `json:"finishedAt,omitempty"`
+	Report     *report.Report `json:"report,omitempty"`
+
+	cfg    *config.Config
+	cancel context.CancelFunc
+}
+
+// poolOf returns the pool a run changes or reads, which only one job at a time may use
+func poolOf(cfg *config.Config) string {
+	switch {
+	case cfg.TargetPoolID != "":
+		return cfg.TargetPoolID
+	case cfg.PoolID != "":
+		return cfg.PoolID
+	}
+	return cfg.SourcePoolID
+}
+
+// poolsOf returns the pools a run uses: those of a multi-pool backup or the
+// one of poolOf. It returns nil for a backup of the pools discovered in
+// regions, which can be any pool.
+func poolsOf(cfg *config.Config) []string {
+	switch {
+	case len(cfg.DiscoverRegions) > 0:
+		return nil
+	case len(cfg.Pools) > 0:
+		return cfg.Pools
+	}
+	return []string{poolOf(cfg)}
+}
+
+// Server queues jobs and runs them with bounded concurrency, one at a time per
+// pool. Jobs discovering their pools run alone.
+type Server struct {
+	decode Decoder
+	run    Runner
+	opts   Options
+
+	mu       sync.Mutex
+	wake     *sync.Cond
+	jobs     map[string]*Job
+	order    []string // job IDs, oldest first
+	queue    []*Job
+	busy     map[string]bool // pools with a running job
+	all      bool            // a job discovering its pools is running
+	stopping bool
+}
+
+// NewServer creates a server decoding job requests with decode and running them with run
+func NewServer(decode Decoder, run Runner, opts Options) *Server {
+	if opts.QueueSize < 1 {
+		opts.QueueSize = DefaultQueueSize
+	}
+	if opts.Concurrency < 1 {
+		opts.Concurrency = DefaultConcurrency
+	}
+	s := &Server{
+		decode: decode,
+		run:    run,
+		opts:   opts,
+		jobs:   make(map[string]*Job),
+		busy:   make(map[string]bool),
+	}
+	s.wake = sync.NewCond(&s.mu)
+	return s
+}
+
+// Run runs the queued jobs until ctx is canceled, which interrupts the
+// running jobs and cancels the queued ones. It returns once they have stopped.
+func (s *Server) Run(ctx context.Context) {
+	var workers sync.WaitGroup
+	for i := 0; i < s.opts.Concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for job := s.next(); job != nil; job = s.next() {
+				s.execute(ctx, job)
+			}
+		}()
+	}
+
+	<-ctx.Done()
+	s.mu.Lock()
+	s.stopping = true
+	for _, job := range s.queue {
+		s.finish(job, StatusCanceled, "server stopped", nil)
+	}
+	s.queue = nil
+	s.wake.Broadcast()
+	s.mu.Unlock()
+	workers.Wait()
+}
+
+// next waits for a queued job whose pool is free and marks it running. It
+// returns nil once the server is stopping.
+func (s *Server) next() *Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for !s.stopping {
+		for i, job := range s.queue {
+			pools := poolsOf(job.cfg)
+			if !s.free(pools) {
+				continue
+			}
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			s.hold(pools, true)
+			now := time.Now().UTC()
+			job.Status = StatusRunning
+			job.StartedAt = &now
+			return job
+		}
+		s.wake.Wait()
+	}
+	return nil
+}
+
+// free reports whether no running job uses the pools, or any pool for nil
+// pools; s.mu is held
+func (s *Server) free(pools []string) bool {
+	if s.all {
+		return false
+	}
+	if pools == nil {
+		return len(s.busy) == 0
+	}
+	for _, pool := range pools {
+		if s.busy[pool] {
+			return false
+		}
+	}
+	return true
+}
+
+// hold marks the pools, or every pool for nil pools, as used by a running job
+// or frees them; s.mu is held
+func (s *Server) hold(pools []string, busy bool) {
+	if pools == nil {
+		s.all = busy
+		return
+	}
+	for _, pool := range pools {
+		if busy {
+			s.busy[pool] = true
+		} else {
+			delete(s.busy, pool)
+		}
+	}
+}
+
+// execute runs a job, which can be canceled from then on
+func (s *Server) execute(ctx context.Context, job *Job) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	s.mu.Lock()
+	job.cancel = cancel
+	canceled := job.Status == StatusCanceled
+	s.mu.Unlock()
+
+	log := slog.With("job_id", job.ID, logging.PoolID, job.PoolID)
+	var rep *report.Report
+	var err error
+	if !canceled {
+		log.Info("job started", "mode", job.Mode)
+		rep, err = s.run(ctx, job.cfg)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hold(poolsOf(job.cfg), false)
+	s.wake.Broadcast()
+	if job.Status == StatusCanceled {
+		job.Report = rep
+		log.Info("job canceled")
+		return
+	}
+	status := report.StatusOf(err)
+	if rep != nil {
+		status = rep.Status
+	}
+	message := ""
+	if err != nil {
+		message = err.Error()
+	}
+	s.finish(job, status, message, rep)
+	log.Info("job finished", "status", status)
+}
+
+// finish ends a job with its outcome; s.mu is held
+func (s *Server) finish(job *Job, status, message string, rep *report.Report) {
+	now := time.Now().UTC()
+	job.Status = status
+	job.Error = message
+	job.FinishedAt = &now
+	job.Report = rep
+}
+
+// Submit queues a job for the run configured by cfg
+func (s *Server) Submit(cfg *config.Config) (*Job, error) {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	job := &Job{
+		ID:        hex.EncodeToString(id),
+		Mode:      cfg.Mode,
+		PoolID:    poolOf(cfg),
+		Pools:     cfg.Pools,
+		Status:    StatusQueued,
+		CreatedAt: time.Now().UTC(),
+		cfg:       cfg,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopping {
+		return nil, errStopping
+	}
+	if len(s.queue) >= s.opts.QueueSize {
+		return nil, errQueueFull
+	}
+	s.queue = append(s.queue, job)
+	s.jobs[job.ID] = job
+	s.order = append(s.order, job.ID)
+	s.forget()
+	s.wake.Broadcast()
+	return job, nil
+}
+
+// forget drops the oldest finished jobs past the history limit; s.mu is held
+func (s *Server) forget() {
+	excess := len(s.order) - historyLimit
+	kept := s.order[:0]
+	for _, id := range s.order {
+		if excess > 0 && s.jobs[id].FinishedAt != nil {
+			delete(s.jobs, id)
+			excess--
+			continue
+		}
+		kept = append(kept, id)
+	}
+	s.order = kept
+}
+
+// Cancel cancels a queued job, or interrupts a running one
+func (s *Server) Cancel(id string) (*Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return nil, errNotFound
+	}
+	switch job.Status {
+	case StatusQueued:
+		for i, queued := range s.queue {
+			if queued == job {
+				s.queue = append(s.queue[:i], s.queue[i+1:]...)
+				break
+			}
+		}
+		s.finish(job, StatusCanceled, "", nil)
+	case StatusRunning:
+		job.Status = StatusCanceled
+		now := time.Now().UTC()
+		job.FinishedAt = &now
+		if job.cancel != nil {
+			job.cancel()
+		}
+	default:
+		return nil, errFinished
+	}
+	return job, nil
+}
+
+var (
+	errNotFound  = errors.New("job not found")
+	errFinished  = errors.New("job has finished")
+	errQueueFull = errors.New("job queue is full")
+	errStopping  = errors.New("server is stopping")
+)
+
+// Handler returns the API's routes
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", s.health)
+	mux.Handle("POST /jobs", s.authorized(s.submit))
+	mux.Handle("GET /jobs", s.authorized(s.list))
+	mux.Handle("GET /jobs/{id}", s.authorized(s.get))
+	mux.Handle("GET /jobs/{id}/report", s.authorized(s.report))
+	mux.Handle("DELETE /jobs/{id}", s.authorized(s.cancel))
+	mux.Handle("GET /backups", s.authorized(s.backups))
+	return mux
+}
+
+// authorized rejects requests without the bearer token
+func (s *Server) authorized(handler http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.opts.Token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, errors.New("missing or invalid token"))
+			return
+		}
+		handler(w, req)
+	})
+}
+
+func (s *Server) health(w http.ResponseWriter, _ *http.Request) {
+	s.mu.Lock()
+	status := struct {
+		Status  string `json:"status"`
+		Queued  int    `json:"queued"`
+		Running int    `json:"running"`
+	}{Status: "ok", Queued: len(s.queue), Running: len(s.busy)}
+	stopping := s.stopping
+	s.mu.Unlock()
+
+	code := http.StatusOK
+	if stopping {
+		status.Status = "stopping"
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, status)
+}
+
+func (s *Server) submit(w http.ResponseWriter, req *http.Request) {
+	data, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxBodySize))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("failed to read request: %w", err))
+		return
+	}
+	cfg, err := s.decode(data)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	job, err := s.Submit(cfg)
+	switch {
+	case errors.Is(err, errQueueFull):
+		writeError(w, http.StatusTooManyRequests, err)
+	case err != nil:
+		writeError(w, http.StatusServiceUnavailable, err)
+	default:
+		slog.Info("job queued", "job_id", job.ID, "mode", job.Mode, logging.PoolID, job.PoolID)
+		w.Header().Set("Location", "/jobs/"+job.ID)
+		s.writeJob(w, http.StatusAccepted, job)
+	}
+}
+
+func (s *Server) list(w http.ResponseWriter, _ *http.Request) {
+	s.mu.Lock()
+	jobs := make([]Job, 0, len(s.order))
+	for i := len(s.order) - 1; i >= 0; i-- {
+		job := *s.jobs[s.order[i]]
+		// The list is a summary, reports are fetched per job
+		job.Report = nil
+		jobs = append(jobs, job)
+	}
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, jobs)
+}
+
+func (s *Server) get(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	job, ok := s.jobs[req.PathValue("id")]
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, errNotFound)
+		return
+	}
+	s.writeJob(w, http.StatusOK, job)
+}
+
+func (s *Server) report(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	job, ok := s.jobs[req.PathValue("id")]
+	var rep *report.Report
+	if ok {
+		rep = job.Report
+	}
+	s.mu.Unlock()
+	if rep == nil {
+		writeError(w, http.StatusNotFound, errors.New("job has no report"))
+		return
+	}
+	writeJSON(w, http.StatusOK, rep)
+}
+
+func (s *Server) cancel(w http.ResponseWriter, req *http.Request) {
+	job, err := s.Cancel(req.PathValue("id"))
+	switch {
+	case errors.Is(err, errNotFound):
+		writeError(w, http.StatusNotFound, err)
+	case err != nil:
+		writeError(w, http.StatusConflict, err)
+	default:
+		slog.Info("job cancel requested", "job_id", job.ID)
+		s.writeJob(w, http.StatusAccepted, job)
+	}
+}
+
+// backups lists the backups of the pool query parameter, in the backupPath
+// parameter or the server's backup path
+func (s *Server) backups(w http.ResponseWriter, req *http.Request) {
+	pool := req.URL.Query().Get("pool")
+	backupPath := req.URL.Query().Get("backupPath")
+	if backupPath == "" {
+		backupPath = s.opts.BackupPath
+	}
+	if pool == "" || backupPath == "" {
+		writeError(w, http.StatusBadRequest, errors.New("pool and backupPath are required"))
+		return
+	}
+
+	manifests, err := backup.List(req.Context(), backupPath, pool)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	if manifests == nil {
+		manifests = []*backup.Manifest{}
+	}
+	writeJSON(w, http.StatusOK, manifests)
+}
+
+// writeJob writes a copy of job taken under s.mu, as workers update it
+func (s *Server) writeJob(w http.ResponseWriter, code int, job *Job) {
+	s.mu.Lock()
+	snapshot := *job
+	s.mu.Unlock()
+	writeJSON(w, code, snapshot)
+}
+
+func writeJSON(w http.ResponseWriter, code int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
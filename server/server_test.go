@@ -0,0 +1,312 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"acbr/config"
+	"acbr/report"
+)
+
+const testToken = "secret"
+
+// decodeEvent reads the few event fields the tests use
+func decodeEvent(data []byte) (*config.Config, error) {
+	var event struct {
+		Mode            string   `json:"mode"`
+		PoolID          string   `json:"poolId"`
+		Pools           []string `json:"pools"`
+		DiscoverRegions []string `json:"discoverRegions"`
+	}
+	if err := json.Unmarshal(data, &event); err != nil {
+		return nil, err
+	}
+	if event.Mode == "" {
+		return nil, errors.New("mode is required")
+	}
+	return &config.Config{Mode: event.Mode, PoolID: event.PoolID, Pools: event.Pools, DiscoverRegions: event.DiscoverRegions}, nil
+}
+
+// blockingRunner runs jobs until they are released or canceled
+type blockingRunner struct {
+	mu      sync.Mutex
+	started chan string
+	release chan struct{}
+	running map[string]int
+	most    int
+	// total counts the running jobs; overlapped is set when a job discovering
+	// its pools ran alongside another
+	total       int
+	discovering bool
+	overlapped  bool
+}
+
+func newBlockingRunner() *blockingRunner {
+	return &blockingRunner{started: make(chan string, 10), release: make(chan struct{}), running: make(map[string]int)}
+}
+
+func (r *blockingRunner) run(ctx context.Context, cfg *config.Config) (*report.Report, error) {
+	discovery := len(cfg.DiscoverRegions) > 0
+	r.mu.Lock()
+	r.running[cfg.PoolID]++
+	if r.running[cfg.PoolID] > r.most {
+		r.most = r.running[cfg.PoolID]
+	}
+	if r.discovering || discovery && r.total > 0 {
+		r.overlapped = true
+	}
+	r.total++
+	r.discovering = r.discovering || discovery
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		r.running[cfg.PoolID]--
+		r.total--
+		if discovery {
+			r.discovering = false
+		}
+		r.mu.Unlock()
+	}()
+
+	r.started <- cfg.PoolID
+	rep := report.New(cfg)
+	var err error
+	select {
+	case <-r.release:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	rep.Finish(err)
+	return rep, err
+}
+
+func startServer(t *testing.T, runner Runner, opts Options) (*Server, *httptest.Server) {
+	t.Helper()
+	opts.Token = testToken
+	s := NewServer(decodeEvent, runner, opts)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+	api := httptest.NewServer(s.Handler())
+	t.Cleanup(func() {
+		api.Close()
+		cancel()
+		<-done
+	})
+	return s, api
+}
+
+func call(t *testing.T, method, url, body string, out any) int {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// waitFor polls the job until it has the status
+func waitFor(t *testing.T, url, id, status string) Job {
+	t.Helper()
+	var job Job
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		call(t, http.MethodGet, url+"/jobs/"+id, "", &job)
+		if job.Status == status {
+			return job
+		}
+	}
+	t.Fatalf("job %s is %s, want %s", id, job.Status, status)
+	return job
+}
+
+func TestJobLifecycle(t *testing.T) {
+	runner := newBlockingRunner()
+	_, api := startServer(t, runner.run, Options{})
+
+	var job Job
+	if code := call(t, http.MethodPost, api.URL+"/jobs", `{"mode": "backup", "poolId": "pool-1"}`, &job); code != http.StatusAccepted {
+		t.Fatalf("POST /jobs = %d", code)
+	}
+	if job.ID == "" || job.Mode != "backup" || job.PoolID != "pool-1" {
+		t.Errorf("POST /jobs job = %+v", job)
+	}
+	<-runner.started
+	waitFor(t, api.URL, job.ID, StatusRunning)
+
+	close(runner.release)
+	finished := waitFor(t, api.URL, job.ID, report.StatusSucceeded)
+	if finished.Report == nil || finished.Report.Mode != "backup" || finished.FinishedAt == nil {
+		t.Errorf("finished job = %+v", finished)
+	}
+
+	var rep report.Report
+	if code := call(t, http.MethodGet, api.URL+"/jobs/"+job.ID+"/report", "", &rep); code != http.StatusOK || rep.Status != report.StatusSucceeded {
+		t.Errorf("GET report = %d %s", code, rep.Status)
+	}
+	var jobs []Job
+	if code := call(t, http.MethodGet, api.URL+"/jobs", "", &jobs); code != http.StatusOK || len(jobs) != 1 || jobs[0].Report != nil {
+		t.Errorf("GET /jobs = %d %+v", code, jobs)
+	}
+	if code := call(t, http.MethodDelete, api.URL+"/jobs/"+job.ID, "", nil); code != http.StatusConflict {
+		t.Errorf("DELETE finished job = %d, want %d", code, http.StatusConflict)
+	}
+}
+
+func TestOneJobPerPool(t *testing.T) {
+	runner := newBlockingRunner()
+	_, api := startServer(t, runner.run, Options{Concurrency: 3})
+
+	var first, second, other Job
+	call(t, http.MethodPost, api.URL+"/jobs", `{"mode": "backup", "poolId": "pool-1"}`, &first)
+	call(t, http.MethodPost, api.URL+"/jobs", `{"mode": "restore", "poolId": "pool-1"}`, &second)
+	call(t, http.MethodPost, api.URL+"/jobs", `{"mode": "backup", "poolId": "pool-2"}`, &other)
+
+	// The other pool's job runs alongside the first, the second waits for it
+	<-runner.started
+	<-runner.started
+	waitFor(t, api.URL, other.ID, StatusRunning)
+	waitFor(t, api.URL, second.ID, StatusQueued)
+
+	close(runner.release)
+	waitFor(t, api.URL, second.ID, report.StatusSucceeded)
+	if runner.most != 1 {
+		t.Errorf("ran %d jobs of a pool at once, want 1", runner.most)
+	}
+}
+
+func TestMultiPoolJobHoldsItsPools(t *testing.T) {
+	runner := newBlockingRunner()
+	_, api := startServer(t, runner.run, Options{Concurrency: 3})
+
+	var multi, covered, other, discovery Job
+	call(t, http.MethodPost, api.URL+"/jobs", `{"mode": "backup", "pools": ["pool-1", "pool-2"]}`, &multi)
+	call(t, http.MethodPost, api.URL+"/jobs", `{"mode": "restore", "poolId": "pool-2"}`, &covered)
+	call(t, http.MethodPost, api.URL+"/jobs", `{"mode": "backup", "poolId": "pool-3"}`, &other)
+	if len(multi.Pools) != 2 {
+		t.Errorf("POST /jobs multi-pool job = %+v", multi)
+	}
+
+	// The restore waits for the backup covering its pool, another pool's job doesn't
+	<-runner.started
+	<-runner.started
+	waitFor(t, api.URL, multi.ID, StatusRunning)
+	waitFor(t, api.URL, other.ID, StatusRunning)
+	waitFor(t, api.URL, covered.ID, StatusQueued)
+
+	// A job discovering its pools waits for every running job, and runs alone
+	call(t, http.MethodPost, api.URL+"/jobs", `{"mode": "backup", "discoverRegions": ["us-east-1"]}`, &discovery)
+	waitFor(t, api.URL, discovery.ID, StatusQueued)
+
+	close(runner.release)
+	waitFor(t, api.URL, covered.ID, report.StatusSucceeded)
+	waitFor(t, api.URL, discovery.ID, report.StatusSucceeded)
+	runner.mu.Lock()
+	defer runner.mu.Unlock()
+	if runner.overlapped {
+		t.Error("ran the discovery job alongside another job")
+	}
+}
+
+func TestCancel(t *testing.T) {
+	runner := newBlockingRunner()
+	_, api := startServer(t, runner.run, Options{Concurrency: 1})
+
+	var running, queued Job
+	call(t, http.MethodPost, api.URL+"/jobs", `{"mode": "backup", "poolId": "pool-1"}`, &running)
+	call(t, http.MethodPost, api.URL+"/jobs", `{"mode": "backup", "poolId": "pool-2"}`, &queued)
+	<-runner.started
+
+	if code := call(t, http.MethodDelete, api.URL+"/jobs/"+queued.ID, "", nil); code != http.StatusAccepted {
+		t.Errorf("DELETE queued job = %d", code)
+	}
+	if code := call(t, http.MethodDelete, api.URL+"/jobs/"+running.ID, "", nil); code != http.StatusAccepted {
+		t.Errorf("DELETE running job = %d", code)
+	}
+	waitFor(t, api.URL, queued.ID, StatusCanceled)
+	job := waitFor(t, api.URL, running.ID, StatusCanceled)
+
+	// The canceled run still hands over its report
+	for deadline := time.Now().Add(5 * time.Second); job.Report == nil && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		call(t, http.MethodGet, api.URL+"/jobs/"+running.ID, "", &job)
+	}
+	if job.Report == nil || job.Report.Status != report.StatusInterrupted {
+		t.Errorf("canceled job report = %+v", job.Report)
+	}
+	if code := call(t, http.MethodDelete, api.URL+"/jobs/unknown", "", nil); code != http.StatusNotFound {
+		t.Errorf("DELETE unknown job = %d", code)
+	}
+}
+
+func TestQueueFull(t *testing.T) {
+	runner := newBlockingRunner()
+	defer close(runner.release)
+	_, api := startServer(t, runner.run, Options{Concurrency: 1, QueueSize: 1})
+
+	call(t, http.MethodPost, api.URL+"/jobs", `{"mode": "backup", "poolId": "pool-1"}`, nil)
+	<-runner.started
+	if code := call(t, http.MethodPost, api.URL+"/jobs", `{"mode": "backup", "poolId": "pool-2"}`, nil); code != http.StatusAccepted {
+		t.Errorf("POST queued job = %d", code)
+	}
+	var body map[string]string
+	if code := call(t, http.MethodPost, api.URL+"/jobs", `{"mode": "backup", "poolId": "pool-3"}`, &body); code != http.StatusTooManyRequests {
+		t.Errorf("POST past the queue size = %d %v", code, body)
+	}
+}
+
+func TestRequests(t *testing.T) {
+	s := NewServer(decodeEvent, nil, Options{Token: testToken, BackupPath: t.TempDir()})
+	handler := s.Handler()
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		body   string
+		want   int
+	}{
+		{"health needs no token", http.MethodGet, "/healthz", "", "", http.StatusOK},
+		{"missing token", http.MethodGet, "/jobs", "", "", http.StatusUnauthorized},
+		{"wrong token", http.MethodGet, "/jobs", "other", "", http.StatusUnauthorized},
+		{"invalid job", http.MethodPost, "/jobs", testToken, `{"poolId": "pool-1"}`, http.StatusBadRequest},
+		{"malformed job", http.MethodPost, "/jobs", testToken, `{`, http.StatusBadRequest},
+		{"unknown job", http.MethodGet, "/jobs/nope", testToken, "", http.StatusNotFound},
+		{"no report", http.MethodGet, "/jobs/nope/report", testToken, "", http.StatusNotFound},
+		{"backups", http.MethodGet, "/backups?pool=pool-1", testToken, "", http.StatusOK},
+		{"backups without pool", http.MethodGet, "/backups", testToken, "", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("%s %s = %d %s, want %d", tt.method, tt.path, rec.Code, rec.Body.String(), tt.want)
+			}
+		})
+	}
+}
@@ -3,8 +3,11 @@ package storage
 import (
 	"context"
 	"fmt"
+	"log/slog"
 	"os"
 	"path/filepath"
+
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type LocalStorage struct{}
@@ -13,7 +16,10 @@ func NewLocalStorage() *LocalStorage {
 	return &LocalStorage{}
 }
 
-func (s *LocalStorage) Save(ctx context.Context, data []byte, path string) error {
+func (s *LocalStorage) Save(ctx context.Context, data []byte, path string) (err error) {
+	_, end := startSpan(ctx, "local", "Save", path, attribute.Int("acbr.bytes", len(data)))
+	defer func() { end(err) }()
+
 	// Create directory if it doesn't exist
 	dir := filepath.Dir(path)
 	if err := os.MkdirAll(dir, 0755); err != nil {
@@ -25,14 +31,49 @@ func (s *LocalStorage) Save(ctx context.Context, data []byte, path string) error
 		return fmt.Errorf("failed to write file: %w", err)
 	}
 
+	written.Add(int64(len(data)))
+	slog.Debug("saved file", "path", path, "bytes", len(data))
 	return nil
 }
 
-func (s *LocalStorage) Load(ctx context.Context, path string) ([]byte, error) {
+func (s *LocalStorage) Load(ctx context.Context, path string) (_ []byte, err error) {
+	_, end := startSpan(ctx, "local", "Load", path)
+	defer func() { end(err) }()
+
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read file: %w", err)
 	}
 
+	slog.Debug("loaded file", "path", path, "bytes", len(data))
 	return data, nil
 }
+
+func (s *LocalStorage) List(ctx context.Context, dir string) (_ []string, err error) {
+	_, end := startSpan(ctx, "local", "List", dir)
+	defer func() { end(err) }()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list directory: %w", err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+func (s *LocalStorage) Delete(ctx context.Context, path string) (err error) {
+	_, end := startSpan(ctx, "local", "Delete", path)
+	defer func() { end(err) }()
+
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("failed to delete file: %w", err)
+	}
+	slog.Debug("deleted file", "path", path)
+	return nil
+}
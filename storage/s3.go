@@ -5,11 +5,13 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"log/slog"
 	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type S3Storage struct {
@@ -18,10 +20,24 @@ type S3Storage struct {
 	prefix string
 }
 
-func NewS3Storage(bucket, prefix string) *S3Storage {
-	cfg, err := config.LoadDefaultConfig(context.Background())
-	if err != nil {
-		panic(fmt.Sprintf("failed to load AWS config: %v", err))
+// awsConfigKey is the context key of the AWS configuration for S3 storage
+type awsConfigKey struct{}
+
+// WithAWSConfig returns a context that makes the S3 storage created with it use
+// cfg, e.g. with credentials for a role in the backup account, instead of the
+// default configuration. It holds for the run that ctx belongs to only.
+func WithAWSConfig(ctx context.Context, cfg aws.Config) context.Context {
+	return context.WithValue(ctx, awsConfigKey{}, cfg)
+}
+
+func NewS3Storage(ctx context.Context, bucket, prefix string) *S3Storage {
+	cfg, ok := ctx.Value(awsConfigKey{}).(aws.Config)
+	if !ok {
+		var err error
+		cfg, err = config.LoadDefaultConfig(ctx)
+		if err != nil {
+			panic(fmt.Sprintf("failed to load AWS config: %v", err))
+		}
 	}
 
 	return &S3Storage{
@@ -31,21 +47,32 @@ func NewS3Storage(bucket, prefix string) *S3Storage {
 	}
 }
 
-func (s *S3Storage) Save(ctx context.Context, data []byte, path string) error {
+func (s *S3Storage) Save(ctx context.Context, data []byte, path string) (err error) {
+	ctx, end := startSpan(ctx, "s3", "Save", path, attribute.String("acbr.bucket", s.bucket), attribute.Int("acbr.bytes", len(data)))
+	defer func() { end(err) }()
+
 	key := path
 	if s.prefix != "" {
 		key = s.prefix + "/" + path
 	}
 
-	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+	_, err = s.client.PutObject(ctx, &s3.PutObjectInput{
 		Bucket: aws.String(s.bucket),
 		Key:    aws.String(key),
 		Body:   bytes.NewReader(data),
 	})
-	return err
+	if err != nil {
+		return err
+	}
+	written.Add(int64(len(data)))
+	slog.Debug("saved S3 object", "bucket", s.bucket, "key", key, "bytes", len(data))
+	return nil
 }
 
-func (s *S3Storage) Load(ctx context.Context, path string) ([]byte, error) {
+func (s *S3Storage) Load(ctx context.Context, path string) (_ []byte, err error) {
+	ctx, end := startSpan(ctx, "s3", "Load", path, attribute.String("acbr.bucket", s.bucket))
+	defer func() { end(err) }()
+
 	key := path
 	if s.prefix != "" {
 		key = s.prefix + "/" + path
@@ -60,5 +87,56 @@ func (s *S3Storage) Load(ctx context.Context, path string) ([]byte, error) {
 	}
 	defer output.Body.Close()
 
+	slog.Debug("loading S3 object", "bucket", s.bucket, "key", key)
 	return io.ReadAll(output.Body)
 }
+
+func (s *S3Storage) List(ctx context.Context, dir string) (_ []string, err error) {
+	ctx, end := startSpan(ctx, "s3", "List", dir, attribute.String("acbr.bucket", s.bucket))
+	defer func() { end(err) }()
+
+	prefix := strings.Trim(dir, "/")
+	if s.prefix != "" {
+		prefix = strings.Trim(s.prefix+"/"+prefix, "/")
+	}
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	var names []string
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket:    aws.String(s.bucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	})
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list S3 objects: %w", err)
+		}
+		for _, object := range output.Contents {
+			names = append(names, strings.TrimPrefix(aws.ToString(object.Key), prefix))
+		}
+	}
+	return names, nil
+}
+
+func (s *S3Storage) Delete(ctx context.Context, path string) (err error) {
+	ctx, end := startSpan(ctx, "s3", "Delete", path, attribute.String("acbr.bucket", s.bucket))
+	defer func() { end(err) }()
+
+	key := path
+	if s.prefix != "" {
+		key = s.prefix + "/" + path
+	}
+
+	_, err = s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete from S3: %w", err)
+	}
+	slog.Debug("deleted S3 object", "bucket", s.bucket, "key", key)
+	return nil
+}
@@ -2,20 +2,38 @@ package storage
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
 // Storage defines the interface for backup storage operations
 type Storage interface {
 	Save(ctx context.Context, data []byte, path string) error
 	Load(ctx context.Context, path string) ([]byte, error)
+	// List returns the names of the files directly inside dir
+	List(ctx context.Context, dir string) ([]string, error)
+	Delete(ctx context.Context, path string) error
+}
+
+// written counts the bytes saved by every storage of this process
+var written atomic.Int64
+
+// BytesWritten returns the bytes this process saved to local or S3 storage
+func BytesWritten() int64 {
+	return written.Load()
 }
 
 // NewStorage creates a storage implementation based on the path
 // Supports:
 // - Local file system: path starts with "/" or "./" or is a relative path
 // - S3: path starts with "s3://"
-func NewStorage(path string) (Storage, error) {
+func NewStorage(ctx context.Context, path string) (Storage, error) {
 	if strings.HasPrefix(path, "s3://") {
 		parts := strings.SplitN(path[5:], "/", 2) // Skip "s3://" and split on first "/"
 		bucket := parts[0]
@@ -27,7 +45,75 @@ func NewStorage(path string) (Storage, error) {
 				prefix = prefix[:lastSlash]
 			}
 		}
-		return NewS3Storage(bucket, prefix), nil
+		return NewS3Storage(ctx, bucket, prefix), nil
 	}
 	return NewLocalStorage(), nil
 }
+
+// SiblingPath returns the path of name stored next to the file at path, in the
+// form expected by the Storage returned from NewStorage(ctx, path)
+func SiblingPath(path, name string) string {
+	if strings.HasPrefix(path, "s3://") {
+		return name
+	}
+	return filepath.Join(filepath.Dir(path), name)
+}
+
+// Dir returns the directory holding the file at path, usable as a backup path
+func Dir(path string) string {
+	if strings.HasPrefix(path, "s3://") {
+		return path[:strings.LastIndex(path, "/")+1]
+	}
+	return filepath.Dir(path)
+}
+
+// BackupDir returns the directory of a backup path, which names either a
+// backup file or the directory holding backups
+func BackupDir(path string) string {
+	if strings.HasSuffix(path, ".json") {
+		return Dir(path)
+	}
+	return path
+}
+
+// SubDir returns the backup path of the directory name inside the backup
+// directory dir
+func SubDir(dir, name string) string {
+	if strings.HasPrefix(dir, "s3://") {
+		return strings.TrimSuffix(dir, "/") + "/" + name + "/"
+	}
+	return filepath.Join(dir, name)
+}
+
+// JoinPath returns the path of name inside the directory dir, in the form
+// expected by the Storage returned from NewStorage(ctx, dir)
+func JoinPath(dir, name string) string {
+	if strings.HasPrefix(dir, "s3://") {
+		return name
+	}
+	return filepath.Join(dir, name)
+}
+
+// ReadFile loads a single local or S3 file
+func ReadFile(ctx context.Context, path string) ([]byte, error) {
+	// Create storage based on path
+	storage, err := NewStorage(ctx, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage: %w", err)
+	}
+
+	// For S3, use just the filename
+	if strings.HasPrefix(path, "s3://") {
+		parts := strings.Split(path, "/")
+		// Get the last part (filename)
+		path = parts[len(parts)-1]
+	}
+
+	return storage.Load(ctx, path)
+}
+
+// IsNotFound reports whether err, returned by a Storage, means the file doesn't exist
+func IsNotFound(err error) bool {
+	var noSuchKey *types.NoSuchKey
+	return errors.Is(err, fs.ErrNotExist) || errors.As(err, &noSuchKey)
+}
@@ -1,9 +1,13 @@
 package storage
 
 import (
+	"context"
 	"fmt"
 	"strings"
 	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
 )
 
 func TestNewStorage(t *testing.T) {
@@ -26,7 +30,7 @@ func TestNewStorage(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := NewStorage(tt.path)
+			got, err := NewStorage(context.Background(), tt.path)
 			if err != nil {
 				t.Errorf("NewStorage() error = %v", err)
 				return
@@ -42,3 +46,100 @@ func TestNewStorage(t *testing.T) {
 		})
 	}
 }
+
+func TestNewStorageAWSConfig(t *testing.T) {
+	runConfig := func(role string) aws.Config {
+		return aws.Config{
+			Region:      "us-east-1",
+			Credentials: credentials.NewStaticCredentialsProvider(role, "secret", ""),
+		}
+	}
+	// Two runs of one process, each with its own storage role
+	first := WithAWSConfig(context.Background(), runConfig("first-role"))
+	second := WithAWSConfig(context.Background(), runConfig("second-role"))
+
+	for _, tt := range []struct {
+		ctx  context.Context
+		want string
+	}{
+		{ctx: first, want: "first-role"},
+		{ctx: second, want: "second-role"},
+		{ctx: first, want: "first-role"},
+	} {
+		store, err := NewStorage(tt.ctx, "s3://my-bucket/backups/backup.json")
+		if err != nil {
+			t.Fatalf("NewStorage() error = %v", err)
+		}
+		creds, err := store.(*S3Storage).client.Options().Credentials.Retrieve(context.Background())
+		if err != nil {
+			t.Fatalf("Retrieve() error = %v", err)
+		}
+		if creds.AccessKeyID != tt.want {
+			t.Errorf("NewStorage() credentials of %s, want %s", creds.AccessKeyID, tt.want)
+		}
+	}
+}
+
+func TestLocalStorageList(t *testing.T) {
+	dir := t.TempDir()
+	s := NewLocalStorage()
+	for _, name := range []string{"a.json", "b.json"} {
+		if err := s.Save(context.Background(), []byte("{}"), JoinPath(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Save(context.Background(), []byte("{}"), JoinPath(dir, "sub/c.json")); err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := s.List(context.Background(), dir)
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(names) != 2 || names[0] != "a.json" || names[1] != "b.json" {
+		t.Errorf("List() = %v, want [a.json b.json]", names)
+	}
+}
+
+func TestLocalStorageDelete(t *testing.T) {
+	path := JoinPath(t.TempDir(), "a.json")
+	s := NewLocalStorage()
+	if err := s.Save(context.Background(), []byte("{}"), path); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Delete(context.Background(), path); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, err := s.Load(context.Background(), path); !IsNotFound(err) {
+		t.Errorf("Load() after Delete() error = %v, want not found", err)
+	}
+}
+
+func TestBytesWritten(t *testing.T) {
+	before := BytesWritten()
+	if err := NewLocalStorage().Save(context.Background(), []byte("hello"), JoinPath(t.TempDir(), "a.json")); err != nil {
+		t.Fatal(err)
+	}
+	if got := BytesWritten() - before; got != 5 {
+		t.Errorf("BytesWritten() grew by %d, want 5", got)
+	}
+}
+
+func TestSubDir(t *testing.T) {
+	tests := []struct {
+		dir  string
+		want string
+	}{
+		{"s3://bucket/backups/", "s3://bucket/backups/us-east-1_a/"},
+		{"s3://bucket/backups", "s3://bucket/backups/us-east-1_a/"},
+		{"s3://bucket", "s3://bucket/us-east-1_a/"},
+		{"./backups", "backups/us-east-1_a"},
+		{"/backups/", "/backups/us-east-1_a"},
+	}
+	for _, tt := range tests {
+		if got := SubDir(tt.dir, "us-east-1_a"); got != tt.want {
+			t.Errorf("SubDir(%q) = %q, want %q", tt.dir, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,17 @@
+package storage
+
+import (
+	"context"
+
+	"acbr/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// startSpan starts the span of a call to the storage system (local or s3) on
+// path; the returned function ends it with the call's error
+func startSpan(ctx context.Context, system, op, path string, attrs ...attribute.KeyValue) (context.Context, func(error)) {
+	attrs = append(attrs, attribute.String("acbr.storage", system), attribute.String("acbr.path", path))
+	ctx, span := tracing.Start(ctx, "Storage."+op, attrs...)
+	return ctx, func(err error) { tracing.End(span, err) }
+}
@@ -0,0 +1,104 @@
+// Package tracing wraps the phases of a run and its AWS and storage calls in
+// OpenTelemetry spans. Tracing is off unless OTEL_TRACES_EXPORTER is set to
+// otlp or console; the OTLP exporters read the standard OTEL_EXPORTER_OTLP_*
+// variables and the resource OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName names the spans' instrumentation scope
+const tracerName = "acbr"
+
+// provider is the tracer provider installed by Setup, if any
+var provider *sdktrace.TracerProvider
+
+// Setup installs a tracer provider exporting spans as the environment says.
+// It does nothing when OTEL_TRACES_EXPORTER is unset or none.
+func Setup(ctx context.Context, version string) error {
+	exporter, err := newExporter(ctx, os.Getenv("OTEL_TRACES_EXPORTER"))
+	if err != nil || exporter == nil {
+		return err
+	}
+
+	// The environment's service name and attributes win over the defaults
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", "acbr"), attribute.String("service.version", version)),
+		resource.WithTelemetrySDK(),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create trace resource: %w", err)
+	}
+
+	provider = sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	return nil
+}
+
+func newExporter(ctx context.Context, name string) (sdktrace.SpanExporter, error) {
+	switch name {
+	case "", "none":
+		return nil, nil
+	case "console", "stdout":
+		return stdouttrace.New()
+	case "otlp":
+		protocol := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_PROTOCOL")
+		if protocol == "" {
+			protocol = os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL")
+		}
+		switch protocol {
+		case "", "http/protobuf":
+			return otlptracehttp.New(ctx)
+		case "grpc":
+			return otlptracegrpc.New(ctx)
+		default:
+			return nil, fmt.Errorf("unsupported OTLP protocol %q, want http/protobuf or grpc", protocol)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported traces exporter %q, want otlp, console or none", name)
+	}
+}
+
+// Flush exports the spans ended so far, e.g. before a Lambda invocation returns
+func Flush(ctx context.Context) error {
+	if provider == nil {
+		return nil
+	}
+	return provider.ForceFlush(ctx)
+}
+
+// Shutdown flushes the spans and stops the exporter
+func Shutdown(ctx context.Context) error {
+	if provider == nil {
+		return nil
+	}
+	return provider.Shutdown(ctx)
+}
+
+// Start starts a span named name as a child of the span in ctx
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End ends span, marking it failed when err isn't nil
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,75 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestNewExporter(t *testing.T) {
+	tests := []struct {
+		name         string
+		exporter     string
+		protocol     string
+		wantExporter bool
+		wantErr      bool
+	}{
+		{name: "unset", exporter: ""},
+		{name: "none", exporter: "none"},
+		{name: "console", exporter: "console", wantExporter: true},
+		{name: "otlp over http", exporter: "otlp", wantExporter: true},
+		{name: "otlp over grpc", exporter: "otlp", protocol: "grpc", wantExporter: true},
+		{name: "unsupported protocol", exporter: "otlp", protocol: "http/json", wantErr: true},
+		{name: "unsupported exporter", exporter: "zipkin", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("OTEL_EXPORTER_OTLP_PROTOCOL", tt.protocol)
+			exporter, err := newExporter(context.Background(), tt.exporter)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newExporter() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if (exporter != nil) != tt.wantExporter {
+				t.Errorf("newExporter() = %v, want an exporter %t", exporter, tt.wantExporter)
+			}
+			if exporter != nil {
+				_ = exporter.Shutdown(context.Background())
+			}
+		})
+	}
+}
+
+func TestStartEnd(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(tp)
+	defer otel.SetTracerProvider(previous)
+
+	ctx, parent := Start(context.Background(), "phase users", attribute.String("acbr.phase", "users"))
+	_, child := Start(ctx, "Cognito.AdminCreateUser")
+	End(child, errors.New("throttled"))
+	End(parent, nil)
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(spans))
+	}
+	call, phase := spans[0], spans[1]
+	if call.Parent.SpanID() != phase.SpanContext.SpanID() {
+		t.Error("call span isn't a child of the phase span")
+	}
+	if call.Status.Code != codes.Error || call.Status.Description != "throttled" {
+		t.Errorf("call span status = %+v, want the error", call.Status)
+	}
+	if phase.Status.Code == codes.Error {
+		t.Errorf("phase span status = %+v, want no error", phase.Status)
+	}
+}
@@ -0,0 +1,171 @@
+package transform
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"text/template"
+
+	awssdk "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider/types"
+	"gopkg.in/yaml.v3"
+)
+
+// Rule actions
+const (
+	ActionDrop     = "drop"
+	ActionRename   = "rename"
+	ActionSet      = "set"
+	ActionReplace  = "replace"
+	ActionTemplate = "template"
+	ActionSkipUser = "skip-user"
+)
+
+// Rules is the layout of a rules file, in YAML or JSON
+type Rules struct {
+	Rules []Rule `json:"rules" yaml:"rules"`
+}
+
+// Rule rewrites one user attribute. Depending on the action it uses:
+//   - drop: no further fields
+//   - rename: To, the new attribute name
+//   - set: Value, a constant
+//   - replace: Pattern, a regular expression, and Replacement, which may use $1 style groups
+//   - template: Template, a text/template given .Username and .Attributes
+//   - skip-user: Pattern, the user is not restored when the attribute matches it
+//     (or the username when Attribute is empty)
+type Rule struct {
+	Attribute   string `json:"attribute" yaml:"attribute"`
+	Action      string `json:"action" yaml:"action"`
+	To          string `json:"to,omitempty" yaml:"to,omitempty"`
+	Value       string `json:"value,omitempty" yaml:"value,omitempty"`
+	Pattern     string `json:"pattern,omitempty" yaml:"pattern,omitempty"`
+	Replacement string `json:"replacement,omitempty" yaml:"replacement,omitempty"`
+	Template    string `json:"template,omitempty" yaml:"template,omitempty"`
+}
+
+// Transformer applies a compiled set of rules to users
+type Transformer struct {
+	rules []compiledRule
+}
+
+type compiledRule struct {
+	Rule
+	pattern  *regexp.Regexp
+	template *template.Template
+}
+
+// templateData is what template rules can reference
+type templateData struct {
+	Username   string
+	Attributes map[string]string
+}
+
+// Parse reads a rules file. JSON is accepted as it is a subset of YAML.
+func Parse(data []byte) (*Transformer, error) {
+	var rules Rules
+	if err := yaml.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("failed to parse rules: %w", err)
+	}
+	return New(rules.Rules)
+}
+
+// New compiles rules into a Transformer
+func New(rules []Rule) (*Transformer, error) {
+	t := &Transformer{}
+	for n, rule := range rules {
+		compiled := compiledRule{Rule: rule}
+		if rule.Attribute == "" && rule.Action != ActionSkipUser {
+			return nil, fmt.Errorf("rule %d: attribute is required", n+1)
+		}
+
+		switch rule.Action {
+		case ActionDrop, ActionSet:
+		case ActionRename:
+			if rule.To == "" {
+				return nil, fmt.Errorf("rule %d: rename requires to", n+1)
+			}
+		case ActionReplace, ActionSkipUser:
+			re, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: invalid pattern: %w", n+1, err)
+			}
+			compiled.pattern = re
+		case ActionTemplate:
+			tmpl, err := template.New(rule.Attribute).Option("missingkey=zero").Parse(rule.Template)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: invalid template: %w", n+1, err)
+			}
+			compiled.template = tmpl
+		default:
+			return nil, fmt.Errorf("rule %d: unknown action %q", n+1, rule.Action)
+		}
+
+		t.rules = append(t.rules, compiled)
+	}
+	return t, nil
+}
+
+// Apply runs the rules in order over a user's attributes. It returns the
+// rewritten attributes, or skip set when a skip-user rule matched.
+func (t *Transformer) Apply(username string, attrs []types.AttributeType) (result []types.AttributeType, skip bool, err error) {
+	// Work on name/value pairs, keeping the original attribute order
+	var names []string
+	known := make(map[string]bool, len(attrs))
+	values := make(map[string]string, len(attrs))
+	set := func(name, value string) {
+		if !known[name] {
+			known[name] = true
+			names = append(names, name)
+		}
+		values[name] = value
+	}
+	for _, attr := range attrs {
+		set(awssdk.ToString(attr.Name), awssdk.ToString(attr.Value))
+	}
+
+	for _, rule := range t.rules {
+		value, present := values[rule.Attribute]
+
+		switch rule.Action {
+		case ActionSkipUser:
+			subject := value
+			if rule.Attribute == "" {
+				subject = username
+			}
+			if rule.pattern.MatchString(subject) {
+				return nil, true, nil
+			}
+		case ActionDrop:
+			delete(values, rule.Attribute)
+		case ActionRename:
+			if present {
+				delete(values, rule.Attribute)
+				set(rule.To, value)
+			}
+		case ActionSet:
+			set(rule.Attribute, rule.Value)
+		case ActionReplace:
+			if present {
+				values[rule.Attribute] = rule.pattern.ReplaceAllString(value, rule.Replacement)
+			}
+		case ActionTemplate:
+			var buf bytes.Buffer
+			data := templateData{Username: username, Attributes: values}
+			if err := rule.template.Execute(&buf, data); err != nil {
+				return nil, false, fmt.Errorf("template for %s: %w", rule.Attribute, err)
+			}
+			set(rule.Attribute, buf.String())
+		}
+	}
+
+	for _, name := range names {
+		if value, ok := values[name]; ok {
+			result = append(result, types.AttributeType{
+				Name:  awssdk.String(name),
+				Value: awssdk.String(value),
+			})
+		}
+	}
+	return result, false, nil
+}
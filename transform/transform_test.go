@@ -0,0 +1,111 @@
+package transform
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider/types"
+)
+
+func attrs(pairs ...string) []types.AttributeType {
+	var out []types.AttributeType
+	for i := 0; i < len(pairs); i += 2 {
+		out = append(out, types.AttributeType{Name: aws.String(pairs[i]), Value: aws.String(pairs[i+1])})
+	}
+	return out
+}
+
+func TestApply(t *testing.T) {
+	rulesYAML := `
+rules:
+  - attribute: email
+    action: skip-user
+    pattern: '@internal\.example\.com$'
+  - attribute: email
+    action: replace
+    pattern: '^([^@]+)@(.+)$'
+    replacement: '${1}+staging@${2}'
+  - attribute: phone_number
+    action: drop
+  - attribute: custom:legacy_id
+    action: rename
+    to: custom:external_id
+  - attribute: custom:env
+    action: set
+    value: staging
+  - attribute: nickname
+    action: template
+    template: '{{ .Username }}-{{ index .Attributes "custom:env" }}'
+`
+	transformer, err := Parse([]byte(rulesYAML))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		username string
+		attrs    []types.AttributeType
+		want     []types.AttributeType
+		wantSkip bool
+	}{
+		{
+			name:     "all rules",
+			username: "alice",
+			attrs:    attrs("email", "alice@x.com", "phone_number", "+15555550100", "custom:legacy_id", "42"),
+			want: attrs("email", "alice+staging@x.com", "custom:external_id", "42",
+				"custom:env", "staging", "nickname", "alice-staging"),
+		},
+		{
+			name:     "skipped user",
+			username: "ops",
+			attrs:    attrs("email", "ops@internal.example.com"),
+			wantSkip: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, skip, err := transformer.Apply(tt.username, tt.attrs)
+			if err != nil {
+				t.Fatalf("Apply() error = %v", err)
+			}
+			if skip != tt.wantSkip {
+				t.Errorf("Apply() skip = %v, want %v", skip, tt.wantSkip)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Apply() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseJSON(t *testing.T) {
+	transformer, err := Parse([]byte(`{"rules": [{"attribute": "email", "action": "drop"}, {"attribute": "email", "action": "set", "value": "x@y.z"}]}`))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	got, _, err := transformer.Apply("alice", attrs("email", "alice@x.com", "name", "Alice"))
+	if err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	if want := attrs("email", "x@y.z", "name", "Alice"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Apply() = %v, want %v", got, want)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []string{
+		`rules: [{attribute: email, action: explode}]`,
+		`rules: [{attribute: email, action: rename}]`,
+		`rules: [{attribute: email, action: replace, pattern: "("}]`,
+		`rules: [{attribute: email, action: template, template: "{{"}]`,
+		`rules: [{action: drop}]`,
+	}
+	for _, rules := range tests {
+		if _, err := Parse([]byte(rules)); err == nil {
+			t.Errorf("Parse(%s) error = nil, want error", rules)
+		}
+	}
+}